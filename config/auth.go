@@ -0,0 +1,65 @@
+package config
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+)
+
+// RawAuthConfig is the auth section of a pool in the yaml config file.
+type RawAuthConfig struct {
+	// Users maps the names of the users that clients can authenticate as to their passwords.
+	Users map[string]string `yaml:"users"`
+}
+
+// AuthConfig is the users that binary protocol clients authenticate as with SASL PLAIN before sending other commands.
+type AuthConfig struct {
+	users map[string]string
+}
+
+// NewAuthConfig creates an AuthConfig that accepts the given users, which maps user names to passwords.
+func NewAuthConfig(users map[string]string) (*AuthConfig, error) {
+	if len(users) == 0 {
+		return nil, errors.New("no users were configured")
+	}
+	copied := make(map[string]string, len(users))
+	for user, password := range users {
+		if user == "" {
+			return nil, errors.New("empty user name")
+		}
+		copied[user] = password
+	}
+	return &AuthConfig{users: copied}, nil
+}
+
+// Authenticate returns true if user is one of the configured users and password is the password of that user.
+func (a *AuthConfig) Authenticate(user, password string) bool {
+	expected, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// RawServerAuthConfig is the server_auth section of a pool in the yaml config file.
+type RawServerAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// ServerCredentials are the username and password that golemproxy authenticates with when connecting to the servers of a pool.
+type ServerCredentials struct {
+	Username string
+	Password string
+}
+
+func (raw *RawServerAuthConfig) build() (*ServerCredentials, error) {
+	// The username and password are separated by NUL bytes when they are sent with SASL PLAIN.
+	if raw.Username == "" || strings.ContainsRune(raw.Username, 0) {
+		return nil, errors.New("username must be non-empty and can't contain NUL bytes")
+	}
+	if strings.ContainsRune(raw.Password, 0) {
+		return nil, errors.New("password can't contain NUL bytes")
+	}
+	return &ServerCredentials{Username: raw.Username, Password: raw.Password}, nil
+}
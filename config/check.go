@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// CheckFile loads and validates the config file at path without starting any listeners,
+// and prints the pools, servers, hash, and distribution that golemproxy would use.
+// It returns the same errors that golemproxy would fail to start with.
+func CheckFile(path string) error {
+	return checkFile(path, os.Stdout)
+}
+
+func checkFile(path string, w io.Writer) error {
+	configs, err := ParseFile(path)
+	if err != nil {
+		return err
+	}
+	err = Validate(configs)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conf := configs[name]
+		hash := conf.Hash
+		if hash == "" {
+			hash = "default"
+		}
+		fmt.Fprintf(w, "%s: listen %s, hash %s, distribution %s\n", name, strings.Join(conf.Listen, ", "), hash, conf.Distribution)
+		printServers(w, "servers", conf.Servers)
+		prefixes := make([]string, 0, len(conf.PrefixRoutes))
+		for prefix := range conf.PrefixRoutes {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			printServers(w, fmt.Sprintf("prefix %q", prefix), conf.PrefixRoutes[prefix])
+		}
+		primaries := make([]string, 0, len(conf.Replicas))
+		for primary := range conf.Replicas {
+			primaries = append(primaries, primary)
+		}
+		sort.Strings(primaries)
+		for _, primary := range primaries {
+			printServers(w, fmt.Sprintf("replicas of %q", primary), conf.Replicas[primary])
+		}
+		if len(conf.Shadow) > 0 {
+			printServers(w, fmt.Sprintf("shadow (ratio %g)", conf.ShadowRatio), conf.Shadow)
+		}
+	}
+	return nil
+}
+
+func printServers(w io.Writer, description string, servers []TCPServer) {
+	fmt.Fprintf(w, "  %s:\n", description)
+	for _, server := range servers {
+		fmt.Fprintf(w, "    %s:%d weight %d key %q\n", server.Host, server.Port, server.Weight, server.Key)
+	}
+}
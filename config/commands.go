@@ -0,0 +1,102 @@
+package config
+
+import "fmt"
+
+// COMMAND_PATTERN_ALL matches every command in allowed_commands and denied_commands.
+const COMMAND_PATTERN_ALL = "*"
+
+// COMMAND_PATTERN_WRITES matches every command that modifies items in allowed_commands and denied_commands.
+const COMMAND_PATTERN_WRITES = "writes"
+
+// writeCommands are the commands matched by COMMAND_PATTERN_WRITES.
+var writeCommands = []string{"set", "add", "replace", "append", "prepend", "cas", "delete", "incr", "decr", "touch", "flush_all", "ms", "md", "ma"}
+
+// readCommands are the text protocol commands that aren't writeCommands. quit can't be restricted.
+var readCommands = []string{"get", "gets", "gat", "gats", "version", "stats", "verbosity", "mg", "mn"}
+
+func allCommands() []string {
+	return append(append([]string{}, writeCommands...), readCommands...)
+}
+
+// CommandPolicy is the set of text protocol commands that clients of a pool are permitted to send.
+type CommandPolicy struct {
+	denied map[string]bool
+}
+
+// NewCommandPolicy creates a policy that permits the commands matching any of allowed (or every command if allowed is empty),
+// except for the commands matching any of denied.
+func NewCommandPolicy(allowed []string, denied []string) (*CommandPolicy, error) {
+	permitted := make(map[string]bool)
+	if len(allowed) == 0 {
+		allowed = []string{COMMAND_PATTERN_ALL}
+	}
+	for _, pattern := range allowed {
+		commands, err := expandCommandPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed_commands: %v", err)
+		}
+		for _, command := range commands {
+			permitted[command] = true
+		}
+	}
+	for _, pattern := range denied {
+		commands, err := expandCommandPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid denied_commands: %v", err)
+		}
+		for _, command := range commands {
+			delete(permitted, command)
+		}
+	}
+	p := &CommandPolicy{denied: make(map[string]bool)}
+	for _, command := range allCommands() {
+		if !permitted[command] {
+			p.denied[command] = true
+		}
+	}
+	return p, nil
+}
+
+// expandCommandPattern returns the commands matched by an entry of allowed_commands or denied_commands.
+func expandCommandPattern(pattern string) ([]string, error) {
+	switch pattern {
+	case COMMAND_PATTERN_ALL:
+		return allCommands(), nil
+	case COMMAND_PATTERN_WRITES:
+		return writeCommands, nil
+	}
+	for _, commands := range [][]string{writeCommands, readCommands} {
+		for _, command := range commands {
+			if command == pattern {
+				return []string{command}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown command %q", pattern)
+}
+
+// Equal returns true if p and other permit the same commands. A nil policy permits every command.
+func (p *CommandPolicy) Equal(other *CommandPolicy) bool {
+	var denied, otherDenied map[string]bool
+	if p != nil {
+		denied = p.denied
+	}
+	if other != nil {
+		otherDenied = other.denied
+	}
+	if len(denied) != len(otherDenied) {
+		return false
+	}
+	for command := range denied {
+		if !otherDenied[command] {
+			return false
+		}
+	}
+	return true
+}
+
+// Permits returns false if clients may not send command.
+// Unknown commands are permitted, so that they are rejected as unknown commands.
+func (p *CommandPolicy) Permits(command string) bool {
+	return !p.denied[command]
+}
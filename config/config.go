@@ -1,39 +1,183 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
+	"net"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// DEFAULT_MAX_LINE_LENGTH is the default limit on the length of request lines from clients.
+const DEFAULT_MAX_LINE_LENGTH = 8192
+
+// DEFAULT_MAX_ITEM_SIZE is the default limit on the length of values from clients, which is the same as the default of memcached.
+const DEFAULT_MAX_ITEM_SIZE = 1 << 20
+
+// MAX_MAX_ITEM_SIZE is the largest max_item_size, which is the same as the largest item size that memcached supports.
+const MAX_MAX_ITEM_SIZE = 1 << 30
+
+// MAX_MAX_TTL is the largest max_ttl. memcached treats larger expiration times as unix timestamps.
+const MAX_MAX_TTL = 60 * 60 * 24 * 30
+
+// MAX_WRITE_BUFFER_SIZE is the largest write_buffer_size.
+const MAX_WRITE_BUFFER_SIZE = 1 << 20
+
+// MAX_BACKEND_READ_BUFFER is the largest backend_read_buffer.
+const MAX_BACKEND_READ_BUFFER = 1 << 20
+
+// DEFAULT_UNIX_SOCKET_MODE is the default file mode of the unix socket that golemproxy listens on, which only allows the same user to connect.
+const DEFAULT_UNIX_SOCKET_MODE os.FileMode = 0700
+
 // RawConfig is the structure unserialized from the yaml config file.
 type RawConfig struct {
-	Listen string `yaml:"listen"`
+	// Listen is the address or list of addresses (tcp host:port or unix socket paths) that clients of the pool connect to.
+	Listen ListenAddresses `yaml:"listen"`
+	// UnixSocketMode is the octal file mode of the unix socket, e.g. "0660".
+	UnixSocketMode string `yaml:"unix_socket_mode"`
+	// UnixSocketUID and UnixSocketGID are the owner and group of the unix socket, if they should be changed.
+	UnixSocketUID *int `yaml:"unix_socket_uid"`
+	UnixSocketGID *int `yaml:"unix_socket_gid"`
+	// UDPListen is an optional host:port to accept requests using memcached's UDP protocol.
+	UDPListen string `yaml:"udp_listen"`
 	// Failover     *string `yaml:"failover"`
 	Hash         string `yaml:"hash"`
+	HashTag      string `yaml:"hash_tag"`
 	Distribution string `yaml:"distribution"`
 	// TODO: Implement these options
 	Timeout    uint `yaml:"timeout"`
 	Backlog    uint `yaml:"backlog"`
 	Preconnect bool `yaml:"preconnect"`
-	// AutoEjectHosts bool     `yaml:"auto_eject_hosts"`
-	Servers []string `yaml:"servers"`
+	// ReusePort sets SO_REUSEPORT on tcp listeners, so that another golemproxy process can listen on the same addresses (Linux only).
+	ReusePort bool `yaml:"reuse_port"`
+	// ConnectTimeout is how many milliseconds to wait when connecting to a server, or 0 to use the timeout.
+	ConnectTimeout uint `yaml:"connect_timeout"`
+	// MaxLineLength is the maximum length of a request line from a client, including the trailing "\r\n".
+	MaxLineLength uint `yaml:"max_line_length"`
+	// MaxItemSize is the maximum length of a value from a client, which should match the -I setting of the memcache servers.
+	MaxItemSize uint `yaml:"max_item_size"`
+	// MetricsListen is an optional host:port to serve Prometheus metrics at /metrics
+	MetricsListen string `yaml:"metrics_listen"`
+	// HealthListen is an optional host:port to serve a health check at /health
+	HealthListen string `yaml:"health_listen"`
+	// ServerConnections is the maximum number of connections to each memcache server.
+	ServerConnections uint `yaml:"server_connections"`
+	// MaxConnections is the maximum number of client connections to the listener, or 0 for no limit.
+	MaxConnections uint `yaml:"max_connections"`
+	// MaxConnectionsPerSecond is the rate at which new client connections to the listener are served, or 0 for no limit.
+	MaxConnectionsPerSecond uint `yaml:"max_connections_per_second"`
+	// ConnectionBurst is the number of connections that can be served at once before max_connections_per_second applies.
+	ConnectionBurst uint `yaml:"connection_burst"`
+	// AllowCIDRs are the IPv4 and IPv6 networks that clients may connect from, or empty to allow every client.
+	AllowCIDRs []string `yaml:"allow_cidrs"`
+	// MaxOutstanding is the maximum number of unanswered requests per connection to a memcache server, or 0 for no limit.
+	MaxOutstanding uint `yaml:"max_outstanding"`
+	// MaxRetries is the number of times a get or gets is retried after the connection to a memcache server breaks.
+	MaxRetries uint `yaml:"max_retries"`
+	// ClientIdleTimeout is how many seconds a client connection can wait between commands before it is closed, or 0 for no limit.
+	ClientIdleTimeout uint `yaml:"client_idle_timeout"`
+	// TCPKeepAlive is the keep-alive period in seconds for accepted tcp connections, or 0 to disable keep-alives.
+	TCPKeepAlive uint `yaml:"tcp_keepalive"`
+	TCPNoDelay   bool `yaml:"tcp_nodelay"`
+	// AutoEjectHosts, ServerFailureLimit, and ServerRetryTimeout (in milliseconds) are the same as in twemproxy.
+	AutoEjectHosts     bool `yaml:"auto_eject_hosts"`
+	ServerFailureLimit uint `yaml:"server_failure_limit"`
+	ServerRetryTimeout uint `yaml:"server_retry_timeout"`
+	// WriteBatchDelay is how many microseconds to wait for more requests to a server to send in the same write, or 0 to not wait.
+	WriteBatchDelay uint `yaml:"write_batch_delay"`
+	// WriteBufferSize is how many bytes of responses to a client can be combined into one write, or 0 to write each response separately.
+	WriteBufferSize uint `yaml:"write_buffer_size"`
+	// BackendReadBuffer is the size of the buffer that responses from each connection to a server are read into, or 0 for 4096 bytes.
+	BackendReadBuffer uint `yaml:"backend_read_buffer"`
+	// SlowlogThreshold is how many milliseconds a request can take before it is logged as slow, or 0 to not log slow requests.
+	SlowlogThreshold uint `yaml:"slowlog_threshold"`
+	// AccessLog is the path of a file to append a line to for every command, or empty to not log commands.
+	AccessLog string `yaml:"access_log"`
+	// TTLOverride is the expiration time in seconds that replaces the expiration time of storage requests, or 0 to forward expiration times unchanged.
+	TTLOverride uint `yaml:"ttl_override"`
+	// MaxTTL is the largest expiration time in seconds of set/add/replace/cas requests, or 0 to not limit expiration times.
+	MaxTTL uint `yaml:"max_ttl"`
+	// ReadOnly rejects commands that modify data, such as set and delete.
+	ReadOnly bool `yaml:"read_only"`
+	// FireAndForgetSets responds STORED to storage requests other than cas before the memcache servers respond.
+	FireAndForgetSets bool `yaml:"fire_and_forget_sets"`
+	// CoalesceGets sends a single request for concurrent gets of the same key.
+	CoalesceGets bool `yaml:"coalesce_gets"`
+	// MissOnBackendDown responds to gets with a miss when the memcache server can't be reached.
+	MissOnBackendDown bool `yaml:"miss_on_backend_down"`
+	// LenientLineEndings accepts request lines from clients that end in \n instead of \r\n.
+	LenientLineEndings bool `yaml:"lenient_line_endings"`
+	// BackendErrors is relay, prefix, or generic.
+	BackendErrors string `yaml:"backend_errors"`
+	// TLS is set if connections to memcache servers should use TLS.
+	TLS *RawTLSConfig `yaml:"tls"`
+	// ClientTLS is set if connections from clients should use TLS.
+	ClientTLS *RawTLSConfig `yaml:"client_tls"`
+	// Auth is set if clients must authenticate with SASL PLAIN, which requires the binary protocol.
+	Auth *RawAuthConfig `yaml:"auth"`
+	// ServerAuth is set if golemproxy must authenticate when connecting to memcache servers.
+	ServerAuth *RawServerAuthConfig `yaml:"server_auth"`
+	// AllowedCommands and DeniedCommands restrict the commands that clients can send. See CommandPolicy.
+	AllowedCommands []string `yaml:"allowed_commands"`
+	DeniedCommands  []string `yaml:"denied_commands"`
+	Servers         []string `yaml:"servers"`
+	// PrefixRoutes maps key prefixes to the servers of separate pools. Keys without a matching prefix are sent to Servers.
+	PrefixRoutes map[string][]string `yaml:"prefix_routes"`
+	// Replicas maps the names of servers to servers that have the same data, which gets and gets are sent to instead.
+	Replicas map[string][]string `yaml:"replicas"`
+	// Selection is random or least_conn.
+	Selection string `yaml:"selection"`
+	// StatsServer is the name of the server in Servers that "stats <subcommand>" requests are sent to.
+	StatsServer string `yaml:"stats_server"`
+	// Shadow is the list of servers of a pool that ShadowRatio of write requests are mirrored to.
+	Shadow      []string `yaml:"shadow"`
+	ShadowRatio float64  `yaml:"shadow_ratio"`
 }
 
+// ListenAddresses is the listen setting of a pool, which is either a single address or a list of addresses in the yaml config file.
+type ListenAddresses []string
+
+func (l *ListenAddresses) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*l = ListenAddresses{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+var _ yaml.Unmarshaler = new(ListenAddresses)
+
 func (raw *RawConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// Use a different type to avoid recursing
 	// https://github.com/go-yaml/yaml/issues/165#issuecomment-255223956
 	type TmpConfig RawConfig
 	result := TmpConfig{
-		Timeout: 1000,
-		Backlog: 1024,
-		// Not specifying hash or distribution - those are mandatory to avoid misconfiguration
-		// Hash:         "fnv1a_64",
+		Timeout:           1000,
+		Backlog:           1024,
+		ServerConnections: 1,
+		MaxLineLength:     DEFAULT_MAX_LINE_LENGTH,
+		MaxItemSize:       DEFAULT_MAX_ITEM_SIZE,
+		BackendErrors:     "relay",
+		TCPKeepAlive:      30,
+		TCPNoDelay:        true,
+		// The same defaults as twemproxy
+		ServerFailureLimit: 2,
+		ServerRetryTimeout: 30000,
+		// Not specifying distribution - that is mandatory to avoid misconfiguration.
+		// An empty hash is the default hash of the sharded package (fnv1a).
 		// Distribution: "ketama",
 	}
 	if err := unmarshal(&result); err != nil {
@@ -58,24 +202,174 @@ type TCPServer struct {
 
 // Config is the validated data from the config file.
 type Config struct {
-	Listen string
+	// Listen is the addresses that the pool accepts client connections at. Every address sends requests to the same servers.
+	Listen []string
+	// UnixSocketMode is the file mode of the unix sockets in Listen. 0 means DEFAULT_UNIX_SOCKET_MODE.
+	UnixSocketMode os.FileMode
+	// UnixSocketUID and UnixSocketGID are the user and group IDs to change the owner of the unix socket to, or nil to keep the ones of the process.
+	UnixSocketUID *int
+	UnixSocketGID *int
+	// UDPListen is the host:port to accept requests (typically gets) in memcached's UDP protocol at, or empty.
+	// Each request must fit in one datagram. Responses are split into datagrams of up to 1400 bytes.
+	UDPListen string
 	// optional failover - must exist. TODO: implement
 	// Failover     *string `yaml:"failover"`
 	// The hashing algorithm used for memcache keys to decide what remote server to send requests to.
+	// This is empty if the default should be used.
 	Hash string
+	// HashTag is empty or two characters such as "{}". If a key contains both characters, only the part between them is hashed.
+	HashTag string
 	// The distribution algorithm used on hashes of memcache keys to decide which server to send values to.
 	Distribution string
 	// Timeout is the timeout in milliseconds when golemproxy assumes a connection to a server is dead.
-	// TODO: implement
+	// Requests without a response by then fail with "SERVER_ERROR timeout", and the connection is closed.
 	Timeout uint `yaml:"timeout"`
+	// ConnectTimeout is how long to wait for a connection to a server to be established, or 0 to wait up to the Timeout.
+	// Requests that were waiting for the connection fail with "SERVER_ERROR connection timeout", which counts as a failure of the server for auto_eject_hosts.
+	ConnectTimeout time.Duration
 	// Backlog is the maximum number of in-flight requests to an individual proxy server. If this is exceeded, then requests from the client will be rejected
 	// TODO: implement
 	Backlog uint `yaml:"backlog"`
 	// Preconnect indicates if golemproxy should connect to remote servers before any incoming requests from the client arrive. (unimplemented)
-	Preconnect           bool `yaml:"preconnect"`
-	MaxServerConnections uint `yaml:"max_server_connections"`
-	// AutoEjectHosts bool `yaml:"auto_eject_hosts"`
-	Servers []TCPServer
+	Preconnect bool `yaml:"preconnect"`
+	// ReusePort is true if tcp listeners are created with SO_REUSEPORT, so that another process can listen on the same address,
+	// e.g. so that a new version of golemproxy can start accepting connections before the old one shuts down.
+	ReusePort bool
+	// MaxLineLength is the maximum length of a request line (e.g. a multiget), excluding the value of storage commands.
+	// Clients sending longer lines receive "CLIENT_ERROR line too long" and are disconnected. 0 means DEFAULT_MAX_LINE_LENGTH.
+	MaxLineLength uint
+	// MaxItemSize is the maximum length of the value of a storage command. 0 means DEFAULT_MAX_ITEM_SIZE.
+	// Text protocol clients sending longer values receive "SERVER_ERROR object too large for cache", and binary protocol clients are disconnected.
+	MaxItemSize uint
+	// MetricsListen is the host:port of an HTTP server for Prometheus metrics, or empty.
+	// The metrics are for the whole process, so pools may share the same address.
+	MetricsListen string
+	// HealthListen is the host:port of an HTTP server for a health check of the whole process, or empty.
+	// It may be the same address as MetricsListen.
+	HealthListen string
+	// MaxServerConnections is the number of pooled connections to each memcache server, which are opened when needed.
+	// Requests are pipelined over the connections, and are sent on whichever connection is first ready to write them.
+	MaxServerConnections uint `yaml:"server_connections"`
+	// MaxConnections is the maximum number of open client connections to the listener, or 0 if there is no limit.
+	// Connections accepted beyond the limit are closed immediately without a response.
+	MaxConnections uint
+	// MaxConnectionsPerSecond is the rate at which new client connections to the listener are served, or 0 if there is no limit.
+	// Connections beyond the rate wait to be served, so that a connection storm from clients doesn't become one to the memcache servers.
+	MaxConnectionsPerSecond uint
+	// ConnectionBurst is the number of new client connections that can be served without waiting, after no connections were accepted for a while.
+	// It is MaxConnectionsPerSecond if it isn't set.
+	ConnectionBurst uint
+	// AllowCIDRs are the networks that tcp and udp clients must connect from, or empty if clients from any address are accepted.
+	// Connections from other addresses are closed immediately, and their datagrams are dropped. Unix socket clients are always accepted.
+	AllowCIDRs []*net.IPNet
+	// MaxOutstanding is the maximum number of requests per connection to a memcache server that haven't received a response, or 0 if there is no limit.
+	// Clients sending more requests to that server stop being read from until responses are received or the timeout elapses.
+	MaxOutstanding uint
+	// MaxRetries is the number of times a get or gets is resent on a new connection after the connection it was sent on broke.
+	// Other commands are not retried, so that a mutation is never applied twice.
+	MaxRetries uint
+	// ClientIdleTimeout is how long a client connection can wait for its next command before it is closed, or 0 if idle connections are kept open.
+	ClientIdleTimeout time.Duration
+	// TCPKeepAlive is the keep-alive period for accepted tcp connections from clients, or 0 if keep-alives are disabled.
+	TCPKeepAlive time.Duration
+	// TCPNoDelay disables Nagle's algorithm on accepted tcp connections so that small responses are sent immediately.
+	TCPNoDelay bool
+	// AutoEjectHosts indicates if a server should be temporarily removed from the pool after ServerFailureLimit consecutive failures.
+	// The keys of an ejected server are distributed to the remaining servers.
+	AutoEjectHosts     bool
+	ServerFailureLimit uint
+	// ServerRetryTimeout is how long a server is ejected before it is added back to the pool.
+	ServerRetryTimeout time.Duration
+	// WriteBatchDelay is how long a connection to a server waits for more requests to send in the same write as a request.
+	// This reduces the number of write syscalls under high request rates, but adds up to this much latency when golemproxy is not busy.
+	WriteBatchDelay time.Duration
+	// WriteBufferSize is the size of the buffer that responses to a client are combined in, or 0 if each response is written separately.
+	// The buffer is written when it is full, or when golemproxy has read every request that the client sent and the responses to them are ready.
+	WriteBufferSize uint
+	// BackendReadBuffer is the size of the buffer that responses from each connection to a server are read into, or 0 for the default of 4096 bytes.
+	// Larger buffers read large values in fewer syscalls, at the cost of memory for each connection.
+	BackendReadBuffer uint
+	// SlowlogThreshold is how long a request can wait for its response before a warning is logged with the command, keys, and servers, or 0 if slow requests are not logged.
+	// This includes the time waiting for the responses to earlier requests from the same client connection.
+	SlowlogThreshold time.Duration
+	// AccessLog is the path of the file that a line is appended to for every command from a client, with its key, response status, and latency.
+	// This is empty if commands are not logged.
+	AccessLog string
+	// TTLOverride is the expiration time (in seconds) sent to servers for storage requests instead of the client's expiration time, or 0 if it is not overridden.
+	TTLOverride uint
+	// MaxTTL is the largest expiration time (in seconds) sent to servers for set/add/replace/cas requests, or 0 if it is not limited.
+	// Requests for items that never expire are sent with this expiration time instead.
+	MaxTTL uint
+	// ReadOnly is true if clients can only use commands that don't modify data, such as get, gets, version, and stats.
+	// Other commands such as set, delete, and flush_all get "CLIENT_ERROR write commands not allowed".
+	ReadOnly bool
+	// FireAndForgetSets is true if set, add, replace, append, and prepend requests get STORED immediately, without waiting for the memcache servers.
+	// This lowers latency at the cost of durability: clients are not told if a write failed, timed out, or was not stored.
+	FireAndForgetSets bool
+	// CoalesceGets is true if a get of a key that is already waiting for a response from a memcache server gets that response instead of sending another request.
+	CoalesceGets bool
+	// MissOnBackendDown is true if get and gets respond END instead of an error when the memcache server fails, times out, or was ejected,
+	// so that clients treat it as a cache miss. Gets are answered without contacting the servers while every server is ejected.
+	MissOnBackendDown bool
+	// LenientLineEndings is true if request lines from clients may end in \n instead of \r\n, for buggy clients.
+	// They are forwarded with \r\n. Values must still be followed by \r\n.
+	LenientLineEndings bool
+	// BackendErrors is how ERROR and SERVER_ERROR responses from servers are sent to clients:
+	// "relay" (unchanged), "prefix" ("SERVER_ERROR backend: <message>"), or "generic" ("SERVER_ERROR backend error").
+	BackendErrors string
+	// TLS is the configuration for connections to servers, or nil if connections to servers are not encrypted.
+	TLS *tls.Config
+	// ClientTLS is the configuration for accepting connections from clients, or nil if connections from clients are not encrypted.
+	ClientTLS *tls.Config
+	// Auth is the users that clients must authenticate as with SASL PLAIN, or nil if clients don't authenticate.
+	// Only the binary protocol supports authentication, so text protocol clients are rejected if this is set.
+	Auth *AuthConfig
+	// ServerAuth is the credentials that are sent on every new connection to a server, or nil if servers don't require authentication.
+	// A server that rejects them is treated like a server that can't be reached.
+	ServerAuth *ServerCredentials
+	// CommandPolicy is the text protocol commands that clients may send, or nil if every command is permitted.
+	CommandPolicy *CommandPolicy
+	Servers       []TCPServer
+	// PrefixRoutes maps key prefixes to the servers of separate pools, which use the same hash and distribution as Servers.
+	// Keys are sent to the pool of the longest prefix they start with, or to Servers if no prefix matches.
+	PrefixRoutes map[string][]TCPServer
+	// Replicas maps the Key of servers in Servers or PrefixRoutes to their read replicas.
+	// Gets and gets of keys that are sharded to such a server are sent to a random replica, and other requests are sent to the server.
+	Replicas map[string][]TCPServer
+	// Selection is how the replica of a server is chosen for a get: "random" (or empty), or "least_conn" for the replica
+	// with the fewest requests waiting for a response relative to its weight, which steers load away from slow replicas.
+	Selection string
+	// StatsServer is the Key of the server in Servers that requests such as "stats slabs" are sent to,
+	// or empty to send them to the first server that isn't ejected.
+	StatsServer string
+	// Shadow is the servers of a pool that write requests are mirrored to (using the same hash and distribution), or empty.
+	// Responses from the shadow pool are discarded.
+	Shadow []TCPServer
+	// ShadowRatio is the fraction of write requests that are mirrored to Shadow, between 0 and 1.
+	ShadowRatio float64
+}
+
+// supportedHashes are the names of the hash algorithms (from twemproxy) that the sharded package implements.
+var supportedHashes = []string{"fnv1_32", "fnv1a", "fnv1a_32", "fnv1_64", "fnv1a_64", "crc32", "crc32a", "md5", "murmur", "one_at_a_time"}
+
+func isSupportedHash(hash string) bool {
+	if hash == "" {
+		return true
+	}
+	for _, supported := range supportedHashes {
+		if hash == supported {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedDistribution(distribution string) bool {
+	switch distribution {
+	case "ketama", "modula", "random":
+		return true
+	}
+	return false
 }
 
 func makeServer(raw string) (TCPServer, error) {
@@ -111,7 +405,7 @@ func makeServer(raw string) (TCPServer, error) {
 		Port:   uint16(port),
 		Weight: uint(weight),
 	}
-	if len(parts) > 2 {
+	if len(parts) > 1 {
 		config.Key = parts[1]
 	} else {
 		// For legacy compatibility reasons, use port for the label only when it isn't 11211
@@ -136,6 +430,21 @@ func makeServers(rawServers []string) ([]TCPServer, error) {
 	return servers, nil
 }
 
+// hasServerKey returns true if key is the Key of a server in servers or prefixRoutes.
+func hasServerKey(servers []TCPServer, prefixRoutes map[string][]TCPServer, key string) bool {
+	for _, server := range servers {
+		if server.Key == key {
+			return true
+		}
+	}
+	for _, routeServers := range prefixRoutes {
+		if hasServerKey(routeServers, nil, key) {
+			return true
+		}
+	}
+	return false
+}
+
 func BuildFromRawConfig(rawConfigs map[string]RawConfig, path string) (map[string]Config, error) {
 	if len(rawConfigs) == 0 {
 		return nil, fmt.Errorf("Did not parse any config entries from %q", path)
@@ -146,11 +455,72 @@ func BuildFromRawConfig(rawConfigs map[string]RawConfig, path string) (map[strin
 		if len(raw.Listen) == 0 {
 			errorMsgs = append(errorMsgs, fmt.Sprintf("empty listen for %q", name))
 		}
-		if raw.Hash != "fnv1a_64" {
-			errorMsgs = append(errorMsgs, fmt.Sprintf(`unsupported hash %q for %q. "fnv1a_64" is supported`, raw.Hash, name))
+		for _, listen := range raw.Listen {
+			if listen == "" {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("empty listen address for %q", name))
+			}
 		}
-		if raw.Timeout < 10 || raw.Timeout > 60000 {
-			errorMsgs = append(errorMsgs, fmt.Sprintf("unsupported/missing timeout %d for %q. Must be between 10ms and 60000ms", raw.Timeout, name))
+		unixSocketMode := DEFAULT_UNIX_SOCKET_MODE
+		if raw.UnixSocketMode != "" {
+			mode, err := strconv.ParseUint(raw.UnixSocketMode, 8, 32)
+			if err != nil || mode > 0777 {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid unix_socket_mode %q for %q. Must be octal permissions such as 0660", raw.UnixSocketMode, name))
+			}
+			unixSocketMode = os.FileMode(mode)
+		}
+		if raw.UDPListen != "" {
+			if _, _, err := net.SplitHostPort(raw.UDPListen); err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid udp_listen %q for %q: %v", raw.UDPListen, name, err))
+			}
+		}
+		if !isSupportedHash(raw.Hash) {
+			errorMsgs = append(errorMsgs, fmt.Sprintf(`unsupported hash %q for %q. Supported hashes are %s`, raw.Hash, name, strings.Join(supportedHashes, ", ")))
+		}
+		if raw.HashTag != "" && len(raw.HashTag) != 2 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid hash_tag %q for %q. Must be 2 characters", raw.HashTag, name))
+		}
+		if !isSupportedDistribution(raw.Distribution) {
+			errorMsgs = append(errorMsgs, fmt.Sprintf(`unsupported distribution %q for %q. "ketama", "modula", and "random" are supported`, raw.Distribution, name))
+		}
+		switch raw.BackendErrors {
+		case "relay", "prefix", "generic":
+		default:
+			errorMsgs = append(errorMsgs, fmt.Sprintf(`unsupported backend_errors %q for %q. "relay", "prefix", and "generic" are supported`, raw.BackendErrors, name))
+		}
+		switch raw.Selection {
+		case "", "random", "least_conn":
+		default:
+			errorMsgs = append(errorMsgs, fmt.Sprintf(`unsupported selection %q for %q. "random" and "least_conn" are supported`, raw.Selection, name))
+		}
+		if raw.MaxLineLength < 64 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid max_line_length %d for %q. Must be at least 64", raw.MaxLineLength, name))
+		}
+		if raw.MaxItemSize < 1 || raw.MaxItemSize > MAX_MAX_ITEM_SIZE {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid max_item_size %d for %q. Must be between 1 and %d", raw.MaxItemSize, name, MAX_MAX_ITEM_SIZE))
+		}
+		if raw.ServerConnections < 1 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid server_connections %d for %q. Must be at least 1", raw.ServerConnections, name))
+		}
+		if raw.AutoEjectHosts && raw.ServerFailureLimit < 1 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid server_failure_limit %d for %q. Must be at least 1", raw.ServerFailureLimit, name))
+		}
+		if raw.TTLOverride > math.MaxInt32 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid ttl_override %d for %q. Must fit in a 32-bit signed integer", raw.TTLOverride, name))
+		}
+		if raw.MaxTTL > MAX_MAX_TTL {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid max_ttl %d for %q. Must be at most %d seconds", raw.MaxTTL, name, MAX_MAX_TTL))
+		}
+		if raw.WriteBatchDelay > 10000 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid write_batch_delay %d for %q. Must be at most 10000 microseconds", raw.WriteBatchDelay, name))
+		}
+		if raw.WriteBufferSize > MAX_WRITE_BUFFER_SIZE {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid write_buffer_size %d for %q. Must be at most %d bytes", raw.WriteBufferSize, name, MAX_WRITE_BUFFER_SIZE))
+		}
+		if raw.BackendReadBuffer > MAX_BACKEND_READ_BUFFER {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid backend_read_buffer %d for %q. Must be at most %d bytes", raw.BackendReadBuffer, name, MAX_BACKEND_READ_BUFFER))
+		}
+		if raw.ConnectTimeout > 60000 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid connect_timeout %d for %q. Must be at most 60000ms", raw.ConnectTimeout, name))
 		}
 		if raw.Timeout < 10 || raw.Timeout > 60000 {
 			errorMsgs = append(errorMsgs, fmt.Sprintf("unsupported/missing timeout %d for %q. Must be between 10ms and 60000ms", raw.Timeout, name))
@@ -159,14 +529,166 @@ func BuildFromRawConfig(rawConfigs map[string]RawConfig, path string) (map[strin
 		if err != nil {
 			errorMsgs = append(errorMsgs, fmt.Sprintf("Invalid server in servers for %q: %v", name, err))
 		}
+		var prefixRoutes map[string][]TCPServer
+		if len(raw.PrefixRoutes) > 0 {
+			prefixRoutes = make(map[string][]TCPServer, len(raw.PrefixRoutes))
+		}
+		for prefix, rawServers := range raw.PrefixRoutes {
+			if prefix == "" {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("empty prefix in prefix_routes for %q", name))
+				continue
+			}
+			if len(rawServers) == 0 {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("no servers for prefix %q in prefix_routes for %q", prefix, name))
+				continue
+			}
+			routeServers, err := makeServers(rawServers)
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("Invalid server in prefix_routes %q for %q: %v", prefix, name, err))
+				continue
+			}
+			prefixRoutes[prefix] = routeServers
+		}
+		var replicas map[string][]TCPServer
+		if len(raw.Replicas) > 0 {
+			replicas = make(map[string][]TCPServer, len(raw.Replicas))
+		}
+		for primary, rawServers := range raw.Replicas {
+			if !hasServerKey(servers, prefixRoutes, primary) {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("unknown server %q in replicas for %q. Must be the name of a server in servers or prefix_routes", primary, name))
+				continue
+			}
+			if len(rawServers) == 0 {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("no replicas for server %q in replicas for %q", primary, name))
+				continue
+			}
+			replicaServers, err := makeServers(rawServers)
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("Invalid server in replicas %q for %q: %v", primary, name, err))
+				continue
+			}
+			replicas[primary] = replicaServers
+		}
+		if raw.StatsServer != "" && !hasServerKey(servers, nil, raw.StatsServer) {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("unknown stats_server %q for %q. Must be the name of a server in servers", raw.StatsServer, name))
+		}
+		shadow, err := makeServers(raw.Shadow)
+		if err != nil {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("Invalid server in shadow for %q: %v", name, err))
+		}
+		if len(raw.Shadow) > 0 && (raw.ShadowRatio <= 0 || raw.ShadowRatio > 1) {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("invalid shadow_ratio %v for %q. Must be greater than 0 and at most 1", raw.ShadowRatio, name))
+		}
+		if len(raw.Shadow) == 0 && raw.ShadowRatio != 0 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("shadow_ratio is set for %q, but shadow is empty", name))
+		}
+		if raw.ConnectionBurst > 0 && raw.MaxConnectionsPerSecond == 0 {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("connection_burst is set for %q, but max_connections_per_second is not", name))
+		}
+		connectionBurst := raw.ConnectionBurst
+		if connectionBurst == 0 {
+			connectionBurst = raw.MaxConnectionsPerSecond
+		}
+		var tlsConfig *tls.Config
+		if raw.TLS != nil {
+			tlsConfig, err = raw.TLS.buildClientTLS()
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid tls for %q: %v", name, err))
+			}
+		}
+		var clientTLSConfig *tls.Config
+		if raw.ClientTLS != nil {
+			clientTLSConfig, err = raw.ClientTLS.buildServerTLS()
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid client_tls for %q: %v", name, err))
+			}
+		}
+		var auth *AuthConfig
+		if raw.Auth != nil {
+			auth, err = NewAuthConfig(raw.Auth.Users)
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid auth for %q: %v", name, err))
+			}
+		}
+		var serverAuth *ServerCredentials
+		if raw.ServerAuth != nil {
+			serverAuth, err = raw.ServerAuth.build()
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid server_auth for %q: %v", name, err))
+			}
+		}
+		var allowCIDRs []*net.IPNet
+		for _, cidr := range raw.AllowCIDRs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid allow_cidrs entry %q for %q: %v", cidr, name, err))
+				continue
+			}
+			allowCIDRs = append(allowCIDRs, network)
+		}
+		var commandPolicy *CommandPolicy
+		if len(raw.AllowedCommands) > 0 || len(raw.DeniedCommands) > 0 {
+			commandPolicy, err = NewCommandPolicy(raw.AllowedCommands, raw.DeniedCommands)
+			if err != nil {
+				errorMsgs = append(errorMsgs, fmt.Sprintf("invalid command policy for %q: %v", name, err))
+			}
+		}
 		config := Config{
-			Listen:       raw.Listen,
-			Hash:         raw.Hash,
-			Distribution: raw.Distribution,
-			Timeout:      raw.Timeout,
-			Backlog:      raw.Backlog,
-			Preconnect:   raw.Preconnect,
-			Servers:      servers,
+			Listen:                  []string(raw.Listen),
+			UnixSocketMode:          unixSocketMode,
+			UnixSocketUID:           raw.UnixSocketUID,
+			UnixSocketGID:           raw.UnixSocketGID,
+			UDPListen:               raw.UDPListen,
+			Hash:                    raw.Hash,
+			HashTag:                 raw.HashTag,
+			Distribution:            raw.Distribution,
+			Timeout:                 raw.Timeout,
+			ConnectTimeout:          time.Duration(raw.ConnectTimeout) * time.Millisecond,
+			Backlog:                 raw.Backlog,
+			Preconnect:              raw.Preconnect,
+			ReusePort:               raw.ReusePort,
+			MaxLineLength:           raw.MaxLineLength,
+			MaxItemSize:             raw.MaxItemSize,
+			MetricsListen:           raw.MetricsListen,
+			HealthListen:            raw.HealthListen,
+			MaxServerConnections:    raw.ServerConnections,
+			MaxConnections:          raw.MaxConnections,
+			MaxConnectionsPerSecond: raw.MaxConnectionsPerSecond,
+			ConnectionBurst:         connectionBurst,
+			AllowCIDRs:              allowCIDRs,
+			MaxOutstanding:          raw.MaxOutstanding,
+			MaxRetries:              raw.MaxRetries,
+			ClientIdleTimeout:       time.Duration(raw.ClientIdleTimeout) * time.Second,
+			TCPKeepAlive:            time.Duration(raw.TCPKeepAlive) * time.Second,
+			TCPNoDelay:              raw.TCPNoDelay,
+			AutoEjectHosts:          raw.AutoEjectHosts,
+			ServerFailureLimit:      raw.ServerFailureLimit,
+			ServerRetryTimeout:      time.Duration(raw.ServerRetryTimeout) * time.Millisecond,
+			WriteBatchDelay:         time.Duration(raw.WriteBatchDelay) * time.Microsecond,
+			WriteBufferSize:         raw.WriteBufferSize,
+			BackendReadBuffer:       raw.BackendReadBuffer,
+			SlowlogThreshold:        time.Duration(raw.SlowlogThreshold) * time.Millisecond,
+			AccessLog:               raw.AccessLog,
+			TTLOverride:             raw.TTLOverride,
+			MaxTTL:                  raw.MaxTTL,
+			ReadOnly:                raw.ReadOnly,
+			FireAndForgetSets:       raw.FireAndForgetSets,
+			CoalesceGets:            raw.CoalesceGets,
+			MissOnBackendDown:       raw.MissOnBackendDown,
+			LenientLineEndings:      raw.LenientLineEndings,
+			BackendErrors:           raw.BackendErrors,
+			TLS:                     tlsConfig,
+			ClientTLS:               clientTLSConfig,
+			Auth:                    auth,
+			ServerAuth:              serverAuth,
+			CommandPolicy:           commandPolicy,
+			Servers:                 servers,
+			PrefixRoutes:            prefixRoutes,
+			Replicas:                replicas,
+			Selection:               raw.Selection,
+			StatsServer:             raw.StatsServer,
+			Shadow:                  shadow,
+			ShadowRatio:             raw.ShadowRatio,
 		}
 		result[name] = config
 	}
@@ -192,7 +714,7 @@ func parseRawConfigs(contents []byte, path string) (map[string]RawConfig, error)
 	result := make(map[string]RawConfig)
 	err := yaml.Unmarshal([]byte(contents), result)
 	if err != nil {
-		log.Fatalf("Failed to read %q: %v", path, err)
+		return nil, fmt.Errorf("Failed to read %q: %v", path, err)
 	}
 
 	return result, nil
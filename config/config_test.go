@@ -3,7 +3,13 @@ package config
 import (
 	"github.com/TysonAndre/golemproxy/testutil"
 
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Check that this can parse the raw contents of yml files without errors.
@@ -35,4 +41,564 @@ func TestLoadExample(t *testing.T) {
 		failover.Servers,
 		"unexpected value for failover servers",
 	)
+	testutil.ExpectEquals(t, uint(DEFAULT_MAX_LINE_LENGTH), main.MaxLineLength, "unexpected default for max_line_length")
+	testutil.ExpectEquals(t, uint(DEFAULT_MAX_ITEM_SIZE), main.MaxItemSize, "unexpected default for max_item_size")
+	testutil.ExpectEquals(t, uint(1), main.MaxServerConnections, "unexpected default for server_connections")
+	testutil.ExpectEquals(t, 30*time.Second, main.TCPKeepAlive, "unexpected default for tcp_keepalive")
+	testutil.ExpectEquals(t, true, main.TCPNoDelay, "unexpected default for tcp_nodelay")
+}
+
+func TestPrefixRoutes(t *testing.T) {
+	raw, err := parseRawConfigs([]byte(`
+main:
+  listen: 127.0.0.1:22122
+  distribution: ketama
+  servers:
+    - 127.0.0.1:11211:1
+  prefix_routes:
+    "session:":
+      - 127.0.0.1:11311:1
+      - 127.0.0.1:11312:1
+`), "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := BuildFromRawConfig(raw, "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(
+		t,
+		map[string][]TCPServer{
+			"session:": {
+				{Host: "127.0.0.1", Port: 11311, Key: "127.0.0.1:11311", Weight: 1},
+				{Host: "127.0.0.1", Port: 11312, Key: "127.0.0.1:11312", Weight: 1},
+			},
+		},
+		configs["main"].PrefixRoutes,
+		"unexpected value for prefix_routes",
+	)
+
+	raw["main"] = RawConfig{
+		Listen:            ListenAddresses{"127.0.0.1:22122"},
+		Distribution:      "ketama",
+		Timeout:           1000,
+		MaxLineLength:     DEFAULT_MAX_LINE_LENGTH,
+		MaxItemSize:       DEFAULT_MAX_ITEM_SIZE,
+		ServerConnections: 1,
+		Servers:           []string{"127.0.0.1:11211:1"},
+		PrefixRoutes:      map[string][]string{"session:": {}},
+	}
+	_, err = BuildFromRawConfig(raw, "test.yml")
+	if err == nil {
+		t.Errorf("expected a prefix without servers to be rejected")
+	}
+}
+
+func TestLoadTwemproxyExample(t *testing.T) {
+	pools, err := LoadYAML("./nutcracker.yml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, 3, len(pools), "unexpected number of pools")
+	testutil.ExpectEquals(
+		t,
+		[]TCPServer{
+			{Host: "127.0.0.1", Port: 11212, Key: "server1", Weight: 1},
+			{Host: "127.0.0.1", Port: 11213, Key: "server2", Weight: 2},
+			{Host: "127.0.0.1", Port: 11214, Key: "server3", Weight: 3},
+		},
+		pools["beta"].Servers,
+		"unexpected value for beta servers",
+	)
+	alpha := pools["alpha"]
+	testutil.ExpectEquals(t, true, alpha.AutoEjectHosts, "unexpected value for auto_eject_hosts")
+	testutil.ExpectEquals(t, uint(400), alpha.Timeout, "unexpected value for timeout")
+	testutil.ExpectEquals(t, 2*time.Second, alpha.ServerRetryTimeout, "unexpected value for server_retry_timeout")
+	gamma := pools["gamma"]
+	testutil.ExpectEquals(t, []string{"/tmp/gamma"}, gamma.Listen, "unexpected value for listen")
+	testutil.ExpectStringEquals(t, "fnv1a_64", gamma.Hash, "expected the twemproxy default hash")
+	testutil.ExpectStringEquals(t, "ketama", gamma.Distribution, "expected the twemproxy default distribution")
+	testutil.ExpectEquals(t, uint(4), gamma.MaxServerConnections, "unexpected value for server_connections")
+	testutil.ExpectEquals(t, uint(1), gamma.Servers[0].Weight, "unexpected weight")
+}
+
+func TestTwemproxyRedisPoolsAreRejected(t *testing.T) {
+	_, err := parseTwemproxyConfigs([]byte(`
+cache:
+  listen: 127.0.0.1:22121
+  redis: true
+  servers:
+   - 127.0.0.1:6379:1
+`), "test.yml")
+	if err == nil {
+		t.Errorf("expected redis pools to be rejected")
+	}
+}
+
+func TestParseListenAddress(t *testing.T) {
+	for _, test := range []struct {
+		listen          string
+		expectedNetwork string
+		expectedAddress string
+	}{
+		{"[::1]:11211", "tcp", "[::1]:11211"},
+		{"0.0.0.0:11211", "tcp", "0.0.0.0:11211"},
+		{"localhost:11211", "tcp", "localhost:11211"},
+		{"/tmp/golem.sock", "unix", "/tmp/golem.sock"},
+		{"/tmp/golem:0.sock", "unix", "/tmp/golem:0.sock"},
+		{"unix:golem:0.sock", "unix", "golem:0.sock"},
+		{"golem.sock", "unix", "golem.sock"},
+	} {
+		network, address := ParseListenAddress(test.listen)
+		testutil.ExpectStringEquals(t, test.expectedNetwork, network, "unexpected network for "+test.listen)
+		testutil.ExpectStringEquals(t, test.expectedAddress, address, "unexpected address for "+test.listen)
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	valid := Config{
+		Listen:       []string{"127.0.0.1:22121"},
+		Hash:         "fnv1a_64",
+		Distribution: "ketama",
+		Timeout:      1000,
+		Servers:      []TCPServer{{Host: "127.0.0.1", Port: 11211, Key: "127.0.0.1", Weight: 1}},
+	}
+	testutil.ExpectEquals(t, nil, Validate(map[string]Config{"main": valid}), "expected a valid config")
+
+	other := valid
+	other.Servers = nil
+	err := Validate(map[string]Config{"main": valid, "other": other})
+	testutil.ExpectEquals(t, ValidationErrors{
+		fmt.Errorf(`pools "main" and "other" both listen on "127.0.0.1:22121"`),
+		fmt.Errorf(`empty servers for "other"`),
+	}, err, "expected both problems to be reported")
+
+	first := valid
+	first.Listen = []string{"unix:/tmp/golemproxy.sock"}
+	second := valid
+	second.Listen = []string{"/tmp/./golemproxy.sock"}
+	second.Distribution = "bogus"
+	second.Timeout = 0
+	err = Validate(map[string]Config{"first": first, "second": second})
+	testutil.ExpectEquals(t, ValidationErrors{
+		fmt.Errorf(`pools "first" and "second" both use the unix socket "/tmp/golemproxy.sock"`),
+		fmt.Errorf(`unsupported distribution "bogus" for "second". "ketama", "modula", and "random" are supported`),
+		fmt.Errorf(`timeout for "second" must be non-zero`),
+	}, err, "expected every problem to be reported")
+}
+
+func TestAuth(t *testing.T) {
+	raw, err := parseRawConfigs([]byte(`
+main:
+  listen: 127.0.0.1:22122
+  distribution: ketama
+  servers:
+    - 127.0.0.1:11211:1
+  auth:
+    users:
+      alice: secret
+`), "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := BuildFromRawConfig(raw, "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := configs["main"].Auth
+	testutil.ExpectEquals(t, true, auth.Authenticate("alice", "secret"), "expected the configured user to authenticate")
+	testutil.ExpectEquals(t, false, auth.Authenticate("alice", "wrong"), "expected a wrong password to be rejected")
+	testutil.ExpectEquals(t, false, auth.Authenticate("bob", "secret"), "expected an unknown user to be rejected")
+
+	conf := configs["main"]
+	conf.UDPListen = "127.0.0.1:22122"
+	err = Validate(map[string]Config{"main": conf})
+	testutil.ExpectEquals(t, ValidationErrors{
+		fmt.Errorf(`udp_listen can't be used with auth for "main", since clients can't authenticate over udp`),
+	}, err, "expected udp_listen to be rejected with auth")
+
+	_, err = NewAuthConfig(nil)
+	if err == nil {
+		t.Errorf("expected auth without users to be rejected")
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	raw, err := parseRawConfigs([]byte(`
+main:
+  listen: 127.0.0.1:22122
+  distribution: ketama
+  servers:
+    - 127.0.0.1:11211:1
+  server_auth:
+    username: golemproxy
+    password: secret
+`), "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := BuildFromRawConfig(raw, "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.ExpectEquals(t, &ServerCredentials{Username: "golemproxy", Password: "secret"}, configs["main"].ServerAuth, "unexpected server_auth")
+
+	main := raw["main"]
+	main.ServerAuth = &RawServerAuthConfig{Username: "golem\x00proxy", Password: "secret"}
+	raw["main"] = main
+	_, err = BuildFromRawConfig(raw, "test.yml")
+	if err == nil {
+		t.Errorf("expected a username with a NUL byte to be rejected")
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	raw, err := parseRawConfigs([]byte(`
+main:
+  listen: 127.0.0.1:22122
+  distribution: ketama
+  servers:
+    - 127.0.0.1:11211:1
+  denied_commands:
+    - flush_all
+readonly:
+  listen: 127.0.0.1:22123
+  distribution: ketama
+  servers:
+    - 127.0.0.1:11211:1
+  allowed_commands:
+    - "*"
+  denied_commands:
+    - writes
+`), "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := BuildFromRawConfig(raw, "test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := configs["main"].CommandPolicy
+	testutil.ExpectEquals(t, false, policy.Permits("flush_all"), "expected flush_all to be denied")
+	testutil.ExpectEquals(t, true, policy.Permits("get"), "expected get to be allowed")
+	testutil.ExpectEquals(t, true, policy.Permits("set"), "expected set to be allowed")
+	testutil.ExpectEquals(t, true, policy.Permits("quit"), "expected quit to be allowed")
+
+	policy = configs["readonly"].CommandPolicy
+	testutil.ExpectEquals(t, false, policy.Permits("set"), "expected writes to be denied")
+	testutil.ExpectEquals(t, false, policy.Permits("incr"), "expected writes to be denied")
+	testutil.ExpectEquals(t, true, policy.Permits("gets"), "expected reads to be allowed")
+
+	policy, err = NewCommandPolicy([]string{"get", "version"}, nil)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, true, policy.Permits("version"), "expected an allowed command to be permitted")
+	testutil.ExpectEquals(t, false, policy.Permits("gets"), "expected commands that aren't allowed to be denied")
+
+	everything, err := NewCommandPolicy([]string{"*"}, nil)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, true, everything.Equal(nil), "expected a policy permitting every command to equal no policy")
+	testutil.ExpectEquals(t, false, policy.Equal(nil), "expected a restrictive policy to differ from no policy")
+	testutil.ExpectEquals(t, true, configs["readonly"].CommandPolicy.Equal(configs["readonly"].CommandPolicy), "expected a policy to equal itself")
+	testutil.ExpectEquals(t, false, configs["readonly"].CommandPolicy.Equal(configs["main"].CommandPolicy), "expected different policies to differ")
+
+	_, err = NewCommandPolicy([]string{"gett"}, nil)
+	testutil.ExpectStringEquals(t, `invalid allowed_commands: unknown command "gett"`, fmt.Sprint(err), "expected unknown commands to be rejected")
+}
+
+// writeTempConfig writes contents to a temporary config file, and returns its path.
+func writeTempConfig(t *testing.T, contents string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "golemproxy-config")
+	if err != nil {
+		t.Fatalf("failed to create a temporary file: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("failed to write the config: %v", err)
+	}
+	return f.Name()
+}
+
+func TestCheckFile(t *testing.T) {
+	output := &bytes.Buffer{}
+	err := checkFile("./config.yml.example", output)
+	testutil.ExpectEquals(t, nil, err, "expected the example config to be valid")
+	testutil.ExpectStringEquals(t, `main: listen 127.0.0.1:21211, hash fnv1a_64, distribution ketama
+  servers:
+    127.0.0.1:11211 weight 1 key "127.0.0.1"
+    127.0.0.1:11212 weight 1 key "127.0.0.1:11212"
+main-fail: listen 127.0.0.1:21212, hash fnv1a_64, distribution ketama
+  servers:
+    127.0.0.1:11221 weight 1 key "127.0.0.1:11221"
+    127.0.0.1:11222 weight 1 key "127.0.0.1:11222"
+`, output.String(), "unexpected summary of the example config")
+
+	// Both pools are valid on their own, so this is only detected by the same validation that golemproxy does at startup.
+	path := writeTempConfig(t, `
+a:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  timeout: 1000
+  servers: [127.0.0.1:11211:1]
+b:
+  listen: 127.0.0.1:22121
+  distribution: random
+  timeout: 1000
+  servers: [127.0.0.1:11212:1]
+`)
+	defer os.Remove(path)
+	output.Reset()
+	err = checkFile(path, output)
+	testutil.ExpectEquals(t, ValidationErrors{
+		fmt.Errorf(`pools "a" and "b" both listen on "127.0.0.1:22121"`),
+	}, err, "expected the duplicate listen address to be reported")
+	testutil.ExpectStringEquals(t, "", output.String(), "expected nothing to be printed for an invalid config")
+}
+
+func TestUnixSocketMode(t *testing.T) {
+	raw := map[string]RawConfig{"main": {
+		Listen:            ListenAddresses{"/tmp/golemproxy.sock"},
+		UnixSocketMode:    "0660",
+		Distribution:      "ketama",
+		ServerConnections: 1,
+		MaxLineLength:     DEFAULT_MAX_LINE_LENGTH,
+		MaxItemSize:       DEFAULT_MAX_ITEM_SIZE,
+		BackendErrors:     "relay",
+		Timeout:           1000,
+		Servers:           []string{"127.0.0.1:11211:1"},
+	}}
+	configs, err := BuildFromRawConfig(raw, "test.yml")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, os.FileMode(0660), configs["main"].UnixSocketMode, "unexpected unix_socket_mode")
+
+	main := raw["main"]
+	main.UnixSocketMode = ""
+	raw["main"] = main
+	configs, err = BuildFromRawConfig(raw, "test.yml")
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, DEFAULT_UNIX_SOCKET_MODE, configs["main"].UnixSocketMode, "expected the default unix_socket_mode")
+
+	main.UnixSocketMode = "0999"
+	raw["main"] = main
+	_, err = BuildFromRawConfig(raw, "test.yml")
+	testutil.ExpectEquals(t, `invalid unix_socket_mode "0999" for "main". Must be octal permissions such as 0660`, fmt.Sprint(err), "expected an invalid mode to be rejected")
+}
+
+func TestMultipleListenAddresses(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: [/tmp/golemproxy.sock, 127.0.0.1:22121]
+  distribution: ketama
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, []string{"/tmp/golemproxy.sock", "127.0.0.1:22121"}, pools["main"].Listen, "unexpected listen addresses")
+	err = Validate(pools)
+	testutil.ExpectEquals(t, nil, err, "expected a pool with several listen addresses to be valid")
+
+	conf := pools["main"]
+	conf.Listen = []string{"127.0.0.1:22121", "127.0.0.1:22121"}
+	err = Validate(map[string]Config{"main": conf})
+	testutil.ExpectEquals(t, ValidationErrors{
+		fmt.Errorf(`pool "main" has the listen address "127.0.0.1:22121" more than once`),
+	}, err, "expected the duplicate listen address to be reported")
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  allow_cidrs: [10.0.0.0/8, "fd00::/8"]
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	cidrs := []string{}
+	for _, network := range pools["main"].AllowCIDRs {
+		cidrs = append(cidrs, network.String())
+	}
+	testutil.ExpectEquals(t, []string{"10.0.0.0/8", "fd00::/8"}, cidrs, "unexpected allow_cidrs")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  allow_cidrs: [10.0.0.1]
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `invalid allow_cidrs entry "10.0.0.1" for "main"`), "expected an address without a prefix length to be rejected, got "+fmt.Sprint(err))
+}
+
+func TestMaxConnectionsPerSecond(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  max_connections_per_second: 100
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, uint(100), pools["main"].MaxConnectionsPerSecond, "unexpected max_connections_per_second")
+	testutil.ExpectEquals(t, uint(100), pools["main"].ConnectionBurst, "expected connection_burst to default to max_connections_per_second")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  connection_burst: 10
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `connection_burst is set for "main", but max_connections_per_second is not`), "expected connection_burst without a rate to be rejected, got "+fmt.Sprint(err))
+}
+
+func TestServerConnections(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1]
+pooled:
+  listen: 127.0.0.1:22122
+  distribution: ketama
+  server_connections: 4
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, uint(1), pools["main"].MaxServerConnections, "expected server_connections to default to 1")
+	testutil.ExpectEquals(t, uint(4), pools["pooled"].MaxServerConnections, "unexpected server_connections")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  server_connections: 0
+  servers: [127.0.0.1:11211:1]
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `invalid server_connections 0 for "main". Must be at least 1`), "expected server_connections of 0 to be rejected, got "+fmt.Sprint(err))
+}
+
+func TestReplicas(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers:
+    - 127.0.0.1:11211:1 primary1
+    - 127.0.0.1:11212:1 primary2
+  replicas:
+    primary1: [127.0.0.1:11311:1, 127.0.0.1:11312:1]
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, map[string][]TCPServer{
+		"primary1": {
+			{Host: "127.0.0.1", Port: 11311, Key: "127.0.0.1:11311", Weight: 1},
+			{Host: "127.0.0.1", Port: 11312, Key: "127.0.0.1:11312", Weight: 1},
+		},
+	}, pools["main"].Replicas, "unexpected replicas")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1 primary1]
+  replicas:
+    primary3: [127.0.0.1:11311:1]
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `unknown server "primary3" in replicas for "main"`), "expected replicas of an unknown server to be rejected, got "+fmt.Sprint(err))
+}
+
+func TestSelection(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1 primary]
+  replicas:
+    primary: [127.0.0.1:11311:1, 127.0.0.1:11312:2]
+  selection: least_conn
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, "least_conn", pools["main"].Selection, "unexpected selection")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1]
+  selection: round_robin
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `unsupported selection "round_robin" for "main"`), "expected an unknown selection to be rejected, got "+fmt.Sprint(err))
+}
+
+func TestStatsServer(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1 first, 127.0.0.1:11212:1 second]
+  stats_server: second
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, "second", pools["main"].StatsServer, "unexpected stats_server")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1 first]
+  stats_server: third
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `unknown stats_server "third" for "main"`), "expected an unknown stats_server to be rejected, got "+fmt.Sprint(err))
+}
+
+func TestBackendReadBuffer(t *testing.T) {
+	path := writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1]
+  backend_read_buffer: 65536
+`)
+	defer os.Remove(path)
+	pools, err := ParseFile(path)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, uint(65536), pools["main"].BackendReadBuffer, "unexpected backend_read_buffer")
+
+	path = writeTempConfig(t, `
+main:
+  listen: 127.0.0.1:22121
+  distribution: ketama
+  servers: [127.0.0.1:11211:1]
+  backend_read_buffer: 2000000
+`)
+	defer os.Remove(path)
+	_, err = ParseFile(path)
+	testutil.ExpectEquals(t, true, strings.Contains(fmt.Sprint(err), `invalid backend_read_buffer 2000000 for "main"`), "expected a huge backend_read_buffer to be rejected, got "+fmt.Sprint(err))
 }
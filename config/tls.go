@@ -0,0 +1,78 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// RawTLSConfig is the tls or client_tls section of a pool in the yaml config file.
+type RawTLSConfig struct {
+	// CAFile is a PEM file of the certificate authorities that are trusted. If empty, the system's certificate authorities are trusted.
+	// For client_tls, clients must present a certificate signed by one of these if this is set.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the PEM files of the certificate that golemproxy presents, if any.
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca_file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no certificates found in ca_file %q", path)
+	}
+	return pool, nil
+}
+
+// buildClientTLS returns the tls.Config used to connect to memcache servers.
+func (raw *RawTLSConfig) buildClientTLS() (*tls.Config, error) {
+	result := &tls.Config{
+		ServerName:         raw.ServerName,
+		InsecureSkipVerify: raw.InsecureSkipVerify,
+	}
+	if raw.CAFile != "" {
+		pool, err := loadCertPool(raw.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		result.RootCAs = pool
+	}
+	if raw.CertFile != "" || raw.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(raw.CertFile, raw.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cert_file and key_file: %v", err)
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
+
+// buildServerTLS returns the tls.Config used to accept connections from clients.
+func (raw *RawTLSConfig) buildServerTLS() (*tls.Config, error) {
+	if raw.CertFile == "" || raw.KeyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(raw.CertFile, raw.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cert_file and key_file: %v", err)
+	}
+	result := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if raw.CAFile != "" {
+		pool, err := loadCertPool(raw.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		result.ClientCAs = pool
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return result, nil
+}
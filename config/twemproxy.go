@@ -0,0 +1,104 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RawTwemproxyConfig is a pool in a nutcracker/twemproxy yaml config file.
+// Settings that golemproxy has no equivalent for (e.g. redis_auth) are ignored.
+type RawTwemproxyConfig struct {
+	Listen       string `yaml:"listen"`
+	Hash         string `yaml:"hash"`
+	HashTag      string `yaml:"hash_tag"`
+	Distribution string `yaml:"distribution"`
+	// Timeout is in milliseconds. twemproxy waits forever if this is unset, which golemproxy does not support.
+	Timeout            uint     `yaml:"timeout"`
+	Backlog            uint     `yaml:"backlog"`
+	Preconnect         bool     `yaml:"preconnect"`
+	Redis              bool     `yaml:"redis"`
+	ServerConnections  uint     `yaml:"server_connections"`
+	AutoEjectHosts     bool     `yaml:"auto_eject_hosts"`
+	ServerRetryTimeout uint     `yaml:"server_retry_timeout"`
+	ServerFailureLimit uint     `yaml:"server_failure_limit"`
+	Servers            []string `yaml:"servers"`
+}
+
+func (raw *RawTwemproxyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type TmpConfig RawTwemproxyConfig
+	// The same defaults as twemproxy, except for timeout.
+	result := TmpConfig{
+		Hash:               "fnv1a_64",
+		Distribution:       "ketama",
+		Timeout:            1000,
+		Backlog:            512,
+		ServerConnections:  1,
+		ServerRetryTimeout: 30000,
+		ServerFailureLimit: 2,
+	}
+	if err := unmarshal(&result); err != nil {
+		return err
+	}
+	*raw = RawTwemproxyConfig(result)
+	return nil
+}
+
+var _ yaml.Unmarshaler = &RawTwemproxyConfig{}
+
+// toRawConfig converts the twemproxy settings to the equivalent golemproxy settings.
+func (raw *RawTwemproxyConfig) toRawConfig() RawConfig {
+	return RawConfig{
+		Listen:             ListenAddresses{raw.Listen},
+		Hash:               raw.Hash,
+		HashTag:            raw.HashTag,
+		Distribution:       raw.Distribution,
+		Timeout:            raw.Timeout,
+		Backlog:            raw.Backlog,
+		Preconnect:         raw.Preconnect,
+		MaxLineLength:      DEFAULT_MAX_LINE_LENGTH,
+		MaxItemSize:        DEFAULT_MAX_ITEM_SIZE,
+		BackendErrors:      "relay",
+		ServerConnections:  raw.ServerConnections,
+		TCPKeepAlive:       30,
+		TCPNoDelay:         true,
+		AutoEjectHosts:     raw.AutoEjectHosts,
+		ServerFailureLimit: raw.ServerFailureLimit,
+		ServerRetryTimeout: raw.ServerRetryTimeout,
+		Servers:            raw.Servers,
+	}
+}
+
+// LoadYAML loads the pools of a nutcracker/twemproxy yaml config file, to make migrating from twemproxy easier.
+// Unlike ParseFile, the twemproxy defaults are used for hash (fnv1a_64) and distribution (ketama).
+func LoadYAML(path string) (map[string]Config, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load %q: %s", path, err)
+	}
+	return parseTwemproxyConfigs(contents, path)
+}
+
+func parseTwemproxyConfigs(contents []byte, path string) (map[string]Config, error) {
+	pools := make(map[string]RawTwemproxyConfig)
+	err := yaml.Unmarshal(contents, pools)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %q: %v", path, err)
+	}
+	rawConfigs := make(map[string]RawConfig, len(pools))
+	errorMsgs := []string{}
+	for name, pool := range pools {
+		if pool.Redis {
+			errorMsgs = append(errorMsgs, fmt.Sprintf("redis is not supported for %q", name))
+			continue
+		}
+		rawConfigs[name] = pool.toRawConfig()
+	}
+	if len(errorMsgs) > 0 {
+		return nil, errors.New(strings.Join(errorMsgs, "; "))
+	}
+	return BuildFromRawConfig(rawConfigs, path)
+}
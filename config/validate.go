@@ -0,0 +1,116 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ParseListenAddress returns the network ("tcp" or "unix") and address to listen on for a listen setting from the config.
+// Unix socket paths start with "/" or "unix:". TCP addresses are "host:port", where IPv6 hosts are in brackets, e.g. "[::1]:11211".
+// Anything else is treated as a relative unix socket path, or an abstract unix socket on Linux if it starts with "@".
+func ParseListenAddress(listen string) (string, string) {
+	if strings.HasPrefix(listen, "unix:") {
+		return "unix", strings.TrimPrefix(listen, "unix:")
+	}
+	if strings.HasPrefix(listen, "/") {
+		return "unix", listen
+	}
+	if _, _, err := net.SplitHostPort(listen); err == nil {
+		return "tcp", listen
+	}
+	return "unix", listen
+}
+
+// ValidationErrors is every problem that Validate found in the configs.
+type ValidationErrors []error
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks that configs can be served together, and returns ValidationErrors with all of the problems if they can't.
+// This catches mistakes that can't be detected when parsing an individual pool, such as two pools with the same listen address.
+func Validate(configs map[string]Config) error {
+	var errs ValidationErrors
+	addError := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if len(configs) == 0 {
+		addError("no pools were configured")
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	listeners := make(map[string]string)
+	for _, name := range names {
+		conf := configs[name]
+		if len(conf.Listen) == 0 {
+			addError("empty listen for %q", name)
+		}
+		for _, listen := range conf.Listen {
+			if listen == "" {
+				addError("empty listen address for %q", name)
+				continue
+			}
+			network, address := ParseListenAddress(listen)
+			// Abstract unix socket names such as "@golemproxy" are not paths.
+			if network == "unix" && !strings.HasPrefix(address, "@") {
+				address = filepath.Clean(address)
+			}
+			key := network + ":" + address
+			if other, ok := listeners[key]; ok {
+				if other == name {
+					addError("pool %q has the listen address %q more than once", name, listen)
+				} else if network == "unix" {
+					addError("pools %q and %q both use the unix socket %q", other, name, address)
+				} else {
+					addError("pools %q and %q both listen on %q", other, name, address)
+				}
+			} else {
+				listeners[key] = name
+			}
+		}
+		if conf.UDPListen != "" && conf.Auth != nil {
+			addError("udp_listen can't be used with auth for %q, since clients can't authenticate over udp", name)
+		}
+		if conf.UDPListen != "" {
+			key := "udp:" + conf.UDPListen
+			if other, ok := listeners[key]; ok {
+				addError("pools %q and %q both use the udp_listen %q", other, name, conf.UDPListen)
+			} else {
+				listeners[key] = name
+			}
+		}
+		if len(conf.Servers) == 0 {
+			addError("empty servers for %q", name)
+		}
+		for prefix, servers := range conf.PrefixRoutes {
+			if len(servers) == 0 {
+				addError("no servers for prefix %q in prefix_routes for %q", prefix, name)
+			}
+		}
+		if !isSupportedHash(conf.Hash) {
+			addError("unsupported hash %q for %q. Supported hashes are %s", conf.Hash, name, strings.Join(supportedHashes, ", "))
+		}
+		if !isSupportedDistribution(conf.Distribution) {
+			addError(`unsupported distribution %q for %q. "ketama", "modula", and "random" are supported`, conf.Distribution, name)
+		}
+		if conf.Timeout == 0 {
+			addError("timeout for %q must be non-zero", name)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
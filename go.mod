@@ -5,8 +5,8 @@ go 1.12
 require (
 	github.com/TysonAndre/gomemcache v0.0.0-20171122195738-8e31a71ee32c
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	github.com/sevlyar/go-daemon v0.1.5 // indirect
+	github.com/sevlyar/go-daemon v0.1.5
 	go4.org v0.0.0-20190218023631-ce4c26f7be8e
-	golang.org/x/sys v0.0.0-20210507161434-a76c4d0a0096 // indirect
+	golang.org/x/sys v0.0.0-20210507161434-a76c4d0a0096
 	gopkg.in/yaml.v2 v2.2.2
 )
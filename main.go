@@ -15,6 +15,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 )
 
 var (
@@ -26,6 +27,8 @@ var (
 	pidFilePath       = flag.String("p", "", "set pid file (default: off)")
 	mbufSizeFlag      = flag.Int("m", 0, "mbuf chunk size for twemproxy compat (IGNORED)")
 	statsIntervalFlag = flag.Int("i", 30000, "stats interval in msec for twemproxy compat (IGNORED)")
+	testConfFlag      = flag.Bool("t", false, "test the config file for errors, print the pools it configures, and exit")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 5*time.Second, "how long to wait for in-flight requests on SIGTERM or SIGINT")
 )
 
 var flagAlias = map[string]string{
@@ -37,6 +40,7 @@ var flagAlias = map[string]string{
 	"verbose":        "v",
 	"mbuf-size":      "m",
 	"stats-interval": "s",
+	"test-conf":      "t",
 }
 
 func daemonize() bool {
@@ -88,9 +92,19 @@ func main() {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if *testConfFlag {
+		err := config.CheckFile(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config file %q: %v\n", configFile, err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Config file %q is valid\n", configFile)
+		os.Exit(0)
+	}
 	configs, err := config.ParseFile(configFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Invalid config file %q: %v\n", configFile, err)
+		os.Exit(1)
 	}
 	if *daemonizeFlag {
 		fmt.Fprintf(os.Stderr, "Going to daemonize\n")
@@ -98,6 +112,15 @@ func main() {
 			os.Exit(0)
 		}
 	}
+	// 7 is LOG_DEBUG in twemproxy
+	proxy.DebugLogging = *verboseLevelFlag >= 7
 	fmt.Fprintf(os.Stderr, "Starting: %#v\n\n", configs)
-	proxy.Run(configs, *statsPortFlag)
+	reloadConfigs := func() (map[string]config.Config, error) {
+		return config.ParseFile(configFile)
+	}
+	err = proxy.Run(configs, *statsPortFlag, *shutdownTimeout, reloadConfigs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start: %v\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,122 @@
+package memcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// authMemcache is a minimal memcache server that requires SASL PLAIN authentication as alice with the password secret
+// before responding to text protocol gets, and closes each connection after its first get.
+type authMemcache struct {
+	l          net.Listener
+	m          sync.Mutex
+	handshakes []string
+}
+
+func serveAuthMemcache(t *testing.T) *authMemcache {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &authMemcache{l: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+// encodeSASLAuthResponse returns a binary protocol response to a SASL_AUTH request.
+func encodeSASLAuthResponse(status uint16, message string) []byte {
+	response := make([]byte, binaryHeaderLength)
+	response[0] = binaryResponseMagic
+	response[1] = binaryOpcodeSASLAuth
+	binary.BigEndian.PutUint16(response[6:8], status)
+	binary.BigEndian.PutUint32(response[8:12], uint32(len(message)))
+	return append(response, message...)
+}
+
+// saslAuthHeader is the header of a SASL_AUTH request with the key PLAIN and an 18 byte body, e.g. to authenticate as alice with the password secret.
+const saslAuthHeader = "\x80\x21\x00\x05\x00\x00\x00\x00\x00\x00\x00\x12\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+func (s *authMemcache) serve(c net.Conn) {
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	header := make([]byte, binaryHeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return
+	}
+	handshake := string(header) + string(body)
+	s.m.Lock()
+	s.handshakes = append(s.handshakes, handshake)
+	s.m.Unlock()
+	if handshake != saslAuthHeader+"PLAIN\x00alice\x00secret" {
+		c.Write(encodeSASLAuthResponse(0x20, "Auth failure."))
+		return
+	}
+	c.Write(encodeSASLAuthResponse(0, "Authenticated"))
+	if _, err := reader.ReadString('\n'); err != nil {
+		return
+	}
+	c.Write([]byte("END\r\n"))
+}
+
+func (s *authMemcache) handshakeLog() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]string{}, s.handshakes...)
+}
+
+func TestAuthenticatesEachConnection(t *testing.T) {
+	s := serveAuthMemcache(t)
+	defer s.l.Close()
+
+	c := New(s.l.Addr().String(), 1, time.Second)
+	c.Credentials = &Credentials{Username: "alice", Password: "wrong!"}
+	defer c.Finalize()
+	_, err := c.Get("foo")
+	authErr, ok := err.(*AuthError)
+	if !ok {
+		t.Fatalf("expected an AuthError for the wrong password, got %v", err)
+	}
+	testutil.ExpectStringEquals(t, "status 0x20: Auth failure.", authErr.Response, "unexpected response to the wrong password")
+	testutil.ExpectEquals(t, true, IsServerFailure(err), "expected failed authentication to count as a server failure")
+
+	c = New(s.l.Addr().String(), 1, time.Second)
+	c.Credentials = &Credentials{Username: "alice", Password: "secret"}
+	defer c.Finalize()
+	_, err = c.Get("foo")
+	testutil.ExpectEquals(t, ErrCacheMiss, err, "expected the get to succeed after authenticating")
+	// The server closes the connection, so the client reconnects and authenticates again.
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err = c.Get("foo")
+		if err == ErrCacheMiss || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.ExpectEquals(t, ErrCacheMiss, err, "expected the get to succeed after reconnecting")
+	testutil.ExpectEquals(t, []string{
+		saslAuthHeader + "PLAIN\x00alice\x00wrong!",
+		saslAuthHeader + "PLAIN\x00alice\x00secret",
+		saslAuthHeader + "PLAIN\x00alice\x00secret",
+	}, s.handshakeLog(), "unexpected handshakes")
+}
@@ -0,0 +1,151 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// serveEchoMemcache is a memcache server that responds to "get <key>" with the key as the value.
+func serveEchoMemcache(tb testing.TB) net.Listener {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				writer := bufio.NewWriter(c)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					key := strings.TrimSuffix(strings.TrimPrefix(line, "gets "), "\r\n")
+					fmt.Fprintf(writer, "VALUE %s 0 %d 1\r\n%s\r\nEND\r\n", key, len(key), key)
+					if reader.Buffered() == 0 {
+						writer.Flush()
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// countingWriter counts the calls to Write, which are the write syscalls of a connection to a server.
+type countingWriter struct {
+	io.Writer
+	writes *uint64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	atomic.AddUint64(w.writes, 1)
+	return w.Writer.Write(p)
+}
+
+// countingConnectionFactory creates connections that count their writes.
+type countingConnectionFactory struct {
+	*PipeliningClient
+	writes uint64
+}
+
+func (f *countingConnectionFactory) getConn() (*conn, error) {
+	cn, err := f.PipeliningClient.getConn()
+	if err != nil {
+		return nil, err
+	}
+	cn.writer = countingWriter{Writer: cn.writer, writes: &f.writes}
+	return cn, nil
+}
+
+// newCountingClient returns a client for addr with a single connection, and the factory that counts the writes of that connection.
+func newCountingClient(tb testing.TB, addr string, writeBatchDelay time.Duration) (*PipeliningClient, *countingConnectionFactory) {
+	tb.Helper()
+	resolved, err := ResolveServerAddr(addr)
+	if err != nil {
+		tb.Fatalf("failed to resolve %s: %v", addr, err)
+	}
+	c := &PipeliningClient{addr: resolved, serverRepr: addr, Timeout: time.Second, WriteBatchDelay: writeBatchDelay}
+	factory := &countingConnectionFactory{PipeliningClient: c}
+	InitWorkerManager(&c.manager, 1, factory)
+	return c, factory
+}
+
+// getConcurrently sends requestCount gets from concurrency goroutines and checks that each response is for the requested key.
+func getConcurrently(tb testing.TB, c *PipeliningClient, concurrency int, requestCount int) {
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			for j := i; j < requestCount; j += concurrency {
+				key := fmt.Sprintf("key%d", j)
+				item, err := c.Get(key)
+				if err != nil {
+					tb.Errorf("get %s failed: %v", key, err)
+					return
+				}
+				if string(item.Value) != key {
+					tb.Errorf("expected the response for %s, got %q", key, item.Value)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWriteBatchingPreservesResponseOrder(t *testing.T) {
+	l := serveEchoMemcache(t)
+	defer l.Close()
+	c, factory := newCountingClient(t, l.Addr().String(), 200*time.Microsecond)
+	defer c.Finalize()
+
+	const requestCount = 2000
+	getConcurrently(t, c, 50, requestCount)
+	writes := atomic.LoadUint64(&factory.writes)
+	if writes >= requestCount {
+		t.Errorf("expected concurrent requests to be batched into fewer than %d writes, got %d", requestCount, writes)
+	}
+
+	// A request that is sent when the client is idle is still written after the delay.
+	item, err := c.Get("idle")
+	testutil.ExpectEquals(t, nil, err, "unexpected error for an idle client")
+	testutil.ExpectStringEquals(t, "idle", string(item.Value), "unexpected value")
+}
+
+func benchmarkWriteBatching(b *testing.B, writeBatchDelay time.Duration) {
+	l := serveEchoMemcache(b)
+	defer l.Close()
+	c, factory := newCountingClient(b, l.Addr().String(), writeBatchDelay)
+	defer c.Finalize()
+	b.ResetTimer()
+	getConcurrently(b, c, 50, b.N)
+	b.StopTimer()
+	b.Logf("%d requests were sent in %d writes", b.N, atomic.LoadUint64(&factory.writes))
+}
+
+func BenchmarkWriteBatchingDisabled(b *testing.B) {
+	benchmarkWriteBatching(b, 0)
+}
+
+// BenchmarkWriteBatching50us should log fewer writes per request than BenchmarkWriteBatchingDisabled.
+func BenchmarkWriteBatching50us(b *testing.B) {
+	benchmarkWriteBatching(b, 50*time.Microsecond)
+}
@@ -0,0 +1,91 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// serveStoringMemcache is a memcache server that responds to sets with STORED, and sends each set it receives to received.
+func serveStoringMemcache(t *testing.T, received chan<- string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					if len(fields) != 5 {
+						return
+					}
+					length, _ := strconv.Atoi(fields[4])
+					body := make([]byte, length+2)
+					if _, err := io.ReadFull(reader, body); err != nil {
+						return
+					}
+					received <- line + string(body)
+					io.WriteString(c, "STORED\r\n")
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestCanceledRequestDataIsNotReusedBeforeWrite(t *testing.T) {
+	received := make(chan string, 10)
+	l := serveStoringMemcache(t, received)
+	defer l.Close()
+	// The worker waits for more requests to write with the first request, so the first request is canceled before it is written.
+	c, _ := newCountingClient(t, l.Addr().String(), 200*time.Millisecond)
+	defer c.Finalize()
+
+	// The request data is reused like the pooled buffers of the proxy, which are reused once a request completes.
+	buf := []byte("set k1 0 0 1\r\na\r\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := &message.SingleMessage{}
+	canceled.HandleSendRequest(buf, buf[4:6], message.REQUEST_MC_SET)
+	c.SendProxiedMessageWithContext(ctx, canceled)
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	_, err := canceled.AwaitResponseBytes()
+	testutil.ExpectEquals(t, message.RESPONSE_ERROR_CANCELED, err, "expected the request to be canceled")
+
+	copy(buf, "set k2 0 0 1\r\nb\r\n")
+	m := &message.SingleMessage{}
+	m.HandleSendRequest(buf, buf[4:6], message.REQUEST_MC_SET)
+	c.SendProxiedMessageAsync(m)
+	response, err := m.AwaitResponseBytes()
+	testutil.ExpectEquals(t, (*message.ResponseError)(nil), err, "unexpected error for the request reusing the buffer")
+	testutil.ExpectStringEquals(t, "STORED\r\n", string(response), "unexpected response")
+
+	for _, expected := range []string{"set k1 0 0 1\r\na\r\n", "set k2 0 0 1\r\nb\r\n"} {
+		select {
+		case request := <-received:
+			testutil.ExpectStringEquals(t, expected, request, "expected the canceled request to be written before its data was reused")
+		case <-time.After(time.Second):
+			t.Fatalf("expected the server to receive %q", expected)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package memcache
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// listenWithFullBacklog returns the address of a socket that never accepts connections and whose backlog is full,
+// so that Linux drops new connection attempts and dials time out. close must be called to close the socket.
+func listenWithFullBacklog(t *testing.T) (addr string, close func()) {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create a socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("failed to bind: %v", err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("failed to get the address: %v", err)
+	}
+	addr = fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	// A backlog of 0 still allows one connection to be queued.
+	filler, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("failed to fill the backlog: %v", err)
+	}
+	return addr, func() {
+		filler.Close()
+		syscall.Close(fd)
+	}
+}
+
+func TestConnectTimeoutWithFullBacklog(t *testing.T) {
+	addr, closeListener := listenWithFullBacklog(t)
+	defer closeListener()
+
+	c := New(addr, 1, 5*time.Second)
+	c.ConnectTimeout = 100 * time.Millisecond
+	defer c.Finalize()
+	m := &message.SingleMessage{}
+	m.HandleSendRequest([]byte("get k\r\n"), []byte("k"), message.REQUEST_MC_GET)
+	start := time.Now()
+	c.SendProxiedMessageAsync(m)
+	_, err := m.AwaitResponseBytes()
+	elapsed := time.Since(start)
+	testutil.ExpectEquals(t, message.RESPONSE_ERROR_CONNECTION_TIMEOUT, err, "expected the request to fail with a connection timeout")
+	if elapsed > time.Second {
+		t.Errorf("expected the dial to fail after the connect timeout rather than the timeout, took %v", elapsed)
+	}
+	testutil.ExpectEquals(t, int64(1), c.ConsecutiveFailures(), "expected the connect timeout to count as a failure of the server")
+}
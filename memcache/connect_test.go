@@ -0,0 +1,37 @@
+package memcache
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// NON_ROUTABLE_ADDR is an address that connections usually hang on until they time out.
+const NON_ROUTABLE_ADDR = "10.255.255.1:11211"
+
+func TestConnectTimeout(t *testing.T) {
+	testutil.ExpectEquals(t, true, IsServerFailure(&ConnectTimeoutError{}), "expected a connect timeout to count as a server failure")
+	if nc, err := net.DialTimeout("tcp", NON_ROUTABLE_ADDR, 50*time.Millisecond); err == nil {
+		nc.Close()
+		t.Skip(NON_ROUTABLE_ADDR + " is reachable from this network")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Skip(NON_ROUTABLE_ADDR + " is rejected immediately by this network: " + err.Error())
+	}
+
+	c := New(NON_ROUTABLE_ADDR, 1, 5*time.Second)
+	c.ConnectTimeout = 100 * time.Millisecond
+	defer c.Finalize()
+	m := &message.SingleMessage{}
+	m.HandleSendRequest([]byte("get k\r\n"), []byte("k"), message.REQUEST_MC_GET)
+	start := time.Now()
+	c.SendProxiedMessageAsync(m)
+	_, err := m.AwaitResponseBytes()
+	elapsed := time.Since(start)
+	testutil.ExpectEquals(t, message.RESPONSE_ERROR_CONNECTION_TIMEOUT, err, "expected the request to fail with a connection timeout")
+	if elapsed > time.Second {
+		t.Errorf("expected the dial to fail after the connect timeout rather than the timeout, took %v", elapsed)
+	}
+}
@@ -0,0 +1,61 @@
+package memcache
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestMaxValueSize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	closed := make(chan struct{})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		reader := bufio.NewReader(c)
+		if _, err := reader.ReadString('\n'); err != nil {
+			return
+		}
+		// Advertise a 100MB value, but only send the start of it.
+		io.WriteString(c, "VALUE foo 0 104857600\r\nabc")
+		// The client should close the connection instead of waiting for the rest of the value.
+		ioutil.ReadAll(reader)
+		close(closed)
+	}()
+
+	c := New(l.Addr().String(), 1, 5*time.Second)
+	c.MaxValueSize = 1 << 20
+	defer c.Finalize()
+	_, responseErr := sendProxied(c, "get foo\r\n", message.REQUEST_MC_GET)
+	testutil.ExpectEquals(t, message.RESPONSE_ERROR_BACKEND_RESPONSE_TOO_LARGE, responseErr, "expected the value to be rejected")
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("expected the connection to the server to be closed")
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	reader := &BufferedReader{maxValueSize: 10, onClose: func() {}}
+	testutil.ExpectEquals(t, false, reader.valueTooLarge(10), "expected a value of the maximum size to be allowed")
+	testutil.ExpectEquals(t, false, reader.failed, "expected the reader to be usable")
+	testutil.ExpectEquals(t, true, reader.valueTooLarge(11), "expected a larger value to be rejected")
+	testutil.ExpectEquals(t, true, reader.failed, "expected the reader to fail")
+
+	reader = &BufferedReader{onClose: func() {}}
+	testutil.ExpectEquals(t, false, reader.valueTooLarge(1<<30), "expected no limit by default")
+	testutil.ExpectEquals(t, true, reader.valueTooLarge(-1), "expected a length that overflowed to be rejected")
+}
@@ -28,6 +28,9 @@ package memcache
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -37,10 +40,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TysonAndre/golemproxy/byteutil"
 	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
 )
 
 // Similar to:
@@ -71,6 +76,21 @@ var (
 	// contain whitespace or control characters.
 	ErrMalformedKey = errors.New("malformed: key is too long or contains invalid characters")
 
+	// ErrTooManyOutstandingRequests means that a request was not sent because the server
+	// did not respond to earlier requests within the timeout, and MaxOutstanding was reached.
+	ErrTooManyOutstandingRequests = errors.New("memcache: too many outstanding requests")
+
+	// ErrBackendClosed means that the server closed the connection before sending a complete response.
+	ErrBackendClosed = errors.New("memcache: server closed the connection in the middle of a response")
+
+	// ErrMalformedResponse means that the server sent a response that could not be parsed.
+	// The connection is closed, since the responses to later requests can't be found.
+	ErrMalformedResponse = errors.New("memcache: malformed response")
+
+	// ErrResponseTooLarge means that the server sent a value larger than MaxValueSize.
+	// The connection is closed without reading the value.
+	ErrResponseTooLarge = errors.New("memcache: the server sent a value larger than the limit")
+
 	// ErrNoServers is returned when no servers are configured or available.
 	// ErrNoServers = errors.New("memcache: no servers configured or available")
 )
@@ -82,6 +102,9 @@ const (
 	// DefaultMaxIdleConns is the default maximum number of idle connections
 	// kept for any single address.
 	DefaultMaxIdleConns = 2
+
+	// DefaultReadBufferSize is the default size of the buffer that responses from the server are read into.
+	DefaultReadBufferSize = 4096
 )
 
 // resumableError returns true if err is only a protocol-level cache error.
@@ -119,13 +142,23 @@ var (
 	resultDeleted   = []byte("DELETED\r\n")
 	resultEnd       = []byte("END\r\n")
 	resultTouched   = []byte("TOUCHED\r\n")
+	resultError     = []byte("ERROR\r\n")
 
 	resultClientErrorPrefix = []byte("CLIENT_ERROR ")
+	resultServerErrorPrefix = []byte("SERVER_ERROR ")
 	resultValuePrefix       = []byte("VALUE ")
+	resultMetaValuePrefix   = []byte("VA ")
+	resultStatPrefix        = []byte("STAT ")
 )
 
 // New returns a memcache client using the provided server.
 func New(server string, serverConnections int, timeout time.Duration) *PipeliningClient {
+	return NewTLS(server, serverConnections, timeout, nil)
+}
+
+// NewTLS returns a memcache client using the provided server.
+// If tlsConfig is not nil, connections to the server use TLS.
+func NewTLS(server string, serverConnections int, timeout time.Duration, tlsConfig *tls.Config) *PipeliningClient {
 	addr, err := ResolveServerAddr(server)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to resolve %s", server))
@@ -135,6 +168,7 @@ func New(server string, serverConnections int, timeout time.Duration) *Pipelinin
 		addr:       addr,
 		serverRepr: server,
 		Timeout:    timeout,
+		tlsConfig:  tlsConfig,
 	}
 	InitWorkerManager(&(client.manager), serverConnections, client)
 	return client
@@ -148,6 +182,9 @@ func (c *PipeliningClient) Finalize() {
 type ClientInterface interface {
 	// TODO generalize
 	SendProxiedMessageAsync(command *message.SingleMessage)
+	// SendProxiedMessageWithContext is SendProxiedMessageAsync for a request that is abandoned if ctx is done before it is sent to the server,
+	// e.g. because the client of the proxy disconnected. The request then fails with an error for ctx.
+	SendProxiedMessageWithContext(ctx context.Context, command *message.SingleMessage)
 
 	Get(key string) (item *Item, err error)
 	GetMulti(keys []string) (map[string]*Item, error)
@@ -166,10 +203,21 @@ type ClientInterface interface {
 // PipeliningClient is a memcache client with pipelining.
 // It is safe for unlocked use by multiple concurrent goroutines.
 type PipeliningClient struct {
+	// pending is the number of requests that are waiting for a response from the server.
+	// failures is the number of consecutive requests that failed, and lastFailure is the unix time in nanoseconds of the last failed request.
+	// These are first for 64-bit alignment.
+	pending     int64
+	failures    int64
+	lastFailure int64
+
 	// Timeout specifies the socket read/write timeout.
 	// If zero, DefaultTimeout is used.
 	Timeout time.Duration
 
+	// ConnectTimeout is how long to wait for a connection to the server to be established.
+	// If zero, Timeout is used.
+	ConnectTimeout time.Duration
+
 	// MaxIdleConns specifies the maximum number of idle connections that will
 	// be maintained per address. If less than one, DefaultMaxIdleConns will be
 	// used.
@@ -183,6 +231,35 @@ type PipeliningClient struct {
 
 	addr net.Addr
 
+	// tlsConfig is nil if connections to the server are not encrypted.
+	tlsConfig *tls.Config
+
+	// Credentials are sent to the server on every new connection if they are set.
+	Credentials *Credentials
+
+	// WriteBatchDelay is how long to wait for more requests to send in the same write as a request.
+	// Batching reduces the number of write syscalls under high request rates, but delays requests that arrive when the client is idle.
+	// If zero, only requests that are already queued are sent together.
+	WriteBatchDelay time.Duration
+
+	// MaxOutstanding is the maximum number of requests per connection that were sent to the server without receiving a response, or 0 for no limit.
+	// Sending a request beyond the limit blocks until a response is received, which applies backpressure to proxy clients,
+	// and fails with ErrTooManyOutstandingRequests if no response is received within the Timeout.
+	MaxOutstanding int
+	// MaxRetries is the number of times a proxied get or gets is resent after the connection it was sent on broke,
+	// e.g. because the server restarted. Other requests are never retried, to avoid applying a mutation twice.
+	MaxRetries int
+	// MaxValueSize is the largest value that the server can send in a response to a proxied request, or 0 for no limit.
+	// This protects the proxy from allocating memory for a huge value from a buggy or compromised server.
+	MaxValueSize int
+	// ReadBufferSize is the size of the buffer that responses are read into on each connection.
+	// Larger buffers read large values in fewer syscalls. If zero, DefaultReadBufferSize is used.
+	ReadBufferSize int
+
+	// outstanding is a semaphore with a slot for each request that can be outstanding, created on first use.
+	outstanding     chan struct{}
+	outstandingOnce sync.Once
+
 	// Embedded within the client
 	manager WorkerManager
 
@@ -192,6 +269,10 @@ type PipeliningClient struct {
 	// For ketama
 	Label  string
 	Weight int
+
+	// OnRequestDone is called with the result of each request to the server if it is set.
+	// The sharded client uses this to eject servers that keep failing.
+	OnRequestDone func(err error)
 }
 
 var _ ClientInterface = &PipeliningClient{}
@@ -228,8 +309,20 @@ type conn struct {
 	ShouldClose bool
 }
 
-func (cn *conn) extendDeadline() {
-	cn.nc.SetDeadline(time.Now().Add(cn.c.netTimeout()))
+func (cn *conn) extendWriteDeadline() {
+	cn.nc.SetWriteDeadline(time.Now().Add(cn.c.netTimeout()))
+}
+
+// responseDeadline returns the deadline for receiving the response to a request that was just written.
+func (cn *conn) responseDeadline() time.Time {
+	return time.Now().Add(cn.c.netTimeout())
+}
+
+func (c *PipeliningClient) connectTimeout() time.Duration {
+	if c.ConnectTimeout != 0 {
+		return c.ConnectTimeout
+	}
+	return c.netTimeout()
 }
 
 func (c *PipeliningClient) netTimeout() time.Duration {
@@ -239,6 +332,73 @@ func (c *PipeliningClient) netTimeout() time.Duration {
 	return DefaultTimeout
 }
 
+// acquireOutstanding waits for a request to be allowed by MaxOutstanding.
+// If this returns nil, releaseOutstanding must be called after the request completes.
+func (c *PipeliningClient) acquireOutstanding(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.MaxOutstanding > 0 {
+		if err := c.waitForOutstandingSlot(ctx); err != nil {
+			return err
+		}
+	}
+	atomic.AddInt64(&c.pending, 1)
+	return nil
+}
+
+// waitForOutstandingSlot waits until fewer than MaxOutstanding requests per connection are outstanding.
+func (c *PipeliningClient) waitForOutstandingSlot(ctx context.Context) error {
+	c.outstandingOnce.Do(func() {
+		c.outstanding = make(chan struct{}, c.MaxOutstanding*c.manager.maxWorkers)
+	})
+	select {
+	case c.outstanding <- struct{}{}:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(c.netTimeout())
+	defer timer.Stop()
+	select {
+	case c.outstanding <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrTooManyOutstandingRequests
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *PipeliningClient) releaseOutstanding() {
+	atomic.AddInt64(&c.pending, -1)
+	if c.MaxOutstanding > 0 {
+		<-c.outstanding
+	}
+}
+
+// ConsecutiveFailures returns the number of requests to the server that failed since the last request that succeeded.
+func (c *PipeliningClient) ConsecutiveFailures() int64 {
+	return atomic.LoadInt64(&c.failures)
+}
+
+// LastFailure returns when a request to the server last failed, or the zero time if no request failed.
+func (c *PipeliningClient) LastFailure() time.Time {
+	nanos := atomic.LoadInt64(&c.lastFailure)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Outstanding returns the number of requests that were sent to the server and are waiting for a response.
+func (c *PipeliningClient) Outstanding() int64 {
+	return atomic.LoadInt64(&c.pending)
+}
+
+func (c *PipeliningClient) writeBatchDelay() time.Duration {
+	return c.WriteBatchDelay
+}
+
 func (c *PipeliningClient) maxIdleConns() int {
 	if c.MaxIdleConns > 0 {
 		return c.MaxIdleConns
@@ -246,6 +406,30 @@ func (c *PipeliningClient) maxIdleConns() int {
 	return DefaultMaxIdleConns
 }
 
+func (c *PipeliningClient) readBufferSize() int {
+	if c.ReadBufferSize > 0 {
+		return c.ReadBufferSize
+	}
+	return DefaultReadBufferSize
+}
+
+// Credentials are the username and password for a server that requires authentication.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// AuthError is the error type used when a server rejects the credentials of a new connection.
+type AuthError struct {
+	Server string
+	// Response describes the server's response to the credentials.
+	Response string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("memcache: authentication with %s failed: %q", e.Server, e.Response)
+}
+
 // ConnectTimeoutError is the error type used when it takes
 // too long to connect to the desired host. This level of
 // detail can generally be ignored.
@@ -258,7 +442,7 @@ func (cte *ConnectTimeoutError) Error() string {
 }
 
 func (c *PipeliningClient) dial(addr net.Addr) (net.Conn, error) {
-	nc, err := net.DialTimeout(addr.Network(), addr.String(), c.netTimeout())
+	nc, err := net.DialTimeout(addr.Network(), addr.String(), c.connectTimeout())
 	if err == nil {
 		if tcpConn, ok := nc.(*net.TCPConn); ok {
 			err = tcpConn.SetWriteBuffer(100000)
@@ -270,6 +454,9 @@ func (c *PipeliningClient) dial(addr net.Addr) (net.Conn, error) {
 				fmt.Fprintf(os.Stderr, "Failed SetReadBuffer: %v\n", err)
 			}
 		}
+		if c.tlsConfig != nil {
+			return c.handshake(nc)
+		}
 		return nc, nil
 	}
 
@@ -280,6 +467,71 @@ func (c *PipeliningClient) dial(addr net.Addr) (net.Conn, error) {
 	return nil, err
 }
 
+// handshake wraps a new connection to the server with TLS.
+func (c *PipeliningClient) handshake(nc net.Conn) (net.Conn, error) {
+	tlsConfig := c.tlsConfig
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		host, _, err := net.SplitHostPort(c.serverRepr)
+		if err != nil {
+			host = c.serverRepr
+		}
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(nc, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(c.netTimeout()))
+	err := tlsConn.Handshake()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("memcache: tls handshake with %s failed: %v", c.serverRepr, err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// The binary protocol constants that are used to authenticate with SASL PLAIN. See RFC 4616 for SASL PLAIN.
+const (
+	binaryRequestMagic   = 0x80
+	binaryResponseMagic  = 0x81
+	binaryOpcodeSASLAuth = 0x21
+	binaryHeaderLength   = 24
+	saslMechanismPlain   = "PLAIN"
+)
+
+// authenticate sends the credentials on a new connection with a binary protocol SASL_AUTH request for the PLAIN mechanism,
+// whose value is "\x00username\x00password". The server responds with the status 0 if they are accepted.
+// Requests sent on the connection afterwards use the text protocol.
+func (c *PipeliningClient) authenticate(nc net.Conn, reader *bufio.Reader) error {
+	value := "\x00" + c.Credentials.Username + "\x00" + c.Credentials.Password
+	request := make([]byte, binaryHeaderLength, binaryHeaderLength+len(saslMechanismPlain)+len(value))
+	request[0] = binaryRequestMagic
+	request[1] = binaryOpcodeSASLAuth
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(saslMechanismPlain)))
+	binary.BigEndian.PutUint32(request[8:12], uint32(len(saslMechanismPlain)+len(value)))
+	request = append(append(request, saslMechanismPlain...), value...)
+
+	nc.SetDeadline(time.Now().Add(c.netTimeout()))
+	defer nc.SetDeadline(time.Time{})
+	if _, err := nc.Write(request); err != nil {
+		return err
+	}
+	header := make([]byte, binaryHeaderLength)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	if header[0] != binaryResponseMagic || header[1] != binaryOpcodeSASLAuth {
+		return &AuthError{Server: c.serverRepr, Response: fmt.Sprintf("unexpected response header %x", header)}
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return err
+	}
+	if status := binary.BigEndian.Uint16(header[6:8]); status != 0 {
+		return &AuthError{Server: c.serverRepr, Response: fmt.Sprintf("status 0x%x: %s", status, body)}
+	}
+	return nil
+}
+
 // getConn establishes a brand new connection
 func (c *PipeliningClient) getConn() (*conn, error) {
 	addr := c.addr
@@ -287,6 +539,15 @@ func (c *PipeliningClient) getConn() (*conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	reader := bufio.NewReaderSize(nc, c.readBufferSize())
+	if c.Credentials != nil {
+		// This is repeated whenever a connection is re-established.
+		err = c.authenticate(nc, reader)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
 	// NoDelay is the default
 	cn := &conn{
 		nc:   nc,
@@ -296,10 +557,13 @@ func (c *PipeliningClient) getConn() (*conn, error) {
 		c:      c,
 	}
 	cn.reader = &BufferedReader{
-		reader: bufio.NewReader(nc),
+		reader:       reader,
+		maxValueSize: c.MaxValueSize,
 		onClose: func() {
 			// XXX this is a race condition
 			cn.ShouldClose = true
+			// Tear down the connection so that a hung server can't send responses for requests that were already failed.
+			nc.Close()
 		},
 	}
 	return cn, nil
@@ -332,7 +596,46 @@ func (c *PipeliningClient) Touch(key string, seconds int32) (err error) {
 // withWorkerFromPool does the same thing as withConnFromPool, but pipelines requests.
 func (c *PipeliningClient) withWorkerFromPool(dataToWrite []byte, readFn func(*BufferedReader) error) (err error) {
 	// Returns error or nil
-	return <-c.manager.sendRequestToWorker(dataToWrite, readFn)
+	if err := c.acquireOutstanding(context.Background()); err != nil {
+		return err
+	}
+	defer c.releaseOutstanding()
+	start := time.Now()
+	errChan, _ := c.manager.sendRequestToWorker(context.Background(), dataToWrite, readFn)
+	err = <-errChan
+	c.requestDone(err, start)
+	return err
+}
+
+// requestDone records the result of a request that was sent at start.
+func (c *PipeliningClient) requestDone(err error, start time.Time) {
+	failed := IsServerFailure(err)
+	stats.Global.RecordBackendRequest(c.serverRepr, time.Since(start), failed)
+	if failed {
+		atomic.AddInt64(&c.failures, 1)
+		atomic.StoreInt64(&c.lastFailure, time.Now().UnixNano())
+	} else {
+		atomic.StoreInt64(&c.failures, 0)
+	}
+	if c.OnRequestDone != nil {
+		c.OnRequestDone(err)
+	}
+}
+
+// IsServerFailure returns true if err means that the server could not be reached or stopped responding,
+// rather than being a memcache protocol error.
+func IsServerFailure(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF, connectionEstablishError, ErrBackendClosed:
+		return true
+	}
+	switch err.(type) {
+	case net.Error, *ConnectTimeoutError, *AuthError:
+		return true
+	}
+	return false
 }
 
 func getIntFromByteSlice(header []byte) (int, error) {
@@ -377,6 +680,9 @@ func parseResponseValues(header []byte, reader *BufferedReader) ([]byte, message
 			fmt.Fprintf(os.Stderr, "Failed to parse values: %v", err)
 			return nil, message.RESPONSE_MC_PROTOCOLERROR
 		}
+		if reader.valueTooLarge(bodyLength) {
+			return nil, message.RESPONSE_MC_PROTOCOLERROR
+		}
 		originalLen := len(result)
 		responseEnd := originalLen + bodyLength + 2
 		// The capacity of a slice is the number of elements in the underlying array, counting from the first element in the slice.
@@ -414,6 +720,57 @@ func parseResponseValues(header []byte, reader *BufferedReader) ([]byte, message
 	}
 }
 
+// isMetaStatus returns true for meta protocol responses without a value, e.g. "HD <flags>*\r\n" or "EN\r\n".
+func isMetaStatus(header []byte) bool {
+	if len(header) < 4 || (header[2] != ' ' && header[2] != '\r') {
+		return false
+	}
+	switch string(header[:2]) {
+	case "HD", "EN", "NF", "NS", "EX", "MN":
+		return true
+	}
+	return false
+}
+
+// parseMetaValue reads the value of a meta protocol "VA <size> <flags>*\r\n<data>\r\n" response.
+func parseMetaValue(header []byte, reader *BufferedReader) ([]byte, message.ResponseType) {
+	sizeEnd := bytes.IndexAny(header[3:], " \r")
+	if sizeEnd < 1 {
+		return nil, message.RESPONSE_MC_PROTOCOLERROR
+	}
+	size, err := strconv.Atoi(string(header[3 : 3+sizeEnd]))
+	if err != nil || size < 0 || reader.valueTooLarge(size) {
+		return nil, message.RESPONSE_MC_PROTOCOLERROR
+	}
+	result := make([]byte, len(header)+size+2)
+	copy(result, header)
+	_, err = reader.Read(result[len(header):])
+	if err != nil || result[len(result)-2] != '\r' || result[len(result)-1] != '\n' {
+		return nil, message.RESPONSE_MC_PROTOCOLERROR
+	}
+	return result, message.RESPONSE_MC_META_VALUE
+}
+
+// parseStats reads the "STAT <name> <value>\r\n" lines of a response to a stats request up to and including "END\r\n".
+func parseStats(header []byte, reader *BufferedReader) ([]byte, message.ResponseType) {
+	result := header
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read stats: %v", err)
+			return nil, message.RESPONSE_MC_PROTOCOLERROR
+		}
+		result = append(result, line...)
+		if bytes.Equal(line, resultEnd) {
+			return result, message.RESPONSE_MC_STAT
+		}
+		if !bytes.HasPrefix(line, resultStatPrefix) || line[len(line)-2] != '\r' {
+			fmt.Fprintf(os.Stderr, "Expected next response line to start with either STAT or END but got %q\n", line)
+			return nil, message.RESPONSE_MC_PROTOCOLERROR
+		}
+	}
+}
+
 func parseMemcacheResponse(header []byte, reader *BufferedReader) ([]byte, message.ResponseType) {
 	if len(header) <= 2 {
 		// Just "\r\n" without a message is an error
@@ -432,6 +789,10 @@ func parseMemcacheResponse(header []byte, reader *BufferedReader) ([]byte, messa
 		if bytes.Equal(header, resultEnd) {
 			return header, message.RESPONSE_MC_END
 		}
+	case 7:
+		if bytes.Equal(header, resultError) {
+			return header, message.RESPONSE_MC_ERROR
+		}
 	case 8:
 		if bytes.Equal(header, resultStored) {
 			return header, message.RESPONSE_MC_STORED
@@ -458,6 +819,21 @@ func parseMemcacheResponse(header []byte, reader *BufferedReader) ([]byte, messa
 	if bytes.HasPrefix(header, resultValuePrefix) {
 		return parseResponseValues(header, reader)
 	}
+	if bytes.HasPrefix(header, resultMetaValuePrefix) {
+		return parseMetaValue(header, reader)
+	}
+	if isMetaStatus(header) {
+		return header, message.RESPONSE_MC_META
+	}
+	if bytes.HasPrefix(header, resultStatPrefix) {
+		return parseStats(header, reader)
+	}
+	if bytes.HasPrefix(header, resultServerErrorPrefix) {
+		return header, message.RESPONSE_MC_SERVER_ERROR
+	}
+	if bytes.HasPrefix(header, resultClientErrorPrefix) {
+		return header, message.RESPONSE_MC_CLIENT_ERROR
+	}
 	c := header[0]
 	if c <= '9' && c >= '0' {
 		// TODO validate uint64
@@ -471,26 +847,151 @@ func parseMemcacheResponse(header []byte, reader *BufferedReader) ([]byte, messa
 }
 
 func (c *PipeliningClient) SendProxiedMessageAsync(command *message.SingleMessage) {
-	errChan := c.manager.sendRequestToWorker(command.RequestData, func(reader *BufferedReader) error {
+	c.SendProxiedMessageWithContext(context.Background(), command)
+}
+
+// SendProxiedMessageWithContext stops waiting for MaxOutstanding, for a worker to write the request, or for the response once ctx is done.
+// The response to a request that was already written is still read and then discarded, so that it isn't mistaken for the response to a later request.
+func (c *PipeliningClient) SendProxiedMessageWithContext(ctx context.Context, command *message.SingleMessage) {
+	if err := c.acquireOutstanding(ctx); err != nil {
+		if isContextError(err) {
+			command.HandleResponseError(contextResponseError(err))
+			return
+		}
+		command.HandleReceiveError(err)
+		return
+	}
+	retries := 0
+	if command.RequestType == message.REQUEST_MC_GET || command.RequestType == message.REQUEST_MC_GETS {
+		retries = c.MaxRetries
+	}
+	// The response is given to command after the request is done, unless command already failed because ctx is done.
+	var responseBody []byte
+	var responseType message.ResponseType
+	readFn := func(reader *BufferedReader) error {
+		if command.NoReply {
+			// The server won't send a response, so don't consume the response to the next request.
+			responseBody, responseType = nil, message.RESPONSE_MC_END
+			return nil
+		}
 		header, err := reader.ReadBytes('\n')
 		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return ErrBackendClosed
+			}
 			return err
 		}
-		fullResponseBody, responseType := parseMemcacheResponse(header, reader)
+		fullResponseBody, fullResponseType := parseMemcacheResponse(header, reader)
 		if fullResponseBody == nil {
-			return err
+			return incompleteResponseError(reader)
 		}
-		command.HandleReceiveResponse(fullResponseBody, responseType)
+		responseBody, responseType = fullResponseBody, fullResponseType
 		return nil
-	})
+	}
+	start := time.Now()
+	errChan, written := c.manager.sendRequestToWorker(ctx, command.RequestData, readFn)
 	go func() {
-		err := <-errChan
-		if err != nil {
-			command.HandleReceiveError(err)
+		done := ctx.Done()
+		// abandoned is true once ctx is done, and failed is true once command was given the error of ctx.
+		abandoned, failed := false, false
+		// awaitWritten is set once ctx is done, so that command fails as soon as the worker no longer uses command.RequestData.
+		// The request data may be a pooled buffer that is reused once command completes, so command can't fail before then.
+		var awaitWritten <-chan struct{}
+		for {
+			var err error
+			select {
+			case err = <-errChan:
+			case <-done:
+				// Keep the slot of the request until its response is read.
+				abandoned, done, awaitWritten = true, nil, written
+				continue
+			case <-awaitWritten:
+				awaitWritten, failed = nil, true
+				command.HandleResponseError(contextResponseError(ctx.Err()))
+				continue
+			}
+			if isContextError(err) {
+				// The request was never sent, so this says nothing about the server.
+				c.releaseOutstanding()
+				if !failed {
+					command.HandleResponseError(contextResponseError(err))
+				}
+				return
+			}
+			c.requestDone(err, start)
+			if retries > 0 && isConnectionBroken(err) && ctx.Err() == nil {
+				// The worker reconnects before writing the request again.
+				retries--
+				start = time.Now()
+				errChan, written = c.manager.sendRequestToWorker(ctx, command.RequestData, readFn)
+				continue
+			}
+			c.releaseOutstanding()
+			if abandoned {
+				if !failed {
+					command.HandleResponseError(contextResponseError(ctx.Err()))
+				}
+				return
+			}
+			if err == ErrBackendClosed {
+				command.HandleResponseError(message.RESPONSE_ERROR_BACKEND_CLOSED)
+			} else if _, ok := err.(*ConnectTimeoutError); ok {
+				command.HandleResponseError(message.RESPONSE_ERROR_CONNECTION_TIMEOUT)
+			} else if err == ErrResponseTooLarge {
+				command.HandleResponseError(message.RESPONSE_ERROR_BACKEND_RESPONSE_TOO_LARGE)
+			} else if err != nil {
+				command.HandleReceiveError(err)
+			} else {
+				command.HandleReceiveResponse(responseBody, responseType)
+			}
+			return
 		}
 	}()
 }
 
+// isContextError returns true if err is the error of a context that was canceled or whose deadline passed.
+func isContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// contextResponseError returns the response for a request that was abandoned because of the error of its context.
+func contextResponseError(err error) *message.ResponseError {
+	if err == context.DeadlineExceeded {
+		return message.RESPONSE_ERROR_TIMEOUT
+	}
+	return message.RESPONSE_ERROR_CANCELED
+}
+
+// incompleteResponseError returns the error for a response that parseMemcacheResponse could not read.
+// If the connection did not fail while reading the response, the response was malformed, and the connection is closed
+// so that the rest of the response isn't mistaken for the responses to later requests.
+func incompleteResponseError(reader *BufferedReader) error {
+	if !reader.failed {
+		reader.handleError(ErrMalformedResponse)
+		return ErrMalformedResponse
+	}
+	if reader.tooLarge {
+		return ErrResponseTooLarge
+	}
+	if reader.timedOut {
+		return reader.previousRequestError()
+	}
+	return ErrBackendClosed
+}
+
+// isConnectionBroken returns true if a request failed because the connection to the server was closed or could not be used,
+// rather than because the server was slow to respond.
+func isConnectionBroken(err error) bool {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF, readerFailedError, ErrBackendClosed:
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return !netErr.Timeout()
+	}
+	return false
+}
+
 func (c *PipeliningClient) get(keys []string, cb func(*Item)) error {
 	writeCmd := []byte("gets " + strings.Join(keys, " ") + "\r\n")
 	//DebugLog("Called get(keys[])")
@@ -299,12 +299,21 @@ func checkCanBench(b skippable) bool {
 }
 
 func BenchmarkSetGet(b *testing.B) {
+	benchmarkSetGet(b, 1)
+}
+
+// BenchmarkSetGetPooled is BenchmarkSetGet with requests spread across a pool of connections to the server.
+func BenchmarkSetGetPooled(b *testing.B) {
+	benchmarkSetGet(b, 4)
+}
+
+func benchmarkSetGet(b *testing.B, serverConnections int) {
 	if !checkCanBench(b) {
 		return
 	}
 	benchmarkWorkerCount := 20
 	// Don't call flush_all
-	c := NewTestClient(benchTestServer)
+	c := New(benchTestServer, serverConnections, 100*time.Millisecond)
 	c.MaxIdleConns = benchmarkWorkerCount + 1
 	defer c.Finalize()
 
@@ -0,0 +1,35 @@
+package memcache
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestParseMetaResponses(t *testing.T) {
+	input := "VA 5 f0 t-1\r\nhello\r\nEN\r\nHD c123\r\nNS\r\nVA 3\r\nab\r\n"
+	reader := &BufferedReader{reader: bufio.NewReader(strings.NewReader(input)), onClose: func() {}}
+	expected := []struct {
+		body         string
+		responseType message.ResponseType
+	}{
+		{"VA 5 f0 t-1\r\nhello\r\n", message.RESPONSE_MC_META_VALUE},
+		{"EN\r\n", message.RESPONSE_MC_META},
+		{"HD c123\r\n", message.RESPONSE_MC_META},
+		{"NS\r\n", message.RESPONSE_MC_META},
+		// The value is 1 byte shorter than the size, so it does not end with \r\n.
+		{"", message.RESPONSE_MC_PROTOCOLERROR},
+	}
+	for _, e := range expected {
+		header, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("unexpected error reading %q: %v", e.body, err)
+		}
+		body, responseType := parseMemcacheResponse(header, reader)
+		testutil.ExpectStringEquals(t, e.body, string(body), "unexpected response body")
+		testutil.ExpectEquals(t, e.responseType, responseType, "unexpected response type")
+	}
+}
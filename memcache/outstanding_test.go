@@ -0,0 +1,112 @@
+package memcache
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// stalledMemcache is a memcache server that reads requests but doesn't respond with END to any of them until resume is closed.
+type stalledMemcache struct {
+	l        net.Listener
+	received int32
+	resume   chan struct{}
+}
+
+func serveStalledMemcache(t *testing.T) *stalledMemcache {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &stalledMemcache{l: l, resume: make(chan struct{})}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *stalledMemcache) serve(c net.Conn) {
+	defer c.Close()
+	pending := make(chan struct{}, 1000)
+	go func() {
+		<-s.resume
+		for range pending {
+			c.Write([]byte("END\r\n"))
+		}
+	}()
+	defer close(pending)
+	reader := bufio.NewReader(c)
+	for {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return
+		}
+		atomic.AddInt32(&s.received, 1)
+		pending <- struct{}{}
+	}
+}
+
+func TestMaxOutstandingAppliesBackpressure(t *testing.T) {
+	s := serveStalledMemcache(t)
+	defer s.l.Close()
+	c := New(s.l.Addr().String(), 1, 2*time.Second)
+	c.MaxOutstanding = 2
+	defer c.Finalize()
+
+	const requestCount = 20
+	var wg sync.WaitGroup
+	var misses int32
+	wg.Add(requestCount)
+	for i := 0; i < requestCount; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get("foo"); err == ErrCacheMiss {
+				atomic.AddInt32(&misses, 1)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	testutil.ExpectEquals(t, int32(2), atomic.LoadInt32(&s.received), "expected only MaxOutstanding requests to be sent to the stalled server")
+
+	close(s.resume)
+	wg.Wait()
+	testutil.ExpectEquals(t, int32(requestCount), atomic.LoadInt32(&misses), "expected every request to complete after the server resumed")
+}
+
+func TestMaxOutstandingTimesOut(t *testing.T) {
+	s := serveStalledMemcache(t)
+	defer s.l.Close()
+	defer close(s.resume)
+	c := New(s.l.Addr().String(), 1, 100*time.Millisecond)
+	c.MaxOutstanding = 1
+	defer c.Finalize()
+
+	go c.Get("foo")
+	time.Sleep(20 * time.Millisecond)
+	// One of these requests is sent when the first request times out, and the other can't be sent before its own timeout.
+	errs := make(chan error, 2)
+	for _, key := range []string{"bar", "baz"} {
+		go func(key string) {
+			_, err := c.Get(key)
+			errs <- err
+		}(key)
+	}
+	tooManyCount := 0
+	for i := 0; i < 2; i++ {
+		if <-errs == ErrTooManyOutstandingRequests {
+			tooManyCount++
+		}
+	}
+	testutil.ExpectEquals(t, 1, tooManyCount, "expected a request to fail while the server isn't responding")
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+)
+
+// accessLog writes a line for every command from clients of the pools that use it.
+// Each line is "<RFC 3339 time> remote=<address> command=<command> key=<quoted keys> status=<status> latency_us=<microseconds>".
+type accessLog struct {
+	m sync.Mutex
+	w io.Writer
+}
+
+// openAccessLog opens the file at path for appending access log lines, creating it if it doesn't exist.
+func openAccessLog(path string) (*accessLog, *os.File, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &accessLog{w: f}, f, nil
+}
+
+// logResponses makes the response queue of a client connection write a line to the access log for every command.
+func (l *accessLog) logResponses(responses *responsequeue.ResponseQueue, client string) {
+	if client == "" {
+		// Clients of unix sockets have no address.
+		client = "-"
+	}
+	responses.SetResponseHandler(func(m message.Message, response []byte, elapsed time.Duration) {
+		command, keys := describeRequest(m)
+		if command == "" {
+			command = "-"
+		}
+		line := fmt.Sprintf("%s remote=%s command=%s key=%q status=%s latency_us=%d\n",
+			time.Now().UTC().Format(time.RFC3339Nano), client, command, strings.Join(keys, " "), responseStatus(response), elapsed/time.Microsecond)
+		l.m.Lock()
+		defer l.m.Unlock()
+		l.w.Write([]byte(line))
+	})
+}
+
+// responseStatus returns the first word of a text protocol response (e.g. VALUE for a get hit and END for a get miss),
+// the status code of a binary protocol response, or NOREPLY if no response was sent.
+func responseStatus(response []byte) string {
+	if len(response) == 0 {
+		return "NOREPLY"
+	}
+	if response[0] == BINARY_RESPONSE_MAGIC {
+		if len(response) < BINARY_HEADER_LENGTH {
+			return "-"
+		}
+		return fmt.Sprintf("binary:0x%02x%02x", response[6], response[7])
+	}
+	if i := bytes.IndexAny(response, " \r"); i >= 0 {
+		return string(response[:i])
+	}
+	return "-"
+}
+
+// accessLogOf returns the access log of the pool with conf, or nil if commands aren't logged.
+func (s *Server) accessLogOf(conf config.Config) *accessLog {
+	if conf.AccessLog == "" {
+		return nil
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.accessLogs[conf.AccessLog]
+}
+
+func (s *Server) closeAccessLogs() {
+	s.m.Lock()
+	files := s.accessLogFiles
+	s.accessLogFiles = nil
+	s.m.Unlock()
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestAccessLog(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	dir, err := ioutil.TempDir("", "golemproxy")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	conf := newTestPoolConfig(t, backend)
+	conf.AccessLog = path
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "get k\r\nset k 0 0 1 noreply\r\nx\r\nget k\r\n")
+	expected := "END\r\nVALUE k 0 1\r\nx\r\nEND\r\n"
+	response := make([]byte, len(expected))
+	_, err = io.ReadFull(c, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, expected, string(response), "unexpected responses")
+	c.Close()
+	s.Shutdown(context.Background())
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the access log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	testutil.ExpectEquals(t, 3, len(lines), "expected a line for each command")
+	var statuses []string
+	for _, line := range lines {
+		fields := strings.Split(line, " ")
+		testutil.ExpectEquals(t, 6, len(fields), "unexpected fields in "+line)
+		if _, err := time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+			t.Errorf("expected a timestamp in %q: %v", line, err)
+		}
+		testutil.ExpectStringEquals(t, "remote="+c.LocalAddr().String(), fields[1], "unexpected remote address")
+		testutil.ExpectStringEquals(t, `key="k"`, fields[3], "unexpected key")
+		if !strings.HasPrefix(fields[5], "latency_us=") {
+			t.Errorf("expected the latency in %q", line)
+		}
+		statuses = append(statuses, fields[2]+" "+fields[4])
+	}
+	testutil.ExpectEquals(t, []string{
+		"command=get status=END",
+		"command=set status=NOREPLY",
+		"command=get status=VALUE",
+	}, statuses, "expected the status of a get hit and a get miss to differ")
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net"
+)
+
+// isAllowedClient returns true if a client with the address addr may use a pool with the given allow_cidrs.
+// Clients of unix sockets don't have an IP address, and are always allowed.
+func isAllowedClient(addr net.Addr, allowCIDRs []*net.IPNet) bool {
+	if len(allowCIDRs) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return true
+	}
+	for _, network := range allowCIDRs {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
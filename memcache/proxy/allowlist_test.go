@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// fakeListener accepts the connections that are sent to conns.
+type fakeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *fakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *fakeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21211}
+}
+
+// remoteAddrConn is a connection from a client with the address remote.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestAllowCIDRs(t *testing.T) {
+	conf := config.Config{}
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, network, err := net.ParseCIDR(cidr)
+		testutil.ExpectEquals(t, nil, err, "unexpected error")
+		conf.AllowCIDRs = append(conf.AllowCIDRs, network)
+	}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	defer s.Shutdown(context.Background())
+	l := newFakeListener()
+	s.addListener(l)
+	go s.serveSocketServer(&fakeRemote{}, l, conf)
+
+	for _, test := range []struct {
+		remote  net.Addr
+		allowed bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 50000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 50000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 50000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, true},
+	} {
+		client, server := net.Pipe()
+		defer client.Close()
+		l.conns <- remoteAddrConn{server, test.remote}
+		client.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(client, "version\r\n")
+		line, err := bufio.NewReader(client).ReadString('\n')
+		if test.allowed {
+			testutil.ExpectEquals(t, nil, err, "unexpected error for a client from "+test.remote.String())
+			testutil.ExpectStringEquals(t, string(versionResponse), line, "unexpected response")
+		} else if err == nil {
+			t.Errorf("expected the connection from %s to be closed, got %q", test.remote, line)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+var endResponse = []byte("END\r\n")
+
+// missOnBackendDownClient responds to gets with a miss instead of an error when the memcache server can't be reached,
+// so that clients fall back to their source of truth as they would for any other miss.
+type missOnBackendDownClient struct {
+	memcache.ClientInterface
+	// reachable returns false if every server of the pool was ejected by auto_eject_hosts.
+	reachable func() bool
+}
+
+var _ memcache.ClientInterface = &missOnBackendDownClient{}
+
+func (c *missOnBackendDownClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *missOnBackendDownClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *missOnBackendDownClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	if m.RequestType != message.REQUEST_MC_GET && m.RequestType != message.REQUEST_MC_GETS {
+		c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+		return
+	}
+	if !c.reachable() {
+		// Don't wait for a server that is known to be down.
+		m.HandleReceiveResponse(endResponse, message.RESPONSE_MC_END)
+		return
+	}
+	// The request data is not copied, since it is released after the client receives the response.
+	forwarded := &message.SingleMessage{}
+	forwarded.HandleSendRequest(m.RequestData, m.Key, m.RequestType)
+	c.ClientInterface.SendProxiedMessageWithContext(ctx, forwarded)
+	go func() {
+		data, responseError := forwarded.AwaitResponseBytes()
+		switch {
+		case responseError == nil:
+			m.HandleReceiveResponse(data, forwarded.ResponseType)
+		case isBackendDownError(responseError):
+			m.HandleReceiveResponse(endResponse, message.RESPONSE_MC_END)
+		default:
+			m.HandleResponseError(responseError)
+		}
+	}()
+}
+
+// isBackendDownError returns true if a request failed because the memcache server could not be reached or did not respond.
+func isBackendDownError(responseError *message.ResponseError) bool {
+	switch responseError {
+	case message.RESPONSE_ERROR_TIMEOUT, message.RESPONSE_ERROR_CONNECTION_TIMEOUT, message.RESPONSE_ERROR_BACKEND_CLOSED, message.RESPONSE_ERROR_UNEXPECTED_TYPE:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestMissOnBackendDown(t *testing.T) {
+	var received int64
+	closeWithoutResponding := func(line string, reader *bufio.Reader, writer io.Writer) {
+		atomic.AddInt64(&received, 1)
+		writer.(net.Conn).Close()
+	}
+	backends := []*fakeBackend{newFakeBackend(t, closeWithoutResponding), newFakeBackend(t, closeWithoutResponding)}
+	for _, backend := range backends {
+		defer backend.close()
+	}
+	conf := newTestPoolConfig(t, backends...)
+	conf.AutoEjectHosts = true
+	conf.ServerFailureLimit = 1
+	conf.ServerRetryTimeout = 10 * time.Second
+	conf.MissOnBackendDown = true
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(c)
+	get := func(request string) string {
+		io.WriteString(c, request)
+		line, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "unexpected error")
+		return line
+	}
+	// Each failed get ejects the server it was sent to, and the client gets a miss instead of an error.
+	testutil.ExpectStringEquals(t, "END\r\n", get("get foo\r\n"), "expected a miss when the server closed the connection")
+	testutil.ExpectStringEquals(t, "END\r\n", get("gets foo\r\n"), "expected a miss when the server closed the connection")
+	testutil.ExpectEquals(t, []string{"main"}, s.unreachablePools(), "expected every server to be ejected")
+
+	// Once every server is ejected, gets are answered without waiting for a server.
+	testutil.ExpectStringEquals(t, "END\r\n", get("get foo\r\n"), "expected a miss while every server is ejected")
+	testutil.ExpectEquals(t, int64(2), atomic.LoadInt64(&received), "expected the get not to be sent to an ejected server")
+	// Writes still report the failure.
+	testutil.ExpectStringEquals(t, "SERVER_ERROR backend closed\r\n", get("delete foo\r\n"), "expected writes to fail")
+}
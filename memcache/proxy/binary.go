@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"go4.org/strutil"
+)
+
+// Requests in the binary protocol are translated to text protocol requests before they are sent to the memcache servers.
+// See https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+
+const (
+	BINARY_REQUEST_MAGIC  = 0x80
+	BINARY_RESPONSE_MAGIC = 0x81
+	BINARY_HEADER_LENGTH  = 24
+)
+
+const (
+	BINARY_OPCODE_GET     = 0x00
+	BINARY_OPCODE_SET     = 0x01
+	BINARY_OPCODE_ADD     = 0x02
+	BINARY_OPCODE_REPLACE = 0x03
+	BINARY_OPCODE_DELETE  = 0x04
+	BINARY_OPCODE_INCR    = 0x05
+	BINARY_OPCODE_DECR    = 0x06
+	BINARY_OPCODE_QUIT    = 0x07
+	BINARY_OPCODE_GETQ    = 0x09
+	BINARY_OPCODE_NOOP    = 0x0a
+	BINARY_OPCODE_VERSION = 0x0b
+	BINARY_OPCODE_GETK    = 0x0c
+	BINARY_OPCODE_GETKQ   = 0x0d
+	BINARY_OPCODE_APPEND  = 0x0e
+	BINARY_OPCODE_PREPEND = 0x0f
+	BINARY_OPCODE_QUITQ   = 0x17
+	BINARY_OPCODE_TOUCH   = 0x1c
+
+	BINARY_OPCODE_SASL_LIST_MECHS = 0x20
+	BINARY_OPCODE_SASL_AUTH       = 0x21
+	BINARY_OPCODE_SASL_STEP       = 0x22
+)
+
+const (
+	BINARY_STATUS_OK               = 0x0000
+	BINARY_STATUS_KEY_NOT_FOUND    = 0x0001
+	BINARY_STATUS_KEY_EXISTS       = 0x0002
+	BINARY_STATUS_INVALID_ARGUMENT = 0x0004
+	BINARY_STATUS_NOT_STORED       = 0x0005
+	BINARY_STATUS_AUTH_ERROR       = 0x0020
+	BINARY_STATUS_UNKNOWN_COMMAND  = 0x0081
+	BINARY_STATUS_INTERNAL_ERROR   = 0x0084
+)
+
+// binaryHeader is the 24 byte header of a binary protocol request.
+type binaryHeader struct {
+	opcode    byte
+	keyLength uint16
+	extrasLen uint8
+	bodyLen   uint32
+	opaque    uint32
+	cas       uint64
+}
+
+// parseBinaryHeader parses the header of a binary protocol request, whose value can be at most maxItemSize bytes long.
+func parseBinaryHeader(data []byte, maxItemSize int) (binaryHeader, error) {
+	if data[0] != BINARY_REQUEST_MAGIC {
+		return binaryHeader{}, fmt.Errorf("unexpected binary protocol magic byte 0x%x", data[0])
+	}
+	header := binaryHeader{
+		opcode:    data[1],
+		keyLength: binary.BigEndian.Uint16(data[2:4]),
+		extrasLen: data[4],
+		bodyLen:   binary.BigEndian.Uint32(data[8:12]),
+		opaque:    binary.BigEndian.Uint32(data[12:16]),
+		cas:       binary.BigEndian.Uint64(data[16:24]),
+	}
+	if uint32(header.keyLength)+uint32(header.extrasLen) > header.bodyLen {
+		return binaryHeader{}, errors.New("binary protocol key and extras are longer than the body")
+	}
+	if valueLen := header.bodyLen - uint32(header.keyLength) - uint32(header.extrasLen); valueLen > uint32(maxItemSize) {
+		return binaryHeader{}, fmt.Errorf("binary protocol value length %d exceeds the max_item_size of %d", valueLen, maxItemSize)
+	}
+	return header, nil
+}
+
+// encodeBinaryResponse returns a binary protocol response packet.
+func encodeBinaryResponse(opcode byte, status uint16, opaque uint32, cas uint64, extras []byte, key []byte, value []byte) []byte {
+	bodyLen := len(extras) + len(key) + len(value)
+	response := make([]byte, BINARY_HEADER_LENGTH, BINARY_HEADER_LENGTH+bodyLen)
+	response[0] = BINARY_RESPONSE_MAGIC
+	response[1] = opcode
+	binary.BigEndian.PutUint16(response[2:4], uint16(len(key)))
+	response[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(response[6:8], status)
+	binary.BigEndian.PutUint32(response[8:12], uint32(bodyLen))
+	binary.BigEndian.PutUint32(response[12:16], opaque)
+	binary.BigEndian.PutUint64(response[16:24], cas)
+	response = append(response, extras...)
+	response = append(response, key...)
+	return append(response, value...)
+}
+
+func encodeBinaryError(header binaryHeader, status uint16, text string) []byte {
+	return encodeBinaryResponse(header.opcode, status, header.opaque, 0, nil, nil, []byte(text))
+}
+
+// parseValueResponse extracts the flags, cas, and value from "VALUE key flags bytes [cas]\r\n<value>\r\nEND\r\n"
+func parseValueResponse(response []byte) (flags uint32, cas uint64, value []byte, err error) {
+	headerEnd := bytes.IndexByte(response, '\n')
+	if headerEnd < 0 {
+		return 0, 0, nil, errors.New("missing newline in VALUE response")
+	}
+	args, err := splitArgsOnSpaces(response[:headerEnd-1])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(args) < 4 || len(args) > 5 {
+		return 0, 0, nil, fmt.Errorf("unexpected VALUE response %q", response[:headerEnd+1])
+	}
+	parsedFlags, err := strutil.ParseUintBytes(args[2], 10, 32)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, err := strutil.ParseUintBytes(args[3], 10, 30)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if len(args) == 5 {
+		cas, err = strutil.ParseUintBytes(args[4], 10, 64)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	valueStart := headerEnd + 1
+	if valueStart+int(length) > len(response) {
+		return 0, 0, nil, errors.New("VALUE response is shorter than the value length")
+	}
+	return uint32(parsedFlags), cas, response[valueStart : valueStart+int(length)], nil
+}
+
+// translateBinaryResponse returns a function converting the text protocol response from a server into a binary protocol response.
+func translateBinaryResponse(header binaryHeader, key []byte) func(m *message.SingleMessage) []byte {
+	quiet := header.opcode == BINARY_OPCODE_GETQ || header.opcode == BINARY_OPCODE_GETKQ
+	return func(m *message.SingleMessage) []byte {
+		if m.ResponseError != nil {
+			return encodeBinaryError(header, BINARY_STATUS_INTERNAL_ERROR, string(bytes.TrimRight(m.ResponseError.ErrorBytes, "\r\n")))
+		}
+		switch m.ResponseType {
+		case message.RESPONSE_MC_VALUE:
+			flags, cas, value, err := parseValueResponse(m.ResponseData)
+			if err != nil {
+				return encodeBinaryError(header, BINARY_STATUS_INTERNAL_ERROR, err.Error())
+			}
+			extras := make([]byte, 4)
+			binary.BigEndian.PutUint32(extras, flags)
+			var responseKey []byte
+			if header.opcode == BINARY_OPCODE_GETK || header.opcode == BINARY_OPCODE_GETKQ {
+				responseKey = key
+			}
+			return encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, cas, extras, responseKey, value)
+		case message.RESPONSE_MC_END, message.RESPONSE_MC_NOT_FOUND:
+			if quiet {
+				// Quiet gets only respond to hits.
+				return nil
+			}
+			return encodeBinaryError(header, BINARY_STATUS_KEY_NOT_FOUND, "Not found")
+		case message.RESPONSE_MC_STORED, message.RESPONSE_MC_DELETED, message.RESPONSE_MC_TOUCHED:
+			return encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, nil)
+		case message.RESPONSE_MC_NOT_STORED:
+			switch header.opcode {
+			case BINARY_OPCODE_ADD:
+				return encodeBinaryError(header, BINARY_STATUS_KEY_EXISTS, "Data exists for key.")
+			case BINARY_OPCODE_REPLACE:
+				return encodeBinaryError(header, BINARY_STATUS_KEY_NOT_FOUND, "Not found")
+			}
+			return encodeBinaryError(header, BINARY_STATUS_NOT_STORED, "Not stored.")
+		case message.RESPONSE_MC_EXISTS:
+			return encodeBinaryError(header, BINARY_STATUS_KEY_EXISTS, "Data exists for key.")
+		case message.RESPONSE_MC_NUMBER:
+			n, err := strconv.ParseUint(string(bytes.TrimRight(m.ResponseData, "\r\n")), 10, 64)
+			if err != nil {
+				return encodeBinaryError(header, BINARY_STATUS_INTERNAL_ERROR, err.Error())
+			}
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, n)
+			return encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, value)
+		}
+		return encodeBinaryError(header, BINARY_STATUS_INTERNAL_ERROR, "unexpected response from memcache server")
+	}
+}
+
+// readBinaryRequest reads the header and body of a binary protocol request, rejecting values longer than maxItemSize.
+func readBinaryRequest(reader *bufio.Reader, maxItemSize int) (binaryHeader, []byte, error) {
+	headerBytes := make([]byte, BINARY_HEADER_LENGTH)
+	_, err := io.ReadFull(reader, headerBytes)
+	if err == io.ErrUnexpectedEOF {
+		return binaryHeader{}, nil, errPartialRequest
+	}
+	if err != nil {
+		return binaryHeader{}, nil, err
+	}
+	header, err := parseBinaryHeader(headerBytes, maxItemSize)
+	if err != nil {
+		return binaryHeader{}, nil, err
+	}
+	body := make([]byte, header.bodyLen)
+	_, err = io.ReadFull(reader, body)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return binaryHeader{}, nil, errPartialRequest
+	}
+	if err != nil {
+		return binaryHeader{}, nil, err
+	}
+	return header, body, nil
+}
+
+// binaryCommandName returns the name of the text protocol command that a binary protocol request is equivalent to,
+// for allowed_commands and denied_commands, or "" for requests that can't be restricted.
+func binaryCommandName(header binaryHeader) string {
+	switch header.opcode {
+	case BINARY_OPCODE_GET, BINARY_OPCODE_GETQ, BINARY_OPCODE_GETK, BINARY_OPCODE_GETKQ:
+		return "gets"
+	case BINARY_OPCODE_SET, BINARY_OPCODE_REPLACE:
+		if header.cas != 0 {
+			return "cas"
+		}
+		if header.opcode == BINARY_OPCODE_REPLACE {
+			return "replace"
+		}
+		return "set"
+	case BINARY_OPCODE_ADD:
+		return "add"
+	case BINARY_OPCODE_APPEND:
+		return "append"
+	case BINARY_OPCODE_PREPEND:
+		return "prepend"
+	case BINARY_OPCODE_DELETE:
+		return "delete"
+	case BINARY_OPCODE_INCR:
+		return "incr"
+	case BINARY_OPCODE_DECR:
+		return "decr"
+	case BINARY_OPCODE_TOUCH:
+		return "touch"
+	case BINARY_OPCODE_VERSION:
+		return "version"
+	case BINARY_OPCODE_NOOP:
+		return "mn"
+	}
+	return ""
+}
+
+// newBinaryCommandHandler returns a handler for binary protocol requests that rejects values longer than maxItemSize.
+func newBinaryCommandHandler(maxItemSize int) func(*bufio.Reader, *responsequeue.ResponseQueue, memcache.ClientInterface) error {
+	return func(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+		return handleBinaryCommand(reader, responses, remote, maxItemSize)
+	}
+}
+
+// handleBinaryCommand reads a binary protocol request, and forwards it as a text protocol request to a memcache client.
+func handleBinaryCommand(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, maxItemSize int) error {
+	header, body, err := readBinaryRequest(reader, maxItemSize)
+	if err != nil {
+		return err
+	}
+	return forwardBinaryRequest(header, body, responses, remote)
+}
+
+// forwardBinaryRequest responds to a binary protocol request, forwarding it as a text protocol request to a memcache client if needed.
+func forwardBinaryRequest(header binaryHeader, body []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+	extras := body[:header.extrasLen]
+	key := body[header.extrasLen : int(header.extrasLen)+int(header.keyLength)]
+	value := body[int(header.extrasLen)+int(header.keyLength):]
+
+	if policy := commandPolicyOf(remote); policy != nil {
+		if command := binaryCommandName(header); command != "" && !policy.Permits(command) {
+			respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_AUTH_ERROR, "command not permitted"))
+			return nil
+		}
+	}
+
+	var request []byte
+	var requestType message.RequestType
+	switch header.opcode {
+	case BINARY_OPCODE_NOOP:
+		respondLocally(responses, 0, encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, nil))
+		return nil
+	case BINARY_OPCODE_VERSION:
+		respondLocally(responses, message.REQUEST_MC_VERSION, encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, []byte("golemproxy-"+VERSION)))
+		return nil
+	case BINARY_OPCODE_QUIT:
+		respondLocally(responses, 0, encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, nil))
+		return errQuit
+	case BINARY_OPCODE_QUITQ:
+		return errQuit
+	case BINARY_OPCODE_GET, BINARY_OPCODE_GETQ, BINARY_OPCODE_GETK, BINARY_OPCODE_GETKQ:
+		// Always request the cas token, which is part of every binary protocol response.
+		request = []byte("gets " + string(key) + "\r\n")
+		requestType = message.REQUEST_MC_GETS
+	case BINARY_OPCODE_SET, BINARY_OPCODE_ADD, BINARY_OPCODE_REPLACE:
+		if len(extras) != 8 {
+			respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_INVALID_ARGUMENT, "Invalid arguments"))
+			return nil
+		}
+		flags := binary.BigEndian.Uint32(extras[0:4])
+		exptime := binary.BigEndian.Uint32(extras[4:8])
+		command := "set"
+		requestType = message.REQUEST_MC_SET
+		switch header.opcode {
+		case BINARY_OPCODE_ADD:
+			command = "add"
+			requestType = message.REQUEST_MC_ADD
+		case BINARY_OPCODE_REPLACE:
+			command = "replace"
+			requestType = message.REQUEST_MC_REPLACE
+		}
+		casSuffix := ""
+		if header.cas != 0 && header.opcode != BINARY_OPCODE_ADD {
+			command = "cas"
+			requestType = message.REQUEST_MC_CAS
+			casSuffix = " " + strconv.FormatUint(header.cas, 10)
+		}
+		request = []byte(fmt.Sprintf("%s %s %d %d %d%s\r\n", command, key, flags, exptime, len(value), casSuffix))
+		request = append(append(request, value...), "\r\n"...)
+	case BINARY_OPCODE_APPEND, BINARY_OPCODE_PREPEND:
+		command := "append"
+		requestType = message.REQUEST_MC_APPEND
+		if header.opcode == BINARY_OPCODE_PREPEND {
+			command = "prepend"
+			requestType = message.REQUEST_MC_PREPEND
+		}
+		request = []byte(fmt.Sprintf("%s %s 0 0 %d\r\n", command, key, len(value)))
+		request = append(append(request, value...), "\r\n"...)
+	case BINARY_OPCODE_DELETE:
+		request = []byte("delete " + string(key) + "\r\n")
+		requestType = message.REQUEST_MC_DELETE
+	case BINARY_OPCODE_INCR, BINARY_OPCODE_DECR:
+		// The initial value and expiration time in the extras are not supported, missing keys are not created.
+		if len(extras) != 20 {
+			respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_INVALID_ARGUMENT, "Invalid arguments"))
+			return nil
+		}
+		command := "incr"
+		requestType = message.REQUEST_MC_INCR
+		if header.opcode == BINARY_OPCODE_DECR {
+			command = "decr"
+			requestType = message.REQUEST_MC_DECR
+		}
+		request = []byte(fmt.Sprintf("%s %s %d\r\n", command, key, binary.BigEndian.Uint64(extras[0:8])))
+	case BINARY_OPCODE_TOUCH:
+		if len(extras) != 4 {
+			respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_INVALID_ARGUMENT, "Invalid arguments"))
+			return nil
+		}
+		request = []byte(fmt.Sprintf("touch %s %d\r\n", key, binary.BigEndian.Uint32(extras)))
+		requestType = message.REQUEST_MC_TOUCH
+	default:
+		respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_UNKNOWN_COMMAND, "Unknown command"))
+		return nil
+	}
+	// Keys with spaces or control characters can't be sent with the text protocol.
+	if validateKey(key) != nil {
+		respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_INVALID_ARGUMENT, "Invalid arguments"))
+		return nil
+	}
+
+	m := &message.TranslatedMessage{Translate: translateBinaryResponse(header, key)}
+	m.HandleSendRequest(request, key, requestType)
+	remote.SendProxiedMessageAsync(&m.SingleMessage)
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+type binaryResponse struct {
+	opcode byte
+	status uint16
+	opaque uint32
+	extras []byte
+	key    []byte
+	value  []byte
+}
+
+func encodeBinaryRequest(opcode byte, opaque uint32, extras []byte, key string, value string) []byte {
+	bodyLen := len(extras) + len(key) + len(value)
+	request := make([]byte, BINARY_HEADER_LENGTH)
+	request[0] = BINARY_REQUEST_MAGIC
+	request[1] = opcode
+	binary.BigEndian.PutUint16(request[2:4], uint16(len(key)))
+	request[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(request[8:12], uint32(bodyLen))
+	binary.BigEndian.PutUint32(request[12:16], opaque)
+	request = append(request, extras...)
+	request = append(request, key...)
+	return append(request, value...)
+}
+
+func readBinaryResponse(t *testing.T, r io.Reader) binaryResponse {
+	t.Helper()
+	header := make([]byte, BINARY_HEADER_LENGTH)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("failed to read binary response header: %v", err)
+	}
+	testutil.ExpectEquals(t, byte(BINARY_RESPONSE_MAGIC), header[0], "unexpected magic byte")
+	keyLength := binary.BigEndian.Uint16(header[2:4])
+	extrasLen := header[4]
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("failed to read binary response body: %v", err)
+	}
+	return binaryResponse{
+		opcode: header[1],
+		status: binary.BigEndian.Uint16(header[6:8]),
+		opaque: binary.BigEndian.Uint32(header[12:16]),
+		extras: body[:extrasLen],
+		key:    body[int(extrasLen) : int(extrasLen)+int(keyLength)],
+		value:  body[int(extrasLen)+int(keyLength):],
+	}
+}
+
+func dialBinaryTestServer(t *testing.T) (net.Conn, func()) {
+	t.Helper()
+	return dialBinaryTestServerWithPolicy(t, nil)
+}
+
+// dialBinaryTestServerWithPolicy connects to a proxy whose pool only permits the commands of policy, or every command if policy is nil.
+func dialBinaryTestServerWithPolicy(t *testing.T, policy *config.CommandPolicy) (net.Conn, func()) {
+	t.Helper()
+	return dialBinaryTestServerWithConfig(t, func(conf *config.Config) { conf.CommandPolicy = policy })
+}
+
+// dialBinaryTestServerWithConfig connects to a proxy whose pool config is changed by configure.
+func dialBinaryTestServerWithConfig(t *testing.T, configure func(conf *config.Config)) (net.Conn, func()) {
+	t.Helper()
+	backend := newFakeBackend(t, newStoreHandler())
+	conf := newTestPoolConfig(t, backend)
+	configure(&conf)
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	return c, func() {
+		c.Close()
+		s.Shutdown(context.Background())
+		backend.close()
+	}
+}
+
+func TestBinarySetGetDelete(t *testing.T) {
+	c, cleanup := dialBinaryTestServer(t)
+	defer cleanup()
+
+	// The extras are the flags and expiration time
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SET, 1, make([]byte, 8), "k", "value"))
+	response := readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, byte(BINARY_OPCODE_SET), response.opcode, "unexpected opcode for set")
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for set")
+	testutil.ExpectEquals(t, uint32(1), response.opaque, "the opaque value should be returned")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_GETK, 2, nil, "k", ""))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for get")
+	testutil.ExpectEquals(t, []byte{0, 0, 0, 0}, response.extras, "expected flags in the extras")
+	testutil.ExpectStringEquals(t, "k", string(response.key), "getk should return the key")
+	testutil.ExpectStringEquals(t, "value", string(response.value), "unexpected value")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_DELETE, 3, nil, "k", ""))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for delete")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_GET, 4, nil, "k", ""))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_KEY_NOT_FOUND), response.status, "expected a miss after delete")
+	testutil.ExpectEquals(t, uint32(4), response.opaque, "the opaque value should be returned")
+}
+
+func TestBinaryQuietGetAndNoop(t *testing.T) {
+	c, cleanup := dialBinaryTestServer(t)
+	defer cleanup()
+
+	// Pipeline a quiet multiget ending in a noop, as binary protocol clients do.
+	request := encodeBinaryRequest(BINARY_OPCODE_SET, 1, make([]byte, 8), "hit", "x")
+	request = append(request, encodeBinaryRequest(BINARY_OPCODE_GETKQ, 2, nil, "missing", "")...)
+	request = append(request, encodeBinaryRequest(BINARY_OPCODE_GETKQ, 3, nil, "hit", "")...)
+	request = append(request, encodeBinaryRequest(BINARY_OPCODE_NOOP, 4, nil, "", "")...)
+	c.Write(request)
+
+	testutil.ExpectEquals(t, uint32(1), readBinaryResponse(t, c).opaque, "expected the response to set")
+	response := readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint32(3), response.opaque, "a quiet get that misses should not respond")
+	testutil.ExpectStringEquals(t, "hit", string(response.key), "unexpected key")
+	testutil.ExpectStringEquals(t, "x", string(response.value), "unexpected value")
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, byte(BINARY_OPCODE_NOOP), response.opcode, "expected the noop to respond last")
+}
+
+func TestBinaryInvalidRequests(t *testing.T) {
+	c, cleanup := dialBinaryTestServer(t)
+	defer cleanup()
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_GET, 1, nil, "has space", ""))
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_INVALID_ARGUMENT), readBinaryResponse(t, c).status, "keys with spaces can't be proxied")
+	c.Write(encodeBinaryRequest(0x50, 2, nil, "", ""))
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_UNKNOWN_COMMAND), readBinaryResponse(t, c).status, "expected unsupported opcodes to be rejected")
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_VERSION, 3, nil, "", ""))
+	testutil.ExpectStringEquals(t, "golemproxy-"+VERSION, string(readBinaryResponse(t, c).value), "unexpected version")
+}
+
+func TestBinaryCommandPolicy(t *testing.T) {
+	policy, err := config.NewCommandPolicy(nil, []string{"writes"})
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	c, cleanup := dialBinaryTestServerWithPolicy(t, policy)
+	defer cleanup()
+
+	for i, opcode := range []byte{BINARY_OPCODE_SET, BINARY_OPCODE_ADD, BINARY_OPCODE_REPLACE, BINARY_OPCODE_APPEND, BINARY_OPCODE_PREPEND} {
+		c.Write(encodeBinaryRequest(opcode, uint32(i), make([]byte, 8), "k", "value"))
+		response := readBinaryResponse(t, c)
+		testutil.ExpectEquals(t, uint16(BINARY_STATUS_AUTH_ERROR), response.status, "expected storage commands to be denied")
+		testutil.ExpectEquals(t, uint32(i), response.opaque, "the opaque value should be returned")
+	}
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_DELETE, 10, nil, "k", ""))
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_AUTH_ERROR), readBinaryResponse(t, c).status, "expected delete to be denied")
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_INCR, 11, make([]byte, 20), "k", ""))
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_AUTH_ERROR), readBinaryResponse(t, c).status, "expected incr to be denied")
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_TOUCH, 12, make([]byte, 4), "k", ""))
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_AUTH_ERROR), readBinaryResponse(t, c).status, "expected touch to be denied")
+
+	// Reads are still forwarded, and the denied set was not.
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_GET, 13, nil, "k", ""))
+	response := readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_KEY_NOT_FOUND), response.status, "expected gets to be permitted")
+	testutil.ExpectEquals(t, uint32(13), response.opaque, "the opaque value should be returned")
+}
+
+func TestBinaryMaxItemSize(t *testing.T) {
+	const maxItemSize = 512 * 1024
+	c, cleanup := dialBinaryTestServerWithConfig(t, func(conf *config.Config) { conf.MaxItemSize = maxItemSize })
+	defer cleanup()
+
+	value := strings.Repeat("x", maxItemSize)
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SET, 1, make([]byte, 8), "k", value))
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), readBinaryResponse(t, c).status, "expected a value of max_item_size to be stored")
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_GET, 2, nil, "k", ""))
+	response := readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for get")
+	testutil.ExpectEquals(t, maxItemSize, len(response.value), "unexpected length of the value")
+
+	// The default limit is larger, but values longer than max_item_size close the connection.
+	// The connection may be reset, because the proxy closes it without reading the value.
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SET, 3, make([]byte, 8), "k", value+"x"))
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Errorf("expected the connection to be closed, read %d bytes, err=%v", n, err)
+	}
+}
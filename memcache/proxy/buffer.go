@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// MIN_POOLED_BUFFER_SIZE is the capacity of the smallest pooled request buffer. Each size class is twice as large as the previous one.
+const MIN_POOLED_BUFFER_SIZE = 1 << 10
+
+// requestBufferPools holds buffers for the requests of storage commands, indexed by size class.
+// The largest size class fits a request with a value of MAX_ITEM_SIZE.
+var requestBufferPools [12]sync.Pool
+
+// bufferSizeClass returns the index of the smallest size class with a capacity of at least n.
+func bufferSizeClass(n int) int {
+	class := 0
+	for size := MIN_POOLED_BUFFER_SIZE; size < n; size <<= 1 {
+		class++
+	}
+	return class
+}
+
+// getRequestBuffer returns a buffer of length n. It should be returned with putRequestBuffer once it is no longer used.
+func getRequestBuffer(n int) *[]byte {
+	class := bufferSizeClass(n)
+	if class >= len(requestBufferPools) {
+		buf := make([]byte, n)
+		return &buf
+	}
+	if pooled := requestBufferPools[class].Get(); pooled != nil {
+		buf := pooled.(*[]byte)
+		*buf = (*buf)[:n]
+		return buf
+	}
+	buf := make([]byte, n, MIN_POOLED_BUFFER_SIZE<<uint(class))
+	return &buf
+}
+
+// putRequestBuffer returns a buffer from getRequestBuffer to the pool.
+func putRequestBuffer(buf *[]byte) {
+	class := bufferSizeClass(cap(*buf))
+	if class >= len(requestBufferPools) || cap(*buf) != MIN_POOLED_BUFFER_SIZE<<uint(class) {
+		return
+	}
+	requestBufferPools[class].Put(buf)
+}
+
+// clientReaderPools holds the readers of closed client connections, keyed by the size of their buffers.
+var clientReaderPools sync.Map
+
+// getClientReader returns a reader from r with a buffer of size bytes. It should be returned with putClientReader once the connection is closed.
+func getClientReader(r io.Reader, size int) *bufio.Reader {
+	if pool, ok := clientReaderPools.Load(size); ok {
+		if reader, ok := pool.(*sync.Pool).Get().(*bufio.Reader); ok {
+			reader.Reset(r)
+			return reader
+		}
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+// putClientReader returns a reader from getClientReader to the pool.
+// Requests are copied out of the reader's buffer before they are forwarded, so no message refers to the buffer.
+func putClientReader(reader *bufio.Reader) {
+	reader.Reset(nil)
+	pool, ok := clientReaderPools.Load(reader.Size())
+	if !ok {
+		pool, _ = clientReaderPools.LoadOrStore(reader.Size(), &sync.Pool{})
+	}
+	pool.(*sync.Pool).Put(reader)
+}
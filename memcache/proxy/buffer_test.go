@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestRequestBufferSizeClasses(t *testing.T) {
+	for _, n := range []int{0, 1, MIN_POOLED_BUFFER_SIZE, MIN_POOLED_BUFFER_SIZE + 1, MAX_ITEM_SIZE + 300} {
+		buf := getRequestBuffer(n)
+		testutil.ExpectEquals(t, n, len(*buf), fmt.Sprintf("unexpected length for %d", n))
+		putRequestBuffer(buf)
+	}
+	// Requests that are too large for any size class are not pooled.
+	buf := getRequestBuffer(4 * MAX_ITEM_SIZE)
+	testutil.ExpectEquals(t, 4*MAX_ITEM_SIZE, len(*buf), "unexpected length")
+	putRequestBuffer(buf)
+}
+
+// TestReusedRequestBuffersKeepValues checks that values are not corrupted when request buffers are reused.
+func TestReusedRequestBuffersKeepValues(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	input := ""
+	expected := ""
+	for i, size := range []int{10, 2000, 5, 70000, 2000, 1} {
+		value := strings.Repeat(string('a'+byte(i)), size)
+		input += fmt.Sprintf("set k%d 0 0 %d\r\n%s\r\n", i, size, value)
+		expected += "STORED\r\n"
+	}
+	for i, size := range []int{10, 2000, 5, 70000, 2000, 1} {
+		value := strings.Repeat(string('a'+byte(i)), size)
+		input += fmt.Sprintf("get k%d\r\n", i)
+		expected += fmt.Sprintf("VALUE k%d 0 %d\r\n%s\r\nEND\r\n", i, size, value)
+	}
+	errs := handleAllCommands(input, responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, expected)
+}
+
+// storedRemote responds to every request with STORED without recording it.
+type storedRemote struct {
+	memcache.ClientInterface
+}
+
+func (r storedRemote) SendProxiedMessageAsync(m *message.SingleMessage) {
+	m.HandleReceiveResponse([]byte("STORED\r\n"), message.RESPONSE_MC_STORED)
+}
+
+func (r storedRemote) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	r.SendProxiedMessageAsync(m)
+}
+
+// notifyingWriter sends on written after each write.
+type notifyingWriter struct {
+	written chan struct{}
+}
+
+func (w notifyingWriter) Write(p []byte) (int, error) {
+	w.written <- struct{}{}
+	return len(p), nil
+}
+
+// BenchmarkSetLargeValue reports the allocations for forwarding sets of large values from a client that waits for each response.
+func BenchmarkSetLargeValue(b *testing.B) {
+	value := bytes.Repeat([]byte("x"), MAX_ITEM_SIZE)
+	request := append([]byte(fmt.Sprintf("set k 0 0 %d\r\n", len(value))), value...)
+	request = append(request, '\r', '\n')
+	written := make(chan struct{}, 1)
+	responses := responsequeue.CreateResponseQueue(notifyingWriter{written})
+	defer responses.Close()
+	reader := bufio.NewReaderSize(bytes.NewReader(nil), 4096)
+	source := bytes.NewReader(request)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(request)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source.Reset(request)
+		reader.Reset(source)
+		err := handleCommand(reader, responses, storedRemote{}, MAX_ITEM_SIZE)
+		if err != nil {
+			b.Fatal(err)
+		}
+		<-written
+	}
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// contextClient sends the requests of a client connection with the context of that connection,
+// so that requests which are still waiting for a memcache server are abandoned once the client is gone.
+type contextClient struct {
+	memcache.ClientInterface
+	ctx context.Context
+}
+
+var _ memcache.ClientInterface = &contextClient{}
+
+func (c *contextClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *contextClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.ClientInterface.SendProxiedMessageWithContext(c.ctx, m)
+}
+
+// cancelingConn cancels the context of a client connection when a response can't be written to the client.
+type cancelingConn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c cancelingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
+}
+
+// isConnectionReset returns true if reading a request failed because the client connection broke,
+// rather than because the client closed its side of the connection or was idle.
+func isConnectionReset(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && !netErr.Timeout()
+}
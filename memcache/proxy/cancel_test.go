@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// openConnections returns the number of client connections that s is serving.
+func openConnections(s *Server) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return len(s.conns)
+}
+
+func TestClientDisconnectAbandonsRequests(t *testing.T) {
+	received := make(chan string, 10)
+	release := make(chan struct{})
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		received <- line
+		<-release
+		io.WriteString(writer, "END\r\n")
+	})
+	defer backend.close()
+	released := false
+	releaseBackend := func() {
+		if !released {
+			released = true
+			close(release)
+		}
+	}
+	defer releaseBackend()
+	conf := newTestPoolConfig(t, backend)
+	// Without cancellation, the proxy would wait for the response until the request times out.
+	conf.Timeout = 10000
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	io.WriteString(c, "get slow\r\n")
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the request to be sent to the server")
+	}
+	// Resetting the connection breaks it immediately, like a client that crashed.
+	c.(*net.TCPConn).SetLinger(0)
+	c.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for openConnections(s) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the proxy to stop waiting for the server after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The response to the abandoned request is discarded, rather than being sent to the next client.
+	releaseBackend()
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "get other\r\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, "END\r\n", line, "unexpected response")
+	testutil.ExpectStringEquals(t, "get other\r\n", <-received, "expected the next request to be sent to the server")
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// coalescingClient sends a single request for concurrent gets of the same key, and gives its response to every client that requested the key.
+// This protects the memcache servers when many clients request a hot key at the same time, e.g. right after it expired.
+// A get received after a request that modifies the key is never combined with a get that was sent before that request.
+type coalescingClient struct {
+	memcache.ClientInterface
+	m sync.Mutex
+	// inflight maps keys to the get that was sent to a memcache server for them and hasn't received a response yet.
+	inflight map[string]*coalescedGet
+}
+
+// coalescedGet is the client requests waiting for the response to a get that was sent to a memcache server.
+type coalescedGet struct {
+	waiters []*message.SingleMessage
+}
+
+var _ memcache.ClientInterface = &coalescingClient{}
+
+func newCoalescingClient(remote memcache.ClientInterface) *coalescingClient {
+	return &coalescingClient{ClientInterface: remote, inflight: make(map[string]*coalescedGet)}
+}
+
+func (c *coalescingClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *coalescingClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *coalescingClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	if m.RequestType != message.REQUEST_MC_GET {
+		if len(m.Key) > 0 {
+			// Later gets of the key must not get a response that was read before this request.
+			c.m.Lock()
+			delete(c.inflight, string(m.Key))
+			c.m.Unlock()
+		}
+		c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+		return
+	}
+	key := string(m.Key)
+	c.m.Lock()
+	if get := c.inflight[key]; get != nil {
+		get.waiters = append(get.waiters, m)
+		c.m.Unlock()
+		return
+	}
+	get := &coalescedGet{waiters: []*message.SingleMessage{m}}
+	c.inflight[key] = get
+	c.m.Unlock()
+
+	// The buffer of the client's request is reused after the client gets its response, so the forwarded request needs a copy.
+	// It isn't canceled with ctx, since other clients can wait for its response.
+	forwarded := &message.SingleMessage{}
+	forwarded.HandleSendRequest(append([]byte(nil), m.RequestData...), append([]byte(nil), m.Key...), m.RequestType)
+	c.ClientInterface.SendProxiedMessageAsync(forwarded)
+	go c.respond(key, get, forwarded)
+}
+
+// respond waits for the response to the forwarded get, and gives it to every client request that was combined with it.
+func (c *coalescingClient) respond(key string, get *coalescedGet, forwarded *message.SingleMessage) {
+	data, err := forwarded.AwaitResponseBytes()
+	c.m.Lock()
+	if c.inflight[key] == get {
+		delete(c.inflight, key)
+	}
+	// No more requests can be added once the get is no longer in inflight.
+	waiters := get.waiters
+	c.m.Unlock()
+	for _, m := range waiters {
+		if err != nil {
+			m.HandleResponseError(err)
+		} else {
+			// The response is shared, and is not modified when it is sent to the clients.
+			m.HandleReceiveResponse(data, forwarded.ResponseType)
+		}
+	}
+}
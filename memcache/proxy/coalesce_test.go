@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// sendGets sends gets of key from concurrent clients, and returns the messages once every get was sent.
+func sendGets(c *coalescingClient, key string, count int) []*message.SingleMessage {
+	gets := make([]*message.SingleMessage, count)
+	var wg sync.WaitGroup
+	for i := range gets {
+		gets[i] = &message.SingleMessage{}
+		wg.Add(1)
+		go func(m *message.SingleMessage) {
+			defer wg.Done()
+			m.HandleSendRequest([]byte("get "+key+"\r\n"), []byte(key), message.REQUEST_MC_GET)
+			c.SendProxiedMessageAsync(m)
+		}(gets[i])
+	}
+	wg.Wait()
+	return gets
+}
+
+func TestCoalesceGets(t *testing.T) {
+	var m sync.Mutex
+	sent := []*message.SingleMessage{}
+	c := newCoalescingClient(&delayedRemote{send: func(request *message.SingleMessage) {
+		m.Lock()
+		sent = append(sent, request)
+		m.Unlock()
+	}})
+
+	gets := sendGets(c, "hot", 50)
+	testutil.ExpectEquals(t, 1, len(sent), "expected one request to the memcache server for 50 concurrent gets")
+	testutil.ExpectStringEquals(t, "get hot\r\n", string(sent[0].RequestData), "unexpected request")
+	sent[0].HandleReceiveResponse([]byte("VALUE hot 0 1\r\nx\r\nEND\r\n"), message.RESPONSE_MC_VALUE)
+	for _, get := range gets {
+		data, err := get.AwaitResponseBytes()
+		testutil.ExpectEquals(t, (*message.ResponseError)(nil), err, "unexpected error")
+		testutil.ExpectStringEquals(t, "VALUE hot 0 1\r\nx\r\nEND\r\n", string(data), "unexpected response")
+		testutil.ExpectEquals(t, message.RESPONSE_MC_VALUE, get.ResponseType, "unexpected response type")
+	}
+
+	// A miss is given to every client, and a get after the response is sent to the server again.
+	gets = sendGets(c, "hot", 10)
+	testutil.ExpectEquals(t, 2, len(sent), "expected a new request once the previous one got a response")
+	sent[1].HandleReceiveResponse([]byte("END\r\n"), message.RESPONSE_MC_END)
+	for _, get := range gets {
+		data, err := get.AwaitResponseBytes()
+		testutil.ExpectEquals(t, (*message.ResponseError)(nil), err, "unexpected error")
+		testutil.ExpectStringEquals(t, "END\r\n", string(data), "unexpected response for a miss")
+	}
+}
+
+func TestCoalesceGetsAfterWrite(t *testing.T) {
+	sent := []*message.SingleMessage{}
+	c := newCoalescingClient(&delayedRemote{send: func(request *message.SingleMessage) {
+		sent = append(sent, request)
+	}})
+	first := sendGets(c, "k", 1)[0]
+	set := &message.SingleMessage{}
+	set.HandleSendRequest([]byte("set k 0 0 1\r\nx\r\n"), []byte("k"), message.REQUEST_MC_SET)
+	c.SendProxiedMessageAsync(set)
+	second := sendGets(c, "k", 1)[0]
+	testutil.ExpectEquals(t, 3, len(sent), "expected a get after a set to be sent separately")
+
+	sent[0].HandleReceiveResponse([]byte("END\r\n"), message.RESPONSE_MC_END)
+	sent[1].HandleReceiveResponse([]byte("STORED\r\n"), message.RESPONSE_MC_STORED)
+	sent[2].HandleReceiveError(errTimeout{})
+	data, _ := first.AwaitResponseBytes()
+	testutil.ExpectStringEquals(t, "END\r\n", string(data), "unexpected response to the first get")
+	_, err := second.AwaitResponseBytes()
+	testutil.ExpectEquals(t, message.RESPONSE_ERROR_TIMEOUT, err, "expected the error to be given to the second get")
+}
+
+// errTimeout is a network error for a request that timed out.
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
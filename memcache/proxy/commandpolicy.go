@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"go4.org/strutil"
+)
+
+// commandPolicyClient attaches the allowed_commands and denied_commands of a pool to its client.
+// handleCommand rejects the commands that the policy doesn't permit before they are parsed.
+type commandPolicyClient struct {
+	memcache.ClientInterface
+	policy *config.CommandPolicy
+}
+
+var _ memcache.ClientInterface = &commandPolicyClient{}
+
+func (c *commandPolicyClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+// commandPolicyOf returns the commands that clients of remote may send, or nil if every command is permitted.
+func commandPolicyOf(remote memcache.ClientInterface) *config.CommandPolicy {
+	for {
+		if c, ok := remote.(*commandPolicyClient); ok {
+			return c.policy
+		}
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			return nil
+		}
+		remote = wrapper.unwrap()
+	}
+}
+
+// rejectCommand responds with RESPONSE_ERROR_COMMAND_NOT_PERMITTED to a request that the command policy does not permit.
+// The value of a storage command is read first, so that it is not mistaken for the next command.
+func rejectCommand(requestHeader []byte, reader *bufio.Reader, responses *responsequeue.ResponseQueue) error {
+	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
+	if err != nil {
+		return err
+	}
+	switch string(args[0]) {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(args) < 5 {
+			return fmt.Errorf("missing length for %s", args[0])
+		}
+		length, err := strutil.ParseUintBytes(args[4], 10, 31)
+		if err != nil {
+			return fmt.Errorf("invalid length %q", args[4])
+		}
+		if err := discardRequestBody(int(length), reader); err != nil {
+			return err
+		}
+	case "ms":
+		if len(args) < 3 {
+			return fmt.Errorf("missing datalen for %s", args[0])
+		}
+		length, err := strutil.ParseUintBytes(args[2], 10, 31)
+		if err != nil {
+			return fmt.Errorf("invalid datalen %q", args[2])
+		}
+		if err := discardRequestBody(int(length), reader); err != nil {
+			return err
+		}
+	}
+	m := &message.SingleMessage{NoReply: len(args) > 1 && bytes.Equal(args[len(args)-1], noreplyBytes)}
+	m.ResponseError = message.RESPONSE_ERROR_COMMAND_NOT_PERMITTED
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
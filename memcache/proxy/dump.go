@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+)
+
+// dumpState writes a snapshot of the client connections and servers of every pool to w, for debugging a proxy that seems stuck.
+func (s *Server) dumpState(w io.Writer) {
+	s.m.Lock()
+	var uptime time.Duration
+	if s.started {
+		uptime = time.Since(s.startedAt)
+	}
+	connections := len(s.conns)
+	names := make([]string, 0, len(s.pools))
+	for name := range s.pools {
+		names = append(names, name)
+	}
+	pools := s.pools
+	s.m.Unlock()
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "uptime: %v\n", uptime.Truncate(time.Second))
+	fmt.Fprintf(w, "client connections: %d\n", connections)
+	for _, name := range names {
+		pool := pools[name]
+		ejected := make(map[*memcache.PipeliningClient]bool)
+		for _, server := range pool.EjectedServers() {
+			ejected[server] = true
+		}
+		fmt.Fprintf(w, "pool %s:\n", name)
+		for _, server := range pool.Servers() {
+			fmt.Fprintf(w, "  server %s: outstanding %d, ejected %t\n", server.GetServer(), server.Outstanding(), ejected[server])
+		}
+	}
+}
+
+// handleDumpState writes a snapshot of the state of the server to stderr whenever the process receives SIGUSR1.
+func handleDumpState(s *Server) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1)
+	go func() {
+		for range sigc {
+			s.dumpState(os.Stderr)
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestDumpState(t *testing.T) {
+	release := make(chan struct{})
+	store := newStoreHandler()
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if strings.Contains(line, "blocked") {
+			<-release
+		}
+		store(line, reader, writer)
+	})
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "get blocked\r\n")
+
+	expected := "client connections: 1\npool main:\n  server " + backend.addr() + ": outstanding 1, ejected false\n"
+	var output string
+	deadline := time.Now().Add(time.Second)
+	for {
+		buf := &bytes.Buffer{}
+		s.dumpState(buf)
+		output = buf.String()
+		if strings.HasSuffix(output, expected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	if !strings.HasPrefix(output, "uptime: ") {
+		t.Errorf("expected the dump to start with the uptime, got %q", output)
+	}
+	testutil.ExpectStringEquals(t, expected, output[strings.IndexByte(output, '\n')+1:], "unexpected dump")
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
+)
+
+var storedResponse = []byte("STORED\r\n")
+
+// fireAndForgetClient responds STORED to set, add, replace, append, and prepend requests without waiting for the memcache servers.
+// The requests are still forwarded, but clients are not told if a server failed or did not store the value,
+// so a write can be lost (or an add/replace can be wrongly reported as stored) without the client knowing.
+// cas requests are forwarded normally, since the result of a cas is the reason to send it.
+type fireAndForgetClient struct {
+	memcache.ClientInterface
+}
+
+var _ memcache.ClientInterface = &fireAndForgetClient{}
+
+func (c *fireAndForgetClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *fireAndForgetClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *fireAndForgetClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	if !isStorageRequest(m.RequestType) || m.RequestType == message.REQUEST_MC_CAS {
+		c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+		return
+	}
+	// The buffer of the client's request is reused after the client gets its response, so the forwarded request needs a copy.
+	// It isn't canceled with ctx, since the client is told that the value was stored.
+	forwarded := &message.SingleMessage{
+		NoReply: m.NoReply,
+		Flags:   m.Flags,
+		Exptime: m.Exptime,
+	}
+	forwarded.HandleSendRequest(append([]byte(nil), m.RequestData...), append([]byte(nil), m.Key...), m.RequestType)
+	c.ClientInterface.SendProxiedMessageAsync(forwarded)
+	go func() {
+		if _, err := forwarded.AwaitResponseBytes(); err != nil {
+			stats.Global.RecordError(err)
+		}
+	}()
+	m.HandleReceiveResponse(storedResponse, message.RESPONSE_MC_STORED)
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestFireAndForgetSets(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	// The backend does not respond until the test allows it to.
+	forwarded := make(chan *message.SingleMessage, 10)
+	backend := &delayedRemote{send: func(m *message.SingleMessage) {
+		forwarded <- m
+	}}
+	remote := &fireAndForgetClient{ClientInterface: backend}
+	errs := handleAllCommands("set a 0 0 1\r\nx\r\nadd b 0 0 1 noreply\r\ny\r\nappend c 0 0 1\r\nz\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nSTORED\r\n")
+
+	expected := []string{"set a 0 0 1\r\nx\r\n", "add b 0 0 1 noreply\r\ny\r\n", "append c 0 0 1\r\nz\r\n"}
+	for _, request := range expected {
+		select {
+		case m := <-forwarded:
+			testutil.ExpectStringEquals(t, request, string(m.RequestData), "unexpected forwarded request")
+			m.HandleReceiveResponse([]byte("NOT_STORED\r\n"), message.RESPONSE_MC_NOT_STORED)
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q to be forwarded to the backend", request)
+		}
+	}
+}
+
+func TestFireAndForgetSetsAwaitsCas(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	backend := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("EXISTS\r\n")
+		},
+	}
+	remote := &fireAndForgetClient{ClientInterface: backend}
+	errs := handleAllCommands("cas a 0 0 1 1\r\nx\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "EXISTS\r\n")
+}
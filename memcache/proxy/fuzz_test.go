@@ -0,0 +1,86 @@
+//go:build go1.18
+// +build go1.18
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+)
+
+// wellFormedRemote fails the test if a request that is forwarded to a memcache server is malformed, and responds with END.
+type wellFormedRemote struct {
+	memcache.ClientInterface
+	t *testing.T
+}
+
+func (r *wellFormedRemote) SendProxiedMessageAsync(m *message.SingleMessage) {
+	data := m.RequestData
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		r.t.Errorf("forwarded request %q does not end with \\r\\n", data)
+	}
+	if m.Key != nil {
+		if err := validateKey(m.Key); err != nil {
+			r.t.Errorf("forwarded request %q has an invalid key %q: %v", data, m.Key, err)
+		}
+		if !bytes.Contains(data, m.Key) {
+			r.t.Errorf("forwarded request %q does not contain its key %q", data, m.Key)
+		}
+	}
+	m.HandleReceiveResponse([]byte("END\r\n"), message.RESPONSE_MC_END)
+}
+
+func (r *wellFormedRemote) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	r.SendProxiedMessageAsync(m)
+}
+
+func FuzzHandleCommand(f *testing.F) {
+	for _, seed := range []string{
+		"\r\n",
+		"\n",
+		"get\r\n",
+		"get \r\n",
+		"get k\r\n",
+		"gets  a b \r\n",
+		"gat 1\r\n",
+		"gat 1 k\r\n",
+		"set k 0 0 1\r\nx\r\n",
+		"set k 0 0 1 noreply\r\nx\r\n",
+		"set k 0 0\r\n",
+		"cas k 0 0 1 1\r\nx\r\n",
+		"append k 0 0 5\r\nx\r\n",
+		"delete\r\n",
+		"delete k 0 noreply\r\n",
+		"incr k\r\n",
+		"incr k 1\r\n",
+		"touch k 1\r\n",
+		"mg k v\r\n",
+		"ms k 1\r\nx\r\n",
+		"md k q\r\n",
+		"ma k\r\n",
+		"mn\r\n",
+		"verbosity\r\n",
+		"flush_all x\r\n",
+		"stats slabs\r\n",
+		"stats\r\n",
+		"version\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		responses := responsequeue.CreateResponseQueue(ioutil.Discard)
+		defer responses.Close()
+		remote := &wellFormedRemote{t: t}
+		reader := bufio.NewReader(bytes.NewReader(input))
+		// Like serveSocket, stop at the first error, which closes the connection.
+		for handleCommand(reader, responses, remote, MAX_ITEM_SIZE) == nil {
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// unreachablePools returns the sorted names of the pools in which every server was ejected by auto_eject_hosts.
+func (s *Server) unreachablePools() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var result []string
+	for name, pool := range s.pools {
+		if !pool.Reachable() {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// healthHandler responds 200 if every pool has a server that isn't ejected, and 503 otherwise or while shutting down.
+// This is meant for load balancer health checks and Kubernetes probes.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if s.isShuttingDown() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "shutting down\n")
+		return
+	}
+	if unreachable := s.unreachablePools(); len(unreachable) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "no reachable servers in pools: %s\n", strings.Join(unreachable, ", "))
+		return
+	}
+	fmt.Fprintf(w, "OK\n")
+}
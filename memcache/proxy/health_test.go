@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func getHealthStatus(t *testing.T, addr string) int {
+	t.Helper()
+	response, err := http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatalf("failed to check health: %v", err)
+	}
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	closeWithoutResponding := func(line string, reader *bufio.Reader, writer io.Writer) {
+		writer.(net.Conn).Close()
+	}
+	backends := []*fakeBackend{newFakeBackend(t, closeWithoutResponding), newFakeBackend(t, closeWithoutResponding)}
+	for _, backend := range backends {
+		defer backend.close()
+	}
+	conf := newTestPoolConfig(t, backends...)
+	conf.AutoEjectHosts = true
+	conf.ServerFailureLimit = 1
+	conf.ServerRetryTimeout = 300 * time.Millisecond
+	conf.HealthListen = "127.0.0.1:0"
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+	s.m.Lock()
+	// The health listener is created after the listeners of the pools.
+	healthAddr := s.listeners[1].Addr().String()
+	s.m.Unlock()
+	testutil.ExpectEquals(t, http.StatusOK, getHealthStatus(t, healthAddr), "expected the pool to be healthy before requests fail")
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	// Each failed get ejects the server it was sent to, and the next get is sent to the remaining server.
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "get foo\r\n")
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+	}
+	testutil.ExpectEquals(t, http.StatusServiceUnavailable, getHealthStatus(t, healthAddr), "expected the pool to be unhealthy after every server was ejected")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for getHealthStatus(t, healthAddr) != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the pool to be healthy after the servers were restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
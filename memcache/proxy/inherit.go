@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/TysonAndre/golemproxy/config"
+)
+
+// LISTEN_FDS_START is the first file descriptor of the sockets passed with systemd's socket activation protocol.
+const LISTEN_FDS_START = 3
+
+// inheritedListeners returns listeners for the sockets that the parent process passed with systemd's socket activation protocol:
+// LISTEN_FDS is the number of sockets, which are the file descriptors starting at LISTEN_FDS_START, and LISTEN_PID is the process they were passed to.
+// The environment variables are removed so that child processes don't use the same sockets.
+func inheritedListeners() ([]net.Listener, error) {
+	count := os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// The sockets were passed to another process, e.g. a script that started golemproxy.
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", count)
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		fd := LISTEN_FDS_START + i
+		files[i] = os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	}
+	return listenersFromFiles(files)
+}
+
+// listenersFromFiles returns a listener for each of the listening sockets, and closes the files.
+func listenersFromFiles(files []*os.File) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(files))
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		name := f.Name()
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, f := range files[i+1:] {
+				f.Close()
+			}
+			return nil, fmt.Errorf("%s is not a listening socket: %v", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// takeInheritedListener returns the inherited listener that is bound to a listen address of a pool, or nil if there is none.
+func (s *Server) takeInheritedListener(socketPath string) net.Listener {
+	network, address := config.ParseListenAddress(socketPath)
+	for i, l := range s.inherited {
+		if isBoundTo(l.Addr(), network, address) {
+			s.inherited = append(s.inherited[:i], s.inherited[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// closeUnusedInheritedListeners closes the inherited listeners that aren't bound to the listen address of any pool.
+func (s *Server) closeUnusedInheritedListeners() {
+	for _, l := range s.inherited {
+		getLogger().Warn("Closing an inherited socket that is not a listen address of any pool", "addr", l.Addr().String())
+		l.Close()
+	}
+	s.inherited = nil
+}
+
+// isBoundTo returns true if a listener with the address addr is listening on the address from the listen setting of a pool.
+func isBoundTo(addr net.Addr, network string, address string) bool {
+	if network != "tcp" {
+		unixAddr, ok := addr.(*net.UnixAddr)
+		return ok && unixAddr.Name == address
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	expected, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil || expected.Port != tcpAddr.Port {
+		return false
+	}
+	if expected.IP == nil || expected.IP.IsUnspecified() {
+		// e.g. a socket listening on 0.0.0.0 has the address [::] if it also accepts IPv6 connections.
+		return tcpAddr.IP.IsUnspecified()
+	}
+	return expected.IP.Equal(tcpAddr.IP)
+}
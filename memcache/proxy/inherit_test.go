@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestIsBoundTo(t *testing.T) {
+	for _, test := range []struct {
+		addr     net.Addr
+		listen   string
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22121}, "127.0.0.1:22121", true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22121}, "127.0.0.1:22122", false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22121}, "0.0.0.0:22121", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 22121}, "0.0.0.0:22121", true},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 22121}, ":22121", true},
+		{&net.UnixAddr{Name: "/tmp/golemproxy.sock", Net: "unix"}, "/tmp/golemproxy.sock", true},
+		{&net.UnixAddr{Name: "/tmp/golemproxy.sock", Net: "unix"}, "127.0.0.1:22121", false},
+	} {
+		network, address := config.ParseListenAddress(test.listen)
+		testutil.ExpectEquals(t, test.expected, isBoundTo(test.addr, network, address), "unexpected result for "+test.addr.String()+" and "+test.listen)
+	}
+}
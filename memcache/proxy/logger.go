@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Logger receives the log messages of the proxy. keyvals are alternating keys and values, e.g. "remote", "127.0.0.1:1234".
+// *slog.Logger implements this interface, and other loggers such as zap and logrus can be adapted to it.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// writerLogger writes log messages to a writer. Debug messages are only written if DebugLogging is true.
+type writerLogger struct {
+	m      sync.Mutex
+	writer io.Writer
+}
+
+var _ Logger = &writerLogger{}
+
+// NewWriterLogger returns a Logger that writes messages to w in the format "message key=value key=value".
+func NewWriterLogger(w io.Writer) Logger {
+	return &writerLogger{writer: w}
+}
+
+func (l *writerLogger) log(msg string, keyvals []interface{}) {
+	line := msg
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			line += fmt.Sprintf(" %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			line += fmt.Sprintf(" %v", keyvals[i])
+		}
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	fmt.Fprintln(l.writer, line)
+}
+
+func (l *writerLogger) Debug(msg string, keyvals ...interface{}) {
+	if DebugLogging {
+		l.log(msg, keyvals)
+	}
+}
+
+func (l *writerLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(msg, keyvals)
+}
+
+func (l *writerLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(msg, keyvals)
+}
+
+func (l *writerLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(msg, keyvals)
+}
+
+var (
+	loggerMutex sync.RWMutex
+	logger      = NewWriterLogger(os.Stderr)
+)
+
+// SetLogger replaces the logger of the proxy, which writes to stderr by default.
+func SetLogger(l Logger) {
+	loggerMutex.Lock()
+	logger = l
+	loggerMutex.Unlock()
+}
+
+// getLogger returns the current logger.
+func getLogger() Logger {
+	loggerMutex.RLock()
+	defer loggerMutex.RUnlock()
+	return logger
+}
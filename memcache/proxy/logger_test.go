@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+// capturingLogger records log messages for tests.
+type capturingLogger struct {
+	m       sync.Mutex
+	entries []logEntry
+}
+
+func (l *capturingLogger) record(level string, msg string, keyvals []interface{}) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, keyvals})
+}
+
+func (l *capturingLogger) Debug(msg string, keyvals ...interface{}) { l.record("debug", msg, keyvals) }
+func (l *capturingLogger) Info(msg string, keyvals ...interface{})  { l.record("info", msg, keyvals) }
+func (l *capturingLogger) Warn(msg string, keyvals ...interface{})  { l.record("warn", msg, keyvals) }
+func (l *capturingLogger) Error(msg string, keyvals ...interface{}) { l.record("error", msg, keyvals) }
+
+func (l *capturingLogger) getEntries() []logEntry {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return append([]logEntry{}, l.entries...)
+}
+
+func TestParseFailureIsLoggedAtWarn(t *testing.T) {
+	previous := getLogger()
+	captured := &capturingLogger{}
+	SetLogger(captured)
+	defer SetLogger(previous)
+
+	l := startTestServer(t, &fakeRemote{}, config.Config{})
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "set k 0 0 abc\r\n")
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	// Wait for the proxy to close the connection.
+	ioutil.ReadAll(c)
+
+	// Other tests' servers may also log, e.g. when their listeners are closed.
+	var entry *logEntry
+	deadline := time.Now().Add(time.Second)
+	for entry == nil && time.Now().Before(deadline) {
+		for _, e := range captured.getEntries() {
+			if e.msg == "Request parsing failed" {
+				e := e
+				entry = &e
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if entry == nil {
+		t.Fatalf("expected the parse failure to be logged, got %#v", captured.getEntries())
+	}
+	testutil.ExpectStringEquals(t, "warn", entry.level, "unexpected level")
+	testutil.ExpectEquals(t, []interface{}{"remote", c.LocalAddr().String(), "command", "set"}, entry.keyvals[:4], "unexpected fields")
+}
+
+func TestWriterLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWriterLogger(&buf)
+	l.Warn("Closing client connection", "remote", "127.0.0.1:1234", "error", io.EOF)
+	l.Debug("not written unless DebugLogging is set")
+	testutil.ExpectStringEquals(t, "Closing client connection remote=127.0.0.1:1234 error=EOF\n", buf.String(), "unexpected output")
+}
@@ -17,4 +17,18 @@ func (error *ResponseError) Error() string {
 }
 
 var RESPONSE_ERROR_UNEXPECTED_TYPE = NewResponseError([]byte("SERVER_ERROR multiget fail\r\n"))
+var RESPONSE_ERROR_TIMEOUT = NewResponseError([]byte("SERVER_ERROR timeout\r\n"))
+var RESPONSE_ERROR_INVALID_DELTA = NewResponseError([]byte("CLIENT_ERROR invalid numeric delta argument\r\n"))
+var RESPONSE_ERROR_INVALID_EXPTIME = NewResponseError([]byte("CLIENT_ERROR invalid exptime argument\r\n"))
+var RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT = NewResponseError([]byte("CLIENT_ERROR bad command line format\r\n"))
 var RESPONSE_ERROR_UNKNOWN_COMMAND = NewResponseError([]byte("SERVER_ERROR unknown command\r\n"))
+var RESPONSE_ERROR_NONEXISTENT_COMMAND = NewResponseError([]byte("ERROR\r\n"))
+var RESPONSE_ERROR_LINE_TOO_LONG = NewResponseError([]byte("CLIENT_ERROR line too long\r\n"))
+var RESPONSE_ERROR_WRITE_NOT_ALLOWED = NewResponseError([]byte("CLIENT_ERROR write commands not allowed\r\n"))
+var RESPONSE_ERROR_AUTHENTICATION_REQUIRED = NewResponseError([]byte("CLIENT_ERROR authentication required\r\n"))
+var RESPONSE_ERROR_OBJECT_TOO_LARGE = NewResponseError([]byte("SERVER_ERROR object too large for cache\r\n"))
+var RESPONSE_ERROR_COMMAND_NOT_PERMITTED = NewResponseError([]byte("CLIENT_ERROR command not permitted\r\n"))
+var RESPONSE_ERROR_BACKEND_CLOSED = NewResponseError([]byte("SERVER_ERROR backend closed\r\n"))
+var RESPONSE_ERROR_CONNECTION_TIMEOUT = NewResponseError([]byte("SERVER_ERROR connection timeout\r\n"))
+var RESPONSE_ERROR_CANCELED = NewResponseError([]byte("SERVER_ERROR request canceled\r\n"))
+var RESPONSE_ERROR_BACKEND_RESPONSE_TOO_LARGE = NewResponseError([]byte("SERVER_ERROR backend response too large\r\n"))
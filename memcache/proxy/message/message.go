@@ -2,7 +2,11 @@
 package message
 
 import (
+	"bytes"
+	"fmt"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,16 +21,44 @@ const (
 	RESPONSE_MC_TOUCHED       ResponseType = 8
 	RESPONSE_MC_OK            ResponseType = 8
 	RESPONSE_MC_NUMBER        ResponseType = 9
+	// RESPONSE_MC_ERROR, RESPONSE_MC_CLIENT_ERROR, and RESPONSE_MC_SERVER_ERROR are errors sent by the memcache server.
+	RESPONSE_MC_ERROR        ResponseType = 10
+	RESPONSE_MC_CLIENT_ERROR ResponseType = 11
+	RESPONSE_MC_SERVER_ERROR ResponseType = 12
+	// RESPONSE_MC_META_VALUE is a meta protocol "VA <size> <flags>*" response with a value,
+	// and RESPONSE_MC_META is any other meta protocol response, such as "HD" or "EN".
+	RESPONSE_MC_META_VALUE ResponseType = 13
+	RESPONSE_MC_META       ResponseType = 14
+	// RESPONSE_MC_STAT is a response to a stats request with 1 or more "STAT <name> <value>" lines followed by "END".
+	RESPONSE_MC_STAT ResponseType = 15
 )
 
 const (
-	REQUEST_MC_UNKNOWN RequestType = 1
-	REQUEST_MC_GET     RequestType = 2
-	REQUEST_MC_GETS    RequestType = 3
-	REQUEST_MC_SET     RequestType = 4
-	REQUEST_MC_DELETE  RequestType = 5
-	REQUEST_MC_INCR    RequestType = 6
-	REQUEST_MC_CAS     RequestType = 7
+	REQUEST_MC_UNKNOWN   RequestType = 1
+	REQUEST_MC_GET       RequestType = 2
+	REQUEST_MC_GETS      RequestType = 3
+	REQUEST_MC_SET       RequestType = 4
+	REQUEST_MC_DELETE    RequestType = 5
+	REQUEST_MC_INCR      RequestType = 6
+	REQUEST_MC_CAS       RequestType = 7
+	REQUEST_MC_ADD       RequestType = 8
+	REQUEST_MC_REPLACE   RequestType = 9
+	REQUEST_MC_APPEND    RequestType = 10
+	REQUEST_MC_PREPEND   RequestType = 11
+	REQUEST_MC_DECR      RequestType = 12
+	REQUEST_MC_TOUCH     RequestType = 13
+	REQUEST_MC_GAT       RequestType = 14
+	REQUEST_MC_GATS      RequestType = 15
+	REQUEST_MC_VERSION   RequestType = 16
+	REQUEST_MC_STATS     RequestType = 17
+	REQUEST_MC_FLUSH_ALL RequestType = 18
+	REQUEST_MC_VERBOSITY RequestType = 19
+	// REQUEST_MC_META_GET, etc. are the mg, ms, md, ma, and mn commands of the meta protocol.
+	REQUEST_MC_META_GET        RequestType = 20
+	REQUEST_MC_META_SET        RequestType = 21
+	REQUEST_MC_META_DELETE     RequestType = 22
+	REQUEST_MC_META_ARITHMETIC RequestType = 23
+	REQUEST_MC_META_NOOP       RequestType = 24
 )
 
 type RequestType uint8
@@ -35,15 +67,30 @@ type ResponseType uint8
 // Message is the representation of a well-formed request for 1 or more keys
 type Message interface {
 	AwaitResponseBytes() ([]byte, *ResponseError)
+	// Next returns the pointer to the message after this one in the linked list of responses to send.
+	Next() *Message
+	// RecordTime returns the pointer to the time that a response queue measuring slow requests recorded the message.
+	RecordTime() *time.Time
 }
 
 var _ Message = &SingleMessage{}
 var _ Message = &FragmentedMessage{}
+var _ Message = &FanoutMessage{}
+var _ Message = &TranslatedMessage{}
 
 const END_LINE_LENGTH = 5 // END\r\n
 
 type MessageLinkedListEntry struct {
 	NextOutgoingResponse Message
+	RecordedAt           time.Time
+}
+
+func (entry *MessageLinkedListEntry) Next() *Message {
+	return &entry.NextOutgoingResponse
+}
+
+func (entry *MessageLinkedListEntry) RecordTime() *time.Time {
+	return &entry.RecordedAt
 }
 
 type SingleMessage struct {
@@ -56,6 +103,13 @@ type SingleMessage struct {
 	Key           []byte
 	ResponseType  ResponseType
 	RequestType   RequestType
+	// NoReply is true if the request ended in "noreply". The server will not send a response and the client should not receive one.
+	NoReply bool
+	// Flags and Exptime are the flags and expiration time of storage requests.
+	Flags   uint32
+	Exptime int32
+	// Release is called by ReleaseRequestData if it is set. The proxy uses this to reuse the buffers of large requests.
+	Release func()
 }
 
 // A message that affects multiple keys, possibly on different backends. Currently just memcache multigets.
@@ -65,6 +119,28 @@ type FragmentedMessage struct {
 	Fragments []SingleMessage
 }
 
+// A message that is sent to every backend, such as flush_all. The client receives a single response.
+type FanoutMessage struct {
+	MessageLinkedListEntry
+	// One request per backend
+	Fragments []SingleMessage
+	// Servers contains the name of the backend for each fragment, for error messages.
+	Servers []string
+	// ExpectedResponse is the response that every backend must send, which is then sent to the client.
+	ExpectedResponse []byte
+	// NoReply is true if the client should not receive a response.
+	NoReply bool
+}
+
+// A message that is forwarded to a server in a different format than the client sent it.
+// For example, requests from clients using the binary protocol are forwarded as text protocol requests.
+type TranslatedMessage struct {
+	SingleMessage
+	// Translate converts the response from the server into the response for the client.
+	// It returns no data if no response should be sent, e.g. for quiet binary protocol requests.
+	Translate func(m *SingleMessage) []byte
+}
+
 // type MessageCombiner func([]*SingleMessage) ([]byte, *ResponseError)
 
 // 1. A message is sent and received by the proxy, locking the mutex
@@ -87,7 +163,17 @@ func (message *SingleMessage) HandleReceiveResponse(data []byte, responseType Re
 
 func (message *SingleMessage) HandleReceiveError(err error) {
 	// fmt.Fprintf(os.Stderr, "TODO: Handle error %v\n", err)
-	message.ResponseError = RESPONSE_ERROR_UNEXPECTED_TYPE
+	if timeoutErr, ok := err.(interface{ Timeout() bool }); ok && timeoutErr.Timeout() {
+		message.ResponseError = RESPONSE_ERROR_TIMEOUT
+	} else {
+		message.ResponseError = RESPONSE_ERROR_UNEXPECTED_TYPE
+	}
+	message.Mutex.Unlock()
+}
+
+// HandleResponseError fails the request with an error generated by the proxy, without sending it to a server.
+func (message *SingleMessage) HandleResponseError(responseError *ResponseError) {
+	message.ResponseError = responseError
 	message.Mutex.Unlock()
 }
 
@@ -96,12 +182,45 @@ func (message *SingleMessage) AwaitResponseBytes() ([]byte, *ResponseError) {
 	return message.ResponseData, message.ResponseError
 }
 
+// ReleaseRequestData is called after AwaitResponseBytes returns, when the server is done with RequestData.
+func (message *SingleMessage) ReleaseRequestData() {
+	if message.Release != nil {
+		message.Release()
+		message.Release = nil
+	}
+	message.RequestData = nil
+}
+
 func (message *FragmentedMessage) AwaitResponseBytes() ([]byte, *ResponseError) {
 	// This will await all responses separately and combine them.
 	return CombineMemcacheMultiget(message.Fragments)
 }
 
-// Combine the VALUE key\r\n
+func (message *FanoutMessage) AwaitResponseBytes() ([]byte, *ResponseError) {
+	var failedServers []string
+	for i := range message.Fragments {
+		data, err := message.Fragments[i].AwaitResponseBytes()
+		if err != nil || !bytes.Equal(data, message.ExpectedResponse) {
+			failedServers = append(failedServers, message.Servers[i])
+		}
+	}
+	if len(failedServers) > 0 {
+		command := bytes.TrimRight(message.Fragments[0].RequestData, "\r\n")
+		if i := bytes.IndexByte(command, ' '); i >= 0 {
+			command = command[:i]
+		}
+		return nil, NewResponseError([]byte(fmt.Sprintf("SERVER_ERROR %s failed on %s\r\n", command, strings.Join(failedServers, ","))))
+	}
+	return message.ExpectedResponse, nil
+}
+
+func (message *TranslatedMessage) AwaitResponseBytes() ([]byte, *ResponseError) {
+	message.SingleMessage.AwaitResponseBytes()
+	return message.Translate(&message.SingleMessage), nil
+}
+
+// CombineMemcacheMultiget combines the "VALUE key flags bytes [cas]\r\n" lines and data of each fragment, followed by a single END.
+// The VALUE lines are copied unchanged, so a gets or gats keeps the cas unique that the server of each key sent.
 func CombineMemcacheMultiget(fragments []SingleMessage) ([]byte, *ResponseError) {
 	var combination []byte
 	n := len(fragments)
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"go4.org/strutil"
+)
+
+// The commands of the meta protocol of memcached 1.6. See https://github.com/memcached/memcached/wiki/MetaCommands
+var (
+	requestMetaGet        = []byte("mg")
+	requestMetaSet        = []byte("ms")
+	requestMetaDelete     = []byte("md")
+	requestMetaArithmetic = []byte("ma")
+	requestMetaNoop       = []byte("mn")
+)
+
+var metaNoopResponse = []byte("MN\r\n")
+
+// parseMetaArgs returns the key and flags of "<command> <key> <flags>*\r\n", or an error response for the client.
+// The q flag is rejected, since the proxy relies on the server responding to every request to keep responses in order.
+func parseMetaArgs(requestHeader []byte, minArgs int) ([][]byte, *message.ResponseError, error) {
+	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) < minArgs {
+		return nil, nil, errors.New("missing key for " + string(args[0]))
+	}
+	if validateKey(args[1]) != nil {
+		return args, message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT, nil
+	}
+	for _, flag := range args[minArgs:] {
+		if flag[0] == 'q' {
+			return args, message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT, nil
+		}
+	}
+	return args, nil, nil
+}
+
+// handleMeta forwards the "mg", "md", or "ma" request for a single key, e.g. "mg <key> <flags>*\r\n".
+func handleMeta(requestHeader []byte, requestType message.RequestType, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+	args, responseError, err := parseMetaArgs(requestHeader, 2)
+	if err != nil {
+		return err
+	}
+	if responseError != nil {
+		respondWithError(responses, responseError)
+		return nil
+	}
+	m := &message.SingleMessage{}
+	m.HandleSendRequest(requestHeader, args[1], requestType)
+	remote.SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
+
+// handleMetaSet forwards "ms <key> <datalen> <flags>*\r\n<data>\r\n".
+func handleMetaSet(requestHeader []byte, reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, maxItemSize int) error {
+	args, responseError, err := parseMetaArgs(requestHeader, 3)
+	if err != nil {
+		return err
+	}
+	length, err := strutil.ParseUintBytes(args[2], 10, 31)
+	if err != nil {
+		return errors.New("failed to parse datalen for ms")
+	}
+	if length > uint64(maxItemSize) {
+		return rejectTooLarge(int(length), false, reader, responses)
+	}
+	buf, err := readRequestBody(requestHeader, int(length), reader)
+	if err != nil {
+		return err
+	}
+	// The value is read before the request is rejected, so that the value is not mistaken for the next command.
+	if responseError != nil {
+		putRequestBuffer(buf)
+		respondWithError(responses, responseError)
+		return nil
+	}
+	m := &message.SingleMessage{Release: func() { putRequestBuffer(buf) }}
+	m.HandleSendRequest(*buf, args[1], message.REQUEST_MC_META_SET)
+	remote.SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestMetaCommands(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			switch {
+			case bytes.Equal(m.Key, []byte("hit")):
+				return []byte("VA 3 f0\r\nabc\r\n")
+			case bytes.Equal(m.Key, []byte("miss")):
+				return []byte("EN\r\n")
+			}
+			return []byte("HD\r\n")
+		},
+	}
+	errs := handleAllCommands("mg hit v f\r\nmg miss v\r\nms key 3 T60\r\nxyz\r\nmd key\r\nmn\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "VA 3 f0\r\nabc\r\nEN\r\nHD\r\nHD\r\nMN\r\n")
+	testutil.ExpectEquals(t, []string{"mg hit v f\r\n", "mg miss v\r\n", "ms key 3 T60\r\nxyz\r\n", "md key\r\n"}, remote.requestData(), "unexpected forwarded requests")
+}
+
+func TestMetaCommandsRejectInvalidRequests(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{}
+	// The q flag would suppress responses that the proxy relies on to keep responses in order.
+	errs := handleAllCommands("mg key v q\r\nms key 3 q\r\nxyz\r\nms key 2000000\r\n", responses, remote)
+	testutil.ExpectEquals(t, 1, len(errs), "expected the truncated oversized value to be an error")
+	awaitOutput(t, output, "CLIENT_ERROR bad command line format\r\nCLIENT_ERROR bad command line format\r\n")
+	testutil.ExpectEquals(t, []string{}, remote.requestData(), "expected nothing to be forwarded")
+}
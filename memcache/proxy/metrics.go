@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
+)
+
+// metricsHandler serves the counters of the proxy in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := stats.Global.WritePrometheus(w)
+	if err != nil {
+		getLogger().Error("Failed to write metrics", "error", err)
+	}
+}
+
+// serveHTTP starts an HTTP server at each distinct metrics_listen and health_listen address of the pools,
+// serving /metrics and/or /health depending on which settings use that address.
+func (s *Server) serveHTTP(configs map[string]config.Config) error {
+	addrs := map[string]string{}
+	muxes := map[string]*http.ServeMux{}
+	handle := func(name string, addr string, pattern string, handler http.HandlerFunc) {
+		mux, ok := muxes[addr]
+		if !ok {
+			mux = http.NewServeMux()
+			muxes[addr] = mux
+			addrs[addr] = name
+		}
+		mux.HandleFunc(pattern, handler)
+	}
+	// Iterate in a deterministic order so that a pattern is only registered once for each address.
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metricsAddrs := map[string]bool{}
+	healthAddrs := map[string]bool{}
+	for _, name := range names {
+		conf := configs[name]
+		if conf.MetricsListen != "" && !metricsAddrs[conf.MetricsListen] {
+			metricsAddrs[conf.MetricsListen] = true
+			handle(name, conf.MetricsListen, "/metrics", metricsHandler)
+		}
+		if conf.HealthListen != "" && !healthAddrs[conf.HealthListen] {
+			healthAddrs[conf.HealthListen] = true
+			handle(name, conf.HealthListen, "/health", s.healthHandler)
+		}
+	}
+	sortedAddrs := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		sortedAddrs = append(sortedAddrs, addr)
+	}
+	sort.Strings(sortedAddrs)
+
+	for _, addr := range sortedAddrs {
+		l, err := createTCPSocket(addr, "http")
+		if err != nil {
+			return &ListenError{Pool: addrs[addr], Listen: addr, Err: err}
+		}
+		s.addListener(l)
+		mux := muxes[addr]
+		go func() {
+			// This returns when Shutdown closes the listener.
+			http.Serve(l, mux)
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.MetricsListen = "127.0.0.1:0"
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "set k 0 0 1\r\nx\r\nget k\r\n")
+	reader := bufio.NewReader(c)
+	for _, expected := range []string{"STORED\r\n", "VALUE k 0 1\r\n", "x\r\n", "END\r\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		testutil.ExpectStringEquals(t, expected, line, "unexpected response")
+	}
+
+	var metricsAddr string
+	deadline := time.Now().Add(time.Second)
+	for metricsAddr == "" && time.Now().Before(deadline) {
+		s.m.Lock()
+		// The metrics listener is created after the listeners of the pools.
+		if len(s.listeners) > 1 {
+			metricsAddr = s.listeners[1].Addr().String()
+		}
+		s.m.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	if metricsAddr == "" {
+		t.Fatalf("metrics server did not start listening")
+	}
+	response, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	metrics := string(body)
+	for _, expected := range []string{
+		"# TYPE golemproxy_connections_current gauge\n",
+		"# TYPE golemproxy_requests_total counter\n",
+		"golemproxy_requests_total{command=\"get\"} ",
+		"golemproxy_requests_total{command=\"set\"} ",
+		"# TYPE golemproxy_get_keys_total counter\n",
+		"golemproxy_get_keys_total{result=\"hit\"} ",
+		"golemproxy_get_keys_total{result=\"miss\"} ",
+		"# TYPE golemproxy_backend_request_duration_seconds histogram\n",
+		"golemproxy_backend_request_duration_seconds_bucket{server=\"" + backend.addr() + "\",le=\"+Inf\"} ",
+		"golemproxy_backend_request_duration_seconds_count{server=\"" + backend.addr() + "\"} ",
+		"golemproxy_backend_errors_total{server=\"" + backend.addr() + "\"} 0\n",
+		"# TYPE golemproxy_backend_ejections_total counter\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected the metrics to contain %q, got:\n%s", expected, metrics)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// pipelinedRequest is a request of TestPipelinedResponseOrder and the response lines it expects.
+type pipelinedRequest struct {
+	request string
+	// expected is the lines of the response. The cas unique of VALUE lines is not compared for gets.
+	expected []string
+	isGets   bool
+}
+
+// generatePipelinedRequests returns count random get, gets, multiget, set, and delete requests for a few keys,
+// with the responses of a memcache server that processes them in order.
+// Each set stores a value containing the index of the request, so that a response for the wrong request can be detected.
+func generatePipelinedRequests(rng *rand.Rand, count int) []pipelinedRequest {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	values := make(map[string]string)
+	valueLines := func(key string) []string {
+		value, ok := values[key]
+		if !ok {
+			return nil
+		}
+		return []string{fmt.Sprintf("VALUE %s 0 %d", key, len(value)), value}
+	}
+	requests := make([]pipelinedRequest, 0, count)
+	for i := 0; i < count; i++ {
+		key := keys[rng.Intn(len(keys))]
+		switch rng.Intn(5) {
+		case 0:
+			value := fmt.Sprintf("value%d", i)
+			values[key] = value
+			requests = append(requests, pipelinedRequest{
+				request:  fmt.Sprintf("set %s 0 0 %d\r\n%s\r\n", key, len(value), value),
+				expected: []string{"STORED"},
+			})
+		case 1:
+			requests = append(requests, pipelinedRequest{
+				request:  "get " + key + "\r\n",
+				expected: append(valueLines(key), "END"),
+			})
+		case 2:
+			requests = append(requests, pipelinedRequest{
+				request:  "gets " + key + "\r\n",
+				expected: append(valueLines(key), "END"),
+				isGets:   true,
+			})
+		case 3:
+			response := "NOT_FOUND"
+			if _, ok := values[key]; ok {
+				response = "DELETED"
+				delete(values, key)
+			}
+			requests = append(requests, pipelinedRequest{
+				request:  "delete " + key + "\r\n",
+				expected: []string{response},
+			})
+		case 4:
+			multigetKeys := []string{key}
+			for n := rng.Intn(4); n > 0; n-- {
+				multigetKeys = append(multigetKeys, keys[rng.Intn(len(keys))])
+			}
+			var expected []string
+			for _, multigetKey := range multigetKeys {
+				expected = append(expected, valueLines(multigetKey)...)
+			}
+			requests = append(requests, pipelinedRequest{
+				request:  "get " + strings.Join(multigetKeys, " ") + "\r\n",
+				expected: append(expected, "END"),
+			})
+		}
+	}
+	return requests
+}
+
+func TestPipelinedResponseOrder(t *testing.T) {
+	var backends []*fakeBackend
+	for i := 0; i < 3; i++ {
+		backend := newFakeBackend(t, newStoreHandler())
+		defer backend.close()
+		backends = append(backends, backend)
+	}
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backends...)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	for seed := int64(1); seed <= 5; seed++ {
+		requests := generatePipelinedRequests(rand.New(rand.NewSource(seed)), 500)
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		// Every request is written before any response is read.
+		go func() {
+			var input strings.Builder
+			for _, request := range requests {
+				input.WriteString(request.request)
+			}
+			io.WriteString(c, input.String())
+		}()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(c)
+		for i, request := range requests {
+			for _, expected := range request.expected {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("seed %d: failed to read the response to request %d %q: %v", seed, i, request.request, err)
+				}
+				line = strings.TrimSuffix(line, "\r\n")
+				if request.isGets && strings.HasPrefix(line, "VALUE ") {
+					line = line[:strings.LastIndexByte(line, ' ')]
+				}
+				testutil.ExpectStringEquals(t, expected, line, fmt.Sprintf("seed %d: unexpected response to request %d %q", seed, i, request.request))
+			}
+		}
+		c.Close()
+		// Each seed starts with empty backends.
+		for _, backend := range backends {
+			backend.handle("flush_all\r\n", nil, ioutil.Discard)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+)
+
+// connectionRateLimiter is a token bucket for the connections accepted by a listener.
+// It is only used by the goroutine accepting connections, so it isn't locked.
+type connectionRateLimiter struct {
+	// rate is the number of tokens added per second, and burst is the most tokens the bucket can hold.
+	rate  float64
+	burst float64
+	// tokens is the number of tokens at last, which is negative while connections are waiting for tokens.
+	tokens float64
+	last   time.Time
+}
+
+// newConnectionRateLimiter returns the rate limiter for connections to a listener of the pool, or nil if there is no limit.
+func newConnectionRateLimiter(conf config.Config) *connectionRateLimiter {
+	if conf.MaxConnectionsPerSecond == 0 {
+		return nil
+	}
+	burst := conf.ConnectionBurst
+	if burst == 0 {
+		burst = conf.MaxConnectionsPerSecond
+	}
+	return &connectionRateLimiter{
+		rate:   float64(conf.MaxConnectionsPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token for a connection accepted at now, and returns how long the connection must wait for the token.
+func (l *connectionRateLimiter) reserve(now time.Time) time.Duration {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
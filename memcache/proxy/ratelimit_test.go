@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestConnectionRateLimiter(t *testing.T) {
+	l := newConnectionRateLimiter(config.Config{MaxConnectionsPerSecond: 10, ConnectionBurst: 2})
+	now := l.last
+	testutil.ExpectEquals(t, time.Duration(0), l.reserve(now), "expected the burst to be served immediately")
+	testutil.ExpectEquals(t, time.Duration(0), l.reserve(now), "expected the burst to be served immediately")
+	testutil.ExpectEquals(t, 100*time.Millisecond, l.reserve(now), "expected a connection beyond the burst to wait for a token")
+	testutil.ExpectEquals(t, 200*time.Millisecond, l.reserve(now), "expected connections to wait for tokens in order")
+	// The bucket refills at the rate, up to the burst.
+	testutil.ExpectEquals(t, time.Duration(0), l.reserve(now.Add(time.Second)), "expected tokens to be added over time")
+	testutil.ExpectEquals(t, time.Duration(0), l.reserve(now.Add(time.Second)), "expected tokens to be added over time")
+	testutil.ExpectEquals(t, 100*time.Millisecond, l.reserve(now.Add(time.Second)), "expected the bucket to hold at most the burst")
+
+	testutil.ExpectEquals(t, (*connectionRateLimiter)(nil), newConnectionRateLimiter(config.Config{}), "expected no limit by default")
+}
+
+// getVersionFrom returns the response of the proxy to the version command on the connection c.
+func getVersionFrom(t *testing.T, c net.Conn) string {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(c, "version\r\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	return line
+}
+
+func TestMaxConnectionsPerSecond(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.MaxConnectionsPerSecond = 20
+	conf.ConnectionBurst = 2
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	before := Stats()
+	start := time.Now()
+	conns := make([]net.Conn, 6)
+	for i := range conns {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+	// Every connection is served, but the connections beyond the burst wait for tokens.
+	for _, c := range conns {
+		testutil.ExpectStringEquals(t, string(versionResponse), getVersionFrom(t, c), "expected every connection to be served")
+	}
+	throttled := Stats().ThrottledConnections - before.ThrottledConnections
+	testutil.ExpectEquals(t, true, throttled >= 2, "expected connections opened faster than the limit to be throttled")
+	testutil.ExpectEquals(t, true, time.Since(start) >= 100*time.Millisecond, "expected the throttled connections to be served at the limited rate")
+}
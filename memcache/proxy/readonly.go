@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// wrappedClient is implemented by clients that modify requests before forwarding them to the memcache servers of another client.
+type wrappedClient interface {
+	unwrap() memcache.ClientInterface
+}
+
+// readOnlyClient rejects write requests with RESPONSE_ERROR_WRITE_NOT_ALLOWED instead of forwarding them to the wrapped client.
+type readOnlyClient struct {
+	memcache.ClientInterface
+}
+
+var _ memcache.ClientInterface = &readOnlyClient{}
+
+func (c *readOnlyClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *readOnlyClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *readOnlyClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	if isWriteRequest(m.RequestType) {
+		m.HandleResponseError(message.RESPONSE_ERROR_WRITE_NOT_ALLOWED)
+		return
+	}
+	c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+}
+
+// isReadOnly returns true if write requests to remote are rejected.
+func isReadOnly(remote memcache.ClientInterface) bool {
+	for {
+		if _, ok := remote.(*readOnlyClient); ok {
+			return true
+		}
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			return false
+		}
+		remote = wrapper.unwrap()
+	}
+}
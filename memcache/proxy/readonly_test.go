@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestReadOnlyRejectsWrites(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	backend := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("VALUE k 0 1\r\nx\r\nEND\r\n")
+		},
+	}
+	remote := &readOnlyClient{ClientInterface: backend}
+	errs := handleAllCommands("set k 0 0 1\r\nx\r\nget k\r\ndelete k\r\nincr k 1\r\nset k 0 0 1 noreply\r\ny\r\nflush_all\r\ngets k\r\nversion\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	rejected := "CLIENT_ERROR write commands not allowed\r\n"
+	awaitOutput(t, output, rejected+"VALUE k 0 1\r\nx\r\nEND\r\n"+rejected+rejected+rejected+"VALUE k 0 1\r\nx\r\nEND\r\nVERSION golemproxy-"+VERSION+"\r\n")
+	testutil.ExpectEquals(t, []string{"get k\r\n", "gets k\r\n"}, backend.requestData(), "expected only reads to be forwarded")
+}
+
+func TestServersOfUnwrapsClients(t *testing.T) {
+	backend := &fakeRemote{}
+	remote := &readOnlyClient{ClientInterface: &ttlOverrideClient{ClientInterface: backend, ttl: 60}}
+	testutil.ExpectEquals(t, []memcache.ClientInterface{backend}, serversOf(remote), "expected the servers of the wrapped client")
+}
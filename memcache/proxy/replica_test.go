@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// recordingBackend is a fakeBackend that records the request lines it receives.
+type recordingBackend struct {
+	*fakeBackend
+	m     sync.Mutex
+	lines []string
+}
+
+func newRecordingBackend(t *testing.T, handle func(line string, reader *bufio.Reader, writer io.Writer)) *recordingBackend {
+	b := &recordingBackend{}
+	b.fakeBackend = newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		b.m.Lock()
+		b.lines = append(b.lines, line)
+		b.m.Unlock()
+		handle(line, reader, writer)
+	})
+	return b
+}
+
+func (b *recordingBackend) received() []string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return append([]string{}, b.lines...)
+}
+
+func TestReplicas(t *testing.T) {
+	primary := newRecordingBackend(t, newStoreHandler())
+	defer primary.close()
+	replicaHandler := func(line string, reader *bufio.Reader, writer io.Writer) {
+		io.WriteString(writer, "VALUE k 0 7\r\nreplica\r\nEND\r\n")
+	}
+	replicas := []*recordingBackend{newRecordingBackend(t, replicaHandler), newRecordingBackend(t, replicaHandler)}
+	for _, replica := range replicas {
+		defer replica.close()
+	}
+	conf := newTestPoolConfig(t, primary.fakeBackend)
+	conf.Replicas = map[string][]config.TCPServer{
+		primary.addr(): {tcpServerOf(t, replicas[0].fakeBackend), tcpServerOf(t, replicas[1].fakeBackend)},
+	}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(c)
+	io.WriteString(c, "set k 0 0 7\r\nprimary\r\n")
+	line, err := reader.ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, "STORED\r\n", line, "unexpected response to set")
+	for i := 0; i < 20; i++ {
+		io.WriteString(c, "get k\r\n")
+		for _, expected := range []string{"VALUE k 0 7\r\n", "replica\r\n", "END\r\n"} {
+			line, err := reader.ReadString('\n')
+			testutil.ExpectEquals(t, nil, err, "unexpected error")
+			testutil.ExpectStringEquals(t, expected, line, "expected get to be sent to a replica")
+		}
+	}
+
+	testutil.ExpectEquals(t, []string{"set k 0 0 7\r\n"}, primary.received(), "expected only the set to be sent to the primary")
+	gets := len(replicas[0].received()) + len(replicas[1].received())
+	testutil.ExpectEquals(t, 20, gets, "expected every get to be sent to a replica")
+	testutil.ExpectEquals(t, true, len(replicas[0].received()) > 0 && len(replicas[1].received()) > 0, "expected gets to be spread across the replicas")
+}
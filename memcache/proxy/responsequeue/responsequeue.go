@@ -2,29 +2,75 @@
 package responsequeue
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
+)
+
+// BackendErrorMode is how ERROR and SERVER_ERROR responses from memcache servers are sent to the client.
+type BackendErrorMode uint8
+
+const (
+	// BACKEND_ERRORS_RELAY sends errors from servers to the client unchanged.
+	BACKEND_ERRORS_RELAY BackendErrorMode = iota
+	// BACKEND_ERRORS_PREFIX sends "SERVER_ERROR backend: <message>", so that clients can tell that the server failed rather than the proxy.
+	BACKEND_ERRORS_PREFIX
+	// BACKEND_ERRORS_GENERIC sends "SERVER_ERROR backend error", hiding the details of the error from the client.
+	BACKEND_ERRORS_GENERIC
+)
+
+var (
+	serverErrorPrefix         = []byte("SERVER_ERROR ")
+	backendServerErrorPrefix  = []byte("SERVER_ERROR backend: ")
+	genericBackendErrorString = []byte("SERVER_ERROR backend error\r\n")
 )
 
 type ResponseQueue struct {
 	m      sync.Mutex
 	writer io.Writer
-	head   message.Message
-	tail   message.Message
-	notify chan bool
+	// buffered combines responses into fewer writes to writer, or is nil if each response is written separately.
+	buffered *bufio.Writer
+	// inputDrained is set when the client has no more unread requests, and cleared when the buffered responses are flushed.
+	inputDrained bool
+	// backendErrors is how errors from servers are sent to the client.
+	backendErrors BackendErrorMode
+	// slowThreshold is the time after which onSlow is called for a request that has not received a response, or 0.
+	slowThreshold time.Duration
+	onSlow        func(m message.Message, elapsed time.Duration)
+	// onResponse is called with the response to every request, or nil.
+	onResponse func(m message.Message, response []byte, elapsed time.Duration)
+	head       message.Message
+	tail       message.Message
+	notify     chan bool
+	// done is closed after the queue is closed and the remaining responses are written
+	done chan struct{}
 }
 
+// queuePool holds the queues of closed connections. This reduces allocations when clients connect and disconnect frequently.
+var queuePool = sync.Pool{
+	New: func() interface{} {
+		return &ResponseQueue{}
+	},
+}
+
+// writeBufferPools holds the write buffers of closed connections, keyed by their size.
+var writeBufferPools sync.Map
+
 func CreateResponseQueue(writer io.Writer) *ResponseQueue {
-	queue := ResponseQueue{}
+	queue := queuePool.Get().(*ResponseQueue)
 	queue.writer = writer
 	// Make a channel of size 1
 	queue.notify = make(chan bool, 1)
+	queue.done = make(chan struct{})
 	go queue.run()
-	return &queue
+	return queue
 }
 
 func (queue *ResponseQueue) run() {
@@ -36,27 +82,182 @@ func (queue *ResponseQueue) run() {
 		}
 		head := queue.extractEvents()
 		err := queue.processEvents(head)
+		if err == nil && queue.buffered != nil && queue.shouldFlush() {
+			err = queue.buffered.Flush()
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Response writer got unexpected error")
 		}
 	}
+	if queue.buffered != nil {
+		queue.buffered.Flush()
+	}
 	if closer, ok := queue.writer.(io.Closer); ok {
-		fmt.Fprintf(os.Stderr, "Shutting down response writer")
 		closer.Close()
 	}
+	close(queue.done)
+}
+
+// SetBackendErrorMode changes how errors from servers are sent to the client. This must be called before recording requests.
+func (queue *ResponseQueue) SetBackendErrorMode(mode BackendErrorMode) {
+	queue.backendErrors = mode
+}
+
+// SetSlowRequestHandler makes the queue call onSlow for requests that took longer than threshold to get a response,
+// measured from when the request was recorded to when its response is ready to send. This must be called before recording requests.
+func (queue *ResponseQueue) SetSlowRequestHandler(threshold time.Duration, onSlow func(m message.Message, elapsed time.Duration)) {
+	queue.slowThreshold = threshold
+	queue.onSlow = onSlow
+}
+
+// SetResponseHandler makes the queue call onResponse with the response that is sent to the client for every request,
+// and the time from when the request was recorded to when its response was ready to send.
+// The response is nil if the client asked not to receive one. This must be called before recording requests.
+func (queue *ResponseQueue) SetResponseHandler(onResponse func(m message.Message, response []byte, elapsed time.Duration)) {
+	queue.onResponse = onResponse
+}
+
+// SetWriteBuffer makes the queue combine responses into writes of up to size bytes.
+// The buffered responses are written when the buffer is full, or when every request recorded before the last call to InputDrained has been answered.
+// This must be called before recording requests.
+func (queue *ResponseQueue) SetWriteBuffer(size int) {
+	if pool, ok := writeBufferPools.Load(size); ok {
+		if buffered, ok := pool.(*sync.Pool).Get().(*bufio.Writer); ok {
+			buffered.Reset(queue.writer)
+			queue.buffered = buffered
+			return
+		}
+	}
+	queue.buffered = bufio.NewWriterSize(queue.writer, size)
+}
+
+// InputDrained tells the queue that the client has no more unread requests, e.g. because the goroutine reading them is about to block.
+// It is called only by the goroutine that accepts messages from a client of the proxy, and must not be called after Close.
+func (queue *ResponseQueue) InputDrained() {
+	if queue.buffered == nil {
+		return
+	}
+	queue.m.Lock()
+	queue.inputDrained = true
+	queue.m.Unlock()
+	// Wake up the writer goroutine in case it is already waiting for more requests.
+	select {
+	case queue.notify <- true:
+	default:
+	}
 }
 
+// shouldFlush returns true if the buffered responses should be written because the client is waiting for them.
+func (queue *ResponseQueue) shouldFlush() bool {
+	queue.m.Lock()
+	defer queue.m.Unlock()
+	if !queue.inputDrained || queue.head != nil {
+		return false
+	}
+	queue.inputDrained = false
+	return true
+}
+
+// isTimed returns true if the queue needs to know when requests were recorded.
+func (queue *ResponseQueue) isTimed() bool {
+	return queue.slowThreshold > 0 || queue.onResponse != nil
+}
+
+// translateBackendError returns the response to send to the client for an ERROR or SERVER_ERROR response from a server.
+func translateBackendError(data []byte, mode BackendErrorMode) []byte {
+	switch mode {
+	case BACKEND_ERRORS_PREFIX:
+		details := bytes.TrimPrefix(data, serverErrorPrefix)
+		if bytes.Equal(data, []byte("ERROR\r\n")) {
+			// The server did not recognize the command
+			details = []byte("ERROR\r\n")
+		}
+		return append(append([]byte(nil), backendServerErrorPrefix...), details...)
+	case BACKEND_ERRORS_GENERIC:
+		return genericBackendErrorString
+	}
+	return data
+}
+
+// Close stops the queue after the responses to the requests that were already recorded are written.
+// The writer is then closed if it is an io.Closer.
 func (queue *ResponseQueue) Close() {
 	close(queue.notify)
 }
 
-func getLinkedListNext(m message.Message) *message.Message {
-	// Can probably optimize with unsafe?
-	if single, ok := m.(*message.SingleMessage); ok {
-		return &single.NextOutgoingResponse
+// Wait blocks until the queue is closed and the remaining responses are written.
+func (queue *ResponseQueue) Wait() {
+	<-queue.done
+}
+
+// Release returns the queue to be reused by CreateResponseQueue.
+// This must only be called after Wait returns, when every response was written and the queue no longer refers to any message.
+// The queue must not be used after it is released.
+func (queue *ResponseQueue) Release() {
+	if buffered := queue.buffered; buffered != nil {
+		buffered.Reset(nil)
+		pool, ok := writeBufferPools.Load(buffered.Size())
+		if !ok {
+			pool, _ = writeBufferPools.LoadOrStore(buffered.Size(), &sync.Pool{})
+		}
+		pool.(*sync.Pool).Put(buffered)
+	}
+	*queue = ResponseQueue{}
+	queuePool.Put(queue)
+}
+
+// isNoReply returns true if the client asked not to receive a response to the request.
+func isNoReply(m message.Message) bool {
+	switch m := m.(type) {
+	case *message.SingleMessage:
+		return m.NoReply
+	case *message.TranslatedMessage:
+		return m.NoReply
+	case *message.FanoutMessage:
+		return m.NoReply
+	}
+	return false
+}
+
+// requestTypeOf returns the type of the client's request. Error responses generated by the proxy have no request type.
+func requestTypeOf(m message.Message) message.RequestType {
+	switch m := m.(type) {
+	case *message.SingleMessage:
+		return m.RequestType
+	case *message.TranslatedMessage:
+		return m.RequestType
+	case *message.FanoutMessage:
+		return m.Fragments[0].RequestType
+	}
+	return m.(*message.FragmentedMessage).Fragments[0].RequestType
+}
+
+// recordGetResults counts whether each key of a successful get or gets request was a hit, i.e. the response was VALUE rather than END.
+func recordGetResults(m message.Message) {
+	switch m := m.(type) {
+	case *message.SingleMessage:
+		recordGetResult(m)
+	case *message.TranslatedMessage:
+		recordGetResult(&m.SingleMessage)
+	case *message.FragmentedMessage:
+		for i := range m.Fragments {
+			recordGetResult(&m.Fragments[i])
+		}
+	}
+}
+
+func recordGetResult(m *message.SingleMessage) {
+	switch m.RequestType {
+	case message.REQUEST_MC_GET, message.REQUEST_MC_GETS:
+	default:
+		return
+	}
+	switch m.ResponseType {
+	case message.RESPONSE_MC_VALUE:
+		stats.Global.RecordGet(true)
+	case message.RESPONSE_MC_END:
+		stats.Global.RecordGet(false)
 	}
-	multi := m.(*message.FragmentedMessage)
-	return &multi.NextOutgoingResponse
 }
 
 func (queue *ResponseQueue) extractEvents() message.Message {
@@ -77,31 +278,82 @@ func (queue *ResponseQueue) processEvents(response message.Message) error {
 	for response != nil {
 		// TODO: Non-blocking check if the response was sent, so that messages can be combined for clients that pipeline?
 		data, err := response.AwaitResponseBytes()
-		if err != nil {
-			data = err.ErrorBytes
+		if queue.slowThreshold > 0 {
+			if elapsed := time.Since(*response.RecordTime()); elapsed > queue.slowThreshold {
+				queue.onSlow(response, elapsed)
+			}
 		}
-		if len(data) == 0 {
-			panic("Expected response data")
+		writeErr := queue.writeResponse(response, data, err)
+		if single, ok := response.(*message.SingleMessage); ok {
+			// The response was received, so the request was already sent.
+			single.ReleaseRequestData()
 		}
-		_, writeErr := queue.writer.Write(data)
 		if writeErr != nil {
 			return writeErr
 		}
-		response = *getLinkedListNext(response)
+		response = *response.Next()
 	}
 	return nil
 }
 
+// writeResponse sends the response to a request to the client, unless the client asked not to receive it.
+func (queue *ResponseQueue) writeResponse(response message.Message, data []byte, err *message.ResponseError) error {
+	if isNoReply(response) {
+		// The client asked not to receive a response to this request, even if there was an error.
+		if err != nil {
+			stats.Global.RecordError(err)
+		}
+		if queue.onResponse != nil {
+			queue.onResponse(response, nil, time.Since(*response.RecordTime()))
+		}
+		return nil
+	}
+	if err != nil {
+		stats.Global.RecordError(err)
+		data = err.ErrorBytes
+	} else {
+		recordGetResults(response)
+	}
+	if single, ok := response.(*message.SingleMessage); ok && err == nil {
+		switch single.ResponseType {
+		case message.RESPONSE_MC_ERROR, message.RESPONSE_MC_SERVER_ERROR:
+			data = translateBackendError(data, queue.backendErrors)
+		}
+	}
+	if queue.onResponse != nil {
+		queue.onResponse(response, data, time.Since(*response.RecordTime()))
+	}
+	if len(data) == 0 {
+		if _, ok := response.(*message.TranslatedMessage); ok {
+			// e.g. a quiet binary protocol get that missed
+			return nil
+		}
+		panic("Expected response data")
+	}
+	writer := queue.writer
+	if queue.buffered != nil {
+		writer = queue.buffered
+	}
+	n, writeErr := writer.Write(data)
+	stats.Global.AddBytesWritten(n)
+	return writeErr
+}
+
 // RecordOutgoingRequest tracks an outgoing request so that responses to pipelined requests caan be sent in order.
 // It is called only by the goroutine that accepts messages from a client of the proxy
+// The response to a message with NoReply set is awaited but not written to the client.
 func (queue *ResponseQueue) RecordOutgoingRequest(message message.Message) {
-	// Precondition: A reply from the server is expected for the given message
+	// Precondition: The message will eventually be completed with a response or an error
+	stats.Global.RecordCommand(requestTypeOf(message))
+	if queue.isTimed() {
+		*message.RecordTime() = time.Now()
+	}
 
 	// A channel is not used to avoid blocking the goroutine that handles communication with remote servers, if writing to the requestor blocks.
 	// A slow client of the proxy should not block fast clients of the proxy
 	queue.m.Lock()
 	if queue.tail != nil {
-		*getLinkedListNext(queue.tail) = message
+		*queue.tail.Next() = message
 		queue.tail = message
 	} else {
 		queue.tail = message
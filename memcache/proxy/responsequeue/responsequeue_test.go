@@ -3,8 +3,12 @@ package responsequeue
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
 	"github.com/TysonAndre/golemproxy/testutil"
@@ -79,3 +83,127 @@ func TestResponseQueueHandleMessageCombine(t *testing.T) {
 	}
 	testutil.ExpectEquals(t, expected, actual, "should receive response")
 }
+
+func TestResponseQueueCloseWritesPendingResponses(t *testing.T) {
+	mockWriter := &bytes.Buffer{}
+	queue := CreateResponseQueue(mockWriter)
+	m := message.SingleMessage{}
+	m.HandleSendRequest([]byte("get key\r\n"), []byte("key"), message.REQUEST_MC_GET)
+	queue.RecordOutgoingRequest(&m)
+	queue.Close()
+	go m.HandleReceiveResponse([]byte("END\r\n"), message.RESPONSE_MC_END)
+	queue.Wait()
+	testutil.ExpectEquals(t, []byte("END\r\n"), mockWriter.Bytes(), "should write the pending response before closing")
+}
+
+func TestTranslateBackendError(t *testing.T) {
+	serverError := []byte("SERVER_ERROR out of memory\r\n")
+	testutil.ExpectStringEquals(t, string(serverError), string(translateBackendError(serverError, BACKEND_ERRORS_RELAY)), "unexpected relayed error")
+	testutil.ExpectStringEquals(t, "SERVER_ERROR backend: out of memory\r\n", string(translateBackendError(serverError, BACKEND_ERRORS_PREFIX)), "unexpected prefixed error")
+	testutil.ExpectStringEquals(t, "SERVER_ERROR backend: ERROR\r\n", string(translateBackendError([]byte("ERROR\r\n"), BACKEND_ERRORS_PREFIX)), "unexpected prefixed error")
+	testutil.ExpectStringEquals(t, "SERVER_ERROR backend error\r\n", string(translateBackendError(serverError, BACKEND_ERRORS_GENERIC)), "unexpected generic error")
+	testutil.ExpectStringEquals(t, "SERVER_ERROR out of memory\r\n", string(serverError), "the original response should not be modified")
+}
+
+func TestResponseQueueRelease(t *testing.T) {
+	first := &bytes.Buffer{}
+	queue := CreateResponseQueue(first)
+	queue.SetBackendErrorMode(BACKEND_ERRORS_GENERIC)
+	m := &message.SingleMessage{}
+	m.HandleSendRequest([]byte("get key\r\n"), []byte("key"), message.REQUEST_MC_GET)
+	queue.RecordOutgoingRequest(m)
+	m.HandleReceiveResponse([]byte("SERVER_ERROR out of memory\r\n"), message.RESPONSE_MC_SERVER_ERROR)
+	queue.Close()
+	queue.Wait()
+	queue.Release()
+	testutil.ExpectStringEquals(t, "SERVER_ERROR backend error\r\n", first.String(), "unexpected response")
+
+	// A queue reused from the pool must not keep the settings or responses of the previous connection.
+	second := &bytes.Buffer{}
+	queue = CreateResponseQueue(second)
+	m = &message.SingleMessage{}
+	m.HandleSendRequest([]byte("get key\r\n"), []byte("key"), message.REQUEST_MC_GET)
+	queue.RecordOutgoingRequest(m)
+	m.HandleReceiveResponse([]byte("SERVER_ERROR out of memory\r\n"), message.RESPONSE_MC_SERVER_ERROR)
+	queue.Close()
+	queue.Wait()
+	queue.Release()
+	testutil.ExpectStringEquals(t, "SERVER_ERROR out of memory\r\n", second.String(), "unexpected response")
+}
+
+// countingWriter counts the calls to Write, which would each be a write syscall for a client connection.
+type countingWriter struct {
+	m      sync.Mutex
+	writer io.Writer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.writes++
+	return w.writer.Write(p)
+}
+
+func TestResponseQueueWriteBuffer(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := &countingWriter{writer: output}
+	queue := CreateResponseQueue(writer)
+	queue.SetWriteBuffer(4096)
+	for i := 0; i < 3; i++ {
+		m := &message.SingleMessage{}
+		m.HandleSendRequest([]byte("get key\r\n"), []byte("key"), message.REQUEST_MC_GET)
+		queue.RecordOutgoingRequest(m)
+		m.HandleReceiveResponse([]byte("END\r\n"), message.RESPONSE_MC_END)
+	}
+	// The responses are only written once the client has no more requests.
+	queue.InputDrained()
+	for {
+		writer.m.Lock()
+		writes := writer.writes
+		writer.m.Unlock()
+		if writes > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writer.m.Lock()
+	testutil.ExpectEquals(t, 1, writer.writes, "expected the responses to be combined into one write")
+	testutil.ExpectStringEquals(t, "END\r\nEND\r\nEND\r\n", output.String(), "unexpected responses")
+	writer.m.Unlock()
+	queue.Close()
+	queue.Wait()
+}
+
+func benchmarkPipelinedGets(b *testing.B, writeBufferSize int) {
+	writer := &countingWriter{writer: ioutil.Discard}
+	response := []byte("VALUE key 0 4\r\nabcd\r\nEND\r\n")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		queue := CreateResponseQueue(writer)
+		if writeBufferSize > 0 {
+			queue.SetWriteBuffer(writeBufferSize)
+		}
+		for j := 0; j < 100; j++ {
+			m := &message.SingleMessage{}
+			m.HandleSendRequest([]byte("get key\r\n"), []byte("key"), message.REQUEST_MC_GET)
+			queue.RecordOutgoingRequest(m)
+			m.HandleReceiveResponse(response, message.RESPONSE_MC_END)
+		}
+		queue.InputDrained()
+		queue.Close()
+		queue.Wait()
+		queue.Release()
+	}
+	b.StopTimer()
+	b.Logf("%d pipelines of 100 gets were sent in %d writes", b.N, writer.writes)
+}
+
+func BenchmarkPipelinedGetsUnbuffered(b *testing.B) {
+	benchmarkPipelinedGets(b, 0)
+}
+
+// BenchmarkPipelinedGetsWriteBuffer should log fewer writes per pipeline than BenchmarkPipelinedGetsUnbuffered.
+func BenchmarkPipelinedGetsWriteBuffer(b *testing.B) {
+	benchmarkPipelinedGets(b, 16384)
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// createReusePortTCPSocket listens on a tcp address with SO_REUSEPORT, so that another golemproxy process can listen on the same address.
+// The kernel distributes new connections between the processes listening on the address.
+func createReusePortTCPSocket(path string, serverType string) (net.Listener, error) {
+	getLogger().Info("Listening for requests", "server", serverType, "tcp", path, "reuse_port", true)
+	lc := net.ListenConfig{Control: setReusePort}
+	return lc.Listen(context.Background(), "tcp", path)
+}
+
+func setReusePort(network string, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
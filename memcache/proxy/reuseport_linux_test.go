@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestReusePort(t *testing.T) {
+	first, err := createReusePortTCPSocket("127.0.0.1:0", "memcache")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer first.Close()
+	addr := first.Addr().String()
+	second, err := createReusePortTCPSocket(addr, "memcache")
+	if err != nil {
+		t.Fatalf("expected a second listener with SO_REUSEPORT to share %s: %v", addr, err)
+	}
+	defer second.Close()
+	if l, err := net.Listen("tcp", addr); err == nil {
+		l.Close()
+		t.Errorf("expected a listener without SO_REUSEPORT to fail to listen on %s", addr)
+	}
+
+	// The kernel distributes connections between both listeners.
+	accepted := make(chan int, 200)
+	for i, l := range []net.Listener{first, second} {
+		go func(i int, l net.Listener) {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+				accepted <- i
+			}
+		}(i, l)
+	}
+	counts := make([]int, 2)
+	for i := 0; i < 200 && (counts[0] == 0 || counts[1] == 0); i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		c.Close()
+		counts[<-accepted]++
+	}
+	testutil.ExpectEquals(t, true, counts[0] > 0 && counts[1] > 0, "expected both listeners to accept connections")
+}
+
+// getVersion returns the response of the proxy at addr to the version command.
+func getVersion(t *testing.T, addr string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	return getVersionFrom(t, c)
+}
+
+func TestReusePortServers(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.ReusePort = true
+	old := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, old)
+	defer old.Shutdown(context.Background())
+
+	// A new process can start listening on the same address before the old one shuts down.
+	conf.Listen = []string{addr}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+	old.Shutdown(context.Background())
+	for i := 0; i < 10; i++ {
+		testutil.ExpectStringEquals(t, string(versionResponse), getVersion(t, addr), "expected the new server to accept every connection")
+	}
+}
+
+func TestInheritedListeners(t *testing.T) {
+	parent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := parent.Addr().String()
+	f, err := parent.(*net.TCPListener).File()
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	// Connections made before the new server starts wait in the backlog of the inherited socket.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	parent.Close()
+
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	unusedFile, err := unused.(*net.TCPListener).File()
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	unused.Close()
+	inherited, err := listenersFromFiles([]*os.File{f, unusedFile})
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.Listen = []string{addr}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	s.inherited = inherited
+	serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+	testutil.ExpectEquals(t, addr, s.BoundAddrs()["main"].String(), "expected the inherited socket to be used")
+	testutil.ExpectEquals(t, 0, len(s.inherited), "expected the unused inherited socket to be closed")
+
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "version\r\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, string(versionResponse), line, "unexpected response from the inherited socket")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// createReusePortTCPSocket fails, since reuse_port is only supported on Linux.
+func createReusePortTCPSocket(path string, serverType string) (net.Listener, error) {
+	return nil, errors.New("reuse_port is only supported on Linux")
+}
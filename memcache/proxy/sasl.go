@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+)
+
+// SASL_MECHANISM_PLAIN is the only SASL mechanism that golemproxy supports. See RFC 4616.
+const SASL_MECHANISM_PLAIN = "PLAIN"
+
+var errAuthenticationRequired = errors.New("text protocol clients can't authenticate")
+
+// parsePlainCredentials returns the user and password from the SASL PLAIN message "[authzid] NUL authcid NUL passwd".
+func parsePlainCredentials(data []byte) (string, string, bool) {
+	parts := bytes.Split(data, []byte{0})
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	return string(parts[1]), string(parts[2]), true
+}
+
+// newBinarySASLHandler returns a handler for the requests of one binary protocol connection,
+// which must authenticate as one of the users in auth with SASL PLAIN before sending commands other than version, noop, and quit.
+// Values longer than maxItemSize are rejected.
+func newBinarySASLHandler(auth *config.AuthConfig, maxItemSize int) func(*bufio.Reader, *responsequeue.ResponseQueue, memcache.ClientInterface) error {
+	authenticated := false
+	return func(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+		header, body, err := readBinaryRequest(reader, maxItemSize)
+		if err != nil {
+			return err
+		}
+		switch header.opcode {
+		case BINARY_OPCODE_SASL_LIST_MECHS:
+			respondLocally(responses, 0, encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, []byte(SASL_MECHANISM_PLAIN)))
+			return nil
+		case BINARY_OPCODE_SASL_AUTH:
+			mechanism := body[header.extrasLen : int(header.extrasLen)+int(header.keyLength)]
+			data := body[int(header.extrasLen)+int(header.keyLength):]
+			user, password, ok := parsePlainCredentials(data)
+			if string(mechanism) != SASL_MECHANISM_PLAIN || !ok || !auth.Authenticate(user, password) {
+				getLogger().Warn("Client failed to authenticate", "mechanism", string(mechanism), "user", user)
+				respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_AUTH_ERROR, "Auth failure."))
+				return nil
+			}
+			authenticated = true
+			respondLocally(responses, 0, encodeBinaryResponse(header.opcode, BINARY_STATUS_OK, header.opaque, 0, nil, nil, []byte("Authenticated")))
+			return nil
+		case BINARY_OPCODE_SASL_STEP:
+			// PLAIN authenticates in a single step.
+			respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_AUTH_ERROR, "Auth failure."))
+			return nil
+		case BINARY_OPCODE_VERSION, BINARY_OPCODE_NOOP, BINARY_OPCODE_QUIT, BINARY_OPCODE_QUITQ:
+		default:
+			if !authenticated {
+				respondLocally(responses, 0, encodeBinaryError(header, BINARY_STATUS_AUTH_ERROR, "Auth failure."))
+				return nil
+			}
+		}
+		return forwardBinaryRequest(header, body, responses, remote)
+	}
+}
+
+// rejectUnauthenticatedText responds to a text protocol client of a pool with auth and closes the connection.
+func rejectUnauthenticatedText(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+	respondWithError(responses, message.RESPONSE_ERROR_AUTHENTICATION_REQUIRED)
+	return errAuthenticationRequired
+}
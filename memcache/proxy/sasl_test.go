@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func dialSASLTestServer(t *testing.T) (string, func()) {
+	t.Helper()
+	backend := newFakeBackend(t, newStoreHandler())
+	conf := newTestPoolConfig(t, backend)
+	auth, err := config.NewAuthConfig(map[string]string{"alice": "secret"})
+	if err != nil {
+		t.Fatalf("failed to create the auth config: %v", err)
+	}
+	conf.Auth = auth
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	return addr, func() {
+		s.Shutdown(context.Background())
+		backend.close()
+	}
+}
+
+func TestBinarySASLPlain(t *testing.T) {
+	addr, cleanup := dialSASLTestServer(t)
+	defer cleanup()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SET, 1, make([]byte, 8), "k", "value"))
+	response := readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_AUTH_ERROR), response.status, "expected commands to be rejected before authenticating")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SASL_LIST_MECHS, 2, nil, "", ""))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for list mechanisms")
+	testutil.ExpectStringEquals(t, "PLAIN", string(response.value), "unexpected mechanisms")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SASL_AUTH, 3, nil, "PLAIN", "\x00alice\x00wrong"))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_AUTH_ERROR), response.status, "expected a wrong password to be rejected")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SASL_AUTH, 4, nil, "PLAIN", "\x00alice\x00secret"))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "expected the correct password to be accepted")
+	testutil.ExpectEquals(t, uint32(4), response.opaque, "the opaque value should be returned")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_SET, 5, make([]byte, 8), "k", "value"))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for set after authenticating")
+
+	c.Write(encodeBinaryRequest(BINARY_OPCODE_GET, 6, nil, "k", ""))
+	response = readBinaryResponse(t, c)
+	testutil.ExpectEquals(t, uint16(BINARY_STATUS_OK), response.status, "unexpected status for get after authenticating")
+	testutil.ExpectStringEquals(t, "value", string(response.value), "unexpected value")
+}
+
+func TestTextProtocolRejectedWithAuth(t *testing.T) {
+	addr, cleanup := dialSASLTestServer(t)
+	defer cleanup()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "get k\r\n")
+	reader := bufio.NewReader(c)
+	line, err := reader.ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading the response")
+	testutil.ExpectStringEquals(t, "CLIENT_ERROR authentication required\r\n", line, "unexpected response")
+	_, err = reader.ReadByte()
+	testutil.ExpectEquals(t, io.EOF, err, "expected the connection to be closed")
+}
+
+func TestParsePlainCredentials(t *testing.T) {
+	user, password, ok := parsePlainCredentials([]byte("admin\x00alice\x00secret"))
+	testutil.ExpectEquals(t, true, ok, "expected the authorization identity to be allowed")
+	testutil.ExpectStringEquals(t, "alice", user, "unexpected user")
+	testutil.ExpectStringEquals(t, "secret", password, "unexpected password")
+	_, _, ok = parsePlainCredentials([]byte("alice:secret"))
+	testutil.ExpectEquals(t, false, ok, "expected credentials without NUL separators to be rejected")
+}
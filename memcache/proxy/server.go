@@ -4,23 +4,27 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
-	"github.com/TysonAndre/golemproxy/byteutil"
 	"github.com/TysonAndre/golemproxy/config"
 	"github.com/TysonAndre/golemproxy/memcache"
 	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
 	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
 	"github.com/TysonAndre/golemproxy/sharded"
 	"go4.org/strutil"
 )
@@ -29,26 +33,68 @@ var (
 	// these are all used as constants
 	noreplyBytes = []byte("noreply")
 
-	requestAdd     = []byte("add")
-	requestAppend  = []byte("append")
-	requestCas     = []byte("cas")
-	requestDelete  = []byte("delete")
-	requestIncr    = []byte("incr")
-	requestDecr    = []byte("decr")
-	requestGet     = []byte("get")
-	requestGets    = []byte("gets")
-	requestPrepend = []byte("prepend")
-	requestQuit    = []byte("quit")
-	requestReplace = []byte("replace")
-	requestSet     = []byte("set")
-	requestTouch   = []byte("touch")
+	requestAdd        = []byte("add")
+	requestAppend     = []byte("append")
+	requestCas        = []byte("cas")
+	requestDelete     = []byte("delete")
+	requestFlushAll   = []byte("flush_all")
+	requestIncr       = []byte("incr")
+	requestDecr       = []byte("decr")
+	requestGat        = []byte("gat")
+	requestGats       = []byte("gats")
+	requestGet        = []byte("get")
+	requestGets       = []byte("gets")
+	requestPrepend    = []byte("prepend")
+	requestQuit       = []byte("quit")
+	requestReplace    = []byte("replace")
+	requestSet        = []byte("set")
+	requestStats      = []byte("stats\r\n")
+	requestStatsReset = []byte("stats reset\r\n")
+	requestTouch      = []byte("touch")
+	requestVersion    = []byte("version")
+	requestVerbosity  = []byte("verbosity")
 )
 
+// VERSION is the version of golemproxy that is sent in response to the memcache version command.
+const VERSION = "0.1.0"
+
+var versionResponse = []byte("VERSION golemproxy-" + VERSION + "\r\n")
+
+var okResponse = []byte("OK\r\n")
+
 var (
 	errQuit = errors.New("quit")
+	// errPartialRequest is returned if the client closed the connection in the middle of a request.
+	errPartialRequest = errors.New("connection closed in the middle of a request")
+	errLineTooLong    = errors.New("request line too long")
 )
 
-const MAX_ITEM_SIZE = 1 << 20
+// DebugLogging enables logging of events that are normally not worth logging, such as clients disconnecting in the middle of a request.
+var DebugLogging = false
+
+// requestError is returned by handleCommand for a request that could not be parsed. The connection to the client is then closed.
+type requestError struct {
+	command string
+	err     error
+}
+
+func (e *requestError) Error() string {
+	return fmt.Sprintf("%s request parsing failed: %v", e.command, e.err)
+}
+
+// requestFailed wraps an error from parsing a request with the name of the command.
+func requestFailed(command string, err error) error {
+	if err == nil || err == errPartialRequest {
+		return err
+	}
+	return &requestError{command: command, err: err}
+}
+
+// MAX_ITEM_SIZE is the default maximum length of a value. See maxItemSizeOf.
+const MAX_ITEM_SIZE = config.DEFAULT_MAX_ITEM_SIZE
+
+// MAX_KEY_LENGTH is the maximum length of a memcache key, which is the same as the limit of memcached.
+const MAX_KEY_LENGTH = 250
 
 // itob converts an integer to the bytes to represent that integer
 func itob(value int) []byte {
@@ -91,41 +137,119 @@ func splitArgsOnSpaces(data []byte) ([][]byte, error) {
 	return append(parts, data[start:]), nil
 }
 
+// nextKey returns the first of the keys separated by one or more spaces in data, and the rest of data after that key.
+// key is empty if there are no more keys. Unlike the other commands, sloppy clients commonly send retrieval commands such as "get key \r\n".
+// key is a slice of data rather than a copy, so it must not be used after the buffer of the request is released.
+func nextKey(data []byte) (key []byte, rest []byte) {
+	for len(data) > 0 && data[0] == ' ' {
+		data = data[1:]
+	}
+	i := bytes.IndexByte(data, ' ')
+	if i < 0 {
+		return data, nil
+	}
+	return data[:i], data[i+1:]
+}
+
+// extractKeys appends the keys separated by one or more spaces in data to keys, ignoring leading and trailing spaces.
+// Callers pass a buffer on their stack, so that requests for a single key don't allocate.
+func extractKeys(keys [][]byte, data []byte) [][]byte {
+	for key, rest := nextKey(data); len(key) > 0; key, rest = nextKey(rest) {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// commandArgs returns the index of the space after the command of a "<command> <args>\r\n" request header, and the args before the "\r\n".
+// ok is false if there is no space after the command or the header doesn't end in "\r\n".
+// handleCommand only passes on headers ending in "\r\n", but this keeps malformed headers from causing a panic.
+func commandArgs(requestHeader []byte) (keyI int, args []byte, ok bool) {
+	keyI = bytes.IndexByte(requestHeader, ' ')
+	if keyI < 0 || keyI+1 > len(requestHeader)-2 || !bytes.HasSuffix(requestHeader, []byte("\r\n")) {
+		return keyI, nil, false
+	}
+	return keyI, requestHeader[keyI+1 : len(requestHeader)-2], true
+}
+
 // handleGet forwards the 'get' or 'gets' (with CAS) request to a memcache client and sends a response back
 // request is "get key1 key2 key3\r\n"
 func handleGet(requestHeader []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
-	// TODO: Check for malformed get command (e.g. stray \r)
-
-	keyI := bytes.IndexByte(requestHeader, ' ')
-	if keyI < 0 {
-		return errors.New("missing space")
+	keyI, args, ok := commandArgs(requestHeader)
+	var keysBuffer [1][]byte
+	keys := extractKeys(keysBuffer[:0], args)
+	if !ok || len(keys) == 0 {
+		// e.g. "get\r\n". There is no value to skip, so the connection stays open.
+		respondWithError(responses, message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT)
+		return nil
 	}
-	keys, err := splitArgsOnSpaces(requestHeader[keyI+1 : len(requestHeader)-2])
-	if err != nil {
-		return err
+	if !validKeys(keys) {
+		// Like memcached, the connection stays open, so the client can keep sending pipelined commands.
+		respondWithError(responses, message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT)
+		return nil
+	}
+	requestType := message.REQUEST_MC_GET
+	if keyI == 4 {
+		requestType = message.REQUEST_MC_GETS
+	}
+	if len(keys) == 1 && len(requestHeader) != keyI+len(keys[0])+3 {
+		// Forward "get key\r\n" instead of a request with extra spaces.
+		requestHeader = append(append(append([]byte(nil), requestHeader[:keyI+1]...), keys[0]...), "\r\n"...)
+		keys[0] = requestHeader[keyI+1 : len(requestHeader)-2]
 	}
+	forwardRetrieval(requestHeader, requestHeader[:keyI+1], keys, requestType, responses, remote)
+	return nil
+}
 
-	if len(keys) == 0 {
-		return errors.New("missing key")
+// handleGat forwards the 'gat' or 'gats' (with CAS) request, which updates the expiration time of keys and returns their values.
+// request is "gat exptime key1 key2 key3\r\n"
+func handleGat(requestHeader []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+	keyI, argBytes, ok := commandArgs(requestHeader)
+	args, err := splitArgsOnSpaces(argBytes)
+	if !ok || err != nil || len(args) < 2 {
+		// e.g. "gat 60\r\n". Like handleGet, the connection stays open.
+		respondWithError(responses, message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT)
+		return nil
 	}
+	if validateExptime(args[0]) != nil {
+		respondWithError(responses, message.RESPONSE_ERROR_INVALID_EXPTIME)
+		return nil
+	}
+	if !validKeys(args[1:]) {
+		respondWithError(responses, message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT)
+		return nil
+	}
+	requestType := message.REQUEST_MC_GAT
+	if keyI == 4 {
+		requestType = message.REQUEST_MC_GATS
+	}
+	// The prefix is 'gat <exptime> '
+	forwardRetrieval(requestHeader, requestHeader[:keyI+len(args[0])+2], args[1:], requestType, responses, remote)
+	return nil
+}
+
+// forwardRetrieval sends a get, gets, gat, or gats request for 1 or more keys.
+// prefix is the part of requestHeader before the first key, e.g. "get " or "gat 60 ".
+func forwardRetrieval(requestHeader []byte, prefix []byte, keys [][]byte, requestType message.RequestType, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) {
 	if len(keys) == 1 {
 		m := &message.SingleMessage{}
 		key := keys[0]
 		// fmt.Fprintf(os.Stderr, "handleGet %q key=%v\n", string(requestHeader), string(key))
-		m.HandleSendRequest(requestHeader, key, message.REQUEST_MC_GET)
+		m.HandleSendRequest(requestHeader, key, requestType)
 		remote.SendProxiedMessageAsync(m)
 		responses.RecordOutgoingRequest(m)
-		return nil
+		return
 	}
+	// Each key is sent as a separate request so that it can be routed to the server that owns it.
+	// The FragmentedMessage waits for every fragment and combines them into a single response ending in one END.
 	fragments := make([]message.SingleMessage, len(keys))
 	for i, key := range keys {
-		requestFragment := make([]byte, keyI+3+len(key))
+		requestFragment := make([]byte, len(prefix)+len(key)+2)
 		// 'get ' + key + '\r\n'
-		copy(requestFragment, requestHeader[:keyI+1])
-		copy(requestFragment[keyI+1:], key)
-		copy(requestFragment[keyI+1+len(key):], "\r\n")
+		copy(requestFragment, prefix)
+		copy(requestFragment[len(prefix):], key)
+		copy(requestFragment[len(prefix)+len(key):], "\r\n")
 		m := &fragments[i]
-		m.HandleSendRequest(requestFragment, key, message.REQUEST_MC_GET)
+		m.HandleSendRequest(requestFragment, key, requestType)
 		remote.SendProxiedMessageAsync(m)
 		// responses.RecordOutgoingRequest(m)
 	}
@@ -134,44 +258,178 @@ func handleGet(requestHeader []byte, responses *responsequeue.ResponseQueue, rem
 		Fragments: fragments,
 	}
 	responses.RecordOutgoingRequest(fragmentedRequest)
-
-	return nil
 }
 
+// handleDelete forwards "delete <key> [<time>] [noreply]\r\n".
+// Old clients send a time, which memcached no longer supports, so it is removed from the request that is forwarded.
 func handleDelete(requestHeader []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
-	// TODO: Check for malformed delete command (e.g. stray \r)
 	m := &message.SingleMessage{}
 
-	keyI := bytes.IndexByte(requestHeader, ' ')
-	if keyI < 0 {
-		return errors.New("missing space")
-	}
-	args, err := splitArgsOnSpaces(requestHeader[keyI+1 : len(requestHeader)-2])
+	_, argBytes, ok := commandArgs(requestHeader)
+	args, err := splitArgsOnSpaces(argBytes)
 	if err != nil {
 		return err
 	}
-	if len(args) < 1 || len(args) > 2 {
-		return errors.New("unexpected arg count for " + string(requestHeader[:4]))
+	if !ok || len(args) < 1 {
+		// e.g. "delete\r\n"
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
+		responses.RecordOutgoingRequest(m)
+		return nil
 	}
-	noreply := false
+	if len(args) > 1 && bytes.Equal(args[len(args)-1], noreplyBytes) {
+		m.NoReply = true
+		args = args[:len(args)-1]
+	}
+	request := requestHeader
 	if len(args) == 2 {
-		if !bytes.Equal(args[1], noreplyBytes) {
-			return errors.New("expected extra arg to be noreply")
+		if _, err := strutil.ParseUintBytes(args[1], 10, 32); err == nil {
+			key := args[0]
+			request = append([]byte("delete "), key...)
+			if m.NoReply {
+				request = append(request, " noreply"...)
+			}
+			request = append(request, "\r\n"...)
+			args = [][]byte{request[len("delete ") : len("delete ")+len(key)]}
 		}
+	}
+	if len(args) != 1 || validateKey(args[0]) != nil {
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
+		responses.RecordOutgoingRequest(m)
+		return nil
+	}
+	m.HandleSendRequest(request, args[0], message.REQUEST_MC_DELETE)
+	remote.SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
+
+// serversOf returns a client for each memcache server that remote sends requests to.
+func serversOf(remote memcache.ClientInterface) []memcache.ClientInterface {
+	for {
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			break
+		}
+		remote = wrapper.unwrap()
+	}
+	pool, ok := remote.(interface {
+		Servers() []*memcache.PipeliningClient
+	})
+	if !ok {
+		return []memcache.ClientInterface{remote}
+	}
+	servers := pool.Servers()
+	result := make([]memcache.ClientInterface, len(servers))
+	for i, server := range servers {
+		result[i] = server
+	}
+	return result
+}
+
+// serverName returns the name of a memcache server for error messages.
+func serverName(server memcache.ClientInterface) string {
+	if client, ok := server.(*memcache.PipeliningClient); ok {
+		return client.GetServer()
+	}
+	return "unknown"
+}
+
+// handleFlushAll sends a flush_all request to every memcache server and responds with OK if all of them succeed.
+// request is "flush_all [delay] [noreply]\r\n"
+func handleFlushAll(requestHeader []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
+	if err != nil {
+		return err
+	}
+	args = args[1:]
+	noreply := false
+	if len(args) > 0 && bytes.Equal(args[len(args)-1], noreplyBytes) {
 		noreply = true
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("unexpected arg count %d for flush_all", len(args))
+	}
+	// The request to each server always expects a response, so that failures can be detected.
+	request := []byte("flush_all\r\n")
+	if len(args) == 1 {
+		if _, err := strutil.ParseUintBytes(args[0], 10, 32); err != nil {
+			return fmt.Errorf("failed to parse flush_all delay: %v", err)
+		}
+		request = []byte("flush_all " + string(args[0]) + "\r\n")
 	}
 
-	key := args[0]
-	m.HandleSendRequest(requestHeader, key, message.REQUEST_MC_DELETE)
-	remote.SendProxiedMessageAsync(m)
-	if !noreply {
+	if isReadOnly(remote) {
+		m := &message.SingleMessage{NoReply: noreply}
+		m.ResponseError = message.RESPONSE_ERROR_WRITE_NOT_ALLOWED
 		responses.RecordOutgoingRequest(m)
+		return nil
+	}
+	servers := serversOf(remote)
+	m := &message.FanoutMessage{
+		Fragments:        make([]message.SingleMessage, len(servers)),
+		Servers:          make([]string, len(servers)),
+		ExpectedResponse: []byte("OK\r\n"),
+		NoReply:          noreply,
 	}
+	for i, server := range servers {
+		m.Servers[i] = serverName(server)
+		fragment := &m.Fragments[i]
+		fragment.HandleSendRequest(request, nil, message.REQUEST_MC_FLUSH_ALL)
+		server.SendProxiedMessageAsync(fragment)
+	}
+	responses.RecordOutgoingRequest(m)
 	return nil
 }
 
-func handleIncrOrDecr(requestHeader []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
-	// TODO: Check for malformed delete command (e.g. stray \r)
+// handleVerbosity acknowledges "verbosity <level> [noreply]\r\n" without forwarding it, since the level of the memcache servers is not the proxy's to change.
+func handleVerbosity(requestHeader []byte, responses *responsequeue.ResponseQueue) error {
+	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
+	if err != nil {
+		return err
+	}
+	args = args[1:]
+	m := &message.SingleMessage{}
+	m.RequestType = message.REQUEST_MC_VERBOSITY
+	if len(args) > 0 && bytes.Equal(args[len(args)-1], noreplyBytes) {
+		m.NoReply = true
+		args = args[:len(args)-1]
+	}
+	if len(args) != 1 {
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
+	} else if _, err := strutil.ParseUintBytes(args[0], 10, 32); err != nil {
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
+	} else {
+		m.ResponseData = okResponse
+	}
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
+
+// respondWithError sends an error response to the client without forwarding the request to a memcache server.
+func respondWithError(responses *responsequeue.ResponseQueue, responseError *message.ResponseError) {
+	// The mutex of the message is unlocked, so the response is available immediately.
+	m := &message.SingleMessage{}
+	m.ResponseError = responseError
+	responses.RecordOutgoingRequest(m)
+}
+
+// respondLocally sends a response to the client without forwarding the request to a memcache server.
+func respondLocally(responses *responsequeue.ResponseQueue, requestType message.RequestType, response []byte) {
+	m := &message.SingleMessage{}
+	m.RequestType = requestType
+	m.ResponseData = response
+	responses.RecordOutgoingRequest(m)
+}
+
+// Stats returns the current values of the proxy's counters.
+func Stats() stats.Snapshot {
+	return stats.Global.Snapshot()
+}
+
+// handleIncrOrDecr forwards an incr, decr, or touch request to the memcache servers.
+// request is "incr|decr <key> <delta> [noreply]\r\n" or "touch <key> <exptime> [noreply]\r\n"
+func handleIncrOrDecr(requestHeader []byte, requestType message.RequestType, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
 	m := &message.SingleMessage{}
 
 	keyI := bytes.IndexByte(requestHeader, ' ')
@@ -185,8 +443,15 @@ func handleIncrOrDecr(requestHeader []byte, responses *responsequeue.ResponseQue
 	if len(args) < 2 || len(args) > 3 {
 		return fmt.Errorf("unexpected arg count %d for %s", len(args), string(requestHeader[:keyI]))
 	}
-	if !byteutil.IsExclusivelyDigits(args[1]) {
-		return fmt.Errorf("expected argument for %s to be a number", string(requestHeader[:keyI]))
+	if requestType == message.REQUEST_MC_TOUCH {
+		if validateExptime(args[1]) != nil {
+			respondWithError(responses, message.RESPONSE_ERROR_INVALID_EXPTIME)
+			return nil
+		}
+	} else if _, err := strutil.ParseUintBytes(args[1], 10, 64); err != nil {
+		// Like memcached, reject deltas that aren't 64-bit unsigned integers but keep the connection open.
+		respondWithError(responses, message.RESPONSE_ERROR_INVALID_DELTA)
+		return nil
 	}
 	noreply := false
 	if len(args) == 3 {
@@ -197,17 +462,27 @@ func handleIncrOrDecr(requestHeader []byte, responses *responsequeue.ResponseQue
 	}
 
 	key := args[0]
-	m.HandleSendRequest(requestHeader, key, message.REQUEST_MC_INCR)
-	remote.SendProxiedMessageAsync(m)
-	// If a request includes 'noreply' then the server would not send back a response.
-	if !noreply {
+	if validateKey(key) != nil {
+		m.NoReply = noreply
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
 		responses.RecordOutgoingRequest(m)
+		return nil
 	}
+	m.HandleSendRequest(requestHeader, key, requestType)
+	// If a request includes 'noreply' then the server would not send back a response.
+	m.NoReply = noreply
+	remote.SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
 	return nil
 }
 
+// validateKey checks that a key is 1 to MAX_KEY_LENGTH bytes and has no whitespace or control characters.
+// Keys with a stray \r or \n would be misinterpreted by memcache servers.
 func validateKey(key []byte) error {
-	if len(key) > 250 {
+	if len(key) == 0 {
+		return errors.New("empty memcache key")
+	}
+	if len(key) > MAX_KEY_LENGTH {
 		return errors.New("memcache key too long")
 	}
 	for _, c := range key {
@@ -218,27 +493,54 @@ func validateKey(key []byte) error {
 	return nil
 }
 
-func validateKeyFlagsExpiry(args [][]byte) error {
-	err := validateKey(args[1])
+// validKeys returns true if every key is valid.
+func validKeys(keys [][]byte) bool {
+	for _, key := range keys {
+		if validateKey(key) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// parseExptime parses an expiration time, which memcached allows to be any 32-bit signed integer.
+// Negative expiration times are allowed and expire items immediately.
+func parseExptime(exptime []byte) (int32, error) {
+	negative := len(exptime) > 0 && exptime[0] == '-'
+	if negative {
+		exptime = exptime[1:]
+	}
+	value, err := strutil.ParseUintBytes(exptime, 10, 31)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	// TODO: use https://godoc.org/go4.org/strutil#ParseUintBytes
-	_, err = strutil.ParseUintBytes(args[2], 10, 32)
+	if negative {
+		return -int32(value), nil
+	}
+	return int32(value), nil
+}
+
+// validateExptime checks that an expiration time is a 32-bit signed integer.
+func validateExptime(exptime []byte) error {
+	_, err := parseExptime(exptime)
+	return err
+}
+
+// parseFlagsExpiry returns the flags and expiration time of a storage command.
+func parseFlagsExpiry(args [][]byte) (uint32, int32, error) {
+	flags, err := strutil.ParseUintBytes(args[2], 10, 32)
 	if err != nil {
-		return fmt.Errorf("failed to parse flags: %v", err)
+		return 0, 0, fmt.Errorf("failed to parse flags: %v", err)
 	}
-	_, err = strutil.ParseUintBytes(args[3], 10, 32)
+	exptime, err := parseExptime(args[3])
 	if err != nil {
-		return fmt.Errorf("failed to parse expiry: %v", err)
+		return 0, 0, fmt.Errorf("failed to parse expiry: %v", err)
 	}
-	return nil
+	return uint32(flags), exptime, nil
 }
 
-// handleSet forwards a set request to the memcache servers and returns a result.
-// TODO: Add the capability to mock successful responses before sending the request
-func handleSet(requestHeader []byte, reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
-	// FIXME support 'noreply'
+// handleSet forwards a set, add, replace, append, or prepend request to the memcache servers and returns a result.
+func handleSet(requestHeader []byte, requestType message.RequestType, reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, maxItemSize int) error {
 	// parse the number of bytes then read
 	// requestHeader is set|add|replace|insert key <flags> <expiry> <valuelen> [noreply]\r\n<value>\r\n
 	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
@@ -250,21 +552,16 @@ func handleSet(requestHeader []byte, reader *bufio.Reader, responses *responsequ
 		return fmt.Errorf("unexpected word count %d for %s, expected '%s key flags expiry valuelen [noreply]'", len(args), cmd, cmd)
 	}
 
-	err = validateKeyFlagsExpiry(args)
+	flags, exptime, err := parseFlagsExpiry(args)
 	if err != nil {
 		return err
 	}
 
-	length, err := strutil.ParseUintBytes(args[4], 10, 30)
+	length, err := strutil.ParseUintBytes(args[4], 10, 31)
 	if err != nil {
 		return fmt.Errorf("failed to parse length: %v", err)
 	}
-	if length < 0 {
-		return fmt.Errorf("Wrong length: expected non-negative value")
-	}
-	if length > MAX_ITEM_SIZE {
-		return fmt.Errorf("Wrong length: %d exceeds MAX_ITEM_SIZE of %d", length, MAX_ITEM_SIZE)
-	}
+	// length is unsigned. A length of 0 is allowed and stores an empty value.
 	noreply := false
 	if len(args) == 6 {
 		if !bytes.Equal(args[5], noreplyBytes) {
@@ -272,49 +569,102 @@ func handleSet(requestHeader []byte, reader *bufio.Reader, responses *responsequ
 		}
 		noreply = true
 	}
-	fullRequestLength := len(requestHeader) + int(length) + 2
-	requestBody := make([]byte, fullRequestLength)
+	if length > uint64(maxItemSize) {
+		return rejectTooLarge(int(length), noreply, reader, responses)
+	}
+	buf, err := readRequestBody(requestHeader, int(length), reader)
+	if err != nil {
+		return err
+	}
+	key := args[1]
+	// The value is read before the key is rejected, so that the value is not mistaken for the next command.
+	if validateKey(key) != nil {
+		putRequestBuffer(buf)
+		m := &message.SingleMessage{NoReply: noreply}
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
+		responses.RecordOutgoingRequest(m)
+		return nil
+	}
+	requestBody := *buf
+	m := &message.SingleMessage{Release: func() { putRequestBuffer(buf) }}
+	m.HandleSendRequest(requestBody, key, requestType)
+	m.Flags = flags
+	m.Exptime = exptime
+	m.NoReply = noreply
+	remote.SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
+
+// rejectTooLarge responds to a storage request with a value longer than the max_item_size.
+// Like memcached, the value is read and discarded so that it is not mistaken for the next command.
+func rejectTooLarge(length int, noreply bool, reader *bufio.Reader, responses *responsequeue.ResponseQueue) error {
+	err := discardRequestBody(length, reader)
+	if err != nil {
+		return err
+	}
+	m := &message.SingleMessage{NoReply: noreply}
+	m.ResponseError = message.RESPONSE_ERROR_OBJECT_TOO_LARGE
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
+
+// discardRequestBody reads the value of a storage request without keeping it.
+func discardRequestBody(length int, reader *bufio.Reader) error {
+	_, err := io.CopyN(ioutil.Discard, reader, int64(length))
+	if err == nil {
+		var end [2]byte
+		_, err = io.ReadFull(reader, end[:])
+		if err == nil && (end[0] != '\r' || end[1] != '\n') {
+			return fmt.Errorf("Value was not followed by \\r\\n")
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errPartialRequest
+	}
+	return err
+}
+
+// readRequestBody reads the value of a storage request and returns a pooled buffer containing the header followed by the value.
+func readRequestBody(requestHeader []byte, length int, reader *bufio.Reader) (*[]byte, error) {
+	fullRequestLength := len(requestHeader) + length + 2
+	buf := getRequestBuffer(fullRequestLength)
+	requestBody := *buf
 	copy(requestBody, requestHeader)
 	n, err := io.ReadFull(reader, requestBody[len(requestHeader):])
 	if err != nil {
-		return fmt.Errorf("Failed to read %d requestBody, got %d: %v", length, n, err)
+		putRequestBuffer(buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errPartialRequest
+		}
+		return nil, fmt.Errorf("Failed to read %d requestBody, got %d: %v", length, n, err)
 	}
 	// skip \r\n
 	if requestBody[fullRequestLength-2] != '\r' || requestBody[fullRequestLength-1] != '\n' {
-		return fmt.Errorf("Value was not followed by \\r\\n")
-	}
-	m := &message.SingleMessage{}
-
-	key := args[1]
-	m.HandleSendRequest(requestBody, key, message.REQUEST_MC_CAS)
-	remote.SendProxiedMessageAsync(m)
-	if !noreply {
-		responses.RecordOutgoingRequest(m)
+		putRequestBuffer(buf)
+		return nil, fmt.Errorf("Value was not followed by \\r\\n")
 	}
-	return nil
+	return buf, nil
 }
 
 // handleCas forwards a cas request to the memcache servers and returns a result.
-func handleCas(requestHeader []byte, reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
-	// FIXME support 'noreply'
+func handleCas(requestHeader []byte, reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, maxItemSize int) error {
 	// parse the number of bytes then read
-	// requestHeader is set|add|replace|insert key <flags> <expiry> <valuelen> [noreply]\r\n<value>\r\n
+	// requestHeader is cas key <flags> <expiry> <valuelen> <cas unique> [noreply]\r\n<value>\r\n
 	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
 	if err != nil {
 		return fmt.Errorf("could not parse %q: %v\n", string(requestHeader), err)
 	}
 	if len(args) < 6 || len(args) > 7 {
-		cmd := string(args[0])
-		return fmt.Errorf("unexpected word count %d for %s, expected '%s key flags expiry valuelen [noreply]'", len(args), cmd, cmd)
+		return fmt.Errorf("unexpected word count %d for cas, expected 'cas key flags expiry valuelen casunique [noreply]'", len(args))
 	}
 
-	// TODO: use https://godoc.org/go4.org/strutil#ParseUintBytes
-	err = validateKeyFlagsExpiry(args)
+	flags, exptime, err := parseFlagsExpiry(args)
 	if err != nil {
 		return err
 	}
 
-	length, err := strutil.ParseUintBytes(args[4], 10, 30)
+	length, err := strutil.ParseUintBytes(args[4], 10, 31)
 	if err != nil {
 		return fmt.Errorf("failed to parse length: %v", err)
 	}
@@ -324,12 +674,7 @@ func handleCas(requestHeader []byte, reader *bufio.Reader, responses *responsequ
 		return fmt.Errorf("failed to parse cas token: %v", err)
 	}
 
-	if length < 0 {
-		return fmt.Errorf("Wrong length: expected non-negative value")
-	}
-	if length > MAX_ITEM_SIZE {
-		return fmt.Errorf("Wrong length: %d exceeds MAX_ITEM_SIZE of %d", length, MAX_ITEM_SIZE)
-	}
+	// length is unsigned. A length of 0 is allowed and stores an empty value.
 	noreply := false
 	if len(args) == 7 {
 		if !bytes.Equal(args[6], noreplyBytes) {
@@ -337,217 +682,844 @@ func handleCas(requestHeader []byte, reader *bufio.Reader, responses *responsequ
 		}
 		noreply = true
 	}
-	fullRequestLength := len(requestHeader) + int(length) + 2
-	requestBody := make([]byte, fullRequestLength)
-	copy(requestBody, requestHeader)
-	n, err := io.ReadFull(reader, requestBody[len(requestHeader):])
-	if err != nil {
-		return fmt.Errorf("Failed to read %d requestBody, got %d: %v", length, n, err)
+	if length > uint64(maxItemSize) {
+		return rejectTooLarge(int(length), noreply, reader, responses)
 	}
-	// skip \r\n
-	if requestBody[fullRequestLength-2] != '\r' || requestBody[fullRequestLength-1] != '\n' {
-		return fmt.Errorf("Value was not followed by \\r\\n")
+	buf, err := readRequestBody(requestHeader, int(length), reader)
+	if err != nil {
+		return err
 	}
-	m := &message.SingleMessage{}
-
 	key := args[1]
-	m.HandleSendRequest(requestBody, key, message.REQUEST_MC_SET)
-	remote.SendProxiedMessageAsync(m)
-	if !noreply {
+	// The value is read before the key is rejected, so that the value is not mistaken for the next command.
+	if validateKey(key) != nil {
+		putRequestBuffer(buf)
+		m := &message.SingleMessage{NoReply: noreply}
+		m.ResponseError = message.RESPONSE_ERROR_BAD_COMMAND_LINE_FORMAT
 		responses.RecordOutgoingRequest(m)
+		return nil
 	}
+	requestBody := *buf
+	m := &message.SingleMessage{Release: func() { putRequestBuffer(buf) }}
+	m.HandleSendRequest(requestBody, key, message.REQUEST_MC_CAS)
+	m.Flags = flags
+	m.Exptime = exptime
+	m.NoReply = noreply
+	remote.SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
 	return nil
 }
 
-func handleCommand(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
-	// ReadBytes is safe to reuse, ReadSlice isn't.
-	header, err := reader.ReadBytes('\n')
+// newCommandHandler returns a handler for text protocol requests that rejects values longer than maxItemSize.
+// If lenientLineEndings is true, request lines may end in \n instead of \r\n.
+func newCommandHandler(maxItemSize int, lenientLineEndings bool) func(*bufio.Reader, *responsequeue.ResponseQueue, memcache.ClientInterface) error {
+	return func(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+		return handleTextCommand(reader, responses, remote, maxItemSize, lenientLineEndings)
+	}
+}
+
+// handleCommand reads a text protocol request from reader and forwards it to remote, or responds to it locally.
+func handleCommand(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, maxItemSize int) error {
+	return handleTextCommand(reader, responses, remote, maxItemSize, false)
+}
+
+// handleTextCommand is handleCommand for request lines that may end in \n instead of \r\n if lenientLineEndings is true.
+// Values must still be followed by \r\n, as memcached requires.
+func handleTextCommand(reader *bufio.Reader, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, maxItemSize int, lenientLineEndings bool) error {
+	// The length of a request line is limited by the size of the reader's buffer.
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		respondWithError(responses, message.RESPONSE_ERROR_LINE_TOO_LONG)
+		return errLineTooLong
+	}
 	if err != nil {
-		// Check if the reader exited cleanly
-		if err != io.EOF {
-			// TODO: Handle EOF
-			fmt.Fprintf(os.Stderr, "ReadSlice failed: %s\n", err.Error())
+		if err == io.EOF && len(line) > 0 {
+			return errPartialRequest
 		}
+		// io.EOF if the client closed the connection between requests, or a network error.
 		return err
 	}
+	// The data from ReadSlice is overwritten by the next read, but the key is used after the value is read.
+	header := append([]byte(nil), line...)
+	if lenientLineEndings && (len(header) < 2 || header[len(header)-2] != '\r') {
+		// Memcache servers require \r\n, so "get k\n" is forwarded as "get k\r\n".
+		header = append(header[:len(header)-1], '\r', '\n')
+	}
 	headerLen := len(header)
 	if headerLen < 2 {
 		return errors.New("request too short")
 	}
 
-	// If a client sends the carriage return in the wrong place, close that client,
-	// the client might not be properly validating keys.
-	carriageReturnPos := bytes.IndexByte(header, '\r')
-	if carriageReturnPos != headerLen-2 {
-		if carriageReturnPos < 0 {
-			return errors.New("request header did not have carriage return in the expected position")
-		} else {
-			return errors.New("request header had carriage return in an unexpected position")
-		}
+	if header[headerLen-2] != '\r' {
+		return errors.New("request header did not have carriage return in the expected position")
 	}
+	// A carriage return in any other position is part of a key or argument, which is rejected when the keys or arguments are validated.
 	i := bytes.IndexByte(header, ' ')
 	if i < 0 {
-		i = carriageReturnPos
+		i = headerLen - 2
+	}
+
+	if tracer := tracerOf(remote); tracer != nil && tracer.hooks.CommandParsed != nil {
+		tracer.hooks.CommandParsed(CommandTrace{Pool: tracer.pool, Command: string(header[:i]), Bytes: headerLen, Time: time.Now()})
+	}
+	if policy := commandPolicyOf(remote); policy != nil && !policy.Permits(string(header[:i])) {
+		return requestFailed(string(header[:i]), rejectCommand(header, reader, responses))
 	}
 
 	// fmt.Fprintf(os.Stderr, "got request %q i=%d\n", header, i)
 	switch i {
+	case 2:
+		if bytes.HasPrefix(header, requestMetaGet) {
+			return requestFailed("mg", handleMeta(header, message.REQUEST_MC_META_GET, responses, remote))
+		}
+		if bytes.HasPrefix(header, requestMetaSet) {
+			return requestFailed("ms", handleMetaSet(header, reader, responses, remote, maxItemSize))
+		}
+		if bytes.HasPrefix(header, requestMetaDelete) {
+			return requestFailed("md", handleMeta(header, message.REQUEST_MC_META_DELETE, responses, remote))
+		}
+		if bytes.HasPrefix(header, requestMetaArithmetic) {
+			return requestFailed("ma", handleMeta(header, message.REQUEST_MC_META_ARITHMETIC, responses, remote))
+		}
+		if bytes.HasPrefix(header, requestMetaNoop) {
+			respondLocally(responses, message.REQUEST_MC_META_NOOP, metaNoopResponse)
+			return nil
+		}
 	case 3:
 		// memcached protocol is case sensitive
 		if bytes.HasPrefix(header, requestGet) {
-			err := handleGet(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "get request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("get", handleGet(header, responses, remote))
 		}
-		if bytes.HasPrefix(header, requestSet) || bytes.HasPrefix(header, requestAdd) {
-			err := handleSet(header, reader, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s request parsing failed: %s\n", string(header[:3]), err.Error())
-			}
-			return err
+		if bytes.HasPrefix(header, requestGat) {
+			return requestFailed("gat", handleGat(header, responses, remote))
+		}
+		if bytes.HasPrefix(header, requestSet) {
+			return requestFailed("set", handleSet(header, message.REQUEST_MC_SET, reader, responses, remote, maxItemSize))
+		}
+		if bytes.HasPrefix(header, requestAdd) {
+			return requestFailed("add", handleSet(header, message.REQUEST_MC_ADD, reader, responses, remote, maxItemSize))
 		}
 		if bytes.HasPrefix(header, requestCas) {
-			err := handleCas(header, reader, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "cas request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("cas", handleCas(header, reader, responses, remote, maxItemSize))
 		}
 	case 4:
 		// memcached protocol is case sensitive
 		if bytes.HasPrefix(header, requestGets) {
-			err := handleGet(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "gets request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("gets", handleGet(header, responses, remote))
+		}
+		if bytes.HasPrefix(header, requestGats) {
+			return requestFailed("gats", handleGat(header, responses, remote))
 		}
 		if bytes.HasPrefix(header, requestIncr) {
-			err := handleIncrOrDecr(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "incr request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("incr", handleIncrOrDecr(header, message.REQUEST_MC_INCR, responses, remote))
 		}
 		if bytes.HasPrefix(header, requestDecr) {
-			err := handleIncrOrDecr(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "decr request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("decr", handleIncrOrDecr(header, message.REQUEST_MC_DECR, responses, remote))
 		}
 		if bytes.HasPrefix(header, requestQuit) {
 			// fmt.Fprintf(os.Stderr, "Got quit from client")
 			return errQuit
 		}
 	case 5:
+		if bytes.Equal(header, requestStats) {
+			// Report the counters of the proxy itself rather than those of the memcache servers.
+			respondLocally(responses, message.REQUEST_MC_STATS, Stats().Format("golemproxy-"+VERSION))
+			return nil
+		}
+		if bytes.Equal(header, requestStatsReset) {
+			stats.Global.Reset()
+			respondLocally(responses, message.REQUEST_MC_STATS, []byte("RESET\r\n"))
+			return nil
+		}
+		if bytes.Equal(header, requestStatsServers) {
+			respondLocally(responses, message.REQUEST_MC_STATS, formatServerStatuses(serverStatusesOf(remote)))
+			return nil
+		}
+		if bytes.HasPrefix(header, requestStatsSubcommand) {
+			return requestFailed("stats", handleStats(header, responses, remote))
+		}
 		if bytes.HasPrefix(header, requestTouch) {
 			// fmt.Fprintf(os.Stderr, "Got quit from client")
 			// 'touch <key> <expiry>[noreply]\r\n' is similar to incr
-			err := handleIncrOrDecr(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "touch request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("touch", handleIncrOrDecr(header, message.REQUEST_MC_TOUCH, responses, remote))
 		}
 	case 6:
 		if bytes.HasPrefix(header, requestDelete) {
-			err := handleDelete(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "delete request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("delete", handleDelete(header, responses, remote))
 		}
 		if bytes.HasPrefix(header, requestAppend) {
-			err := handleSet(header, reader, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "append request parsing failed: %s\n", err.Error())
-			}
-			return err
+			return requestFailed("append", handleSet(header, message.REQUEST_MC_APPEND, reader, responses, remote, maxItemSize))
 		}
 	case 7:
-		if bytes.HasPrefix(header, requestDelete) {
-			err := handleDelete(header, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "delete request parsing failed: %s\n", err.Error())
-			}
-			return err
+		if bytes.HasPrefix(header, requestVersion) {
+			// Respond without contacting a memcache server, so that health checks work even when every server is down.
+			respondLocally(responses, message.REQUEST_MC_VERSION, versionResponse)
+			return nil
 		}
 		// replace and prepend have the same arg count as set
-		if bytes.HasPrefix(header, requestReplace) || bytes.HasPrefix(header, requestPrepend) {
-			err := handleSet(header, reader, responses, remote)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s request parsing failed: %s\n", string(header[:7]), err.Error())
-			}
-			return err
+		if bytes.HasPrefix(header, requestReplace) {
+			return requestFailed("replace", handleSet(header, message.REQUEST_MC_REPLACE, reader, responses, remote, maxItemSize))
+		}
+		if bytes.HasPrefix(header, requestPrepend) {
+			return requestFailed("prepend", handleSet(header, message.REQUEST_MC_PREPEND, reader, responses, remote, maxItemSize))
+		}
+	case 9:
+		if bytes.HasPrefix(header, requestFlushAll) {
+			return requestFailed("flush_all", handleFlushAll(header, responses, remote))
+		}
+		if bytes.HasPrefix(header, requestVerbosity) {
+			return requestFailed("verbosity", handleVerbosity(header, responses))
 		}
 	}
-	fmt.Fprintf(os.Stderr, "Unknown command %q\n", header)
-	return errors.New("unknown command")
+	// Like memcached, respond with ERROR to empty lines and unknown commands, and keep the connection open.
+	respondWithError(responses, message.RESPONSE_ERROR_NONEXISTENT_COMMAND)
+	return nil
+}
+
+// countingReader counts the bytes read from a client connection.
+type countingReader struct {
+	reader io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	stats.Global.AddBytesRead(n)
+	return n, err
+}
+
+// drainingReader tells a response queue with a write buffer to send the buffered responses before waiting for more requests from the client.
+// A bufio.Reader only reads from it once every buffered request was handled.
+type drainingReader struct {
+	reader    io.Reader
+	responses *responsequeue.ResponseQueue
+}
+
+func (r drainingReader) Read(p []byte) (int, error) {
+	r.responses.InputDrained()
+	return r.reader.Read(p)
+}
+
+// configureClientConn applies the socket options from the config to a connection accepted from a client.
+func configureClientConn(c net.Conn, conf config.Config) {
+	tcpConn, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if conf.TCPKeepAlive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(conf.TCPKeepAlive)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+	tcpConn.SetNoDelay(conf.TCPNoDelay)
+}
+
+// clientConnListener applies the socket options from the config to accepted connections before they are wrapped with TLS.
+type clientConnListener struct {
+	net.Listener
+	conf config.Config
+}
+
+func (l clientConnListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		configureClientConn(c, l.conf)
+	}
+	return c, err
+}
+
+// wrapClientTLS returns a listener that terminates TLS from clients if the config has client_tls.
+func wrapClientTLS(l net.Listener, conf config.Config) net.Listener {
+	if conf.ClientTLS == nil {
+		return l
+	}
+	return tls.NewListener(clientConnListener{Listener: l, conf: conf}, conf.ClientTLS)
+}
+
+// ListenError is returned by Serve and Run if golemproxy could not listen for requests to a pool.
+type ListenError struct {
+	// Pool is the name of the pool from the config file
+	Pool   string
+	Listen string
+	Err    error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("failed to listen for pool %q at %s: %v", e.Pool, e.Listen, e.Err)
+}
+
+// Unwrap returns the error from net.Listen.
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// Server proxies memcache requests from the listeners of each pool to the memcache servers of that pool.
+type Server struct {
+	configs   map[string]config.Config
+	statsPort uint
+	// Trace is the hooks for tracing connections and requests, which must be set before Start. Tracing is disabled by default.
+	Trace TraceHooks
+	// inherited are the listening sockets passed by the parent process, which Start uses instead of binding the listen addresses they are bound to.
+	inherited []net.Listener
+
+	// m protects listeners, boundAddrs, packetConns, conns, pools, and shadows
+	m         sync.Mutex
+	listeners []net.Listener
+	// boundAddrs are the addresses of the listeners of each pool, in the order of the listen addresses in the config
+	boundAddrs map[string][]net.Addr
+	// packetConns are the udp listeners
+	packetConns []net.PacketConn
+	conns       map[net.Conn]struct{}
+	// pools are the clients for the servers of each pool, which are replaced by Reload.
+	pools map[string]*sharded.ReloadableClient
+	// shadows are the clients that mirror requests to the shadow pools of pools.
+	shadows []*shadowClient
+	// accessLogs are the access logs opened by Start, keyed by path, and accessLogFiles are closed by Shutdown.
+	accessLogs     map[string]*accessLog
+	accessLogFiles []*os.File
+	// connWG tracks the goroutines serving client connections
+	connWG sync.WaitGroup
+	// started and startedAt are set by Start. listenWG tracks the goroutines accepting connections, which send errors to acceptErrors.
+	started      bool
+	startedAt    time.Time
+	listenWG     sync.WaitGroup
+	acceptErrors chan error
+	// shutdown is closed when Shutdown is first called, and drained is closed when Shutdown returns.
+	shutdown chan struct{}
+	drained  chan struct{}
+}
+
+// NewServer creates a Server for the given pools. If statsPort is non-zero, a stats server is also started on that port.
+func NewServer(configs map[string]config.Config, statsPort uint) *Server {
+	return &Server{
+		configs:    configs,
+		statsPort:  statsPort,
+		conns:      make(map[net.Conn]struct{}),
+		pools:      make(map[string]*sharded.ReloadableClient),
+		accessLogs: make(map[string]*accessLog),
+		boundAddrs: make(map[string][]net.Addr),
+		shutdown:   make(chan struct{}),
+		drained:    make(chan struct{}),
+	}
+}
+
+// BoundAddrs returns the address that the listener for the first listen address of each pool is bound to, keyed by pool name.
+// This includes the port that was assigned by the OS if the configured port was 0.
+func (s *Server) BoundAddrs() map[string]net.Addr {
+	s.m.Lock()
+	defer s.m.Unlock()
+	result := make(map[string]net.Addr, len(s.boundAddrs))
+	for name, addrs := range s.boundAddrs {
+		result[name] = addrs[0]
+	}
+	return result
+}
+
+// PoolBoundAddrs returns the addresses that the listeners of the pool are bound to, in the order of its listen addresses.
+func (s *Server) PoolBoundAddrs(pool string) []net.Addr {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]net.Addr(nil), s.boundAddrs[pool]...)
+}
+
+func (s *Server) isShuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) addListener(l net.Listener) {
+	s.m.Lock()
+	s.listeners = append(s.listeners, l)
+	s.m.Unlock()
+}
+
+func (s *Server) addPacketConn(pc net.PacketConn) {
+	s.m.Lock()
+	s.packetConns = append(s.packetConns, pc)
+	s.m.Unlock()
+}
+
+// trackConn records a newly accepted connection. It returns false if the server is shutting down.
+func (s *Server) trackConn(c net.Conn) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.isShuttingDown() {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.connWG.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(c net.Conn) {
+	s.m.Lock()
+	delete(s.conns, c)
+	s.m.Unlock()
+	s.connWG.Done()
+}
+
+// Shutdown stops accepting new connections and waits for the commands that were already read from clients to get responses.
+// If ctx is done before that, the remaining client connections are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	if s.isShuttingDown() {
+		s.m.Unlock()
+		<-s.drained
+		return nil
+	}
+	close(s.shutdown)
+	listeners := s.listeners
+	packetConns := s.packetConns
+	for c := range s.conns {
+		// Wake up goroutines waiting for the next command from an idle client.
+		// Commands that were already buffered are still processed.
+		c.SetReadDeadline(time.Now())
+	}
+	s.m.Unlock()
+	defer close(s.drained)
+
+	for _, l := range listeners {
+		// Stop listening (and unlink the socket if unix type):
+		l.Close()
+	}
+	for _, pc := range packetConns {
+		pc.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		// Requests are no longer sent once every client connection is closed, even if ctx is done first.
+		s.finalizePools()
+		close(done)
+	}()
+	// Lines for the responses that are still being sent after ctx is done are not logged.
+	defer s.closeAccessLogs()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.m.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.m.Unlock()
+		return ctx.Err()
+	}
+}
+
+// finalizePools closes the connections to the servers of every pool and shadow pool.
+func (s *Server) finalizePools() {
+	s.m.Lock()
+	pools := s.pools
+	shadows := s.shadows
+	s.m.Unlock()
+	for _, pool := range pools {
+		pool.Finalize()
+	}
+	for _, shadow := range shadows {
+		shadow.finalize()
+	}
 }
 
 // serveSocket runs in a loop to read memcached requests and send memcached responses
-func serveSocket(remote memcache.ClientInterface, c net.Conn) {
-	reader := bufio.NewReader(c)
-	responseQueue := responsequeue.CreateResponseQueue(c)
+func (s *Server) serveSocket(remote memcache.ClientInterface, c net.Conn, conf config.Config) {
+	defer s.untrackConn(c)
+	stats.Global.ConnectionOpened()
+	defer stats.Global.ConnectionClosed()
+	configureClientConn(c, conf)
+	if tracer := tracerOf(remote); tracer != nil && tracer.hooks.ConnectionOpened != nil {
+		tracer.hooks.ConnectionOpened(ConnectionTrace{Pool: tracer.pool, RemoteAddr: c.RemoteAddr(), Time: time.Now()})
+	}
+	// Requests that are still waiting for a memcache server are abandoned if the client connection breaks.
+	// A client that only closes its side of the connection still gets the responses to the requests it sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	remote = &contextClient{ClientInterface: remote, ctx: ctx}
+	responseQueue := createClientResponseQueue(cancelingConn{c, cancel}, conf)
+	reader := getClientReader(drainingReader{countingReader{c}, responseQueue}, maxLineLengthOf(conf))
+	logSlowRequests(responseQueue, remote, conf)
+	if log := s.accessLogOf(conf); log != nil {
+		log.logResponses(responseQueue, remoteAddrString(c))
+	}
 
+	// Clients using the binary protocol can use the same listener, which is detected from the first byte of the first request.
+	maxItemSize := maxItemSizeOf(conf)
+	handle := newCommandHandler(maxItemSize, conf.LenientLineEndings)
+	if conf.ClientIdleTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(conf.ClientIdleTimeout))
+	}
+	binaryProtocol := false
+	if first, err := reader.Peek(1); err == nil && first[0] == BINARY_REQUEST_MAGIC {
+		binaryProtocol = true
+		handle = newBinaryCommandHandler(maxItemSize)
+	}
+	if conf.Auth != nil {
+		// Only the binary protocol supports authentication.
+		if binaryProtocol {
+			handle = newBinarySASLHandler(conf.Auth, maxItemSize)
+		} else {
+			handle = rejectUnauthenticatedText
+		}
+	}
 	for {
-		err := handleCommand(reader, responseQueue, remote)
+		if conf.ClientIdleTimeout > 0 {
+			// This is set before checking isShuttingDown, so that it can't replace the deadline that Shutdown sets to wake up idle clients.
+			c.SetReadDeadline(time.Now().Add(conf.ClientIdleTimeout))
+		}
+		// Commands that were already read from the client, e.g. pipelined with the previous command, are still handled after Shutdown is called.
+		if s.isShuttingDown() && reader.Buffered() == 0 {
+			break
+		}
+		err := handle(reader, responseQueue, remote)
 		if err != nil {
-			c.Close()
-			return
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && conf.ClientIdleTimeout > 0 && !s.isShuttingDown() {
+				getLogger().Debug("Closing idle client connection", "remote", remoteAddrString(c), "client_idle_timeout", conf.ClientIdleTimeout)
+				break
+			}
+			if isConnectionReset(err) {
+				cancel()
+			}
+			logConnectionError(err, remoteAddrString(c), s.isShuttingDown())
+			break
+		}
+	}
+	// Send the responses to the commands that were already forwarded. The response queue then closes c.
+	responseQueue.Close()
+	responseQueue.Wait()
+	responseQueue.Release()
+	putClientReader(reader)
+}
+
+// maxLineLengthOf returns the maximum length of request lines from clients of the pool.
+func maxLineLengthOf(conf config.Config) int {
+	if conf.MaxLineLength == 0 {
+		return config.DEFAULT_MAX_LINE_LENGTH
+	}
+	return int(conf.MaxLineLength)
+}
+
+// maxItemSizeOf returns the maximum length of values from clients of the pool.
+func maxItemSizeOf(conf config.Config) int {
+	if conf.MaxItemSize == 0 {
+		return MAX_ITEM_SIZE
+	}
+	return int(conf.MaxItemSize)
+}
+
+// createClientResponseQueue creates the queue of responses to a client of the pool.
+func createClientResponseQueue(w io.Writer, conf config.Config) *responsequeue.ResponseQueue {
+	responseQueue := responsequeue.CreateResponseQueue(w)
+	switch conf.BackendErrors {
+	case "prefix":
+		responseQueue.SetBackendErrorMode(responsequeue.BACKEND_ERRORS_PREFIX)
+	case "generic":
+		responseQueue.SetBackendErrorMode(responsequeue.BACKEND_ERRORS_GENERIC)
+	}
+	if conf.WriteBufferSize > 0 {
+		responseQueue.SetWriteBuffer(int(conf.WriteBufferSize))
+	}
+	return responseQueue
+}
+
+// logConnectionError logs the error that caused a client connection to be closed, unless it is expected.
+func logConnectionError(err error, remote string, shuttingDown bool) {
+	switch e := err.(type) {
+	case *requestError:
+		getLogger().Warn("Request parsing failed", "remote", remote, "command", e.command, "error", e.err)
+		return
+	case net.Error:
+		// e.g. the connection was reset by the client, or Shutdown woke up an idle connection.
+		if !shuttingDown {
+			getLogger().Warn("Closing client connection", "remote", remote, "error", err)
 		}
+		return
+	}
+	switch err {
+	case io.EOF, errQuit:
+	case errPartialRequest:
+		getLogger().Debug("Closing client connection", "remote", remote, "error", err)
+	default:
+		getLogger().Warn("Closing client connection", "remote", remote, "error", err)
 	}
 }
 
-func handleUnexpectedExit(listeners []net.Listener, didExit *bool) {
+// remoteAddrString returns the address of the client for logging. This is empty for unix sockets.
+func remoteAddrString(c net.Conn) string {
+	if addr := c.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func handleUnexpectedExit(s *Server, shutdownTimeout time.Duration) {
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt, os.Kill, syscall.SIGTERM)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
 	go func(c chan os.Signal) {
-		// Wait for a SIGINT or SIGKILL:
+		// Wait for a SIGINT or SIGTERM:
 		sig := <-c
-		*didExit = true
-		fmt.Fprintf(os.Stderr, "Caught signal %s: shutting down.\n", sig)
-		for _, l := range listeners {
-			// Stop listening (and unlink the socket if unix type):
-			l.Close()
-		}
-		// And we're done:
-		os.Exit(0)
+		getLogger().Info("Caught signal, shutting down", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := s.Shutdown(ctx)
+		if err != nil {
+			getLogger().Warn("Gave up waiting for in-flight requests", "timeout", shutdownTimeout, "error", err)
+		}
 	}(sigc)
 }
 
+// handleReload reloads the servers of every pool from loadConfigs whenever the process receives SIGHUP.
+func handleReload(s *Server, loadConfigs func() (map[string]config.Config, error)) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	go func() {
+		for range sigc {
+			getLogger().Info("Caught SIGHUP, reloading the config")
+			configs, err := loadConfigs()
+			if err == nil {
+				err = s.Reload(configs)
+			}
+			if err != nil {
+				getLogger().Error("Failed to reload the config, keeping the old config", "error", err)
+				continue
+			}
+			getLogger().Info("Reloaded the config")
+		}
+	}()
+}
+
+// Reload replaces the servers, hash, distribution, and other settings for connecting to servers of every pool with the ones in configs.
+// Listeners and client connections are kept open. Requests that are in flight complete against the old servers.
+// Adding or removing pools or changing listen addresses requires a restart, so configs must have the same pools and listen addresses.
+// If an error is returned, no pools were changed.
+func (s *Server) Reload(configs map[string]config.Config) error {
+	err := config.Validate(configs)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.isShuttingDown() {
+		return errors.New("the server is shutting down")
+	}
+	if len(configs) != len(s.configs) {
+		return fmt.Errorf("expected %d pools, got %d. Adding or removing pools requires a restart", len(s.configs), len(configs))
+	}
+	for name, conf := range configs {
+		oldConf, ok := s.configs[name]
+		if !ok {
+			return fmt.Errorf("unknown pool %q. Adding or removing pools requires a restart", name)
+		}
+		if !equalStrings(conf.Listen, oldConf.Listen) {
+			return fmt.Errorf("listen for %q changed from %q to %q. Changing listen addresses requires a restart", name, oldConf.Listen, conf.Listen)
+		}
+		if option := changedClientOption(oldConf, conf); option != "" {
+			return fmt.Errorf("%s for %q changed. Changing %s requires a restart", option, name, option)
+		}
+		if _, ok := s.pools[name]; !ok {
+			return fmt.Errorf("pool %q is not serving requests yet", name)
+		}
+	}
+	newConfigs := make(map[string]config.Config, len(configs))
+	for name, conf := range configs {
+		err := reloadPool(s.pools[name], conf)
+		if err != nil {
+			return fmt.Errorf("failed to reload %q: %v", name, err)
+		}
+		newConfigs[name] = conf
+	}
+	s.configs = newConfigs
+	return nil
+}
+
+// changedClientOption returns the name of an option that differs between oldConf and conf, out of the options
+// that wrap the client of a pool in Start, or "" if they are unchanged. Reload only replaces the servers of the pool.
+func changedClientOption(oldConf, conf config.Config) string {
+	switch {
+	case oldConf.CoalesceGets != conf.CoalesceGets:
+		return "coalesce_gets"
+	case oldConf.MissOnBackendDown != conf.MissOnBackendDown:
+		return "miss_on_backend_down"
+	case !equalServers(oldConf.Shadow, conf.Shadow):
+		return "shadow"
+	case oldConf.ShadowRatio != conf.ShadowRatio:
+		return "shadow_ratio"
+	case oldConf.TTLOverride != conf.TTLOverride:
+		return "ttl_override"
+	case oldConf.MaxTTL != conf.MaxTTL:
+		return "max_ttl"
+	case oldConf.FireAndForgetSets != conf.FireAndForgetSets:
+		return "fire_and_forget_sets"
+	case oldConf.ReadOnly != conf.ReadOnly:
+		return "read_only"
+	case !oldConf.CommandPolicy.Equal(conf.CommandPolicy):
+		return "allowed_commands/denied_commands"
+	}
+	return ""
+}
+
+func equalServers(a, b []config.TCPServer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadPool calls pool.Reload, converting a panic from an invalid config into an error.
+func reloadPool(pool *sharded.ReloadableClient, conf config.Config) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return pool.Reload(conf)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// createUnixSocket listens on the unix socket at path, which is removed when the listener is closed.
+// On Linux, a path starting with "@" is an abstract socket, which has no file to create or remove.
 func createUnixSocket(path string, serverType string) (net.Listener, error) {
-	fmt.Fprintf(os.Stderr, "Listening for %s requests at unix socket %q\n", serverType, path)
+	getLogger().Info("Listening for requests", "server", serverType, "unix", path)
 	l, err := net.Listen("unix", path)
-	return l, err
+	if err != nil {
+		return nil, err
+	}
+	if isAbstractUnixSocket(path) {
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+	}
+	return l, nil
+}
+
+// setUnixSocketPermissions applies the file mode and owner from the config to the unix socket at path.
+func setUnixSocketPermissions(path string, conf config.Config) error {
+	if isAbstractUnixSocket(path) {
+		// Abstract sockets have no file. Any process in the same network namespace can connect.
+		return nil
+	}
+	mode := conf.UnixSocketMode
+	if mode == 0 {
+		mode = config.DEFAULT_UNIX_SOCKET_MODE
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if conf.UnixSocketUID == nil && conf.UnixSocketGID == nil {
+		return nil
+	}
+	// -1 keeps the current owner or group.
+	uid, gid := -1, -1
+	if conf.UnixSocketUID != nil {
+		uid = *conf.UnixSocketUID
+	}
+	if conf.UnixSocketGID != nil {
+		gid = *conf.UnixSocketGID
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// isAbstractUnixSocket returns true if path is the name of a Linux abstract unix socket rather than a file.
+func isAbstractUnixSocket(path string) bool {
+	return len(path) > 0 && path[0] == '@'
+}
+
+// createPoolListener listens on a tcp address or unix socket from the listen addresses of conf.
+func createPoolListener(socketPath string, conf config.Config) (net.Listener, error) {
+	network, address := config.ParseListenAddress(socketPath)
+	if network == "tcp" {
+		if conf.ReusePort {
+			return createReusePortTCPSocket(address, "memcache")
+		}
+		return createTCPSocket(address, "memcache")
+	}
+	l, err := createUnixSocket(address, "memcache")
+	if err != nil {
+		return nil, err
+	}
+	if err := setUnixSocketPermissions(address, conf); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
 func createTCPSocket(path string, serverType string) (net.Listener, error) {
-	fmt.Fprintf(os.Stderr, "Listening for %s requests at tcp server %q\n", serverType, path)
+	getLogger().Info("Listening for requests", "server", serverType, "tcp", path)
 	l, err := net.Listen("tcp", path)
 	return l, err
 }
 
-func serveSocketServer(remote memcache.ClientInterface, l net.Listener, path string, didExit *bool) {
+// serveSocketServer accepts connections from l until the server shuts down or accepting fails.
+// It returns nil if the server shut down.
+func (s *Server) serveSocketServer(remote memcache.ClientInterface, l net.Listener, conf config.Config) error {
+	path := l.Addr().String()
+	// liveConnections is the number of connections from this listener that are being served.
+	var liveConnections int64
+	limiter := newConnectionRateLimiter(conf)
 	for {
 		fd, err := l.Accept()
-		if *didExit {
-			return
+		if s.isShuttingDown() {
+			if fd != nil {
+				fd.Close()
+			}
+			return nil
 		}
 		if err != nil {
-			// TODO: Clean up debug code
-			fmt.Fprintf(os.Stderr, "accept error for %q: %v", path, err)
-			return
+			getLogger().Error("Failed to accept a connection", "listen", path, "error", err)
+			return fmt.Errorf("failed to accept connections at %s: %v", path, err)
+		}
+		if !isAllowedClient(fd.RemoteAddr(), conf.AllowCIDRs) {
+			getLogger().Debug("Rejecting client connection from outside of allow_cidrs", "listen", path, "remote", remoteAddrString(fd))
+			stats.Global.ConnectionRejected()
+			fd.Close()
+			continue
+		}
+		if conf.MaxConnections > 0 && atomic.LoadInt64(&liveConnections) >= int64(conf.MaxConnections) {
+			getLogger().Debug("Rejecting client connection, max_connections was reached", "listen", path, "remote", remoteAddrString(fd))
+			stats.Global.ConnectionRejected()
+			fd.Close()
+			continue
+		}
+		if limiter != nil {
+			if wait := limiter.reserve(time.Now()); wait > 0 {
+				// Later connections wait in the listen backlog until this one is served.
+				stats.Global.ConnectionThrottled()
+				time.Sleep(wait)
+			}
+		}
+		if !s.trackConn(fd) {
+			fd.Close()
+			return nil
 		}
 
-		go serveSocket(remote, fd)
+		atomic.AddInt64(&liveConnections, 1)
+		go func() {
+			defer atomic.AddInt64(&liveConnections, -1)
+			s.serveSocket(remote, fd, conf)
+		}()
 	}
 }
 
-func serveStatsServer(statsPortFlag uint, didExit *bool) {
+func (s *Server) serveStatsServer() {
+	statsPortFlag := s.statsPort
 	if statsPortFlag == 0 || statsPortFlag >= (1<<16) {
 		return
 	}
@@ -558,19 +1530,20 @@ func serveStatsServer(statsPortFlag uint, didExit *bool) {
 	l, err = createTCPSocket(statsServerAddr, "stats")
 	if err != nil {
 		// TODO: Clean up the rest of the sockets
-		fmt.Fprintf(os.Stderr, "Listen error at %s: %v\n", statsServerAddr, err)
+		getLogger().Error("Failed to listen", "server", "stats", "listen", statsServerAddr, "error", err)
 		return
 	}
+	s.addListener(l)
 
 	go func() {
 		for {
 			fd, err := l.Accept()
-			if *didExit {
+			if s.isShuttingDown() {
 				return
 			}
 			if err != nil {
 				// TODO: Clean up debug code
-				fmt.Fprintf(os.Stderr, "accept error for %s: %v", statsServerAddr, err)
+				getLogger().Error("Failed to accept a connection", "listen", statsServerAddr, "error", err)
 				return
 			}
 
@@ -591,43 +1564,203 @@ func serveStatsServer(statsPortFlag uint, didExit *bool) {
 	}()
 }
 
-func Run(configs map[string]config.Config, statsPort uint) {
-	var wg sync.WaitGroup
-	wg.Add(len(configs))
-
-	didExit := false
-	listeners := []net.Listener{}
+// Serve listens for requests to every pool and blocks until the listeners stop. This is the same as Start followed by Wait.
+func (s *Server) Serve() error {
+	err := s.Start()
+	if err != nil {
+		return err
+	}
+	return s.Wait()
+}
 
-	for _, config := range configs {
-		remote := sharded.New(config)
-		socketPath := config.Listen
-		// TODO: Also support tcp sockets
-		var l net.Listener
-		var err error
-		i := strings.IndexRune(socketPath, ':')
-		if i >= 0 {
-			l, err = createTCPSocket(socketPath, "memcache")
-		} else {
-			l, err = createUnixSocket(socketPath, "memcache")
+// Start listens for requests to every pool and returns once every listener is created, without waiting for the listeners to stop.
+// If listening for any pool fails, the listeners that were already created are closed (removing their unix socket files) and a *ListenError is returned.
+func (s *Server) Start() error {
+	s.m.Lock()
+	configs := s.configs
+	if s.started {
+		s.m.Unlock()
+		return errors.New("the server was already started")
+	}
+	s.started = true
+	s.startedAt = time.Now()
+	for _, conf := range configs {
+		if conf.AccessLog == "" || s.accessLogs[conf.AccessLog] != nil {
+			continue
 		}
+		log, f, err := openAccessLog(conf.AccessLog)
 		if err != nil {
-			// TODO: Clean up the rest of the sockets
-			fmt.Fprintf(os.Stderr, "Listen error at %s: %v\n", socketPath, err)
-			for _, l := range listeners {
-				l.Close()
+			s.m.Unlock()
+			s.Shutdown(context.Background())
+			return fmt.Errorf("failed to open the access log: %v", err)
+		}
+		s.accessLogs[conf.AccessLog] = log
+		s.accessLogFiles = append(s.accessLogFiles, f)
+	}
+	// Each pool has a goroutine for each listener and possibly one for the udp listener.
+	listenerCount := 0
+	for _, conf := range configs {
+		listenerCount += len(conf.Listen) + 1
+	}
+	acceptErrors := make(chan error, listenerCount)
+	s.acceptErrors = acceptErrors
+	s.m.Unlock()
+	if len(configs) == 0 {
+		return errors.New("no pools were configured")
+	}
+	defer s.closeUnusedInheritedListeners()
+	wg := &s.listenWG
+
+	for name, conf := range configs {
+		conf := conf
+		pool := sharded.NewReloadable(conf)
+		s.m.Lock()
+		s.pools[name] = pool
+		s.m.Unlock()
+		var remote memcache.ClientInterface = pool
+		if s.Trace.enabled() {
+			remote = &tracingClient{ClientInterface: remote, pool: name, hooks: s.Trace}
+		}
+		if conf.CoalesceGets {
+			remote = newCoalescingClient(remote)
+		}
+		if conf.MissOnBackendDown {
+			remote = &missOnBackendDownClient{ClientInterface: remote, reachable: pool.Reachable}
+		}
+		if len(conf.Shadow) > 0 {
+			shadowConf := conf
+			shadowConf.Servers = conf.Shadow
+			shadowConf.PrefixRoutes = nil
+			shadow := &shadowClient{ClientInterface: remote, shadow: sharded.New(shadowConf), ratio: conf.ShadowRatio}
+			s.m.Lock()
+			s.shadows = append(s.shadows, shadow)
+			s.m.Unlock()
+			remote = shadow
+		}
+		// The expiration time is overridden before requests are mirrored to the shadow pool.
+		if conf.TTLOverride > 0 {
+			remote = &ttlOverrideClient{ClientInterface: remote, ttl: conf.TTLOverride}
+		}
+		if conf.MaxTTL > 0 {
+			remote = &maxTTLClient{ClientInterface: remote, maxTTL: conf.MaxTTL}
+		}
+		if conf.FireAndForgetSets {
+			remote = &fireAndForgetClient{ClientInterface: remote}
+		}
+		if conf.ReadOnly {
+			remote = &readOnlyClient{ClientInterface: remote}
+		}
+		if conf.CommandPolicy != nil {
+			remote = &commandPolicyClient{ClientInterface: remote, policy: conf.CommandPolicy}
+		}
+		// Every listen address of the pool sends requests to the same servers.
+		for _, socketPath := range conf.Listen {
+			l := s.takeInheritedListener(socketPath)
+			var err error
+			if l == nil {
+				l, err = createPoolListener(socketPath, conf)
+			}
+			if err != nil {
+				getLogger().Error("Failed to listen", "pool", name, "listen", socketPath, "error", err)
+				// Stop the pools that already started listening.
+				s.Shutdown(context.Background())
+				wg.Wait()
+				return &ListenError{Pool: name, Listen: socketPath, Err: err}
+			}
+			l = wrapClientTLS(l, conf)
+			s.addListener(l)
+			s.m.Lock()
+			s.boundAddrs[name] = append(s.boundAddrs[name], l.Addr())
+			s.m.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer l.Close()
+				err := s.serveSocketServer(remote, l, conf)
+				if err != nil {
+					acceptErrors <- err
+				}
+			}()
+		}
+
+		if conf.UDPListen != "" {
+			getLogger().Info("Listening for requests", "server", "memcache", "udp", conf.UDPListen)
+			pc, err := net.ListenPacket("udp", conf.UDPListen)
+			if err != nil {
+				getLogger().Error("Failed to listen", "pool", name, "udp_listen", conf.UDPListen, "error", err)
+				s.Shutdown(context.Background())
+				wg.Wait()
+				return &ListenError{Pool: name, Listen: conf.UDPListen, Err: err}
 			}
-			return
+			s.addPacketConn(pc)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer pc.Close()
+				err := s.serveUDP(remote, pc, conf)
+				if err != nil {
+					acceptErrors <- err
+				}
+			}()
 		}
-		listeners = append(listeners, l)
+	}
+	err := s.serveHTTP(configs)
+	if err != nil {
+		getLogger().Error("Failed to listen", "server", "http", "error", err)
+		s.Shutdown(context.Background())
+		wg.Wait()
+		return err
+	}
+	s.serveStatsServer()
+	return nil
+}
 
-		go func() {
-			defer l.Close()
-			serveSocketServer(remote, l, socketPath, &didExit)
-			wg.Done()
-		}()
+// Wait blocks until the listeners started by Start stop. If Shutdown was called, this also waits for Shutdown to finish.
+// If accepting connections fails, the other pools keep serving requests, and the first error is returned after they stop.
+func (s *Server) Wait() error {
+	s.listenWG.Wait()
+	if s.isShuttingDown() {
+		<-s.drained
+	}
+	s.m.Lock()
+	acceptErrors := s.acceptErrors
+	s.m.Unlock()
+	select {
+	case err := <-acceptErrors:
+		return err
+	default:
+		return nil
 	}
-	serveStatsServer(statsPort, &didExit)
+}
+
+// Stop shuts down the server like Shutdown, then waits for the listeners started by Start to stop.
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.Shutdown(ctx)
+	s.listenWG.Wait()
+	return err
+}
 
-	handleUnexpectedExit(listeners, &didExit)
-	wg.Wait()
+// Run serves requests for the given pools until the process receives SIGINT or SIGTERM.
+// It then waits up to shutdownTimeout for responses to requests that are in flight.
+// A snapshot of the client connections and servers is written to stderr when the process receives SIGUSR1.
+// If loadConfigs is non-nil, the servers of the pools are reloaded from it when the process receives SIGHUP.
+// Listening sockets passed by the parent process with LISTEN_FDS (e.g. systemd socket activation) are used for the listen addresses they are bound to.
+// An error is returned if the configs are invalid or golemproxy could not start listening.
+func Run(configs map[string]config.Config, statsPort uint, shutdownTimeout time.Duration, loadConfigs func() (map[string]config.Config, error)) error {
+	err := config.Validate(configs)
+	if err != nil {
+		return err
+	}
+	s := NewServer(configs, statsPort)
+	s.inherited, err = inheritedListeners()
+	if err != nil {
+		return err
+	}
+	handleUnexpectedExit(s, shutdownTimeout)
+	handleDumpState(s)
+	if loadConfigs != nil {
+		handleReload(s, loadConfigs)
+	}
+	return s.Serve()
 }
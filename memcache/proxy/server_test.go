@@ -0,0 +1,2183 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
+	"github.com/TysonAndre/golemproxy/sharded"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// fakeRemote records the messages that would be sent to a memcache server and replies to them with respond.
+// Only sending messages is implemented, other methods of ClientInterface will panic.
+type fakeRemote struct {
+	memcache.ClientInterface
+	m        sync.Mutex
+	requests []*message.SingleMessage
+	// data is a copy of the RequestData of each request, which is released after the response is received.
+	data    []string
+	respond func(m *message.SingleMessage) []byte
+}
+
+func (r *fakeRemote) SendProxiedMessageAsync(m *message.SingleMessage) {
+	r.m.Lock()
+	r.requests = append(r.requests, m)
+	r.data = append(r.data, string(m.RequestData))
+	r.m.Unlock()
+	response := []byte("END\r\n")
+	if r.respond != nil {
+		response = r.respond(m)
+	}
+	m.HandleReceiveResponse(response, fakeResponseType(response))
+}
+
+func (r *fakeRemote) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	r.SendProxiedMessageAsync(m)
+}
+
+// fakeResponseType returns the response type for the fixed responses used in these tests.
+func fakeResponseType(response []byte) message.ResponseType {
+	switch {
+	case bytes.HasPrefix(response, []byte("VALUE ")):
+		return message.RESPONSE_MC_VALUE
+	case bytes.Equal(response, []byte("END\r\n")):
+		return message.RESPONSE_MC_END
+	case bytes.Equal(response, []byte("STORED\r\n")):
+		return message.RESPONSE_MC_STORED
+	case bytes.Equal(response, []byte("NOT_STORED\r\n")):
+		return message.RESPONSE_MC_NOT_STORED
+	case bytes.Equal(response, []byte("DELETED\r\n")):
+		return message.RESPONSE_MC_DELETED
+	case bytes.Equal(response, []byte("NOT_FOUND\r\n")):
+		return message.RESPONSE_MC_NOT_FOUND
+	}
+	return message.RESPONSE_MC_PROTOCOLERROR
+}
+
+// delayedRemote passes messages to send without responding to them.
+type delayedRemote struct {
+	memcache.ClientInterface
+	send func(m *message.SingleMessage)
+}
+
+func (r *delayedRemote) SendProxiedMessageAsync(m *message.SingleMessage) {
+	r.send(m)
+}
+
+func (r *delayedRemote) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	r.send(m)
+}
+
+func (r *fakeRemote) requestData() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]string{}, r.data...)
+}
+
+// fakeBackend is a memcache server on a local tcp port. handle is called with each request line (including \r\n)
+// and may read a request body from reader.
+type fakeBackend struct {
+	listener net.Listener
+	handle   func(line string, reader *bufio.Reader, writer io.Writer)
+	// open is the number of connections from the proxy that are open.
+	open int32
+}
+
+func newFakeBackend(t *testing.T, handle func(line string, reader *bufio.Reader, writer io.Writer)) *fakeBackend {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	backend := &fakeBackend{listener: l, handle: handle}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go backend.serve(c)
+		}
+	}()
+	return backend
+}
+
+func (b *fakeBackend) serve(c net.Conn) {
+	atomic.AddInt32(&b.open, 1)
+	defer atomic.AddInt32(&b.open, -1)
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		b.handle(line, reader, c)
+	}
+}
+
+func (b *fakeBackend) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *fakeBackend) close() {
+	b.listener.Close()
+}
+
+// newStoreHandler returns a handler for a fakeBackend that implements get, set, cas, delete, incr, decr, touch, gat, and flush_all with an in-memory map.
+// Expiration times are ignored.
+func newStoreHandler() func(line string, reader *bufio.Reader, writer io.Writer) {
+	var m sync.Mutex
+	values := make(map[string]string)
+	// casUniques is the cas unique of each value, which changes whenever the value is stored.
+	casUniques := make(map[string]uint64)
+	var lastCasUnique uint64
+	store := func(key string, value string) {
+		lastCasUnique++
+		values[key] = value
+		casUniques[key] = lastCasUnique
+	}
+	return func(line string, reader *bufio.Reader, writer io.Writer) {
+		m.Lock()
+		defer m.Unlock()
+		args := strings.Fields(line)
+		noreply := args[len(args)-1] == "noreply"
+		reply := func(response string) {
+			if !noreply {
+				io.WriteString(writer, response)
+			}
+		}
+		switch args[0] {
+		case "get", "gets", "gat", "gats":
+			keys := args[1:]
+			if args[0] == "gat" || args[0] == "gats" {
+				keys = args[2:]
+			}
+			response := ""
+			for _, key := range keys {
+				if value, ok := values[key]; ok {
+					response += "VALUE " + key + " 0 " + strconv.Itoa(len(value))
+					if args[0] == "gets" || args[0] == "gats" {
+						response += " " + strconv.FormatUint(casUniques[key], 10)
+					}
+					response += "\r\n" + value + "\r\n"
+				}
+			}
+			io.WriteString(writer, response+"END\r\n")
+		case "set":
+			length, _ := strconv.Atoi(args[4])
+			body := make([]byte, length+2)
+			io.ReadFull(reader, body)
+			store(args[1], string(body[:length]))
+			reply("STORED\r\n")
+		case "cas":
+			length, _ := strconv.Atoi(args[4])
+			body := make([]byte, length+2)
+			io.ReadFull(reader, body)
+			if _, ok := values[args[1]]; !ok {
+				reply("NOT_FOUND\r\n")
+				return
+			}
+			if strconv.FormatUint(casUniques[args[1]], 10) != args[5] {
+				reply("EXISTS\r\n")
+				return
+			}
+			store(args[1], string(body[:length]))
+			reply("STORED\r\n")
+		case "delete":
+			if _, ok := values[args[1]]; !ok {
+				reply("NOT_FOUND\r\n")
+				return
+			}
+			delete(values, args[1])
+			reply("DELETED\r\n")
+		case "flush_all":
+			values = make(map[string]string)
+			reply("OK\r\n")
+		case "touch":
+			if _, ok := values[args[1]]; !ok {
+				reply("NOT_FOUND\r\n")
+				return
+			}
+			reply("TOUCHED\r\n")
+		case "incr", "decr":
+			value, ok := values[args[1]]
+			if !ok {
+				reply("NOT_FOUND\r\n")
+				return
+			}
+			n, _ := strconv.ParseUint(value, 10, 64)
+			delta, _ := strconv.ParseUint(args[2], 10, 64)
+			if args[0] == "incr" {
+				// incr wraps around at 64 bits
+				n += delta
+			} else if delta > n {
+				// decr stops at 0
+				n = 0
+			} else {
+				n -= delta
+			}
+			values[args[1]] = strconv.FormatUint(n, 10)
+			reply(values[args[1]] + "\r\n")
+		default:
+			io.WriteString(writer, "ERROR\r\n")
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to read while a ResponseQueue writes to it.
+type syncBuffer struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
+
+// awaitOutput waits for the response queue to write at least len(expected) bytes to the client.
+func awaitOutput(t *testing.T, output *syncBuffer, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(output.String()) < len(expected) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	testutil.ExpectStringEquals(t, expected, output.String(), "unexpected response to client")
+}
+
+// handleAllCommands runs handleCommand until the input is fully consumed and returns the non-EOF errors.
+func handleAllCommands(input string, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) []error {
+	reader := bufio.NewReader(strings.NewReader(input))
+	errs := []error{}
+	for {
+		err := handleCommand(reader, responses, remote, MAX_ITEM_SIZE)
+		if err == io.EOF {
+			return errs
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+}
+
+func TestReplaceAndPrependAreStorageCommands(t *testing.T) {
+	for _, test := range []struct {
+		command     string
+		requestType message.RequestType
+	}{
+		{"set", message.REQUEST_MC_SET},
+		{"add", message.REQUEST_MC_ADD},
+		{"replace", message.REQUEST_MC_REPLACE},
+		{"append", message.REQUEST_MC_APPEND},
+		{"prepend", message.REQUEST_MC_PREPEND},
+	} {
+		output := &syncBuffer{}
+		responses := responsequeue.CreateResponseQueue(output)
+		remote := &fakeRemote{
+			respond: func(m *message.SingleMessage) []byte {
+				if m.RequestType == message.REQUEST_MC_GET {
+					return []byte("VALUE key 0 3\r\nfoo\r\nEND\r\n")
+				}
+				return []byte("STORED\r\n")
+			},
+		}
+		storageRequest := test.command + " key 0 0 3\r\nfoo\r\n"
+		errs := handleAllCommands(storageRequest+"get key\r\n", responses, remote)
+		testutil.ExpectEquals(t, []error{}, errs, "unexpected errors for "+test.command)
+		testutil.ExpectEquals(t, []string{storageRequest, "get key\r\n"}, remote.requestData(), "unexpected requests for "+test.command)
+		testutil.ExpectEquals(t, test.requestType, remote.requests[0].RequestType, "unexpected request type for "+test.command)
+		testutil.ExpectStringEquals(t, "key", string(remote.requests[0].Key), "unexpected key for "+test.command)
+		awaitOutput(t, output, "STORED\r\nVALUE key 0 3\r\nfoo\r\nEND\r\n")
+		responses.Close()
+	}
+}
+
+func TestCommandNameLengths(t *testing.T) {
+	for _, test := range []struct {
+		request     string
+		requestType message.RequestType
+	}{
+		{"delete key\r\n", message.REQUEST_MC_DELETE},
+		{"append key 0 0 1\r\nx\r\n", message.REQUEST_MC_APPEND},
+		{"replace key 0 0 1\r\nx\r\n", message.REQUEST_MC_REPLACE},
+		{"prepend key 0 0 1\r\nx\r\n", message.REQUEST_MC_PREPEND},
+	} {
+		output := &syncBuffer{}
+		responses := responsequeue.CreateResponseQueue(output)
+		remote := &fakeRemote{
+			respond: func(m *message.SingleMessage) []byte {
+				return []byte("NOT_FOUND\r\n")
+			},
+		}
+		errs := handleAllCommands(test.request, responses, remote)
+		testutil.ExpectEquals(t, []error{}, errs, "unexpected errors for "+test.request)
+		testutil.ExpectEquals(t, []string{test.request}, remote.requestData(), "unexpected requests for "+test.request)
+		testutil.ExpectEquals(t, test.requestType, remote.requests[0].RequestType, "unexpected request type for "+test.request)
+		awaitOutput(t, output, "NOT_FOUND\r\n")
+		responses.Close()
+	}
+
+	// A 7 character command is not mistaken for the 6 character command that it starts with.
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{}
+	errs := handleAllCommands("deletes key\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{}, remote.requestData(), "expected nothing to be forwarded")
+	awaitOutput(t, output, "ERROR\r\n")
+}
+
+func TestLenientLineEndings(t *testing.T) {
+	backend := newRecordingBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend.fakeBackend)
+	conf.LenientLineEndings = true
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	// The value is still followed by \r\n.
+	io.WriteString(c, "set k 0 0 1\nx\r\nget k\n\nget k\r\n")
+	reader := bufio.NewReader(c)
+	for _, expected := range []string{
+		"STORED\r\n",
+		"VALUE k 0 1\r\n",
+		"x\r\n",
+		"END\r\n",
+		"ERROR\r\n",
+		"VALUE k 0 1\r\n",
+		"x\r\n",
+		"END\r\n",
+	} {
+		line, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "unexpected error")
+		testutil.ExpectStringEquals(t, expected, line, "unexpected response")
+	}
+	testutil.ExpectEquals(t, []string{"set k 0 0 1\r\n", "get k\r\n", "get k\r\n"}, backend.received(), "expected requests to be forwarded with \\r\\n")
+
+	// By default, request lines must end in \r\n.
+	remote := &fakeRemote{}
+	responses := responsequeue.CreateResponseQueue(&syncBuffer{})
+	defer responses.Close()
+	errs := handleAllCommands("get k\n", responses, remote)
+	testutil.ExpectEquals(t, 1, len(errs), "expected get k\\n to be rejected")
+	testutil.ExpectEquals(t, []string{}, remote.requestData(), "expected nothing to be forwarded")
+}
+
+func TestUnknownCommand(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("VALUE k 0 1\r\nx\r\nEND\r\n")
+		},
+	}
+	errs := handleAllCommands("bogus x\r\nget k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "expected the unknown command not to close the connection")
+	testutil.ExpectEquals(t, []string{"get k\r\n"}, remote.requestData(), "expected only the get to be forwarded")
+	awaitOutput(t, output, "ERROR\r\nVALUE k 0 1\r\nx\r\nEND\r\n")
+}
+
+func TestExtractKeys(t *testing.T) {
+	for _, test := range []struct {
+		data     string
+		expected []string
+	}{
+		{"key", []string{"key"}},
+		{"key ", []string{"key"}},
+		{"  a b  c ", []string{"a", "b", "c"}},
+		{"", []string{}},
+		{"   ", []string{}},
+	} {
+		keys := []string{}
+		for _, key := range extractKeys(nil, []byte(test.data)) {
+			keys = append(keys, string(key))
+		}
+		testutil.ExpectEquals(t, test.expected, keys, "unexpected keys for "+test.data)
+	}
+	// The keys of a get of a single key fit in the buffer on the stack of handleGet.
+	data := []byte("key ")
+	allocs := testing.AllocsPerRun(100, func() {
+		var keysBuffer [1][]byte
+		extractKeys(keysBuffer[:0], data)
+	})
+	testutil.ExpectEquals(t, 0.0, allocs, "expected extracting a single key not to allocate")
+}
+
+func TestEmptyValue(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("set k 0 0 0\r\n\r\nget k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nVALUE k 0 0\r\n\r\nEND\r\n")
+}
+
+func TestBackendClosesMidResponse(t *testing.T) {
+	var closed int32
+	store := newStoreHandler()
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if line == "get k\r\n" && atomic.CompareAndSwapInt32(&closed, 0, 1) {
+			io.WriteString(writer, "VALUE k 0 5\r\nab")
+			writer.(net.Conn).Close()
+			return
+		}
+		store(line, reader, writer)
+	})
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("get k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "SERVER_ERROR backend closed\r\n")
+
+	// The proxy reconnects to the server, and the client connection can still be used.
+	errs = handleAllCommands("set k 0 0 5\r\nhello\r\nget k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "SERVER_ERROR backend closed\r\nSTORED\r\nVALUE k 0 5\r\nhello\r\nEND\r\n")
+}
+
+func TestMaxItemSize(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("STORED\r\n")
+		},
+	}
+	value := strings.Repeat("x", MAX_ITEM_SIZE)
+	errs := handleAllCommands(fmt.Sprintf("set k 0 0 %d\r\n%s\r\n", MAX_ITEM_SIZE, value), responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "a value of exactly MAX_ITEM_SIZE should be accepted")
+	testutil.ExpectEquals(t, 1, len(remote.requests), "expected the set to be forwarded")
+	awaitOutput(t, output, "STORED\r\n")
+
+	// The value is discarded, so that the connection can be used for the next command.
+	errs = handleAllCommands(fmt.Sprintf("set k 0 0 %d\r\n%sx\r\nset k 0 0 %d noreply\r\n%sx\r\nset k 0 0 1\r\ny\r\n", MAX_ITEM_SIZE+1, value, MAX_ITEM_SIZE+1, value), responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "a value larger than MAX_ITEM_SIZE should be rejected without closing the connection")
+	testutil.ExpectEquals(t, []string{"set k 0 0 1\r\ny\r\n"}, remote.requestData()[1:], "the large values should not be forwarded")
+	awaitOutput(t, output, "STORED\r\nSERVER_ERROR object too large for cache\r\nSTORED\r\n")
+}
+
+func TestCustomMaxItemSize(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("STORED\r\n")
+		},
+	}
+	const maxItemSize = 512 * 1024
+	handle := newCommandHandler(maxItemSize, false)
+	value := strings.Repeat("x", maxItemSize)
+	err := handle(bufio.NewReader(strings.NewReader(fmt.Sprintf("set k 0 0 %d\r\n%s\r\n", maxItemSize, value))), responses, remote)
+	testutil.ExpectEquals(t, nil, err, "a value of exactly the max_item_size should be accepted")
+	err = handle(bufio.NewReader(strings.NewReader(fmt.Sprintf("set k 0 0 %d\r\n%sx\r\n", maxItemSize+1, value))), responses, remote)
+	testutil.ExpectEquals(t, nil, err, "a value larger than the max_item_size should be rejected with a response")
+	testutil.ExpectEquals(t, 1, len(remote.requests), "the large value should not be forwarded")
+	awaitOutput(t, output, "STORED\r\nSERVER_ERROR object too large for cache\r\n")
+}
+
+func TestMultiget(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			if string(m.Key) == "b" {
+				return []byte("END\r\n")
+			}
+			return []byte("VALUE " + string(m.Key) + " 0 1\r\nx\r\nEND\r\n")
+		},
+	}
+	errs := handleAllCommands("get a b c\r\nget d\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"get a\r\n", "get b\r\n", "get c\r\n", "get d\r\n"}, remote.requestData(), "expected one request per key")
+	awaitOutput(t, output, "VALUE a 0 1\r\nx\r\nVALUE c 0 1\r\nx\r\nEND\r\nVALUE d 0 1\r\nx\r\nEND\r\n")
+}
+
+func TestGetWithExtraSpaces(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("VALUE " + string(m.Key) + " 0 1\r\nx\r\nEND\r\n")
+		},
+	}
+	errs := handleAllCommands("get key \r\nget  key\r\ngets  a  b \r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"get key\r\n", "get key\r\n", "gets a\r\n", "gets b\r\n"}, remote.requestData(), "expected extra spaces to be ignored")
+	awaitOutput(t, output, "VALUE key 0 1\r\nx\r\nEND\r\nVALUE key 0 1\r\nx\r\nEND\r\nVALUE a 0 1\r\nx\r\nVALUE b 0 1\r\nx\r\nEND\r\n")
+}
+
+func TestMultigetAwaitsAllFragments(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	var pending []*message.SingleMessage
+	remote := &delayedRemote{
+		send: func(m *message.SingleMessage) {
+			pending = append(pending, m)
+		},
+	}
+	errs := handleAllCommands("gets a b\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, 2, len(pending), "expected one request per key")
+	testutil.ExpectEquals(t, message.REQUEST_MC_GETS, pending[0].RequestType, "unexpected request type")
+
+	pending[1].HandleReceiveResponse([]byte("VALUE b 0 1 22\r\ny\r\nEND\r\n"), message.RESPONSE_MC_VALUE)
+	time.Sleep(10 * time.Millisecond)
+	testutil.ExpectStringEquals(t, "", output.String(), "should wait for every fragment")
+	pending[0].HandleReceiveResponse([]byte("VALUE a 0 1 11\r\nx\r\nEND\r\n"), message.RESPONSE_MC_VALUE)
+	awaitOutput(t, output, "VALUE a 0 1 11\r\nx\r\nVALUE b 0 1 22\r\ny\r\nEND\r\n")
+}
+
+func TestMultigetGetsKeepsCasOfEachServer(t *testing.T) {
+	backends := []*fakeBackend{newFakeBackend(t, newStoreHandler()), newFakeBackend(t, newStoreHandler())}
+	for _, backend := range backends {
+		defer backend.close()
+	}
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backends...)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(c)
+
+	// Store keys until each backend holds one of them.
+	keyOfBackend := make([]string, len(backends))
+	for i := 0; keyOfBackend[0] == "" || keyOfBackend[1] == ""; i++ {
+		if i == 100 {
+			t.Fatalf("expected keys to be sent to both backends")
+		}
+		// Keys that differ in their last byte have similar fnv1a_64 hashes, so the number is at the start.
+		key := fmt.Sprintf("%dkey", i)
+		io.WriteString(c, "set "+key+" 0 0 1\r\nx\r\n")
+		if line, _ := reader.ReadString('\n'); line != "STORED\r\n" {
+			t.Fatalf("unexpected response to set: %q", line)
+		}
+		for j, backend := range backends {
+			response := &bytes.Buffer{}
+			backend.handle("get "+key+"\r\n", nil, response)
+			if response.String() != "END\r\n" && keyOfBackend[j] == "" {
+				keyOfBackend[j] = key
+			}
+		}
+	}
+	// Overwrite the second key on its backend so that the cas uniques of the two keys differ.
+	for i := 0; i < 5; i++ {
+		backends[1].handle("set "+keyOfBackend[1]+" 0 0 1\r\n", bufio.NewReader(strings.NewReader("y\r\n")), ioutil.Discard)
+	}
+	expected := ""
+	for j, backend := range backends {
+		response := &bytes.Buffer{}
+		backend.handle("gets "+keyOfBackend[j]+"\r\n", nil, response)
+		expected += strings.TrimSuffix(response.String(), "END\r\n")
+	}
+	expected += "END\r\n"
+	testutil.ExpectEquals(t, 2, strings.Count(expected, "VALUE "), "expected each backend to hold a key")
+
+	io.WriteString(c, "gets "+keyOfBackend[0]+" "+keyOfBackend[1]+"\r\n")
+	actual := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, actual); err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	testutil.ExpectStringEquals(t, expected, string(actual), "expected the value and cas unique of each key and one END")
+}
+
+func TestNoreply(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("set k 0 0 1 noreply\r\nx\r\ndelete missing noreply\r\nget k\r\nset k 0 0 2\r\nyz\r\nget k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "VALUE k 0 1\r\nx\r\nEND\r\nSTORED\r\nVALUE k 0 2\r\nyz\r\nEND\r\n")
+}
+
+func TestIncrDecr(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("set n 0 0 2\r\n10\r\nincr n 5\r\ndecr n 20\r\nincr missing 1\r\ndecr missing 1\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\n15\r\n0\r\nNOT_FOUND\r\nNOT_FOUND\r\n")
+}
+
+func TestIncrWrapsAround(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("set n 0 0 20\r\n18446744073709551615\r\nincr n 2\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\n1\r\n")
+}
+
+func TestIncrDecrRequestTypes(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("NOT_FOUND\r\n")
+		},
+	}
+	errs := handleAllCommands("incr a 1\r\ndecr b 2\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, message.REQUEST_MC_INCR, remote.requests[0].RequestType, "unexpected request type for incr")
+	testutil.ExpectEquals(t, message.REQUEST_MC_DECR, remote.requests[1].RequestType, "unexpected request type for decr")
+	testutil.ExpectStringEquals(t, "b", string(remote.requests[1].Key), "unexpected key for decr")
+	awaitOutput(t, output, "NOT_FOUND\r\nNOT_FOUND\r\n")
+}
+
+func TestIncrInvalidDelta(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("2\r\n")
+		},
+	}
+	errs := handleAllCommands("incr n -1\r\ndecr n abc\r\nincr n 18446744073709551616\r\nincr n 1\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "invalid deltas should not close the connection")
+	testutil.ExpectEquals(t, []string{"incr n 1\r\n"}, remote.requestData(), "invalid requests should not be forwarded")
+	invalid := "CLIENT_ERROR invalid numeric delta argument\r\n"
+	awaitOutput(t, output, invalid+invalid+invalid+"2\r\n")
+}
+
+func TestTouchAndGat(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("set k 0 0 1\r\nx\r\ntouch k 60\r\ntouch missing 60\r\ngat 60 k\r\ngats 0 missing\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nTOUCHED\r\nNOT_FOUND\r\nVALUE k 0 1\r\nx\r\nEND\r\nEND\r\n")
+}
+
+func TestMalformedGatKeepsConnection(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{}
+	errs := handleAllCommands("gat\r\ngat 60\r\ngats \r\ngat  60 k\r\ngat 60 k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"gat 60 k\r\n"}, remote.requestData(), "expected only the well formed gat to be forwarded")
+	awaitOutput(t, output, strings.Repeat("CLIENT_ERROR bad command line format\r\n", 4)+"END\r\n")
+
+	// handleCommand only passes on headers ending in \r\n, but handleGat must not panic for shorter headers.
+	for _, header := range []string{"", "gat", "gat 60 k", "gat \r"} {
+		output := &syncBuffer{}
+		responses := responsequeue.CreateResponseQueue(output)
+		testutil.ExpectEquals(t, nil, handleGat([]byte(header), responses, remote), "unexpected error for "+header)
+		awaitOutput(t, output, "CLIENT_ERROR bad command line format\r\n")
+		responses.Close()
+	}
+}
+
+func TestCas(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("set k 0 0 1\r\nx\r\ngets k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nVALUE k 0 1 1\r\nx\r\nEND\r\n")
+
+	output = &syncBuffer{}
+	responses = responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	// The first cas succeeds, which changes the cas unique, so the second cas with the same cas unique fails.
+	errs = handleAllCommands("cas k 0 0 1 1\r\ny\r\ncas k 0 0 1 1\r\nz\r\ncas missing 0 0 1 1\r\nz\r\ngets k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nEXISTS\r\nNOT_FOUND\r\nVALUE k 0 1 2\r\ny\r\nEND\r\n")
+}
+
+func TestAddRelaysNotStored(t *testing.T) {
+	var adds int32
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return
+		}
+		// The key exists after the first add, so memcached doesn't store the value of the second add.
+		if atomic.AddInt32(&adds, 1) == 1 {
+			io.WriteString(writer, "STORED\r\n")
+		} else {
+			io.WriteString(writer, "NOT_STORED\r\n")
+		}
+	})
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("add k 0 0 1\r\nx\r\nadd k 0 0 1\r\ny\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nNOT_STORED\r\n")
+}
+
+func TestGetLargeValue(t *testing.T) {
+	// The value contains "\r\nEND\r\n", so a response that isn't framed by its length would be cut short.
+	value := bytes.Repeat([]byte("0123456789\r\nEND\r\n"), (MAX_ITEM_SIZE-512)/17)
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if line != "get big\r\n" {
+			io.WriteString(writer, "VALUE small 0 1\r\nx\r\nEND\r\n")
+			return
+		}
+		response := append([]byte(fmt.Sprintf("VALUE big 0 %d\r\n", len(value))), value...)
+		response = append(response, "\r\nEND\r\n"...)
+		// Send the response in small writes, so that the proxy reads it in many parts.
+		for len(response) > 0 {
+			n := 4000
+			if n > len(response) {
+				n = len(response)
+			}
+			writer.Write(response[:n])
+			response = response[n:]
+		}
+	})
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "get big\r\nget small\r\n")
+	expected := fmt.Sprintf("VALUE big 0 %d\r\n%s\r\nEND\r\nVALUE small 0 1\r\nx\r\nEND\r\n", len(value), value)
+	response := make([]byte, len(expected))
+	_, err = io.ReadFull(c, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading the responses")
+	if !bytes.Equal([]byte(expected), response) {
+		t.Errorf("expected the %d byte value to be sent unchanged, followed by the next response", len(value))
+	}
+}
+
+func TestWriteBufferFlushesWhenClientIsIdle(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.WriteBufferSize = 16384
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(c)
+	requests := "set k 0 0 1\r\nx\r\n" + strings.Repeat("get k\r\n", 100)
+	expected := "STORED\r\n" + strings.Repeat("VALUE k 0 1\r\nx\r\nEND\r\n", 100)
+	io.WriteString(c, requests)
+	// The client keeps the connection open without sending more requests, so the responses must be flushed without waiting for more.
+	response := make([]byte, len(expected))
+	_, err = io.ReadFull(reader, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading the responses")
+	testutil.ExpectStringEquals(t, expected, string(response), "unexpected responses")
+
+	// The response to a get is sent while the proxy waits for the rest of the value of the next request.
+	io.WriteString(c, "get k\r\nset b 0 0 5\r\nab")
+	expected = "VALUE k 0 1\r\nx\r\nEND\r\n"
+	response = make([]byte, len(expected))
+	_, err = io.ReadFull(reader, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading the response to get")
+	testutil.ExpectStringEquals(t, expected, string(response), "unexpected response to get")
+	io.WriteString(c, "cde\r\n")
+	line, err := reader.ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading the response to set")
+	testutil.ExpectStringEquals(t, "STORED\r\n", line, "unexpected response to set")
+}
+
+func TestCasRequiresCasUnique(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("STORED\r\n")
+		},
+	}
+	for _, request := range []string{"cas k 0 0 1\r\nx\r\n", "cas k 0 0 1 abc\r\nx\r\n", "cas k 0 0 1 1 extra\r\nx\r\n"} {
+		err := handleCommand(bufio.NewReader(strings.NewReader(request)), responses, remote, MAX_ITEM_SIZE)
+		if err == nil {
+			t.Errorf("expected %q to be rejected", request)
+		}
+	}
+	testutil.ExpectEquals(t, 0, len(remote.requests), "invalid requests should not be forwarded")
+}
+
+func TestMultiKeyGat(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			if string(m.Key) == "b" {
+				return []byte("END\r\n")
+			}
+			return []byte("VALUE " + string(m.Key) + " 0 1\r\nx\r\nEND\r\n")
+		},
+	}
+	errs := handleAllCommands("gat 60 a b c\r\ngats -1 d\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"gat 60 a\r\n", "gat 60 b\r\n", "gat 60 c\r\n", "gats -1 d\r\n"}, remote.requestData(), "expected one request per key")
+	testutil.ExpectEquals(t, message.REQUEST_MC_GAT, remote.requests[0].RequestType, "unexpected request type for gat")
+	testutil.ExpectEquals(t, message.REQUEST_MC_GATS, remote.requests[3].RequestType, "unexpected request type for gats")
+	awaitOutput(t, output, "VALUE a 0 1\r\nx\r\nVALUE c 0 1\r\nx\r\nEND\r\nVALUE d 0 1\r\nx\r\nEND\r\n")
+}
+
+func TestInvalidExptime(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("TOUCHED\r\n")
+		},
+	}
+	errs := handleAllCommands("touch k soon\r\ngat 1.5 k\r\ntouch k 99999999999\r\ntouch k -1\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "invalid expiration times should not close the connection")
+	testutil.ExpectEquals(t, []string{"touch k -1\r\n"}, remote.requestData(), "invalid requests should not be forwarded")
+	invalid := "CLIENT_ERROR invalid exptime argument\r\n"
+	awaitOutput(t, output, invalid+invalid+invalid+"TOUCHED\r\n")
+}
+
+// startTestServer serves memcache requests for remote on an ephemeral local tcp port and returns the listener.
+func startTestServer(t *testing.T, remote memcache.ClientInterface, conf config.Config) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	conf.Listen = []string{l.Addr().String()}
+	s := NewServer(nil, 0)
+	s.addListener(l)
+	go s.serveSocketServer(remote, l, conf)
+	return l
+}
+
+// newTestPoolConfig returns the config of a pool listening on an ephemeral local tcp port that proxies requests to the given backends.
+func newTestPoolConfig(t *testing.T, backends ...*fakeBackend) config.Config {
+	t.Helper()
+	conf := config.Config{
+		Listen:       []string{"127.0.0.1:0"},
+		Hash:         "fnv1a_64",
+		Distribution: "ketama",
+		Timeout:      1000,
+		TCPNoDelay:   true,
+	}
+	for _, backend := range backends {
+		conf.Servers = append(conf.Servers, tcpServerOf(t, backend))
+	}
+	return conf
+}
+
+// tcpServerOf returns the config of a server for backend, which is named after its address.
+func tcpServerOf(t *testing.T, backend *fakeBackend) config.TCPServer {
+	t.Helper()
+	host, portString, _ := net.SplitHostPort(backend.addr())
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		t.Fatalf("invalid backend address %q", backend.addr())
+	}
+	return config.TCPServer{Host: host, Port: uint16(port), Key: backend.addr(), Weight: 1}
+}
+
+// serveInBackground starts s and returns the address of the listener of its only pool.
+func serveInBackground(t *testing.T, s *Server) string {
+	t.Helper()
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	for _, addr := range s.BoundAddrs() {
+		return addr.String()
+	}
+	t.Fatalf("server did not start listening")
+	return ""
+}
+
+func TestBoundAddrs(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{
+		"first":  newTestPoolConfig(t, backend),
+		"second": newTestPoolConfig(t, backend),
+	}, 0)
+	testutil.ExpectEquals(t, 0, len(s.BoundAddrs()), "expected no addresses before Start")
+	err := s.Start()
+	if err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	defer s.Stop(context.Background())
+
+	addrs := s.BoundAddrs()
+	testutil.ExpectEquals(t, 2, len(addrs), "expected an address for each pool")
+	for name, addr := range addrs {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || tcpAddr.Port == 0 {
+			t.Fatalf("expected pool %q to be bound to a port, got %v", name, addr)
+		}
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatalf("failed to connect to pool %q: %v", name, err)
+		}
+		c.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(c, "version\r\n")
+		line, err := bufio.NewReader(c).ReadString('\n')
+		c.Close()
+		testutil.ExpectEquals(t, nil, err, "unexpected error for pool "+name)
+		testutil.ExpectStringEquals(t, "VERSION golemproxy-"+VERSION+"\r\n", line, "unexpected response for pool "+name)
+	}
+	if addrs["first"].String() == addrs["second"].String() {
+		t.Errorf("expected the pools to be bound to different ports")
+	}
+}
+
+func TestMultipleListenAddresses(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	dir, err := ioutil.TempDir("", "golemproxy")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "golemproxy.sock")
+	conf := newTestPoolConfig(t, backend)
+	conf.Listen = []string{socketPath, "127.0.0.1:0"}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	err = s.Start()
+	if err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+
+	addrs := s.PoolBoundAddrs("main")
+	testutil.ExpectEquals(t, 2, len(addrs), "expected an address for each listen address")
+	testutil.ExpectStringEquals(t, socketPath, addrs[0].String(), "unexpected unix socket address")
+	expected := []string{"STORED\r\nVALUE k 0 1\r\nx\r\nEND\r\n", "VALUE k 0 1\r\nx\r\nEND\r\n"}
+	requests := []string{"set k 0 0 1\r\nx\r\nget k\r\n", "get k\r\n"}
+	for i, addr := range addrs {
+		c, err := net.Dial(addr.Network(), addr.String())
+		if err != nil {
+			t.Fatalf("failed to connect to %v: %v", addr, err)
+		}
+		c.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(c, requests[i])
+		response := make([]byte, len(expected[i]))
+		_, err = io.ReadFull(c, response)
+		c.Close()
+		testutil.ExpectEquals(t, nil, err, "unexpected error for "+addr.String())
+		testutil.ExpectStringEquals(t, expected[i], string(response), "unexpected response for "+addr.String())
+	}
+
+	s.Stop(context.Background())
+	for _, addr := range addrs {
+		if c, err := net.Dial(addr.Network(), addr.String()); err == nil {
+			c.Close()
+			t.Errorf("expected the listener at %v to be closed", addr)
+		}
+	}
+}
+
+func TestStartAndStop(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.Listen = []string{"127.0.0.1:0"}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	err := s.Start()
+	testutil.ExpectEquals(t, nil, err, "unexpected error starting the server")
+	testutil.ExpectEquals(t, "the server was already started", fmt.Sprint(s.Start()), "expected a second Start to fail")
+
+	addr := s.BoundAddrs()["main"].(*net.TCPAddr)
+	if addr.Port == 0 {
+		t.Fatalf("expected the listener to be assigned a port")
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "set k 0 0 1\r\nx\r\nget k\r\n")
+	reader := bufio.NewReader(c)
+	var lines []string
+	for i := 0; i < 4; i++ {
+		line, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "unexpected error reading a response")
+		lines = append(lines, line)
+	}
+	testutil.ExpectEquals(t, []string{"STORED\r\n", "VALUE k 0 1\r\n", "x\r\n", "END\r\n"}, lines, "unexpected responses")
+	c.Close()
+
+	err = s.Stop(context.Background())
+	testutil.ExpectEquals(t, nil, err, "unexpected error stopping the server")
+	testutil.ExpectEquals(t, nil, s.Wait(), "expected Wait to return after Stop")
+	_, err = net.Dial("tcp", addr.String())
+	if err == nil {
+		t.Errorf("expected the listener to be closed after Stop")
+	}
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	handler := newStoreHandler()
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		// Respond after Shutdown is called.
+		time.Sleep(100 * time.Millisecond)
+		handler(line, reader, writer)
+	})
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "get k\r\n")
+	time.Sleep(20 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+	response, err := ioutil.ReadAll(c)
+	testutil.ExpectEquals(t, nil, err, "expected the connection to be closed cleanly")
+	testutil.ExpectStringEquals(t, "END\r\n", string(response), "expected a response to the in-flight get")
+	testutil.ExpectEquals(t, nil, <-shutdownErr, "expected Shutdown to succeed")
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("expected the listener to be closed")
+	}
+}
+
+func TestShutdownAnswersPipelinedCommands(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	parsed := make(chan struct{})
+	var parsedOnce sync.Once
+	s.Trace = TraceHooks{
+		CommandParsed: func(trace CommandTrace) {
+			// Hold the first get until Shutdown is called, while the second get is buffered.
+			parsedOnce.Do(func() {
+				close(parsed)
+				for !s.isShuttingDown() {
+					time.Sleep(time.Millisecond)
+				}
+			})
+		},
+	}
+	addr := serveInBackground(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "get a\r\nget b\r\n")
+	<-parsed
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- s.Shutdown(ctx)
+	}()
+	response, err := ioutil.ReadAll(c)
+	testutil.ExpectEquals(t, nil, err, "expected the connection to be closed cleanly")
+	testutil.ExpectStringEquals(t, "END\r\nEND\r\n", string(response), "expected responses to both pipelined gets")
+	testutil.ExpectEquals(t, nil, <-shutdownErr, "expected Shutdown to succeed")
+}
+
+func TestServeCleansUpAfterListenError(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer taken.Close()
+	dir, err := ioutil.TempDir("", "golemproxy")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "golemproxy.sock")
+
+	unixConf := newTestPoolConfig(t, backend)
+	unixConf.Listen = []string{socketPath}
+	tcpConf := newTestPoolConfig(t, backend)
+	tcpConf.Listen = []string{taken.Addr().String()}
+	s := NewServer(map[string]config.Config{"unix": unixConf, "tcp": tcpConf}, 0)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after failing to listen")
+	}
+	if err == nil {
+		t.Fatalf("expected an error for a port that is already in use")
+	}
+	if _, statErr := os.Stat(socketPath); !os.IsNotExist(statErr) {
+		t.Errorf("expected the unix socket to be removed, got %v", statErr)
+	}
+	if c, err := net.Dial("unix", socketPath); err == nil {
+		c.Close()
+		t.Errorf("expected the unix socket listener to be closed")
+	}
+}
+
+func TestUnixSocketPermissions(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	dir, err := ioutil.TempDir("", "golemproxy")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultConf := newTestPoolConfig(t, backend)
+	defaultConf.Listen = []string{filepath.Join(dir, "default.sock")}
+	sharedConf := newTestPoolConfig(t, backend)
+	sharedConf.Listen = []string{filepath.Join(dir, "shared.sock")}
+	sharedConf.UnixSocketMode = 0660
+	gid := os.Getgid()
+	sharedConf.UnixSocketGID = &gid
+	s := NewServer(map[string]config.Config{"default": defaultConf, "shared": sharedConf}, 0)
+	err = s.Start()
+	if err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	defer s.Shutdown(context.Background())
+
+	for path, expected := range map[string]os.FileMode{defaultConf.Listen[0]: 0700, sharedConf.Listen[0]: 0660} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", path, err)
+		}
+		testutil.ExpectEquals(t, os.ModeSocket|expected, info.Mode(), "unexpected mode of "+path)
+	}
+}
+
+func TestServeReturnsListenError(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.Listen = []string{"127.0.0.1:99999"}
+	err := NewServer(map[string]config.Config{"main": conf}, 0).Serve()
+	listenErr, ok := err.(*ListenError)
+	if !ok {
+		t.Fatalf("expected a *ListenError for an invalid port, got %#v", err)
+	}
+	testutil.ExpectStringEquals(t, "main", listenErr.Pool, "unexpected pool")
+	testutil.ExpectStringEquals(t, "127.0.0.1:99999", listenErr.Listen, "unexpected listen address")
+
+	err = NewServer(map[string]config.Config{}, 0).Serve()
+	if err == nil {
+		t.Errorf("expected an error when there are no pools")
+	}
+}
+
+func TestPartialRequests(t *testing.T) {
+	responses := responsequeue.CreateResponseQueue(&syncBuffer{})
+	defer responses.Close()
+	remote := &fakeRemote{}
+	for _, test := range []struct {
+		input    string
+		expected error
+	}{
+		{"", io.EOF},
+		{"get k", errPartialRequest},
+		{"get k\r", errPartialRequest},
+		{"set k 0 0 5\r\nab", errPartialRequest},
+		{"set k 0 0 5\r\n", errPartialRequest},
+	} {
+		err := handleCommand(bufio.NewReader(strings.NewReader(test.input)), responses, remote, MAX_ITEM_SIZE)
+		testutil.ExpectEquals(t, test.expected, err, fmt.Sprintf("unexpected error for %q", test.input))
+	}
+	testutil.ExpectEquals(t, 0, len(remote.requests), "expected partial requests not to be forwarded")
+}
+
+func TestHalfClosedConnectionWithPartialRequest(t *testing.T) {
+	remote := &fakeRemote{}
+	l := startTestServer(t, remote, config.Config{})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	io.WriteString(c, "get k")
+	c.(*net.TCPConn).CloseWrite()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := ioutil.ReadAll(c)
+	testutil.ExpectEquals(t, nil, err, "expected the proxy to close the connection")
+	testutil.ExpectStringEquals(t, "", string(response), "expected no response to a partial request")
+	testutil.ExpectEquals(t, 0, len(remote.requests), "expected the partial request not to be forwarded")
+}
+
+func TestLineTooLong(t *testing.T) {
+	remote := &fakeRemote{}
+	l := startTestServer(t, remote, config.Config{MaxLineLength: 8192})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	go func() {
+		// This fails once the proxy closes the connection.
+		io.WriteString(c, "get "+strings.Repeat("k", 1<<20))
+	}()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, _ := ioutil.ReadAll(c)
+	testutil.ExpectStringEquals(t, "CLIENT_ERROR line too long\r\n", string(response), "expected an error before the connection is closed")
+	testutil.ExpectEquals(t, 0, len(remote.requests), "expected the request not to be forwarded")
+}
+
+func TestSlowBackendTimesOut(t *testing.T) {
+	handler := newStoreHandler()
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if strings.Contains(line, "slow") {
+			// Respond after the proxy gives up on this request.
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(writer, "VALUE slow 0 4\r\nlate\r\nEND\r\n")
+			return
+		}
+		handler(line, reader, writer)
+	})
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.Timeout = 100
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	reader := bufio.NewReader(c)
+	readLine := func() string {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		return line
+	}
+
+	// The request pipelined behind the slow request is sent on the same backend connection, so it fails too.
+	before := Stats()
+	io.WriteString(c, "get slow\r\nget fast\r\n")
+	testutil.ExpectStringEquals(t, "SERVER_ERROR timeout\r\n", readLine(), "expected the slow request to time out")
+	testutil.ExpectStringEquals(t, "SERVER_ERROR timeout\r\n", readLine(), "expected the pipelined request to fail")
+	testutil.ExpectEquals(t, before.Timeouts+2, Stats().Timeouts, "expected timeouts to be counted")
+
+	// The late response to the slow request must not be sent as the response to later requests.
+	io.WriteString(c, "set fast 0 0 1\r\nx\r\nget fast\r\n")
+	testutil.ExpectStringEquals(t, "STORED\r\n", readLine(), "expected a new backend connection to be used")
+	testutil.ExpectStringEquals(t, "VALUE fast 0 1\r\n", readLine(), "unexpected response to get")
+}
+
+func TestVersionWithoutBackends(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	// Nothing is listening on the address of the backend.
+	backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "version\r\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading the version")
+	testutil.ExpectStringEquals(t, "VERSION golemproxy-"+VERSION+"\r\n", line, "unexpected response to version")
+}
+
+func TestInvalidKeys(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("END\r\n")
+		},
+	}
+	longKey := strings.Repeat("k", 251)
+	errs := handleAllCommands("get "+longKey+"\r\n"+
+		"get a\rb\r\n"+
+		"gets a\x01\r\n"+
+		"get a "+longKey+"\r\n"+
+		"delete "+longKey+"\r\n"+
+		"delete a\rb\r\n"+
+		"delete a\rb noreply\r\n"+
+		"incr a\rb 1\r\n"+
+		"get "+longKey[1:]+"\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, strings.Repeat("CLIENT_ERROR bad command line format\r\n", 7)+"END\r\n")
+	testutil.ExpectEquals(t, []string{"get " + longKey[1:] + "\r\n"}, remote.requestData(), "expected only the valid key to be forwarded")
+}
+
+func TestDeleteWithTime(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("DELETED\r\n")
+		},
+	}
+	errs := handleAllCommands("delete key 0\r\n"+
+		"delete key 0 noreply\r\n"+
+		"delete key noreply\r\n"+
+		"delete key\r\n"+
+		"delete key abc\r\n"+
+		"delete key 0 1\r\n"+
+		"delete key -1\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"delete key\r\n", "delete key noreply\r\n", "delete key noreply\r\n", "delete key\r\n"}, remote.requestData(), "expected the time to be removed from forwarded requests")
+	testutil.ExpectEquals(t, true, remote.requests[1].NoReply, "expected noreply after a time to be detected")
+	awaitOutput(t, output, "DELETED\r\nDELETED\r\n"+strings.Repeat("CLIENT_ERROR bad command line format\r\n", 3))
+}
+
+func TestKeyLengthLimit(t *testing.T) {
+	maxKey := strings.Repeat("k", MAX_KEY_LENGTH)
+	longKey := maxKey + "k"
+	requests := map[string]string{
+		"get":    "get %s\r\n",
+		"gets":   "gets %s\r\n",
+		"set":    "set %s 0 0 1\r\nx\r\n",
+		"delete": "delete %s\r\n",
+		"incr":   "incr %s 1\r\n",
+		"decr":   "decr %s 1\r\n",
+		"touch":  "touch %s 60\r\n",
+	}
+	for command, format := range requests {
+		for _, test := range []struct {
+			key       string
+			forwarded bool
+		}{
+			{maxKey, true},
+			{longKey, false},
+		} {
+			output := &syncBuffer{}
+			responses := responsequeue.CreateResponseQueue(output)
+			remote := &fakeRemote{
+				respond: func(m *message.SingleMessage) []byte {
+					return []byte("NOT_FOUND\r\n")
+				},
+			}
+			request := fmt.Sprintf(format, test.key)
+			errs := handleAllCommands(request, responses, remote)
+			testutil.ExpectEquals(t, []error{}, errs, "unexpected errors for "+command)
+			if test.forwarded {
+				awaitOutput(t, output, "NOT_FOUND\r\n")
+				testutil.ExpectEquals(t, []string{request}, remote.requestData(), "expected a key of MAX_KEY_LENGTH to be forwarded for "+command)
+			} else {
+				awaitOutput(t, output, "CLIENT_ERROR bad command line format\r\n")
+				testutil.ExpectEquals(t, 0, len(remote.requests), "expected a key longer than MAX_KEY_LENGTH not to be forwarded for "+command)
+			}
+			responses.Close()
+		}
+		// An empty key is a malformed request. Gets and deletes without a key get CLIENT_ERROR, and the other commands close the connection.
+		remote := &fakeRemote{}
+		output := &syncBuffer{}
+		responses := responsequeue.CreateResponseQueue(output)
+		err := handleCommand(bufio.NewReader(strings.NewReader(fmt.Sprintf(format, ""))), responses, remote, MAX_ITEM_SIZE)
+		switch command {
+		case "get", "gets", "delete":
+			testutil.ExpectEquals(t, nil, err, "unexpected error for "+command+" with an empty key")
+			awaitOutput(t, output, "CLIENT_ERROR bad command line format\r\n")
+		default:
+			if err == nil {
+				t.Errorf("expected an error for %s with an empty key", command)
+			}
+		}
+		testutil.ExpectEquals(t, 0, len(remote.requests), "expected an empty key not to be forwarded for "+command)
+		responses.Close()
+	}
+	if validateKey([]byte{}) == nil {
+		t.Errorf("expected validateKey to reject an empty key")
+	}
+}
+
+func TestMalformedHeaders(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{}
+	errs := handleAllCommands("get\r\nget \r\ngets\r\ndelete\r\ndelete \r\nget k\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"get k\r\n"}, remote.requestData(), "expected only the get with a key to be forwarded")
+	awaitOutput(t, output, strings.Repeat("CLIENT_ERROR bad command line format\r\n", 5)+"END\r\n")
+
+	// handleCommand only passes on headers ending in \r\n, but the handlers must not panic for shorter headers.
+	for _, header := range []string{"", "g", "get", "get k", "get \r", "delete", "delete k\n"} {
+		output := &syncBuffer{}
+		responses := responsequeue.CreateResponseQueue(output)
+		testutil.ExpectEquals(t, nil, handleGet([]byte(header), responses, remote), "unexpected error for get "+header)
+		testutil.ExpectEquals(t, nil, handleDelete([]byte(header), responses, remote), "unexpected error for delete "+header)
+		awaitOutput(t, output, strings.Repeat("CLIENT_ERROR bad command line format\r\n", 2))
+		responses.Close()
+	}
+	testutil.ExpectEquals(t, []string{"get k\r\n"}, remote.requestData(), "expected malformed headers not to be forwarded")
+}
+
+func TestInvalidKeyKeepsConnection(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	longKey := strings.Repeat("k", MAX_KEY_LENGTH+1)
+	io.WriteString(c, "set good 0 0 1\r\nx\r\nget "+longKey+"\r\nget bad\x7fkey\r\nget good "+longKey+"\r\nget good\r\nversion\r\n")
+	reader := bufio.NewReader(c)
+	for _, expected := range []string{
+		"STORED\r\n",
+		"CLIENT_ERROR bad command line format\r\n",
+		"CLIENT_ERROR bad command line format\r\n",
+		"CLIENT_ERROR bad command line format\r\n",
+		"VALUE good 0 1\r\n",
+		"x\r\n",
+		"END\r\n",
+		string(versionResponse),
+	} {
+		line, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "expected the connection to stay open after a get of an invalid key")
+		testutil.ExpectStringEquals(t, expected, line, "unexpected response")
+	}
+}
+
+func TestBlankLineKeepsConnection(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "set good 0 0 1\r\nx\r\n\r\nbogus command\r\nget good\r\n")
+	reader := bufio.NewReader(c)
+	for _, expected := range []string{
+		"STORED\r\n",
+		"ERROR\r\n",
+		"ERROR\r\n",
+		"VALUE good 0 1\r\n",
+		"x\r\n",
+		"END\r\n",
+	} {
+		line, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "expected the connection to stay open after a blank line or unknown command")
+		testutil.ExpectStringEquals(t, expected, line, "unexpected response")
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{}
+	errs := handleAllCommands("verbosity 1\r\nverbosity 1 noreply\r\nverbosity x\r\nverbosity\r\nverbosity x noreply\r\nversion\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "OK\r\nCLIENT_ERROR bad command line format\r\nCLIENT_ERROR bad command line format\r\nVERSION golemproxy-"+VERSION+"\r\n")
+	testutil.ExpectEquals(t, 0, len(remote.requests), "expected verbosity to be handled by the proxy")
+}
+
+func TestQuitFlushesPendingResponses(t *testing.T) {
+	handler := newStoreHandler()
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		// Respond after the proxy reads quit.
+		time.Sleep(50 * time.Millisecond)
+		handler(line, reader, writer)
+	})
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "get k\r\nquit\r\n")
+	response, err := ioutil.ReadAll(c)
+	testutil.ExpectEquals(t, nil, err, "expected the proxy to close the connection")
+	testutil.ExpectStringEquals(t, "END\r\n", string(response), "expected only the response to the get before quit")
+}
+
+func TestStats(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	before := Stats()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(c)
+	const requests = "set k 0 0 1\r\nx\r\nget k\r\nget a k\r\ndelete k\r\nincr n 1\r\n"
+	const responses = "STORED\r\nVALUE k 0 1\r\nx\r\nEND\r\nVALUE k 0 1\r\nx\r\nEND\r\nDELETED\r\nNOT_FOUND\r\n"
+	io.WriteString(c, requests)
+	response := make([]byte, len(responses))
+	_, err = io.ReadFull(reader, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading responses")
+	testutil.ExpectStringEquals(t, responses, string(response), "unexpected responses")
+
+	after := Stats()
+	testutil.ExpectEquals(t, before.TotalConnections+1, after.TotalConnections, "unexpected total_connections")
+	// Connections from earlier tests may still be closing, so curr_connections isn't exact.
+	testutil.ExpectEquals(t, true, after.CurrentConnections >= 1, "unexpected curr_connections")
+	testutil.ExpectEquals(t, before.BytesRead+uint64(len(requests)), after.BytesRead, "unexpected bytes_read")
+	testutil.ExpectEquals(t, before.BytesWritten+uint64(len(responses)), after.BytesWritten, "unexpected bytes_written")
+	for command, count := range map[string]uint64{"set": 1, "get": 2, "delete": 1, "incr": 1, "decr": 0} {
+		testutil.ExpectEquals(t, before.Commands[command]+count, after.Commands[command], "unexpected count for "+command)
+	}
+
+	io.WriteString(c, "stats\r\n")
+	lines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read stats: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	testutil.ExpectStringEquals(t, "STAT version golemproxy-"+VERSION+"\r\n", lines[0], "unexpected first stat")
+	testutil.ExpectEquals(t, true, strings.Contains(strings.Join(lines, ""), fmt.Sprintf("STAT cmd_get %d\r\n", after.Commands["get"])), "expected cmd_get in stats")
+}
+
+func TestGetHitsAndMisses(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(c)
+	before := Stats()
+	// A multiget counts each key, and other commands such as delete aren't counted.
+	const requests = "set k 0 0 1\r\nx\r\nget k\r\nget missing\r\nget k missing\r\ndelete missing\r\n"
+	const responses = "STORED\r\nVALUE k 0 1\r\nx\r\nEND\r\nEND\r\nVALUE k 0 1\r\nx\r\nEND\r\nNOT_FOUND\r\n"
+	io.WriteString(c, requests)
+	response := make([]byte, len(responses))
+	_, err = io.ReadFull(reader, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading responses")
+	testutil.ExpectStringEquals(t, responses, string(response), "unexpected responses")
+
+	after := Stats()
+	testutil.ExpectEquals(t, before.GetHits+2, after.GetHits, "unexpected get_hits")
+	testutil.ExpectEquals(t, before.GetMisses+2, after.GetMisses, "unexpected get_misses")
+	formatted := string(after.Format(VERSION))
+	testutil.ExpectEquals(t, true, strings.Contains(formatted, fmt.Sprintf("STAT get_hits %d\r\n", after.GetHits)), "expected get_hits in stats")
+	testutil.ExpectEquals(t, true, strings.Contains(formatted, fmt.Sprintf("STAT get_misses %d\r\n", after.GetMisses)), "expected get_misses in stats")
+}
+
+func TestStatsReset(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(c)
+	const responses = "STORED\r\nVALUE k 0 1\r\nx\r\nEND\r\n"
+	io.WriteString(c, "set k 0 0 1\r\nx\r\nget k\r\n")
+	response := make([]byte, len(responses))
+	_, err = io.ReadFull(reader, response)
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading responses")
+	testutil.ExpectStringEquals(t, responses, string(response), "unexpected responses")
+	// The requests to the memcache server are recorded after the responses are forwarded.
+	for deadline := time.Now().Add(time.Second); backendRequests(backend.addr()) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 requests to %s", backend.addr())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	io.WriteString(c, "stats reset\r\n")
+	line, err := reader.ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error reading response")
+	testutil.ExpectStringEquals(t, "RESET\r\n", line, "unexpected response to stats reset")
+
+	io.WriteString(c, "stats\r\n")
+	lines := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read stats: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	result := strings.Join(lines, "")
+	for _, stat := range []string{"total_connections 0", "cmd_get 0", "cmd_set 0", "bytes_read 7", "server_errors 0", "timeouts 0"} {
+		testutil.ExpectEquals(t, true, strings.Contains(result, "STAT "+stat+"\r\n"), "expected "+stat+" in stats:\n"+result)
+	}
+	// The connection of this test is still open.
+	testutil.ExpectEquals(t, true, Stats().CurrentConnections >= 1, "expected stats reset to leave curr_connections unchanged")
+	testutil.ExpectEquals(t, uint64(0), backendRequests(backend.addr()), "unexpected requests to the memcache server")
+}
+
+func backendRequests(server string) uint64 {
+	for _, backend := range stats.Global.BackendSnapshots() {
+		if backend.Server == server {
+			return backend.Requests
+		}
+	}
+	return 0
+}
+
+func TestCommandPolicy(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	backend := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			if m.RequestType == message.REQUEST_MC_SET {
+				return []byte("STORED\r\n")
+			}
+			return []byte("END\r\n")
+		},
+	}
+	policy, err := config.NewCommandPolicy(nil, []string{"flush_all", "prepend"})
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	remote := &commandPolicyClient{ClientInterface: backend, policy: policy}
+	errs := handleAllCommands("flush_all\r\nget a\r\nprepend a 0 0 1\r\nx\r\nflush_all noreply\r\nset a 0 0 1\r\ny\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"get a\r\n", "set a 0 0 1\r\ny\r\n"}, backend.requestData(), "expected only permitted commands to be forwarded")
+	awaitOutput(t, output, "CLIENT_ERROR command not permitted\r\nEND\r\nCLIENT_ERROR command not permitted\r\nSTORED\r\n")
+}
+
+func TestCommandPolicyDeniesMetaSet(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	backend := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("EN\r\n")
+		},
+	}
+	policy, err := config.NewCommandPolicy(nil, []string{"writes"})
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	remote := &commandPolicyClient{ClientInterface: backend, policy: policy}
+	// The value of the denied ms must not be parsed as the next command of the pipeline.
+	errs := handleAllCommands("ms k 5\r\nhello\r\nmg k v\r\nms k 2 T0\r\nhi\r\nmg j v\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	testutil.ExpectEquals(t, []string{"mg k v\r\n", "mg j v\r\n"}, backend.requestData(), "expected only permitted commands to be forwarded")
+	awaitOutput(t, output, "CLIENT_ERROR command not permitted\r\nEN\r\nCLIENT_ERROR command not permitted\r\nEN\r\n")
+}
+
+func TestFlushAllReachesEveryBackend(t *testing.T) {
+	var m sync.Mutex
+	flushes := []string{}
+	newFlushBackend := func() *fakeBackend {
+		var backend *fakeBackend
+		handler := newStoreHandler()
+		backend = newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+			if strings.HasPrefix(line, "flush_all") {
+				m.Lock()
+				flushes = append(flushes, backend.addr()+" "+line)
+				m.Unlock()
+			}
+			handler(line, reader, writer)
+		})
+		return backend
+	}
+	first := newFlushBackend()
+	defer first.close()
+	second := newFlushBackend()
+	defer second.close()
+	remote := sharded.New(newTestPoolConfig(t, first, second))
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("flush_all\r\nflush_all 10 noreply\r\nversion\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "OK\r\nVERSION golemproxy-"+VERSION+"\r\n")
+
+	m.Lock()
+	defer m.Unlock()
+	sort.Strings(flushes)
+	expected := []string{
+		first.addr() + " flush_all\r\n",
+		first.addr() + " flush_all 10\r\n",
+		second.addr() + " flush_all\r\n",
+		second.addr() + " flush_all 10\r\n",
+	}
+	sort.Strings(expected)
+	testutil.ExpectEquals(t, expected, flushes, "expected every backend to be flushed")
+}
+
+func TestFlushAllReportsFailedBackend(t *testing.T) {
+	healthy := newFakeBackend(t, newStoreHandler())
+	defer healthy.close()
+	failing := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		// Close the connection without responding.
+		writer.(net.Conn).Close()
+	})
+	defer failing.close()
+	remote := sharded.New(newTestPoolConfig(t, healthy, failing))
+	defer remote.Finalize()
+
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	errs := handleAllCommands("flush_all\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "SERVER_ERROR flush_all failed on "+failing.addr()+"\r\n")
+}
+
+func TestReloadAddsBackend(t *testing.T) {
+	first := newFakeBackend(t, newStoreHandler())
+	defer first.close()
+	second := newFakeBackend(t, newStoreHandler())
+	defer second.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, first)}, 0)
+	defer s.Shutdown(context.Background())
+	addr := serveInBackground(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(c)
+	set := func(key string) {
+		t.Helper()
+		io.WriteString(c, "set "+key+" 0 0 1\r\nx\r\n")
+		response, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "unexpected error reading the response")
+		testutil.ExpectStringEquals(t, "STORED\r\n", response, "unexpected response to set")
+	}
+	set("before")
+
+	conf := newTestPoolConfig(t, first, second)
+	err = s.Reload(map[string]config.Config{"main": conf})
+	testutil.ExpectEquals(t, nil, err, "unexpected error from Reload")
+
+	// The client connection is kept open, and new keys can be sent to the added backend.
+	secondClient := sharded.New(newTestPoolConfig(t, second))
+	defer secondClient.Finalize()
+	found := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%d:after", i)
+		set(key)
+		if item, _ := secondClient.Get(key); item != nil {
+			found++
+		}
+	}
+	if found == 0 {
+		t.Errorf("expected some keys to be stored on the added backend")
+	}
+
+	conf.Listen = []string{"127.0.0.1:1"}
+	err = s.Reload(map[string]config.Config{"main": conf})
+	if err == nil {
+		t.Errorf("expected changing the listen address to be rejected")
+	}
+}
+
+func TestReloadRejectsClientOptions(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	defer s.Shutdown(context.Background())
+	serveInBackground(t, s)
+
+	denyWrites, err := config.NewCommandPolicy(nil, []string{"writes"})
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	for option, change := range map[string]func(conf *config.Config){
+		"read_only":                        func(conf *config.Config) { conf.ReadOnly = true },
+		"max_ttl":                          func(conf *config.Config) { conf.MaxTTL = 60 },
+		"ttl_override":                     func(conf *config.Config) { conf.TTLOverride = 60 },
+		"coalesce_gets":                    func(conf *config.Config) { conf.CoalesceGets = true },
+		"miss_on_backend_down":             func(conf *config.Config) { conf.MissOnBackendDown = true },
+		"fire_and_forget_sets":             func(conf *config.Config) { conf.FireAndForgetSets = true },
+		"allowed_commands/denied_commands": func(conf *config.Config) { conf.CommandPolicy = denyWrites },
+		"shadow": func(conf *config.Config) {
+			conf.Shadow = conf.Servers
+			conf.ShadowRatio = 1
+		},
+	} {
+		conf := newTestPoolConfig(t, backend)
+		change(&conf)
+		err := s.Reload(map[string]config.Config{"main": conf})
+		if err == nil || !strings.Contains(err.Error(), option+" for \"main\" changed") {
+			t.Errorf("expected changing %s to be rejected, got %v", option, err)
+		}
+	}
+	// The options that were rejected are still the options of the pool.
+	testutil.ExpectEquals(t, false, s.configs["main"].ReadOnly, "expected the config to be unchanged")
+	err = s.Reload(map[string]config.Config{"main": newTestPoolConfig(t, backend)})
+	testutil.ExpectEquals(t, nil, err, "expected reloading the same options to succeed")
+}
+
+func TestBackendErrors(t *testing.T) {
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if strings.HasPrefix(line, "get ") {
+			io.WriteString(writer, "ERROR\r\n")
+			return
+		}
+		reader.ReadString('\n')
+		io.WriteString(writer, "SERVER_ERROR out of memory\r\n")
+	})
+	defer backend.close()
+	remote := memcache.New(backend.addr(), 1, time.Second)
+	defer remote.Finalize()
+
+	for _, test := range []struct {
+		mode     string
+		expected string
+	}{
+		{"relay", "SERVER_ERROR out of memory\r\nERROR\r\n"},
+		{"prefix", "SERVER_ERROR backend: out of memory\r\nSERVER_ERROR backend: ERROR\r\n"},
+		{"generic", "SERVER_ERROR backend error\r\nSERVER_ERROR backend error\r\n"},
+	} {
+		output := &syncBuffer{}
+		responses := createClientResponseQueue(output, config.Config{BackendErrors: test.mode})
+		errs := handleAllCommands("set k 0 0 1\r\nx\r\nget k\r\n", responses, remote)
+		testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+		awaitOutput(t, output, test.expected)
+		responses.Close()
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.MaxConnections = 2
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	defer s.Shutdown(context.Background())
+	addr := serveInBackground(t, s)
+
+	get := func(c net.Conn) (string, error) {
+		c.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(c, "get k\r\n")
+		return bufio.NewReader(c).ReadString('\n')
+	}
+	before := Stats()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer c.Close()
+		conns = append(conns, c)
+	}
+	for _, c := range conns[:2] {
+		response, err := get(c)
+		testutil.ExpectEquals(t, nil, err, "unexpected error for a connection within max_connections")
+		testutil.ExpectStringEquals(t, "END\r\n", response, "unexpected response")
+	}
+	_, err := get(conns[2])
+	if err == nil {
+		t.Errorf("expected the connection exceeding max_connections to be closed")
+	}
+	testutil.ExpectEquals(t, before.RejectedConnections+1, Stats().RejectedConnections, "unexpected rejected_connections")
+
+	// Closing a connection allows a new connection.
+	conns[0].Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		response, err := get(c)
+		c.Close()
+		if err == nil {
+			testutil.ExpectStringEquals(t, "END\r\n", response, "unexpected response")
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a new connection to be accepted after closing a connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.ClientIdleTimeout = 100 * time.Millisecond
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	defer s.Shutdown(context.Background())
+	addr := serveInBackground(t, s)
+
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer idle.Close()
+	busy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer busy.Close()
+
+	// A client that keeps sending commands is not closed, even after the idle timeout elapsed in total.
+	busyReader := bufio.NewReader(busy)
+	for i := 0; i < 6; i++ {
+		time.Sleep(conf.ClientIdleTimeout / 2)
+		busy.SetDeadline(time.Now().Add(time.Second))
+		io.WriteString(busy, "get k\r\n")
+		response, err := busyReader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "unexpected error for a client sending commands")
+		testutil.ExpectStringEquals(t, "END\r\n", response, "unexpected response")
+	}
+
+	// The idle client was closed after the timeout.
+	idle.SetDeadline(time.Now().Add(time.Second))
+	_, err = idle.Read(make([]byte, 1))
+	testutil.ExpectEquals(t, io.EOF, err, "expected the idle connection to be closed")
+}
+
+func TestStatsServers(t *testing.T) {
+	live := newFakeBackend(t, newStoreHandler())
+	defer live.close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	conf := newTestPoolConfig(t, live)
+	host, port, _ := net.SplitHostPort(closedAddr)
+	portNumber, _ := strconv.Atoi(port)
+	conf.Servers = append(conf.Servers, config.TCPServer{Host: host, Port: uint16(portNumber), Key: closedAddr, Weight: 2})
+	conf.AutoEjectHosts = true
+	conf.ServerFailureLimit = 1
+	conf.ServerRetryTimeout = time.Hour
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(c)
+	// Send gets until one of them is sent to the closed server, which ejects it.
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(c, "get %dkey\r\n", i)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read the response: %v", err)
+		}
+		if strings.HasPrefix(line, "SERVER_ERROR") {
+			break
+		}
+	}
+	before := time.Now().Unix()
+
+	io.WriteString(c, "stats servers\r\n")
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read stats: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	testutil.ExpectEquals(t, 8, len(lines), "expected 4 stats for each server")
+	lastFailure := strings.TrimSuffix(lines[7], "\r\n")
+	lastFailure = lastFailure[strings.LastIndexByte(lastFailure, ' ')+1:]
+	if timestamp, err := strconv.ParseInt(lastFailure, 10, 64); err != nil || timestamp < before-60 || timestamp > before {
+		t.Errorf("expected the last failure of the closed server to be a recent unix time, got %q", lines[7])
+	}
+	testutil.ExpectEquals(t, []string{
+		"STAT " + live.addr() + ":weight 1\r\n",
+		"STAT " + live.addr() + ":ejected 0\r\n",
+		"STAT " + live.addr() + ":consecutive_failures 0\r\n",
+		"STAT " + live.addr() + ":last_failure 0\r\n",
+		"STAT " + closedAddr + ":weight 2\r\n",
+		"STAT " + closedAddr + ":ejected 1\r\n",
+		"STAT " + closedAddr + ":consecutive_failures 1\r\n",
+	}, lines[:7], "unexpected server stats")
+}
+
+// BenchmarkConnectionChurn reports the allocations for clients that connect, send one get, and disconnect.
+func BenchmarkConnectionChurn(b *testing.B) {
+	s := NewServer(map[string]config.Config{}, 0)
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("END\r\n")
+		},
+	}
+	conf := config.Config{}
+	response := make([]byte, len("END\r\n"))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, server := net.Pipe()
+		s.trackConn(server)
+		done := make(chan struct{})
+		go func() {
+			s.serveSocket(remote, server, conf)
+			close(done)
+		}()
+		io.WriteString(client, "get k\r\n")
+		if _, err := io.ReadFull(client, response); err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+		<-done
+	}
+}
+
+func BenchmarkExtractKeys(b *testing.B) {
+	for _, request := range []string{"key", "key1 key2 key3"} {
+		data := []byte(request)
+		b.Run(fmt.Sprintf("keys=%d", len(strings.Fields(request))), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var keysBuffer [1][]byte
+				extractKeys(keysBuffer[:0], data)
+			}
+		})
+	}
+}
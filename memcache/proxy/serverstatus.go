@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/sharded"
+)
+
+var requestStatsServers = []byte("stats servers\r\n")
+
+// serverStatusesOf returns the status of the servers that remote sends requests to, or nil if remote isn't a pool.
+func serverStatusesOf(remote memcache.ClientInterface) []sharded.ServerStatus {
+	for {
+		if pool, ok := remote.(interface{ ServerStatuses() []sharded.ServerStatus }); ok {
+			return pool.ServerStatuses()
+		}
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			return nil
+		}
+		remote = wrapper.unwrap()
+	}
+}
+
+// formatServerStatuses returns the response to "stats servers", which has STAT lines for each server prefixed with its address.
+// last_failure is the unix time of the last failed request to the server, or 0 if no request failed.
+func formatServerStatuses(statuses []sharded.ServerStatus) []byte {
+	var buf bytes.Buffer
+	for _, status := range statuses {
+		ejected := 0
+		if status.Ejected {
+			ejected = 1
+		}
+		var lastFailure int64
+		if !status.LastFailure.IsZero() {
+			lastFailure = status.LastFailure.Unix()
+		}
+		fmt.Fprintf(&buf, "STAT %s:weight %d\r\n", status.Address, status.Weight)
+		fmt.Fprintf(&buf, "STAT %s:ejected %d\r\n", status.Address, ejected)
+		fmt.Fprintf(&buf, "STAT %s:consecutive_failures %d\r\n", status.Address, status.ConsecutiveFailures)
+		fmt.Fprintf(&buf, "STAT %s:last_failure %d\r\n", status.Address, lastFailure)
+	}
+	buf.WriteString("END\r\n")
+	return buf.Bytes()
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// shadowClient mirrors a fraction of write requests to a shadow pool, e.g. to test a new pool before migrating to it.
+// Responses from the shadow pool are discarded, and never delay or affect the responses from the primary pool.
+type shadowClient struct {
+	memcache.ClientInterface
+	shadow memcache.ClientInterface
+	// ratio is the fraction of write requests that are mirrored, between 0 and 1.
+	ratio float64
+	// mirroring tracks the requests that are being sent to the shadow pool.
+	mirroring sync.WaitGroup
+}
+
+var _ memcache.ClientInterface = &shadowClient{}
+
+func isWriteRequest(requestType message.RequestType) bool {
+	switch requestType {
+	case message.REQUEST_MC_DELETE, message.REQUEST_MC_INCR, message.REQUEST_MC_DECR, message.REQUEST_MC_TOUCH,
+		message.REQUEST_MC_META_SET, message.REQUEST_MC_META_DELETE, message.REQUEST_MC_META_ARITHMETIC:
+		return true
+	}
+	return isStorageRequest(requestType)
+}
+
+func (c *shadowClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *shadowClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *shadowClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	if !isWriteRequest(m.RequestType) || rand.Float64() >= c.ratio {
+		c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+		return
+	}
+	// Copy the request before sending it to the primary pool, which may reuse the buffer of the request after responding.
+	mirrored := &message.SingleMessage{
+		NoReply: m.NoReply,
+		Flags:   m.Flags,
+		Exptime: m.Exptime,
+	}
+	mirrored.HandleSendRequest(append([]byte(nil), m.RequestData...), append([]byte(nil), m.Key...), m.RequestType)
+	c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+	c.mirroring.Add(1)
+	go func() {
+		defer c.mirroring.Done()
+		c.shadow.SendProxiedMessageAsync(mirrored)
+		mirrored.AwaitResponseBytes()
+	}()
+}
+
+// finalize closes the connections to the shadow pool once the mirrored requests are done.
+// It must only be called after requests are no longer sent to c.
+func (c *shadowClient) finalize() {
+	c.mirroring.Wait()
+	c.shadow.Finalize()
+}
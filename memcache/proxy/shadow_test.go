@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestShadowMirrorsRatioOfWrites(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	primary := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			if m.RequestType == message.REQUEST_MC_GET {
+				return []byte("END\r\n")
+			}
+			return []byte("STORED\r\n")
+		},
+	}
+	// The shadow pool never responds, which must not delay responses from the primary pool.
+	mirrored := make(chan *message.SingleMessage, 1000)
+	shadow := &delayedRemote{send: func(m *message.SingleMessage) {
+		mirrored <- m
+	}}
+	remote := &shadowClient{ClientInterface: primary, shadow: shadow, ratio: 0.25}
+
+	const setCount = 1000
+	errs := handleAllCommands(strings.Repeat("set k 0 0 1\r\nx\r\nget k\r\n", setCount), responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, strings.Repeat("STORED\r\nEND\r\n", setCount))
+
+	// Wait for the mirrored requests, which are sent asynchronously.
+	count := 0
+	for {
+		select {
+		case m := <-mirrored:
+			testutil.ExpectEquals(t, message.REQUEST_MC_SET, m.RequestType, "expected only write requests to be mirrored")
+			testutil.ExpectStringEquals(t, "set k 0 0 1\r\nx\r\n", string(m.RequestData), "unexpected mirrored request")
+			m.HandleReceiveResponse([]byte("STORED\r\n"), message.RESPONSE_MC_STORED)
+			count++
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+		break
+	}
+	if count < setCount/8 || count > setCount/2 {
+		t.Errorf("expected about %d of %d sets to be mirrored, got %d", setCount/4, setCount, count)
+	}
+	testutil.ExpectEquals(t, 2*setCount, len(primary.requestData()), "expected every request to be sent to the primary pool")
+}
+
+func TestShutdownClosesShadowConnections(t *testing.T) {
+	primary := newFakeBackend(t, newStoreHandler())
+	defer primary.close()
+	mirrored := make(chan string, 1)
+	storeShadow := newStoreHandler()
+	shadow := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		storeShadow(line, reader, writer)
+		mirrored <- line
+	})
+	defer shadow.close()
+	conf := newTestPoolConfig(t, primary)
+	conf.Shadow = newTestPoolConfig(t, shadow).Servers
+	conf.ShadowRatio = 1
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "set k 0 0 1\r\nx\r\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectStringEquals(t, "STORED\r\n", line, "unexpected response to set")
+	select {
+	case <-mirrored:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the set to be mirrored to the shadow pool")
+	}
+	c.Close()
+
+	s.Shutdown(context.Background())
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&shadow.open) > 0 || atomic.LoadInt32(&primary.open) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected Shutdown to close the connections to the servers of the pool and the shadow pool")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
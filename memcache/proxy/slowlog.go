@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+)
+
+// logSlowRequests logs a warning for requests that take longer than the slowlog_threshold of the pool to get a response.
+func logSlowRequests(responses *responsequeue.ResponseQueue, remote memcache.ClientInterface, conf config.Config) {
+	if conf.SlowlogThreshold <= 0 {
+		return
+	}
+	responses.SetSlowRequestHandler(conf.SlowlogThreshold, func(m message.Message, elapsed time.Duration) {
+		command, keys := describeRequest(m)
+		var servers []string
+		if fanout, ok := m.(*message.FanoutMessage); ok {
+			servers = fanout.Servers
+		} else {
+			servers = serversForKeys(remote, keys)
+		}
+		getLogger().Warn("Slow request", "command", command, "key", strings.Join(keys, " "), "backend", strings.Join(servers, ","), "elapsed", elapsed)
+	})
+}
+
+// describeRequest returns the command and keys of a request for logging.
+func describeRequest(m message.Message) (string, []string) {
+	var fragments []*message.SingleMessage
+	switch m := m.(type) {
+	case *message.SingleMessage:
+		fragments = []*message.SingleMessage{m}
+	case *message.TranslatedMessage:
+		fragments = []*message.SingleMessage{&m.SingleMessage}
+	case *message.FragmentedMessage:
+		for i := range m.Fragments {
+			fragments = append(fragments, &m.Fragments[i])
+		}
+	case *message.FanoutMessage:
+		return commandName(m.Fragments[0].RequestData), nil
+	}
+	if len(fragments) == 0 || fragments[0].RequestData == nil {
+		// e.g. an error generated by the proxy without a request
+		return "", nil
+	}
+	var keys []string
+	for _, fragment := range fragments {
+		if len(fragment.Key) > 0 {
+			keys = append(keys, string(fragment.Key))
+		}
+	}
+	return commandName(fragments[0].RequestData), keys
+}
+
+// serversForKeys returns the names of the servers that remote sends requests for keys to, without duplicates.
+func serversForKeys(remote memcache.ClientInterface, keys []string) []string {
+	var servers []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if server := serverForKey(remote, []byte(key)); !seen[server] {
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+// serverForKey returns the name of the server that remote sends requests for key to.
+func serverForKey(remote memcache.ClientInterface, key []byte) string {
+	for {
+		if pool, ok := remote.(interface {
+			PickServer(key []byte) memcache.ClientInterface
+		}); ok {
+			return serverName(pool.PickServer(key))
+		}
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			return "unknown"
+		}
+		remote = wrapper.unwrap()
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestSlowlog(t *testing.T) {
+	previous := getLogger()
+	captured := &capturingLogger{}
+	SetLogger(captured)
+	defer SetLogger(previous)
+
+	store := newStoreHandler()
+	backend := newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+		if strings.Contains(line, "slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		store(line, reader, writer)
+	})
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.SlowlogThreshold = 50 * time.Millisecond
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "get fast\r\nget slow\r\n")
+	expected := "END\r\nEND\r\n"
+	response := make([]byte, len(expected))
+	if _, err := io.ReadFull(c, response); err != nil {
+		t.Fatalf("failed to read the responses: %v", err)
+	}
+	testutil.ExpectStringEquals(t, expected, string(response), "unexpected responses")
+
+	var slow []logEntry
+	for _, e := range captured.getEntries() {
+		if e.msg == "Slow request" {
+			slow = append(slow, e)
+		}
+	}
+	if len(slow) != 1 {
+		t.Fatalf("expected 1 slow request to be logged, got %#v", captured.getEntries())
+	}
+	testutil.ExpectStringEquals(t, "warn", slow[0].level, "unexpected level")
+	testutil.ExpectEquals(t, []interface{}{"command", "get", "key", "slow", "backend", backend.addr(), "elapsed"}, slow[0].keyvals[:7], "unexpected fields")
+	if elapsed := slow[0].keyvals[7].(time.Duration); elapsed < 100*time.Millisecond {
+		t.Errorf("expected the elapsed time to include the delay of the backend, got %v", elapsed)
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// acceptedConn returns the client connection that s is serving, once it has been accepted.
+func acceptedConn(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.m.Lock()
+		for c := range s.conns {
+			s.m.Unlock()
+			return c
+		}
+		s.m.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("the connection was not accepted")
+	return nil
+}
+
+// getsockoptInt returns the value of a socket option of c.
+func getsockoptInt(t *testing.T, c net.Conn, level int, option int) int {
+	t.Helper()
+	raw, err := c.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatalf("failed to get the socket of the connection: %v", err)
+	}
+	var value int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		value, sockErr = unix.GetsockoptInt(int(fd), level, option)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		t.Fatalf("failed to get socket option %d: %v", option, err)
+	}
+	return value
+}
+
+func TestClientSocketOptions(t *testing.T) {
+	for _, test := range []struct {
+		conf      config.Config
+		noDelay   int
+		keepAlive int
+	}{
+		{config.Config{TCPNoDelay: true, TCPKeepAlive: time.Minute}, 1, 1},
+		{config.Config{TCPNoDelay: false, TCPKeepAlive: 0}, 0, 0},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		s := NewServer(nil, 0)
+		s.addListener(l)
+		go s.serveSocketServer(&fakeRemote{}, l, test.conf)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		accepted := acceptedConn(t, s)
+		testutil.ExpectEquals(t, test.noDelay, getsockoptInt(t, accepted, unix.IPPROTO_TCP, unix.TCP_NODELAY), "unexpected TCP_NODELAY")
+		testutil.ExpectEquals(t, test.keepAlive, getsockoptInt(t, accepted, unix.SOL_SOCKET, unix.SO_KEEPALIVE), "unexpected SO_KEEPALIVE")
+		if test.keepAlive != 0 {
+			testutil.ExpectEquals(t, int(test.conf.TCPKeepAlive/time.Second), getsockoptInt(t, accepted, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE), "unexpected TCP_KEEPIDLE")
+		}
+		c.Close()
+		l.Close()
+	}
+}
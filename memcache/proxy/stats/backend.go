@@ -0,0 +1,129 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LATENCY_BUCKETS are the upper bounds (in seconds) of the buckets of the backend latency histogram.
+var LATENCY_BUCKETS = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// backendCounters are the counters for a single memcache server.
+type backendCounters struct {
+	requests uint64
+	errors   uint64
+	// ejections is the number of times the server was ejected by auto_eject_hosts
+	ejections uint64
+	// durationNanos is the sum of the durations of requests
+	durationNanos uint64
+	// buckets[i] is the number of requests that took at most LATENCY_BUCKETS[i] seconds (not cumulative)
+	buckets [16]uint64
+}
+
+// backends maps the address of each memcache server to its counters.
+type backends struct {
+	m        sync.RWMutex
+	counters map[string]*backendCounters
+}
+
+func (b *backends) get(server string) *backendCounters {
+	b.m.RLock()
+	counters := b.counters[server]
+	b.m.RUnlock()
+	if counters != nil {
+		return counters
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.counters == nil {
+		b.counters = make(map[string]*backendCounters)
+	}
+	counters = b.counters[server]
+	if counters == nil {
+		counters = &backendCounters{}
+		b.counters[server] = counters
+	}
+	return counters
+}
+
+// reset zeroes the counters of every memcache server.
+// The counters are kept in the map because RecordBackendRequest may still be using them.
+func (b *backends) reset() {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	for _, counters := range b.counters {
+		atomic.StoreUint64(&counters.requests, 0)
+		atomic.StoreUint64(&counters.errors, 0)
+		atomic.StoreUint64(&counters.ejections, 0)
+		atomic.StoreUint64(&counters.durationNanos, 0)
+		for i := range counters.buckets {
+			atomic.StoreUint64(&counters.buckets[i], 0)
+		}
+	}
+}
+
+// RecordBackendRequest records the duration of a request to the memcache server, and whether it failed.
+func (c *Counters) RecordBackendRequest(server string, duration time.Duration, failed bool) {
+	counters := c.backends.get(server)
+	atomic.AddUint64(&counters.requests, 1)
+	if failed {
+		atomic.AddUint64(&counters.errors, 1)
+	}
+	atomic.AddUint64(&counters.durationNanos, uint64(duration))
+	seconds := duration.Seconds()
+	for i, bound := range LATENCY_BUCKETS {
+		if seconds <= bound {
+			atomic.AddUint64(&counters.buckets[i], 1)
+			break
+		}
+	}
+}
+
+// RecordEjection counts a memcache server being ejected because of auto_eject_hosts.
+func (c *Counters) RecordEjection(server string) {
+	atomic.AddUint64(&c.backends.get(server).ejections, 1)
+}
+
+// BackendSnapshot is a copy of the counters of a memcache server at a point in time.
+type BackendSnapshot struct {
+	Server    string
+	Requests  uint64
+	Errors    uint64
+	Ejections uint64
+	Duration  time.Duration
+	// Buckets are the cumulative counts of requests that took at most the corresponding LATENCY_BUCKETS.
+	Buckets []uint64
+}
+
+// BackendSnapshots returns the counters of every memcache server that received requests, sorted by server.
+func (c *Counters) BackendSnapshots() []BackendSnapshot {
+	c.backends.m.RLock()
+	servers := make([]string, 0, len(c.backends.counters))
+	for server := range c.backends.counters {
+		servers = append(servers, server)
+	}
+	c.backends.m.RUnlock()
+	sort.Strings(servers)
+
+	result := make([]BackendSnapshot, 0, len(servers))
+	for _, server := range servers {
+		counters := c.backends.get(server)
+		snapshot := BackendSnapshot{
+			Server:    server,
+			Requests:  atomic.LoadUint64(&counters.requests),
+			Errors:    atomic.LoadUint64(&counters.errors),
+			Ejections: atomic.LoadUint64(&counters.ejections),
+			Duration:  time.Duration(atomic.LoadUint64(&counters.durationNanos)),
+			Buckets:   make([]uint64, len(LATENCY_BUCKETS)),
+		}
+		var cumulative uint64
+		for i := range LATENCY_BUCKETS {
+			cumulative += atomic.LoadUint64(&counters.buckets[i])
+			snapshot.Buckets[i] = cumulative
+		}
+		result = append(result, snapshot)
+	}
+	return result
+}
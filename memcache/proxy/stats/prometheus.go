@@ -0,0 +1,98 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// WritePrometheus writes the counters in the Prometheus text exposition format.
+func (c *Counters) WritePrometheus(w io.Writer) error {
+	s := c.Snapshot()
+	backends := c.BackendSnapshots()
+	p := &prometheusWriter{w: w}
+
+	p.family("golemproxy_connections_current", "gauge", "Client connections that are currently open.")
+	p.sample("golemproxy_connections_current", "", strconv.FormatInt(s.CurrentConnections, 10))
+	p.family("golemproxy_connections_total", "counter", "Client connections that were accepted.")
+	p.sample("golemproxy_connections_total", "", strconv.FormatUint(s.TotalConnections, 10))
+	p.family("golemproxy_connections_rejected_total", "counter", "Client connections that were closed because max_connections was reached or the client was not in allow_cidrs.")
+	p.sample("golemproxy_connections_rejected_total", "", strconv.FormatUint(s.RejectedConnections, 10))
+	p.family("golemproxy_connections_throttled_total", "counter", "Client connections that waited to be served because max_connections_per_second was reached.")
+	p.sample("golemproxy_connections_throttled_total", "", strconv.FormatUint(s.ThrottledConnections, 10))
+	p.family("golemproxy_requests_total", "counter", "Requests from clients by command.")
+	for _, command := range commandNames {
+		p.sample("golemproxy_requests_total", `command="`+command.name+`"`, strconv.FormatUint(s.Commands[command.name], 10))
+	}
+	p.family("golemproxy_get_keys_total", "counter", "Keys of get and gets requests by whether the value was found.")
+	p.sample("golemproxy_get_keys_total", `result="hit"`, strconv.FormatUint(s.GetHits, 10))
+	p.sample("golemproxy_get_keys_total", `result="miss"`, strconv.FormatUint(s.GetMisses, 10))
+	p.family("golemproxy_bytes_read_total", "counter", "Bytes read from clients.")
+	p.sample("golemproxy_bytes_read_total", "", strconv.FormatUint(s.BytesRead, 10))
+	p.family("golemproxy_bytes_written_total", "counter", "Bytes written to clients.")
+	p.sample("golemproxy_bytes_written_total", "", strconv.FormatUint(s.BytesWritten, 10))
+	p.family("golemproxy_response_errors_total", "counter", "Requests from clients that failed by error.")
+	p.sample("golemproxy_response_errors_total", `error="server_error"`, strconv.FormatUint(s.ServerErrors, 10))
+	p.sample("golemproxy_response_errors_total", `error="timeout"`, strconv.FormatUint(s.Timeouts, 10))
+
+	p.family("golemproxy_backend_request_duration_seconds", "histogram", "Latency of requests to memcache servers.")
+	for _, backend := range backends {
+		server := `server="` + escapeLabelValue(backend.Server) + `"`
+		for i, bound := range LATENCY_BUCKETS {
+			p.sample("golemproxy_backend_request_duration_seconds_bucket", server+`,le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, strconv.FormatUint(backend.Buckets[i], 10))
+		}
+		p.sample("golemproxy_backend_request_duration_seconds_bucket", server+`,le="+Inf"`, strconv.FormatUint(backend.Requests, 10))
+		p.sample("golemproxy_backend_request_duration_seconds_sum", server, strconv.FormatFloat(backend.Duration.Seconds(), 'g', -1, 64))
+		p.sample("golemproxy_backend_request_duration_seconds_count", server, strconv.FormatUint(backend.Requests, 10))
+	}
+	p.family("golemproxy_backend_errors_total", "counter", "Requests to memcache servers that failed because of a connection error or timeout.")
+	for _, backend := range backends {
+		p.sample("golemproxy_backend_errors_total", `server="`+escapeLabelValue(backend.Server)+`"`, strconv.FormatUint(backend.Errors, 10))
+	}
+	p.family("golemproxy_backend_ejections_total", "counter", "Times that memcache servers were ejected by auto_eject_hosts.")
+	for _, backend := range backends {
+		p.sample("golemproxy_backend_ejections_total", `server="`+escapeLabelValue(backend.Server)+`"`, strconv.FormatUint(backend.Ejections, 10))
+	}
+	return p.err
+}
+
+// prometheusWriter writes metrics, remembering the first error.
+type prometheusWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *prometheusWriter) family(name string, metricType string, help string) {
+	if p.err == nil {
+		_, p.err = fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	}
+}
+
+func (p *prometheusWriter) sample(name string, labels string, value string) {
+	if p.err != nil {
+		return
+	}
+	if labels != "" {
+		_, p.err = fmt.Fprintf(p.w, "%s{%s} %s\n", name, labels, value)
+	} else {
+		_, p.err = fmt.Fprintf(p.w, "%s %s\n", name, value)
+	}
+}
+
+// escapeLabelValue escapes backslashes, double quotes, and newlines as required by the text format.
+func escapeLabelValue(value string) string {
+	result := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			result = append(result, '\\', '\\')
+		case '"':
+			result = append(result, '\\', '"')
+		case '\n':
+			result = append(result, '\\', 'n')
+		default:
+			result = append(result, value[i])
+		}
+	}
+	return string(result)
+}
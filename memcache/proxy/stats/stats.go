@@ -0,0 +1,193 @@
+// stats contains counters for the whole proxy, which are reported by the memcache stats command and the metrics endpoint
+package stats
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// Counters are updated with atomic operations by the goroutines serving clients.
+type Counters struct {
+	totalConnections     uint64
+	currentConnections   int64
+	rejectedConnections  uint64
+	throttledConnections uint64
+	bytesRead            uint64
+	bytesWritten         uint64
+	serverErrors         uint64
+	timeouts             uint64
+	getHits              uint64
+	getMisses            uint64
+	// commands is the number of requests of each message.RequestType
+	commands [256]uint64
+	backends backends
+}
+
+// Global is the set of counters for this process.
+var Global = &Counters{}
+
+// commandNames are the names of request types in the output of the stats command, in the order they are reported.
+var commandNames = []struct {
+	requestType message.RequestType
+	name        string
+}{
+	{message.REQUEST_MC_GET, "get"},
+	{message.REQUEST_MC_GETS, "gets"},
+	{message.REQUEST_MC_GAT, "gat"},
+	{message.REQUEST_MC_GATS, "gats"},
+	{message.REQUEST_MC_SET, "set"},
+	{message.REQUEST_MC_ADD, "add"},
+	{message.REQUEST_MC_REPLACE, "replace"},
+	{message.REQUEST_MC_APPEND, "append"},
+	{message.REQUEST_MC_PREPEND, "prepend"},
+	{message.REQUEST_MC_CAS, "cas"},
+	{message.REQUEST_MC_DELETE, "delete"},
+	{message.REQUEST_MC_INCR, "incr"},
+	{message.REQUEST_MC_DECR, "decr"},
+	{message.REQUEST_MC_TOUCH, "touch"},
+	{message.REQUEST_MC_FLUSH_ALL, "flush_all"},
+	{message.REQUEST_MC_VERBOSITY, "verbosity"},
+	{message.REQUEST_MC_VERSION, "version"},
+	{message.REQUEST_MC_STATS, "stats"},
+	{message.REQUEST_MC_META_GET, "mg"},
+	{message.REQUEST_MC_META_SET, "ms"},
+	{message.REQUEST_MC_META_DELETE, "md"},
+	{message.REQUEST_MC_META_ARITHMETIC, "ma"},
+	{message.REQUEST_MC_META_NOOP, "mn"},
+}
+
+func (c *Counters) ConnectionOpened() {
+	atomic.AddUint64(&c.totalConnections, 1)
+	atomic.AddInt64(&c.currentConnections, 1)
+}
+
+func (c *Counters) ConnectionClosed() {
+	atomic.AddInt64(&c.currentConnections, -1)
+}
+
+// ConnectionThrottled counts a connection that waited to be served because max_connections_per_second was reached.
+func (c *Counters) ConnectionThrottled() {
+	atomic.AddUint64(&c.throttledConnections, 1)
+}
+
+// ConnectionRejected counts a connection that was closed immediately because max_connections was reached or the client isn't in allow_cidrs.
+func (c *Counters) ConnectionRejected() {
+	atomic.AddUint64(&c.rejectedConnections, 1)
+}
+
+func (c *Counters) AddBytesRead(n int) {
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+}
+
+func (c *Counters) AddBytesWritten(n int) {
+	atomic.AddUint64(&c.bytesWritten, uint64(n))
+}
+
+// RecordCommand counts a request from a client. Multigets are counted as a single request.
+func (c *Counters) RecordCommand(requestType message.RequestType) {
+	atomic.AddUint64(&c.commands[requestType], 1)
+}
+
+// RecordError counts a request that failed because a memcache server returned an error or did not respond in time.
+func (c *Counters) RecordError(err *message.ResponseError) {
+	switch err {
+	case message.RESPONSE_ERROR_TIMEOUT:
+		atomic.AddUint64(&c.timeouts, 1)
+	case message.RESPONSE_ERROR_UNEXPECTED_TYPE:
+		atomic.AddUint64(&c.serverErrors, 1)
+	}
+}
+
+// RecordGet counts a key of a get or gets request, which was a hit if a value was returned.
+func (c *Counters) RecordGet(hit bool) {
+	if hit {
+		atomic.AddUint64(&c.getHits, 1)
+	} else {
+		atomic.AddUint64(&c.getMisses, 1)
+	}
+}
+
+// Reset zeroes the cumulative counters, for the stats reset command.
+// The number of current connections is a gauge and is left unchanged.
+func (c *Counters) Reset() {
+	atomic.StoreUint64(&c.totalConnections, 0)
+	atomic.StoreUint64(&c.rejectedConnections, 0)
+	atomic.StoreUint64(&c.throttledConnections, 0)
+	atomic.StoreUint64(&c.bytesRead, 0)
+	atomic.StoreUint64(&c.bytesWritten, 0)
+	atomic.StoreUint64(&c.serverErrors, 0)
+	atomic.StoreUint64(&c.timeouts, 0)
+	atomic.StoreUint64(&c.getHits, 0)
+	atomic.StoreUint64(&c.getMisses, 0)
+	for i := range c.commands {
+		atomic.StoreUint64(&c.commands[i], 0)
+	}
+	c.backends.reset()
+}
+
+// Snapshot is a copy of the counters at a point in time.
+type Snapshot struct {
+	TotalConnections     uint64
+	CurrentConnections   int64
+	RejectedConnections  uint64
+	ThrottledConnections uint64
+	BytesRead            uint64
+	BytesWritten         uint64
+	// ServerErrors doesn't include timeouts
+	ServerErrors uint64
+	Timeouts     uint64
+	// GetHits and GetMisses count keys of get and gets requests, so a multiget counts once per key.
+	GetHits   uint64
+	GetMisses uint64
+	// Commands maps command names such as "get" to the number of requests
+	Commands map[string]uint64
+}
+
+func (c *Counters) Snapshot() Snapshot {
+	commands := make(map[string]uint64, len(commandNames))
+	for _, command := range commandNames {
+		commands[command.name] = atomic.LoadUint64(&c.commands[command.requestType])
+	}
+	return Snapshot{
+		TotalConnections:     atomic.LoadUint64(&c.totalConnections),
+		CurrentConnections:   atomic.LoadInt64(&c.currentConnections),
+		RejectedConnections:  atomic.LoadUint64(&c.rejectedConnections),
+		ThrottledConnections: atomic.LoadUint64(&c.throttledConnections),
+		BytesRead:            atomic.LoadUint64(&c.bytesRead),
+		BytesWritten:         atomic.LoadUint64(&c.bytesWritten),
+		ServerErrors:         atomic.LoadUint64(&c.serverErrors),
+		Timeouts:             atomic.LoadUint64(&c.timeouts),
+		GetHits:              atomic.LoadUint64(&c.getHits),
+		GetMisses:            atomic.LoadUint64(&c.getMisses),
+		Commands:             commands,
+	}
+}
+
+// Format returns the response to the stats command, in the same format as memcached.
+func (s Snapshot) Format(version string) []byte {
+	var result []byte
+	stat := func(name string, value string) {
+		result = append(result, "STAT "...)
+		result = append(result, name...)
+		result = append(result, ' ')
+		result = append(result, value...)
+		result = append(result, "\r\n"...)
+	}
+	stat("version", version)
+	stat("curr_connections", strconv.FormatInt(s.CurrentConnections, 10))
+	stat("total_connections", strconv.FormatUint(s.TotalConnections, 10))
+	stat("rejected_connections", strconv.FormatUint(s.RejectedConnections, 10))
+	stat("throttled_connections", strconv.FormatUint(s.ThrottledConnections, 10))
+	for _, command := range commandNames {
+		stat("cmd_"+command.name, strconv.FormatUint(s.Commands[command.name], 10))
+	}
+	stat("get_hits", strconv.FormatUint(s.GetHits, 10))
+	stat("get_misses", strconv.FormatUint(s.GetMisses, 10))
+	stat("bytes_read", strconv.FormatUint(s.BytesRead, 10))
+	stat("bytes_written", strconv.FormatUint(s.BytesWritten, 10))
+	stat("server_errors", strconv.FormatUint(s.ServerErrors, 10))
+	stat("timeouts", strconv.FormatUint(s.Timeouts, 10))
+	return append(result, "END\r\n"...)
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+)
+
+// requestStatsSubcommand is the prefix of requests such as "stats slabs\r\n".
+var requestStatsSubcommand = []byte("stats ")
+
+// passthroughStats is the stats subcommands that are sent to a single memcache server, for admin tooling that inspects the memory of memcached.
+// Each of them responds with STAT lines followed by END.
+var passthroughStats = map[string]bool{
+	"slabs":    true,
+	"items":    true,
+	"sizes":    true,
+	"settings": true,
+	"conns":    true,
+}
+
+// statsServerOf returns the server that remote sends requests such as "stats slabs" to, or remote itself if it isn't a pool.
+func statsServerOf(remote memcache.ClientInterface) memcache.ClientInterface {
+	for {
+		if pool, ok := remote.(interface {
+			StatsServer() *memcache.PipeliningClient
+		}); ok {
+			if server := pool.StatsServer(); server != nil {
+				return server
+			}
+			return remote
+		}
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			return remote
+		}
+		remote = wrapper.unwrap()
+	}
+}
+
+// handleStats forwards "stats <subcommand>\r\n" to the stats_server of the pool (or the first server that isn't ejected) and relays its response.
+// The counters of the other servers are not included.
+func handleStats(requestHeader []byte, responses *responsequeue.ResponseQueue, remote memcache.ClientInterface) error {
+	args, err := splitArgsOnSpaces(requestHeader[:len(requestHeader)-2])
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 || !passthroughStats[string(args[1])] {
+		respondWithError(responses, message.RESPONSE_ERROR_NONEXISTENT_COMMAND)
+		return nil
+	}
+	m := &message.SingleMessage{}
+	m.HandleSendRequest(requestHeader, nil, message.REQUEST_MC_STATS)
+	statsServerOf(remote).SendProxiedMessageAsync(m)
+	responses.RecordOutgoingRequest(m)
+	return nil
+}
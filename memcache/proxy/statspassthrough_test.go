@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestStatsPassthrough(t *testing.T) {
+	// newSlabsBackend starts a server that responds to stats slabs with the given number of active slabs.
+	newSlabsBackend := func(activeSlabs string) *fakeBackend {
+		return newFakeBackend(t, func(line string, reader *bufio.Reader, writer io.Writer) {
+			if line != "stats slabs\r\n" {
+				io.WriteString(writer, "ERROR\r\n")
+				return
+			}
+			io.WriteString(writer, "STAT 1:chunk_size 96\r\nSTAT active_slabs "+activeSlabs+"\r\nEND\r\n")
+		})
+	}
+	first := newSlabsBackend("1")
+	defer first.close()
+	second := newSlabsBackend("2")
+	defer second.close()
+	conf := newTestPoolConfig(t, first, second)
+	conf.StatsServer = second.addr()
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(c, "stats slabs\r\nstats cachedump 1 1\r\nversion\r\n")
+	reader := bufio.NewReader(c)
+	for _, expected := range []string{
+		"STAT 1:chunk_size 96\r\n",
+		"STAT active_slabs 2\r\n",
+		"END\r\n",
+		// Other subcommands aren't forwarded.
+		"ERROR\r\n",
+		string(versionResponse),
+	} {
+		line, err := reader.ReadString('\n')
+		testutil.ExpectEquals(t, nil, err, "unexpected error")
+		testutil.ExpectStringEquals(t, expected, line, "unexpected response")
+	}
+	testutil.ExpectEquals(t, uint64(0), backendRequests(first.addr()), "expected stats slabs to only be sent to stats_server")
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// startTLSTestServer is like startTestServer, but terminates TLS from clients with clientTLS.
+func startTLSTestServer(t *testing.T, clientTLS *tls.Config) net.Listener {
+	t.Helper()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("VALUE " + string(m.Key) + " 0 1\r\nx\r\nEND\r\n")
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	conf := config.Config{Listen: []string{l.Addr().String()}, TCPNoDelay: true, ClientTLS: clientTLS}
+	l = wrapClientTLS(l, conf)
+	s := NewServer(nil, 0)
+	s.addListener(l)
+	go s.serveSocketServer(remote, l, conf)
+	return l
+}
+
+func tlsGet(addr string, clientConfig *tls.Config) (string, error) {
+	c, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+	_, err = c.Write([]byte("get foo\r\n"))
+	if err != nil {
+		return "", err
+	}
+	reader := bufio.NewReader(c)
+	result := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return result, err
+		}
+		result += line
+		if line == "END\r\n" {
+			return result, nil
+		}
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	cert, pool := testutil.NewSelfSignedCertificate(t)
+	l := startTLSTestServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer l.Close()
+
+	response, err := tlsGet(l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("get over tls failed: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "VALUE foo 0 1\r\nx\r\nEND\r\n", response, "unexpected response")
+}
+
+func TestClientTLSVerifiesClientCertificates(t *testing.T) {
+	cert, pool := testutil.NewSelfSignedCertificate(t)
+	l := startTLSTestServer(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer l.Close()
+
+	response, err := tlsGet(l.Addr().String(), &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("get over tls with a client certificate failed: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "VALUE foo 0 1\r\nx\r\nEND\r\n", response, "unexpected response")
+
+	untrustedCert, _ := testutil.NewSelfSignedCertificate(t)
+	for _, clientConfig := range []*tls.Config{
+		{RootCAs: pool},
+		{RootCAs: pool, Certificates: []tls.Certificate{untrustedCert}},
+	} {
+		_, err = tlsGet(l.Addr().String(), clientConfig)
+		if err == nil {
+			t.Errorf("expected clients without a trusted certificate to be rejected")
+		}
+	}
+}
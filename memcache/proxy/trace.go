@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// TraceHooks are optional callbacks for tracing client connections and the requests they send, e.g. to create OpenTelemetry spans.
+// Hooks are called synchronously (ConnectionOpened and CommandParsed on the goroutine of the client connection), so they should be fast.
+// Hooks that are nil are not called, and no tracing is done if every hook is nil.
+type TraceHooks struct {
+	// ConnectionOpened is called when a client connection to a pool's listener is accepted.
+	ConnectionOpened func(ConnectionTrace)
+	// CommandParsed is called when the request line of a text protocol command is read from a client,
+	// before the command is forwarded or answered by the proxy.
+	CommandParsed func(CommandTrace)
+	// BackendDispatched is called when a request is sent to the servers of a pool.
+	// The keys of a multiget are sent as separate requests.
+	BackendDispatched func(BackendTrace)
+	// BackendResponded is called when the response to a request sent to the servers of a pool is received, or the request failed.
+	BackendResponded func(BackendTrace)
+}
+
+func (h *TraceHooks) enabled() bool {
+	return h.ConnectionOpened != nil || h.CommandParsed != nil || h.BackendDispatched != nil || h.BackendResponded != nil
+}
+
+// ConnectionTrace describes a client connection.
+type ConnectionTrace struct {
+	Pool       string
+	RemoteAddr net.Addr
+	Time       time.Time
+}
+
+// CommandTrace describes a command from a client.
+type CommandTrace struct {
+	Pool string
+	// Command is the name of the command, e.g. "get".
+	Command string
+	// Bytes is the length of the request line, which does not include the value of a storage command.
+	Bytes int
+	Time  time.Time
+}
+
+// BackendTrace describes a request to the servers of a pool.
+type BackendTrace struct {
+	Pool    string
+	Command string
+	Key     string
+	// RequestBytes is the length of the request, including the value of a storage command.
+	RequestBytes int
+	// ResponseBytes is the length of the response, or 0 before the response is received or if the request failed.
+	ResponseBytes int
+	// Duration is the time from sending the request to receiving the response, or 0 before the response is received.
+	Duration time.Duration
+	// Error is the error that is sent to the client if the request failed, or nil.
+	Error error
+	Time  time.Time
+}
+
+// tracingClient calls the hooks for the requests sent to the servers of a pool.
+// It is the innermost wrapper, so requests that are rejected by other wrappers aren't traced as backend requests.
+type tracingClient struct {
+	memcache.ClientInterface
+	pool  string
+	hooks TraceHooks
+}
+
+var _ memcache.ClientInterface = &tracingClient{}
+
+func (c *tracingClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *tracingClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *tracingClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	trace := BackendTrace{
+		Pool:         c.pool,
+		Command:      commandName(m.RequestData),
+		Key:          string(m.Key),
+		RequestBytes: len(m.RequestData),
+		Time:         time.Now(),
+	}
+	if c.hooks.BackendDispatched != nil {
+		c.hooks.BackendDispatched(trace)
+	}
+	if c.hooks.BackendResponded == nil {
+		c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+		return
+	}
+	// The response is received by a separate message, so that the hook is called before the client can receive the response.
+	// The request data is not copied, since it is released after the client receives the response.
+	forwarded := &message.SingleMessage{
+		NoReply: m.NoReply,
+		Flags:   m.Flags,
+		Exptime: m.Exptime,
+	}
+	forwarded.HandleSendRequest(m.RequestData, m.Key, m.RequestType)
+	c.ClientInterface.SendProxiedMessageWithContext(ctx, forwarded)
+	go func() {
+		data, responseError := forwarded.AwaitResponseBytes()
+		trace.Duration = time.Since(trace.Time)
+		trace.ResponseBytes = len(data)
+		trace.Time = time.Now()
+		if responseError != nil {
+			trace.Error = responseError
+		}
+		c.hooks.BackendResponded(trace)
+		if responseError != nil {
+			m.HandleResponseError(responseError)
+			return
+		}
+		m.HandleReceiveResponse(data, forwarded.ResponseType)
+	}()
+}
+
+// commandName returns the first word of a text protocol request.
+func commandName(request []byte) string {
+	if i := bytes.IndexAny(request, " \r"); i >= 0 {
+		return string(request[:i])
+	}
+	return string(request)
+}
+
+// tracerOf returns the client that calls the trace hooks of remote, or nil if tracing is disabled.
+func tracerOf(remote memcache.ClientInterface) *tracingClient {
+	for {
+		if c, ok := remote.(*tracingClient); ok {
+			return c
+		}
+		wrapper, ok := remote.(wrappedClient)
+		if !ok {
+			return nil
+		}
+		remote = wrapper.unwrap()
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestTraceHooks(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	backend.handle("set k 0 0 5\r\n", bufio.NewReader(strings.NewReader("hello\r\n")), ioutil.Discard)
+
+	var m sync.Mutex
+	var events []string
+	record := func(format string, args ...interface{}) {
+		m.Lock()
+		defer m.Unlock()
+		events = append(events, fmt.Sprintf(format, args...))
+	}
+	s := NewServer(map[string]config.Config{"main": newTestPoolConfig(t, backend)}, 0)
+	s.Trace = TraceHooks{
+		ConnectionOpened: func(trace ConnectionTrace) {
+			record("opened %s", trace.Pool)
+		},
+		CommandParsed: func(trace CommandTrace) {
+			record("parsed %s %s %d", trace.Pool, trace.Command, trace.Bytes)
+		},
+		BackendDispatched: func(trace BackendTrace) {
+			record("dispatched %s %s %s %d", trace.Pool, trace.Command, trace.Key, trace.RequestBytes)
+		},
+		BackendResponded: func(trace BackendTrace) {
+			if trace.Duration <= 0 {
+				t.Errorf("expected a positive duration, got %v", trace.Duration)
+			}
+			record("responded %s %s %s %d %v", trace.Pool, trace.Command, trace.Key, trace.ResponseBytes, trace.Error)
+		},
+	}
+	addr := serveInBackground(t, s)
+	defer s.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "get k\r\n")
+	expected := "VALUE k 0 5\r\nhello\r\nEND\r\n"
+	response := make([]byte, len(expected))
+	if _, err := io.ReadFull(c, response); err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	testutil.ExpectStringEquals(t, expected, string(response), "unexpected response")
+
+	m.Lock()
+	defer m.Unlock()
+	testutil.ExpectEquals(t, []string{
+		"opened main",
+		"parsed main get 7",
+		"dispatched main get k 7",
+		"responded main get k 25 <nil>",
+	}, events, "expected the hooks to be called in order")
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// ttlOverrideClient replaces the expiration time of storage requests with ttl before forwarding them to the wrapped client.
+type ttlOverrideClient struct {
+	memcache.ClientInterface
+	ttl uint
+}
+
+var _ memcache.ClientInterface = &ttlOverrideClient{}
+
+func isStorageRequest(requestType message.RequestType) bool {
+	switch requestType {
+	case message.REQUEST_MC_SET, message.REQUEST_MC_ADD, message.REQUEST_MC_REPLACE, message.REQUEST_MC_APPEND, message.REQUEST_MC_PREPEND, message.REQUEST_MC_CAS:
+		return true
+	}
+	return false
+}
+
+func (c *ttlOverrideClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *ttlOverrideClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *ttlOverrideClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	if isStorageRequest(m.RequestType) {
+		m.RequestData = overrideExptime(m.RequestData, c.ttl)
+		m.Exptime = int32(c.ttl)
+	}
+	c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+}
+
+// MAX_RELATIVE_EXPTIME is the largest expiration time that memcached treats as a number of seconds, rather than a unix timestamp.
+const MAX_RELATIVE_EXPTIME = 60 * 60 * 24 * 30
+
+// maxTTLClient limits the expiration time of set, add, replace, and cas requests to maxTTL seconds before forwarding them to the wrapped client.
+// Items that would never expire (an expiration time of 0) expire after maxTTL seconds instead.
+type maxTTLClient struct {
+	memcache.ClientInterface
+	maxTTL uint
+}
+
+var _ memcache.ClientInterface = &maxTTLClient{}
+
+func (c *maxTTLClient) unwrap() memcache.ClientInterface {
+	return c.ClientInterface
+}
+
+func (c *maxTTLClient) SendProxiedMessageAsync(m *message.SingleMessage) {
+	c.SendProxiedMessageWithContext(context.Background(), m)
+}
+
+func (c *maxTTLClient) SendProxiedMessageWithContext(ctx context.Context, m *message.SingleMessage) {
+	switch m.RequestType {
+	case message.REQUEST_MC_SET, message.REQUEST_MC_ADD, message.REQUEST_MC_REPLACE, message.REQUEST_MC_CAS:
+		if exceedsTTL(m.Exptime, c.maxTTL, time.Now().Unix()) {
+			m.RequestData = overrideExptime(m.RequestData, c.maxTTL)
+			m.Exptime = int32(c.maxTTL)
+		}
+	}
+	c.ClientInterface.SendProxiedMessageWithContext(ctx, m)
+}
+
+// exceedsTTL returns true if an item with the expiration time exptime would be stored for longer than maxTTL seconds.
+// Like memcached, exptime is a unix timestamp if it is more than 30 days, and negative expiration times expire immediately.
+func exceedsTTL(exptime int32, maxTTL uint, now int64) bool {
+	switch {
+	case exptime == 0:
+		return true
+	case exptime < 0:
+		return false
+	case exptime <= MAX_RELATIVE_EXPTIME:
+		return uint(exptime) > maxTTL
+	default:
+		return int64(exptime)-now > int64(maxTTL)
+	}
+}
+
+// overrideExptime returns a copy of the storage request with the expiration time (the 4th word of the header) replaced by ttl.
+func overrideExptime(request []byte, ttl uint) []byte {
+	headerEnd := bytes.IndexByte(request, '\n')
+	if headerEnd < 0 {
+		return request
+	}
+	header := bytes.TrimRight(request[:headerEnd], "\r")
+	args := bytes.Split(header, []byte(" "))
+	if len(args) < 5 {
+		return request
+	}
+	args[3] = strconv.AppendUint(nil, uint64(ttl), 10)
+	result := bytes.Join(args, []byte(" "))
+	result = append(result, '\r')
+	return append(result, request[headerEnd:]...)
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/responsequeue"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestTTLOverride(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	backend := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			if m.RequestType == message.REQUEST_MC_GET {
+				return []byte("END\r\n")
+			}
+			return []byte("STORED\r\n")
+		},
+	}
+	remote := &ttlOverrideClient{ClientInterface: backend, ttl: 60}
+	errs := handleAllCommands("set a 5 0 1\r\nx\r\nadd b 0 -1 2 noreply\r\nxy\r\ncas c 1 3600 1 99\r\nz\r\nget a\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nSTORED\r\nEND\r\n")
+	testutil.ExpectEquals(t, []string{
+		"set a 5 60 1\r\nx\r\n",
+		"add b 0 60 2 noreply\r\nxy\r\n",
+		"cas c 1 60 1 99\r\nz\r\n",
+		"get a\r\n",
+	}, backend.requestData(), "expected the expiry of storage requests to be overridden")
+	testutil.ExpectEquals(t, uint32(5), backend.requests[0].Flags, "unexpected flags")
+	testutil.ExpectEquals(t, int32(60), backend.requests[0].Exptime, "unexpected exptime")
+}
+
+func TestStorageRequestFlagsAndExptime(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	remote := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("STORED\r\n")
+		},
+	}
+	errs := handleAllCommands("set a 4294967295 -30 1\r\nx\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	err := handleCommand(bufio.NewReader(strings.NewReader("set b 1 2147483648 1\r\ny\r\n")), responses, remote, MAX_ITEM_SIZE)
+	if err == nil {
+		t.Errorf("expected an exptime that does not fit in 32 bits to be rejected")
+	}
+	testutil.ExpectEquals(t, 1, len(remote.requests), "expected one request to be forwarded")
+	testutil.ExpectEquals(t, uint32(4294967295), remote.requests[0].Flags, "unexpected flags")
+	testutil.ExpectEquals(t, int32(-30), remote.requests[0].Exptime, "unexpected exptime")
+	testutil.ExpectEquals(t, []string{"set a 4294967295 -30 1\r\nx\r\n"}, remote.requestData(), "expected the request to be forwarded unchanged")
+}
+
+func TestMaxTTL(t *testing.T) {
+	output := &syncBuffer{}
+	responses := responsequeue.CreateResponseQueue(output)
+	defer responses.Close()
+	backend := &fakeRemote{
+		respond: func(m *message.SingleMessage) []byte {
+			return []byte("STORED\r\n")
+		},
+	}
+	remote := &maxTTLClient{ClientInterface: backend, maxTTL: 60}
+	errs := handleAllCommands("set k 0 0 1\r\nx\r\nadd a 0 30 1\r\nx\r\nreplace b 0 3600 1\r\nx\r\nset c 0 -1 1\r\nx\r\nappend d 0 0 1\r\nx\r\n", responses, remote)
+	testutil.ExpectEquals(t, []error{}, errs, "unexpected errors")
+	awaitOutput(t, output, "STORED\r\nSTORED\r\nSTORED\r\nSTORED\r\nSTORED\r\n")
+	testutil.ExpectEquals(t, []string{
+		"set k 0 60 1\r\nx\r\n",
+		"add a 0 30 1\r\nx\r\n",
+		"replace b 0 60 1\r\nx\r\n",
+		"set c 0 -1 1\r\nx\r\n",
+		"append d 0 0 1\r\nx\r\n",
+	}, backend.requestData(), "expected the expiry of set/add/replace to be at most max_ttl")
+	testutil.ExpectEquals(t, int32(60), backend.requests[0].Exptime, "unexpected exptime")
+}
+
+func TestExceedsTTLWithUnixTimestamps(t *testing.T) {
+	now := int64(1600000000)
+	testutil.ExpectEquals(t, false, exceedsTTL(int32(now+60), 60, now), "expected a timestamp 60 seconds from now to be allowed")
+	testutil.ExpectEquals(t, true, exceedsTTL(int32(now+61), 60, now), "expected a timestamp 61 seconds from now to be limited")
+	testutil.ExpectEquals(t, true, exceedsTTL(MAX_RELATIVE_EXPTIME, 60, now), "expected 30 days to be limited")
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+)
+
+const (
+	// UDP_FRAME_HEADER_SIZE is the size of the frame header of memcached's UDP protocol:
+	// a 2 byte request id, 2 byte sequence number, 2 byte total number of datagrams, and 2 reserved bytes.
+	UDP_FRAME_HEADER_SIZE = 8
+	// UDP_MAX_DATAGRAM_SIZE is the maximum size of a response datagram, including the frame header. This is the same as memcached.
+	UDP_MAX_DATAGRAM_SIZE = 1400
+	// UDP_MAX_RESPONSE_DATAGRAMS is the maximum number of datagrams in a response, since the sequence number is 16 bits.
+	UDP_MAX_RESPONSE_DATAGRAMS = 1 << 16
+)
+
+var (
+	// RESPONSE_UDP_TOO_LARGE is sent if a response does not fit in UDP_MAX_RESPONSE_DATAGRAMS datagrams.
+	RESPONSE_UDP_TOO_LARGE = []byte("SERVER_ERROR response too large for udp\r\n")
+)
+
+// parseUDPFrame returns the request id and the request from a datagram sent to a udp listener.
+// Requests must fit in a single datagram, like memcached.
+func parseUDPFrame(datagram []byte) (uint16, []byte, error) {
+	if len(datagram) < UDP_FRAME_HEADER_SIZE {
+		return 0, nil, fmt.Errorf("expected a %d byte frame header, got %d bytes", UDP_FRAME_HEADER_SIZE, len(datagram))
+	}
+	requestID := binary.BigEndian.Uint16(datagram[0:2])
+	sequence := binary.BigEndian.Uint16(datagram[2:4])
+	total := binary.BigEndian.Uint16(datagram[4:6])
+	reserved := binary.BigEndian.Uint16(datagram[6:8])
+	if sequence != 0 || total != 1 {
+		return 0, nil, fmt.Errorf("requests spanning multiple datagrams are not supported (sequence %d of %d)", sequence, total)
+	}
+	if reserved != 0 {
+		return 0, nil, errors.New("expected the reserved bytes of the frame header to be 0")
+	}
+	return requestID, datagram[UDP_FRAME_HEADER_SIZE:], nil
+}
+
+// frameUDPResponse splits a response into datagrams with frame headers for the request with the given id.
+// No datagrams are returned for an empty response.
+func frameUDPResponse(requestID uint16, response []byte) [][]byte {
+	const maxPayload = UDP_MAX_DATAGRAM_SIZE - UDP_FRAME_HEADER_SIZE
+	if len(response) == 0 {
+		// e.g. every command was noreply
+		return nil
+	}
+	total := (len(response) + maxPayload - 1) / maxPayload
+	if total > UDP_MAX_RESPONSE_DATAGRAMS-1 {
+		response = RESPONSE_UDP_TOO_LARGE
+		total = 1
+	}
+	datagrams := make([][]byte, 0, total)
+	for sequence := 0; sequence < total; sequence++ {
+		payload := response
+		if len(payload) > maxPayload {
+			payload = payload[:maxPayload]
+		}
+		response = response[len(payload):]
+		datagram := make([]byte, UDP_FRAME_HEADER_SIZE, UDP_FRAME_HEADER_SIZE+len(payload))
+		binary.BigEndian.PutUint16(datagram[0:2], requestID)
+		binary.BigEndian.PutUint16(datagram[2:4], uint16(sequence))
+		binary.BigEndian.PutUint16(datagram[4:6], uint16(total))
+		datagrams = append(datagrams, append(datagram, payload...))
+	}
+	return datagrams
+}
+
+// handleUDPRequest forwards the commands in the payload of a datagram and returns the responses to them.
+// If log is non-nil, a line is written to it for each command.
+func handleUDPRequest(payload []byte, remote memcache.ClientInterface, conf config.Config, client string, log *accessLog) []byte {
+	reader := bufio.NewReaderSize(bytes.NewReader(payload), maxLineLengthOf(conf))
+	output := &bytes.Buffer{}
+	responseQueue := createClientResponseQueue(output, conf)
+	logSlowRequests(responseQueue, remote, conf)
+	if log != nil {
+		log.logResponses(responseQueue, client)
+	}
+	for {
+		err := handleTextCommand(reader, responseQueue, remote, maxItemSizeOf(conf), conf.LenientLineEndings)
+		if err != nil {
+			if err != io.EOF {
+				logConnectionError(err, client, false)
+			}
+			break
+		}
+	}
+	responseQueue.Close()
+	responseQueue.Wait()
+	responseQueue.Release()
+	return output.Bytes()
+}
+
+// trackUDPRequest records a request that is being processed. It returns false if the server is shutting down.
+func (s *Server) trackUDPRequest() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.isShuttingDown() {
+		return false
+	}
+	s.connWG.Add(1)
+	return true
+}
+
+// serveUDP reads requests from pc until the server shuts down or reading fails.
+// It returns nil if the server shut down.
+func (s *Server) serveUDP(remote memcache.ClientInterface, pc net.PacketConn, conf config.Config) error {
+	buf := make([]byte, 1<<16)
+	log := s.accessLogOf(conf)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if s.isShuttingDown() {
+			return nil
+		}
+		if err != nil {
+			getLogger().Error("Failed to read a datagram", "udp_listen", conf.UDPListen, "error", err)
+			return fmt.Errorf("failed to read datagrams at %s: %v", conf.UDPListen, err)
+		}
+		if !isAllowedClient(addr, conf.AllowCIDRs) {
+			getLogger().Debug("Dropping datagram from outside of allow_cidrs", "remote", addr.String())
+			continue
+		}
+		requestID, payload, err := parseUDPFrame(buf[:n])
+		if err != nil {
+			// memcached also drops invalid datagrams without responding.
+			getLogger().Debug("Dropping invalid datagram", "remote", addr.String(), "error", err)
+			continue
+		}
+		if !s.trackUDPRequest() {
+			return nil
+		}
+		payload = append([]byte(nil), payload...)
+		go func() {
+			defer s.connWG.Done()
+			response := handleUDPRequest(payload, remote, conf, addr.String(), log)
+			for _, datagram := range frameUDPResponse(requestID, response) {
+				_, err := pc.WriteTo(datagram, addr)
+				if err != nil {
+					getLogger().Warn("Failed to send a datagram", "remote", addr.String(), "error", err)
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func encodeUDPRequest(requestID uint16, request string) []byte {
+	datagram := make([]byte, UDP_FRAME_HEADER_SIZE)
+	binary.BigEndian.PutUint16(datagram[0:2], requestID)
+	binary.BigEndian.PutUint16(datagram[4:6], 1)
+	return append(datagram, request...)
+}
+
+// readUDPResponse reads the datagrams of the response to requestID and returns the reassembled response.
+func readUDPResponse(t *testing.T, c net.Conn, requestID uint16) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var payloads []string
+	received := 0
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("failed to read a datagram: %v", err)
+		}
+		testutil.ExpectEquals(t, true, n <= UDP_MAX_DATAGRAM_SIZE, "expected datagrams to be at most UDP_MAX_DATAGRAM_SIZE")
+		testutil.ExpectEquals(t, requestID, binary.BigEndian.Uint16(buf[0:2]), "unexpected request id")
+		sequence := int(binary.BigEndian.Uint16(buf[2:4]))
+		total := int(binary.BigEndian.Uint16(buf[4:6]))
+		if payloads == nil {
+			payloads = make([]string, total)
+		}
+		payloads[sequence] = string(buf[UDP_FRAME_HEADER_SIZE:n])
+		received++
+		if received == total {
+			return strings.Join(payloads, "")
+		}
+	}
+}
+
+func TestUDPGet(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.UDPListen = "127.0.0.1:0"
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	defer s.Shutdown(context.Background())
+	serveInBackground(t, s)
+	var udpAddr string
+	deadline := time.Now().Add(time.Second)
+	for udpAddr == "" && time.Now().Before(deadline) {
+		s.m.Lock()
+		if len(s.packetConns) > 0 {
+			udpAddr = s.packetConns[0].LocalAddr().String()
+		}
+		s.m.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	c, err := net.Dial("udp", udpAddr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	value := strings.Repeat("x", 3000)
+	c.Write(encodeUDPRequest(7, "set big 0 0 3000\r\n"+value+"\r\n"))
+	testutil.ExpectStringEquals(t, "STORED\r\n", readUDPResponse(t, c, 7), "unexpected response to set")
+
+	// The response is split into 3 datagrams.
+	c.Write(encodeUDPRequest(8, "get big missing\r\n"))
+	testutil.ExpectStringEquals(t, "VALUE big 0 3000\r\n"+value+"\r\nEND\r\n", readUDPResponse(t, c, 8), "unexpected response to get")
+
+	// Datagrams without a valid frame header are dropped.
+	c.Write([]byte("get big\r\n"))
+	c.Write(encodeUDPRequest(9, "get missing\r\n"))
+	testutil.ExpectStringEquals(t, "END\r\n", readUDPResponse(t, c, 9), "unexpected response to get")
+}
+
+func TestParseUDPFrame(t *testing.T) {
+	requestID, payload, err := parseUDPFrame(encodeUDPRequest(0x1234, "get a\r\n"))
+	testutil.ExpectEquals(t, nil, err, "unexpected error")
+	testutil.ExpectEquals(t, uint16(0x1234), requestID, "unexpected request id")
+	testutil.ExpectStringEquals(t, "get a\r\n", string(payload), "unexpected payload")
+
+	multiple := encodeUDPRequest(1, "get a\r\n")
+	binary.BigEndian.PutUint16(multiple[4:6], 2)
+	for _, datagram := range [][]byte{[]byte("get"), multiple} {
+		_, _, err = parseUDPFrame(datagram)
+		if err == nil {
+			t.Errorf("expected %q to be rejected", datagram)
+		}
+	}
+	testutil.ExpectEquals(t, 0, len(frameUDPResponse(1, nil)), "expected no datagrams for an empty response")
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestAbstractUnixSocket(t *testing.T) {
+	backend := newFakeBackend(t, newStoreHandler())
+	defer backend.close()
+	conf := newTestPoolConfig(t, backend)
+	conf.Listen = []string{"@golemtest"}
+	s := NewServer(map[string]config.Config{"main": conf}, 0)
+	addr := serveInBackground(t, s)
+	testutil.ExpectStringEquals(t, "@golemtest", addr, "unexpected address of the abstract socket")
+
+	c, err := net.Dial("unix", "@golemtest")
+	if err != nil {
+		t.Fatalf("failed to connect to the abstract socket: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "get k\r\n")
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "END\r\n", line, "unexpected response")
+
+	// The name can be used again after the listener is closed, since there is no file to remove.
+	s.Shutdown(context.Background())
+	l, err := createUnixSocket("@golemtest", "memcache")
+	if err != nil {
+		t.Fatalf("expected the abstract socket to be released after shutdown: %v", err)
+	}
+	l.Close()
+}
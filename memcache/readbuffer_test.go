@@ -0,0 +1,140 @@
+package memcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// serveValuesOfSize is a memcache server that responds to every get with a value of size bytes.
+func serveValuesOfSize(tb testing.TB, size int) net.Listener {
+	tb.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("failed to listen: %v", err)
+	}
+	response := []byte(fmt.Sprintf("VALUE k 0 %d\r\n%s\r\nEND\r\n", size, strings.Repeat("x", size)))
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					c.Write(response)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// countingReader counts the calls to Read, which are the read syscalls of a connection to a server.
+type countingReader struct {
+	io.Reader
+	reads *uint64
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	atomic.AddUint64(r.reads, 1)
+	return r.Reader.Read(p)
+}
+
+// readCountingConnectionFactory creates connections that count their reads.
+type readCountingConnectionFactory struct {
+	*PipeliningClient
+	reads uint64
+	// size is the size of the read buffer of the last connection.
+	size int
+}
+
+func (f *readCountingConnectionFactory) getConn() (*conn, error) {
+	cn, err := f.PipeliningClient.getConn()
+	if err != nil {
+		return nil, err
+	}
+	f.size = cn.reader.reader.Size()
+	cn.reader.reader = bufio.NewReaderSize(countingReader{Reader: cn.nc, reads: &f.reads}, f.size)
+	return cn, nil
+}
+
+// newReadCountingClient returns a client for addr with a single connection, and the factory that counts the reads of that connection.
+func newReadCountingClient(tb testing.TB, addr string, readBufferSize int) (*PipeliningClient, *readCountingConnectionFactory) {
+	tb.Helper()
+	resolved, err := ResolveServerAddr(addr)
+	if err != nil {
+		tb.Fatalf("failed to resolve %s: %v", addr, err)
+	}
+	c := &PipeliningClient{addr: resolved, serverRepr: addr, Timeout: time.Second, ReadBufferSize: readBufferSize}
+	factory := &readCountingConnectionFactory{PipeliningClient: c}
+	InitWorkerManager(&c.manager, 1, factory)
+	return c, factory
+}
+
+func TestReadBufferSize(t *testing.T) {
+	l := serveValuesOfSize(t, 10)
+	defer l.Close()
+	for _, test := range []struct {
+		readBufferSize int
+		expected       int
+	}{
+		{0, DefaultReadBufferSize},
+		{65536, 65536},
+	} {
+		c, factory := newReadCountingClient(t, l.Addr().String(), test.readBufferSize)
+		item, err := c.Get("k")
+		testutil.ExpectEquals(t, nil, err, "unexpected error")
+		testutil.ExpectEquals(t, 10, len(item.Value), "unexpected value")
+		testutil.ExpectEquals(t, test.expected, factory.size, "unexpected size of the read buffer")
+		c.Finalize()
+	}
+}
+
+func benchmarkReadBufferSize(b *testing.B, readBufferSize int) {
+	l := serveValuesOfSize(b, 32*1024)
+	defer l.Close()
+	c, factory := newReadCountingClient(b, l.Addr().String(), readBufferSize)
+	defer c.Finalize()
+	b.ResetTimer()
+	getConcurrently := func() {
+		done := make(chan struct{})
+		for i := 0; i < 10; i++ {
+			go func() {
+				defer func() { done <- struct{}{} }()
+				if _, err := c.Get("k"); err != nil {
+					b.Errorf("get failed: %v", err)
+				}
+			}()
+		}
+		for i := 0; i < 10; i++ {
+			<-done
+		}
+	}
+	for i := 0; i < b.N; i++ {
+		getConcurrently()
+	}
+	b.StopTimer()
+	b.Logf("%d responses were read in %d reads", 10*b.N, atomic.LoadUint64(&factory.reads))
+}
+
+func BenchmarkReadBufferSizeDefault(b *testing.B) {
+	benchmarkReadBufferSize(b, 0)
+}
+
+// BenchmarkReadBufferSize256KiB should log fewer reads per response than BenchmarkReadBufferSizeDefault.
+func BenchmarkReadBufferSize256KiB(b *testing.B) {
+	benchmarkReadBufferSize(b, 256*1024)
+}
@@ -2,41 +2,87 @@ package memcache
 
 import (
 	"bufio"
-	"errors"
+	"io"
+	"net"
 )
 
 type BufferedReader struct {
-	reader  *bufio.Reader
-	failed  bool
-	onClose func()
+	reader *bufio.Reader
+	failed bool
+	// timedOut is true if the reader failed because a response took too long.
+	timedOut bool
+	// maxValueSize is the largest value in a response, or 0 for no limit. tooLarge is true if the reader failed because a value was larger.
+	maxValueSize int
+	tooLarge     bool
+	onClose      func()
 }
 
-var ErrPreviousRequestFailed = errors.New("A previous request failed")
+// previousRequestFailedError is returned when reading the responses to requests that were pipelined after a request that failed.
+type previousRequestFailedError struct {
+	timeout bool
+}
+
+func (e *previousRequestFailedError) Error() string {
+	if e.timeout {
+		return "A previous request timed out"
+	}
+	return "A previous request failed"
+}
+
+// Timeout returns true if the previous request failed because the server took too long to respond.
+func (e *previousRequestFailedError) Timeout() bool {
+	return e.timeout
+}
+
+var ErrPreviousRequestFailed error = &previousRequestFailedError{}
+var errPreviousRequestTimedOut error = &previousRequestFailedError{timeout: true}
 
 // ReadBytes returns a brand new byte slice that does not overlap with other byte slices
 func (reader *BufferedReader) ReadBytes(delim byte) ([]byte, error) {
 	if reader.failed == true {
-		return nil, ErrPreviousRequestFailed
+		return nil, reader.previousRequestError()
 	}
 	result, err := reader.reader.ReadBytes(delim)
 	if err != nil {
-		reader.handleError()
+		reader.handleError(err)
 	}
 	return result, err
 }
 
-func (reader *BufferedReader) handleError() {
+func (reader *BufferedReader) handleError(err error) {
 	reader.failed = true
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		reader.timedOut = true
+	}
 	reader.onClose()
 }
 
+// valueTooLarge returns true if a response has a value of size bytes that is larger than the limit, and closes the connection without reading it.
+// A negative size is a length that overflowed.
+func (reader *BufferedReader) valueTooLarge(size int) bool {
+	if size >= 0 && (reader.maxValueSize <= 0 || size <= reader.maxValueSize) {
+		return false
+	}
+	reader.tooLarge = true
+	reader.handleError(ErrResponseTooLarge)
+	return true
+}
+
+func (reader *BufferedReader) previousRequestError() error {
+	if reader.timedOut {
+		return errPreviousRequestTimedOut
+	}
+	return ErrPreviousRequestFailed
+}
+
+// Read reads exactly len(p) bytes, so that values larger than the buffer of the bufio.Reader are read completely.
 func (reader *BufferedReader) Read(p []byte) (int, error) {
 	if reader.failed == true {
-		return 0, ErrPreviousRequestFailed
+		return 0, reader.previousRequestError()
 	}
-	n, err := reader.reader.Read(p)
+	n, err := io.ReadFull(reader.reader, p)
 	if err != nil {
-		reader.handleError()
+		reader.handleError(err)
 	}
 	return n, err
 }
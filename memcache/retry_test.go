@@ -0,0 +1,93 @@
+package memcache
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// serveRestartingMemcache is a memcache server that closes its first connection after reading a request, as if the server restarted.
+// Later connections respond to every request with a miss.
+func serveRestartingMemcache(t *testing.T) (net.Listener, *int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var requestCount int32
+	go func() {
+		for connCount := 0; ; connCount++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(isFirst bool) {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				for {
+					if _, err := reader.ReadString('\n'); err != nil {
+						return
+					}
+					atomic.AddInt32(&requestCount, 1)
+					if isFirst {
+						return
+					}
+					c.Write([]byte("END\r\n"))
+				}
+			}(connCount == 0)
+		}
+	}()
+	return l, &requestCount
+}
+
+func sendProxied(c *PipeliningClient, request string, requestType message.RequestType) ([]byte, *message.ResponseError) {
+	m := &message.SingleMessage{}
+	m.HandleSendRequest([]byte(request), []byte("foo"), requestType)
+	c.SendProxiedMessageAsync(m)
+	return m.AwaitResponseBytes()
+}
+
+func TestRetryGetAfterConnectionBreaks(t *testing.T) {
+	l, requestCount := serveRestartingMemcache(t)
+	defer l.Close()
+	c := New(l.Addr().String(), 1, time.Second)
+	c.MaxRetries = 1
+	defer c.Finalize()
+
+	response, err := sendProxied(c, "get foo\r\n", message.REQUEST_MC_GET)
+	testutil.ExpectEquals(t, (*message.ResponseError)(nil), err, "expected the retried get to succeed")
+	testutil.ExpectStringEquals(t, "END\r\n", string(response), "unexpected response")
+	testutil.ExpectEquals(t, int32(2), atomic.LoadInt32(requestCount), "expected the get to be sent again on a new connection")
+}
+
+func TestNoRetryForWrites(t *testing.T) {
+	l, requestCount := serveRestartingMemcache(t)
+	defer l.Close()
+	c := New(l.Addr().String(), 1, time.Second)
+	c.MaxRetries = 1
+	defer c.Finalize()
+
+	_, err := sendProxied(c, "delete foo\r\n", message.REQUEST_MC_DELETE)
+	if err == nil {
+		t.Fatalf("expected the delete to fail when the connection breaks")
+	}
+	testutil.ExpectEquals(t, int32(1), atomic.LoadInt32(requestCount), "expected the delete to be sent once")
+}
+
+func TestNoRetryWithoutMaxRetries(t *testing.T) {
+	l, requestCount := serveRestartingMemcache(t)
+	defer l.Close()
+	c := New(l.Addr().String(), 1, time.Second)
+	defer c.Finalize()
+
+	_, err := sendProxied(c, "get foo\r\n", message.REQUEST_MC_GET)
+	if err == nil {
+		t.Fatalf("expected the get to fail when the connection breaks")
+	}
+	testutil.ExpectEquals(t, int32(1), atomic.LoadInt32(requestCount), "expected the get to be sent once")
+}
@@ -0,0 +1,71 @@
+package memcache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// slowConnectionFactory opens connections to a server, and holds the first connection until a second connection is opened.
+// While a worker waits for its connection, requests can only be sent by the other workers.
+type slowConnectionFactory struct {
+	*PipeliningClient
+	opened int32
+	second chan struct{}
+}
+
+func (f *slowConnectionFactory) getConn() (*conn, error) {
+	switch atomic.AddInt32(&f.opened, 1) {
+	case 1:
+		select {
+		case <-f.second:
+		case <-time.After(time.Second):
+		}
+	case 2:
+		close(f.second)
+	}
+	return f.PipeliningClient.getConn()
+}
+
+func TestServerConnectionsAreUsedConcurrently(t *testing.T) {
+	s := serveStalledMemcache(t)
+	defer s.l.Close()
+	addr := s.l.Addr().String()
+	resolved, err := ResolveServerAddr(addr)
+	if err != nil {
+		t.Fatalf("failed to resolve %s: %v", addr, err)
+	}
+	c := &PipeliningClient{addr: resolved, serverRepr: addr, Timeout: 2 * time.Second}
+	factory := &slowConnectionFactory{PipeliningClient: c, second: make(chan struct{})}
+	const serverConnections = 4
+	InitWorkerManager(&c.manager, serverConnections, factory)
+	defer c.Finalize()
+
+	const requestCount = 20
+	var wg sync.WaitGroup
+	var misses int32
+	wg.Add(requestCount)
+	for i := 0; i < requestCount; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get("foo"); err == ErrCacheMiss {
+				atomic.AddInt32(&misses, 1)
+			}
+		}()
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&s.received) < requestCount; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.ExpectEquals(t, int32(requestCount), atomic.LoadInt32(&s.received), "expected every request to be sent to the stalled server")
+	opened := atomic.LoadInt32(&factory.opened)
+	if opened < 2 || opened > serverConnections {
+		t.Errorf("expected between 2 and %d connections to be opened for concurrent requests, got %d", serverConnections, opened)
+	}
+
+	close(s.resume)
+	wg.Wait()
+	testutil.ExpectEquals(t, int32(requestCount), atomic.LoadInt32(&misses), "expected every request to complete after the server resumed")
+}
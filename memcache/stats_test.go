@@ -0,0 +1,33 @@
+package memcache
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+func TestParseStatsResponse(t *testing.T) {
+	input := "STAT 1:chunk_size 96\r\nSTAT active_slabs 1\r\nEND\r\nEND\r\nSTAT items:1:number 5\r\nVALUE k 0 1\r\n"
+	reader := &BufferedReader{reader: bufio.NewReader(strings.NewReader(input)), onClose: func() {}}
+	expected := []struct {
+		body         string
+		responseType message.ResponseType
+	}{
+		{"STAT 1:chunk_size 96\r\nSTAT active_slabs 1\r\nEND\r\n", message.RESPONSE_MC_STAT},
+		// A server with no slabs responds with only END.
+		{"END\r\n", message.RESPONSE_MC_END},
+		{"", message.RESPONSE_MC_PROTOCOLERROR},
+	}
+	for _, e := range expected {
+		header, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("unexpected error reading %q: %v", e.body, err)
+		}
+		body, responseType := parseMemcacheResponse(header, reader)
+		testutil.ExpectStringEquals(t, e.body, string(body), "unexpected response body")
+		testutil.ExpectEquals(t, e.responseType, responseType, "unexpected response type")
+	}
+}
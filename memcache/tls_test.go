@@ -0,0 +1,101 @@
+package memcache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// serveTLSMemcache is a minimal memcache server supporting set and gets over TLS.
+func serveTLSMemcache(t *testing.T, cert tls.Certificate) net.Listener {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var m sync.Mutex
+	values := map[string]string{}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					args := strings.Fields(line)
+					switch {
+					case len(args) == 5 && args[0] == "set":
+						var length int
+						fmt.Sscanf(args[4], "%d", &length)
+						body := make([]byte, length+2)
+						if _, err := io.ReadFull(reader, body); err != nil {
+							return
+						}
+						m.Lock()
+						values[args[1]] = string(body[:length])
+						m.Unlock()
+						c.Write([]byte("STORED\r\n"))
+					case len(args) == 2 && args[0] == "gets":
+						m.Lock()
+						value, ok := values[args[1]]
+						m.Unlock()
+						if ok {
+							fmt.Fprintf(c, "VALUE %s 0 %d 1\r\n%s\r\n", args[1], len(value), value)
+						}
+						c.Write([]byte("END\r\n"))
+					default:
+						c.Write([]byte("ERROR\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTLSRoundTrip(t *testing.T) {
+	cert, pool := testutil.NewSelfSignedCertificate(t)
+	l := serveTLSMemcache(t, cert)
+	defer l.Close()
+
+	c := NewTLS(l.Addr().String(), 1, time.Second, &tls.Config{RootCAs: pool})
+	defer c.Finalize()
+	err := c.Set(&Item{Key: "foo", Value: []byte("bar")})
+	if err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	item, err := c.Get("foo")
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	testutil.ExpectStringEquals(t, "bar", string(item.Value), "unexpected value")
+}
+
+func TestTLSUntrustedServer(t *testing.T) {
+	cert, _ := testutil.NewSelfSignedCertificate(t)
+	l := serveTLSMemcache(t, cert)
+	defer l.Close()
+
+	c := NewTLS(l.Addr().String(), 1, time.Second, &tls.Config{RootCAs: x509.NewCertPool()})
+	defer c.Finalize()
+	_, err := c.Get("foo")
+	if err == nil {
+		t.Fatalf("expected the handshake with an untrusted server to fail")
+	}
+}
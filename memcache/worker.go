@@ -1,6 +1,7 @@
 package memcache
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -18,15 +19,24 @@ const (
 
 	// Needed in case of spurious errors, has to be finite in case memcache cluster is down.
 	MAX_RETRY_COUNT = 3
+
+	// MAX_BATCH_REQUESTS and MAX_BATCH_BYTES limit how many queued requests are coalesced into a single write to a server.
+	MAX_BATCH_REQUESTS = 11
+	MAX_BATCH_BYTES    = 1000000
 )
 
 // constant
 var connectionEstablishError = errors.New("Unable to establish connection")
 var noAvailableWorkersError = errors.New("No available workers")
+var readerFailedError = errors.New("Reader failed; closing writer")
 
 // interface for testability
 type ConnectionFactory interface {
 	getConn() (*conn, error)
+	// writeBatchDelay is how long a worker waits for more requests to write together with a request, or 0 to only coalesce requests that are already queued.
+	writeBatchDelay() time.Duration
+	// netTimeout is how long a request can wait for a worker when the queue of requests is full.
+	netTimeout() time.Duration
 }
 
 var _ ConnectionFactory = &PipeliningClient{}
@@ -39,6 +49,8 @@ type WorkerManager struct {
 }
 
 type workRequest struct {
+	// ctx is checked before writing the request, which is rejected with the error of ctx if it is done.
+	ctx context.Context
 	// Serialization of the non-empty command to send to memcache
 	// (e.g. to send a memcached Get request asynchronously)
 	DataToWrite []byte
@@ -51,6 +63,16 @@ type workRequest struct {
 	// RemainingRetryCount int
 	// Channel on which to send error or success, then close
 	errChan chan<- error
+	// written is closed once the worker is done with DataToWrite, if ctx can be done.
+	// The caller must not reuse DataToWrite before then, even if it stops waiting for the response.
+	written chan struct{}
+}
+
+// finishWriting signals that DataToWrite was written or won't be written.
+func (request *workRequest) finishWriting() {
+	if request.written != nil {
+		close(request.written)
+	}
 }
 
 type workFinalizeRequest struct {
@@ -65,21 +87,27 @@ type workFinalizeRequest struct {
 	// The reader corresponding to the writer this request was written on.
 	// This is needed to gracefully handle old requests when reconnecting.
 	reader *BufferedReader
+	// deadline is the time by which the server must respond to this request.
+	deadline time.Time
 }
 
+// InitWorkerManager starts maxWorkers workers that share a queue of requests to a memcache server.
+// Each worker owns one connection to the server, so at most maxWorkers connections are opened.
+// A request is taken by whichever worker is first ready to write it.
 func InitWorkerManager(manager *WorkerManager, maxWorkers int, connFactory ConnectionFactory) {
-	// FIXME support multiple workers
 	if maxWorkers < 1 {
 		maxWorkers = 1
 	}
-	// XXX the maxWorkers setting is ignored, in practice this isn't useful
+	manager.maxWorkers = maxWorkers
 	manager.createdWorkerCount = 0
 	manager.workChan = make(chan *workRequest, MAX_BACKLOG_SIZE)
 	manager.connFactory = connFactory
 	for i := 0; i < maxWorkers; i++ {
 		go workerForConn(manager.workChan, manager.connFactory)
+		manager.createdWorkerCount++
 	}
-	// Workers will be started lazily.
+	// Connections are established lazily, when a worker receives its first request,
+	// and re-established by that worker after the connection breaks.
 }
 
 func (manager *WorkerManager) Finalize() {
@@ -106,12 +134,23 @@ func (wc *workerConnAndProcessor) Close() {
 	}
 }
 
+// CloseAfterResponses stops using the connection, which is closed once the responses to the requests that were already written are read.
+func (wc *workerConnAndProcessor) CloseAfterResponses() {
+	wc.m.Lock()
+	defer wc.m.Unlock()
+	if wc.conn != nil {
+		wc.conn = nil
+		close(wc.responseProcessingChannel)
+		wc.responseProcessingChannel = nil
+	}
+}
+
 func (wc *workerConnAndProcessor) WriteOrClose(bytes []byte) error {
 	// We take a pointer to workerConnAndProcessor because we modify the fields by value (e.g. wc.conn)
 	for {
 		if wc.conn.ShouldClose {
 			wc.Close()
-			return errors.New("Reader failed; closing writer")
+			return readerFailedError
 		}
 		// DebugLog("started write")
 		n, err := wc.conn.writer.Write(bytes)
@@ -139,20 +178,24 @@ func NewWorkerConnAndProcessor(cf ConnectionFactory) (workerConnAndProcessor, er
 	}
 	return workerConnAndProcessor{
 		conn:                      conn,
-		responseProcessingChannel: createResponseProcessorForConnection(),
+		responseProcessingChannel: createResponseProcessorForConnection(conn),
 	}, nil
 }
 
 // createResponseProcessorForConnection returns a channel that will process the responses for requests.
 // They are inserted and processed asynchronously, but **in the same order** the requests were sent to memcache.
 // If you open a new connection, you have to open a new response processor, and close the channel for the previous one.
-func createResponseProcessorForConnection() chan<- workFinalizeRequest {
+//
+// If a response isn't received by the deadline of its request, the connection is closed and
+// the remaining requests sent on the connection fail with a timeout.
+func createResponseProcessorForConnection(cn *conn) chan<- workFinalizeRequest {
 	tasksWithPendingResponsesChan := make(chan workFinalizeRequest, MAX_BACKLOG_PER_WORKER)
 
 	// This goroutine processes the responses, asynchronously
 	go func() {
 		// Process tasks until the channel is closed.
 		for task := range tasksWithPendingResponsesChan {
+			cn.nc.SetReadDeadline(task.deadline)
 			// DebugLog("Reading a response from corresponding task.reader")
 			err := task.ResponseCB(task.reader)
 			// DebugLog("Read a response")
@@ -177,6 +220,8 @@ func createResponseProcessorForConnection() chan<- workFinalizeRequest {
 				}
 			*/
 		}
+		// There are no more responses to read, e.g. because the client was finalized.
+		cn.nc.Close()
 	}()
 	return tasksWithPendingResponsesChan
 }
@@ -193,6 +238,9 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 
 	processRequests := func(requests []*workRequest, dataToWrite []byte) {
 		err := connAndProcessor.WriteOrClose(dataToWrite)
+		for _, request := range requests {
+			request.finishWriting()
+		}
 		if err != nil {
 			for _, request := range requests {
 				request.errChan <- err
@@ -201,27 +249,72 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 			return
 		}
 		// Writing the batch of commands was successful.
+		deadline := connAndProcessor.conn.responseDeadline()
 		for _, request := range requests {
 			connAndProcessor.responseProcessingChannel <- workFinalizeRequest{
 				errChan:    request.errChan,
 				ResponseCB: request.ResponseCB,
 				reader:     connAndProcessor.conn.reader,
+				deadline:   deadline,
 			}
 		}
 	}
 
 	buf := []byte{}
 
+	// rejectIfCanceled fails a request whose context was done while it was queued, instead of writing it to the server.
+	rejectIfCanceled := func(request *workRequest) bool {
+		if request == nil {
+			return false
+		}
+		if err := request.ctx.Err(); err != nil {
+			request.finishWriting()
+			request.errChan <- err
+			close(request.errChan)
+			return true
+		}
+		return false
+	}
+
 	nonBlockingReadRequest := func() *workRequest {
-		select {
-		case additionalRequest := <-workChan:
+		for {
+			select {
+			case additionalRequest := <-workChan:
+				if !rejectIfCanceled(additionalRequest) {
+					return additionalRequest
+				}
+			default:
+				return nil
+			}
+		}
+	}
+
+	// readRequestForBatch returns another request to write in the same batch, waiting until batchDeadline if none are queued yet.
+	readRequestForBatch := func(batchDeadline time.Time) *workRequest {
+		additionalRequest := nonBlockingReadRequest()
+		if additionalRequest != nil {
 			return additionalRequest
-		default:
+		}
+		wait := time.Until(batchDeadline)
+		if wait <= 0 {
 			return nil
 		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for {
+			select {
+			case additionalRequest := <-workChan:
+				if !rejectIfCanceled(additionalRequest) {
+					return additionalRequest
+				}
+			case <-timer.C:
+				return nil
+			}
+		}
 	}
 
 	rejectPendingRequests := func(request *workRequest, err error) {
+		request.finishWriting()
 		request.errChan <- err
 		close(request.errChan)
 		for {
@@ -231,6 +324,7 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 				if !ok {
 					return
 				}
+				otherRequest.finishWriting()
 				otherRequest.errChan <- err
 				close(otherRequest.errChan)
 			default:
@@ -244,8 +338,17 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 		request, ok := <-workChan
 		// DebugLog("Received request")
 		if !ok {
+			// The client was finalized.
+			connAndProcessor.CloseAfterResponses()
 			return
 		}
+		if rejectIfCanceled(request) {
+			continue
+		}
+		if connAndProcessor.conn != nil && connAndProcessor.conn.ShouldClose {
+			// A response failed or timed out, so the connection was torn down. Reconnect instead of failing this request.
+			connAndProcessor.Close()
+		}
 		if connAndProcessor.conn == nil {
 			// DebugLog("Have a null conn, creating new conn")
 			var err error
@@ -261,9 +364,13 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 		//close(workRequest.errChan)
 
 		// Write (and implicitly flush) the string to memcache (TODO: Only buffer reads, don't buffer writes)
-		connAndProcessor.conn.extendDeadline()
-		// Non-blocking read for additional request data
-		additionalRequest := nonBlockingReadRequest()
+		connAndProcessor.conn.extendWriteDeadline()
+		// Read additional requests that are queued or arrive before the batch deadline, to send them in a single write.
+		var batchDeadline time.Time
+		if delay := cf.writeBatchDelay(); delay > 0 {
+			batchDeadline = time.Now().Add(delay)
+		}
+		additionalRequest := readRequestForBatch(batchDeadline)
 		// DebugLog("Finished read request")
 
 		if additionalRequest != nil {
@@ -277,8 +384,8 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 			buf = append(buf, additionalRequest.DataToWrite...)
 			requests := []*workRequest{request, additionalRequest}
 
-			for len(requests) <= 10 && len(buf) <= 1000000 {
-				additionalRequest = nonBlockingReadRequest()
+			for len(requests) < MAX_BATCH_REQUESTS && len(buf) <= MAX_BATCH_BYTES {
+				additionalRequest = readRequestForBatch(batchDeadline)
 				if additionalRequest == nil {
 					break
 				}
@@ -293,6 +400,7 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 		// fmt.Printf("Batch size = 1\n")
 		// There's a single command
 		err := connAndProcessor.WriteOrClose([]byte(request.DataToWrite))
+		request.finishWriting()
 		if err != nil {
 			rejectPendingRequests(request, err)
 			continue
@@ -304,35 +412,54 @@ func workerForConn(workChan <-chan *workRequest, cf ConnectionFactory) {
 			errChan:    request.errChan,
 			ResponseCB: request.ResponseCB,
 			reader:     connAndProcessor.conn.reader,
+			deadline:   connAndProcessor.conn.responseDeadline(),
 		}
 		// DebugLog("Finished processing single request")
 	}
 }
 
 // sendRequestToWorker will send a request to a worker, or stop if no workers are available.
-func (c *WorkerManager) sendRequestToWorker(dataToWrite []byte, readFn func(*BufferedReader) error) <-chan error {
+// The request is abandoned with the error of ctx if ctx is done before the request is written.
+// If ctx can be done, the returned written channel is closed once dataToWrite is no longer used, which may be before the response is read.
+func (c *WorkerManager) sendRequestToWorker(ctx context.Context, dataToWrite []byte, readFn func(*BufferedReader) error) (result <-chan error, written <-chan struct{}) {
 	errChan := make(chan error, 1)
 	// TODO: This will retry 2 times if we receive the connection error before sending the command.
 	// However, if workChan fills up, this won't retry.
 	request := &workRequest{
+		ctx:         ctx,
 		DataToWrite: dataToWrite,
 		ResponseCB:  readFn,
 		// RemainingRetryCount: 2,
 		errChan: errChan,
 	}
+	if ctx.Done() != nil {
+		// Requests that can't be abandoned don't need to be tracked.
+		request.written = make(chan struct{})
+	}
 	/**
 	 * 1. Send a request to a member of the pool of workers, or start a new worker if that fails.
 	 * 2. Each worker is a goroutine, and has a channel of requests for a given twemproxy socket group.
 	 * 3. Goroutines accept from a shared channel? Multiple channels?
 	 * 4. Due to the read timeouts, I think that they'll stop automatically.
 	 */
-	// XXX is this any better?
 	select {
 	case c.workChan <- request:
-		break
+		return errChan, request.written
 	default:
+	}
+	// Clients can pipeline more requests than fit in the queue, so wait for the workers to catch up before giving up.
+	timer := time.NewTimer(c.connFactory.netTimeout())
+	defer timer.Stop()
+	select {
+	case c.workChan <- request:
+	case <-timer.C:
+		request.finishWriting()
 		errChan <- noAvailableWorkersError
 		close(errChan)
+	case <-ctx.Done():
+		request.finishWriting()
+		errChan <- ctx.Err()
+		close(errChan)
 	}
-	return errChan
+	return errChan, request.written
 }
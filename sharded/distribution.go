@@ -7,6 +7,29 @@ import (
 	"github.com/TysonAndre/golemproxy/sharded/distribution"
 )
 
+// Distribution is the algorithm used to choose a server for the hash of a memcache key.
+type Distribution uint8
+
+const (
+	DISTRIBUTION_KETAMA Distribution = 1
+	DISTRIBUTION_MODULA Distribution = 2
+	DISTRIBUTION_RANDOM Distribution = 3
+)
+
+// ParseDistribution converts the distribution name from the config file to a Distribution.
+func ParseDistribution(name string) (Distribution, error) {
+	switch name {
+	case "ketama":
+		return DISTRIBUTION_KETAMA, nil
+	case "modula":
+		return DISTRIBUTION_MODULA, nil
+	case "random":
+		return DISTRIBUTION_RANDOM, nil
+	default:
+		return 0, fmt.Errorf("unknown distribution %q", name)
+	}
+}
+
 func createKetamaDistribution(buckets []distribution.Bucket) func(h uint32) int {
 	ketama, err := distribution.NewKetama(buckets)
 	if err != nil {
@@ -18,16 +41,26 @@ func createKetamaDistribution(buckets []distribution.Bucket) func(h uint32) int
 }
 
 func createModulaDistribution(buckets []distribution.Bucket) func(h uint32) int {
-	ketama, err := distribution.NewModula(buckets)
+	modula, err := distribution.NewModula(buckets)
 	if err != nil {
-		panic("Failed to create ketama distribution")
+		panic("Failed to create modula distribution")
 	}
 	return func(h uint32) int {
-		return ketama.Get(h)
+		return modula.Get(h)
 	}
 }
 
-func createDistribution(distributionType string, clients []*memcache.PipeliningClient) func(h uint32) int {
+func createRandomDistribution(buckets []distribution.Bucket) func(h uint32) int {
+	random, err := distribution.NewRandom(buckets)
+	if err != nil {
+		panic("Failed to create random distribution")
+	}
+	return func(h uint32) int {
+		return random.Get(h)
+	}
+}
+
+func createDistribution(distributionType Distribution, clients []*memcache.PipeliningClient) func(h uint32) int {
 	if len(clients) == 0 {
 		panic("Expected 1 or more clients when creating distribution")
 	}
@@ -41,11 +74,13 @@ func createDistribution(distributionType string, clients []*memcache.PipeliningC
 	}
 
 	switch distributionType {
-	case "ketama":
+	case DISTRIBUTION_KETAMA:
 		return createKetamaDistribution(buckets)
-	case "modula":
+	case DISTRIBUTION_MODULA:
 		return createModulaDistribution(buckets)
+	case DISTRIBUTION_RANDOM:
+		return createRandomDistribution(buckets)
 	default:
-		panic(fmt.Sprintf("unknown distribution %q", distributionType))
+		panic(fmt.Sprintf("unknown distribution %d", distributionType))
 	}
 }
@@ -0,0 +1,60 @@
+package distribution
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+)
+
+// RandomDistribution chooses a random bucket for each request, with a probability proportional to the bucket's weight.
+type RandomDistribution struct {
+	indexes []int
+	// cumulativeWeights[i] is the sum of the weights of the buckets up to and including i.
+	// This is nil if every bucket has the same weight, in which case buckets are chosen uniformly.
+	cumulativeWeights []int
+}
+
+func NewRandom(buckets []Bucket) (*RandomDistribution, error) {
+	if len(buckets) == 0 {
+		// let them error when they try to use it
+		return nil, nil
+	}
+
+	indexes := make([]int, len(buckets))
+	cumulativeWeights := make([]int, len(buckets))
+	totalWeight := 0
+	sameWeights := true
+	for i, b := range buckets {
+		if b.Weight <= 0 {
+			return nil, fmt.Errorf("invalid weight %d for %q", b.Weight, b.Label)
+		}
+		indexes[i] = b.Data
+		totalWeight += b.Weight
+		cumulativeWeights[i] = totalWeight
+		if b.Weight != buckets[0].Weight {
+			sameWeights = false
+		}
+	}
+	if sameWeights {
+		cumulativeWeights = nil
+	}
+
+	return &RandomDistribution{
+		indexes:           indexes,
+		cumulativeWeights: cumulativeWeights,
+	}, nil
+}
+
+// Get ignores the hash and retrieves the Data of a randomly chosen bucket.
+func (c RandomDistribution) Get(h uint32) int {
+	if len(c.indexes) == 0 {
+		panic("Expected buckets to be non-empty")
+	}
+	if c.cumulativeWeights == nil {
+		return c.indexes[rand.Intn(len(c.indexes))]
+	}
+
+	// Find the first bucket whose cumulative weight is greater than a random number in [0, totalWeight).
+	r := rand.Intn(c.cumulativeWeights[len(c.cumulativeWeights)-1])
+	return c.indexes[sort.SearchInts(c.cumulativeWeights, r+1)]
+}
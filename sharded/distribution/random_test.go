@@ -0,0 +1,54 @@
+package distribution
+
+import (
+	"math"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// expectProportionalCounts picks many buckets and checks that each bucket was picked in proportion to its weight.
+func expectProportionalCounts(t *testing.T, weights []int) {
+	t.Helper()
+	buckets := make([]Bucket, len(weights))
+	totalWeight := 0
+	for i, weight := range weights {
+		buckets[i] = Bucket{Label: "server", Weight: weight, Data: i}
+		totalWeight += weight
+	}
+	random, err := NewRandom(buckets)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	const picks = 200000
+	counts := make([]int, len(weights))
+	for i := 0; i < picks; i++ {
+		counts[random.Get(uint32(i))]++
+	}
+	for i, weight := range weights {
+		expected := float64(picks) * float64(weight) / float64(totalWeight)
+		// More than 5 standard deviations from the expected count is astronomically unlikely.
+		tolerance := 5 * math.Sqrt(expected)
+		if math.Abs(float64(counts[i])-expected) > tolerance {
+			t.Errorf("bucket %d with weight %d was picked %d times, expected %.0f±%.0f for weights %v", i, weight, counts[i], expected, tolerance, weights)
+		}
+	}
+}
+
+func TestRandomHonorsWeights(t *testing.T) {
+	expectProportionalCounts(t, []int{1, 2, 7})
+	expectProportionalCounts(t, []int{10, 1, 1, 1, 1})
+	expectProportionalCounts(t, []int{3, 3, 3, 3})
+	expectProportionalCounts(t, []int{5})
+}
+
+func TestRandomUniformForEqualWeights(t *testing.T) {
+	random, err := NewRandom([]Bucket{{Label: "a", Weight: 2, Data: 10}, {Label: "b", Weight: 2, Data: 20}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testutil.ExpectEquals(t, []int(nil), random.cumulativeWeights, "expected equal weights to use a uniform distribution")
+
+	_, err = NewRandom([]Bucket{{Label: "a", Weight: 0, Data: 10}})
+	testutil.ExpectEquals(t, true, err != nil, "expected an error for a weight of 0")
+}
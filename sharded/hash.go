@@ -1,10 +1,40 @@
 package sharded
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"hash/fnv"
 )
 
+// Hasher computes the 32-bit hash of a memcache key that a distribution uses to choose a server.
+type Hasher func(key []byte) uint32
+
+// DEFAULT_HASH is used when a pool does not configure a hash.
+const DEFAULT_HASH = "fnv1a"
+
+// The hash functions here are compatible with the implementations in twemproxy's src/hashkit.
+
+func fnv32(key []byte) uint32 {
+	hasher := fnv.New32()
+	hasher.Write(key)
+	return hasher.Sum32()
+}
+
+func fnv32a(key []byte) uint32 {
+	hasher := fnv.New32a()
+	hasher.Write(key)
+	return hasher.Sum32()
+}
+
+func fnv64(key []byte) uint32 {
+	hasher := fnv.New64()
+	hasher.Write(key)
+	return uint32(hasher.Sum64())
+}
+
 // compatible with twemproxy's fnv64a implementation
 func fnv64a(key []byte) uint32 {
 	// compute the 64-bit fnv64a and take the lower 32 bits for hashing
@@ -13,11 +43,129 @@ func fnv64a(key []byte) uint32 {
 	return uint32(hasher.Sum64())
 }
 
-func createHasher(algorithm string) func(key []byte) uint32 {
+// crc32Hash is twemproxy's "crc32", which is only 15 bits for compatibility with libmemcached.
+func crc32Hash(key []byte) uint32 {
+	return (crc32.ChecksumIEEE(key) >> 16) & 0x7fff
+}
+
+// crc32aHash is twemproxy's "crc32a", the full 32 bits of the crc32 checksum.
+func crc32aHash(key []byte) uint32 {
+	return crc32.ChecksumIEEE(key)
+}
+
+// md5Hash uses the first 4 bytes of the md5 digest as a little endian integer.
+func md5Hash(key []byte) uint32 {
+	digest := md5.Sum(key)
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// murmurHash is MurmurHash2 with the seed twemproxy uses.
+func murmurHash(key []byte) uint32 {
+	const m = 0x5bd1e995
+	const r = 24
+	length := uint32(len(key))
+	seed := 0xdeadbeef * length
+	h := seed ^ length
+
+	data := key
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+func oneAtATime(key []byte) uint32 {
+	var value uint32
+	for _, c := range key {
+		value += uint32(c)
+		value += value << 10
+		value ^= value >> 6
+	}
+	value += value << 3
+	value ^= value >> 11
+	value += value << 15
+	return value
+}
+
+// NewHasher returns the hash function with the given twemproxy name, or DEFAULT_HASH if the name is empty.
+func NewHasher(algorithm string) (Hasher, error) {
 	switch algorithm {
+	case "":
+		return NewHasher(DEFAULT_HASH)
+	case "fnv1_32":
+		return fnv32, nil
+	case "fnv1a", "fnv1a_32":
+		return fnv32a, nil
+	case "fnv1_64":
+		return fnv64, nil
 	case "fnv1a_64":
-		return fnv64a
+		return fnv64a, nil
+	case "crc32":
+		return crc32Hash, nil
+	case "crc32a":
+		return crc32aHash, nil
+	case "md5":
+		return md5Hash, nil
+	case "murmur":
+		return murmurHash, nil
+	case "one_at_a_time":
+		return oneAtATime, nil
 	default:
-		panic(fmt.Sprintf("unknown hash algorithm %q", algorithm))
+		return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
+// extractHashTag returns the part of the key between the two characters of hashTag, like twemproxy's hash_tag.
+// The whole key is returned if the key doesn't contain a non-empty tag.
+func extractHashTag(key []byte, hashTag string) []byte {
+	start := bytes.IndexByte(key, hashTag[0])
+	if start < 0 {
+		return key
+	}
+	end := bytes.IndexByte(key[start+1:], hashTag[1])
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// withHashTag wraps hasher so that only the tagged part of each key is hashed.
+func withHashTag(hasher Hasher, hashTag string) Hasher {
+	if hashTag == "" {
+		return hasher
+	}
+	return func(key []byte) uint32 {
+		return hasher(extractHashTag(key, hashTag))
+	}
+}
+
+func createHasher(algorithm string) Hasher {
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		panic(err.Error())
 	}
+	return hasher
 }
@@ -13,3 +13,53 @@ func TestFnv64a(t *testing.T) {
 	fnv64aCallback := createHasher("fnv1a_64")
 	testutil.ExpectEquals(t, uint32(0x84222325), fnv64aCallback([]byte("")), "unexpected value for the empty string")
 }
+
+func TestHashFoobar(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		expected  uint32
+	}{
+		{"", 0xbf9cf968},
+		{"fnv1_32", 0x31f0b262},
+		{"fnv1a", 0xbf9cf968},
+		{"fnv1a_32", 0xbf9cf968},
+		{"fnv1_64", 0xa4dda9c2},
+		{"fnv1a_64", 0xf73967e8},
+		{"crc32", 0x1ef6},
+		{"crc32a", 0x9ef61f95},
+		{"md5", 0x22f65838},
+		{"murmur", 0xabecff17},
+		{"one_at_a_time", 0xf952fde7},
+	} {
+		hasher, err := NewHasher(test.algorithm)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", test.algorithm, err)
+			continue
+		}
+		testutil.ExpectEquals(t, test.expected, hasher([]byte("foobar")), "unexpected hash of foobar for "+test.algorithm)
+	}
+}
+
+func TestUnknownHash(t *testing.T) {
+	hasher, err := NewHasher("sha1")
+	if hasher != nil || err == nil {
+		t.Fatalf("expected an error for an unknown hash")
+	}
+	testutil.ExpectStringEquals(t, `unknown hash algorithm "sha1"`, err.Error(), "unexpected error")
+}
+
+func TestExtractHashTag(t *testing.T) {
+	for _, test := range []struct {
+		key      string
+		expected string
+	}{
+		{"user:{123}:name", "123"},
+		{"user:{123}:{456}", "123"},
+		{"{}:empty", "{}:empty"},
+		{"user:123", "user:123"},
+		{"user:{123", "user:{123"},
+		{"user:}123{", "user:}123{"},
+	} {
+		testutil.ExpectStringEquals(t, test.expected, string(extractHashTag([]byte(test.key), "{}")), "unexpected hash tag for "+test.key)
+	}
+}
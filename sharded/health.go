@@ -0,0 +1,120 @@
+package sharded
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/stats"
+)
+
+// serverHealth tracks the consecutive failures of a server for auto_eject_hosts.
+type serverHealth struct {
+	failures uint
+	ejected  bool
+}
+
+// enableAutoEject makes the client eject servers after failureLimit consecutive failures, and restore them after retryTimeout.
+func (c *ShardedClient) enableAutoEject(failureLimit uint, retryTimeout time.Duration) {
+	c.failureLimit = failureLimit
+	c.retryTimeout = retryTimeout
+	c.health = make(map[*memcache.PipeliningClient]*serverHealth, len(c.clients))
+	for _, client := range c.clients {
+		client := client
+		c.health[client] = &serverHealth{}
+		client.OnRequestDone = func(err error) {
+			c.recordResult(client, err)
+		}
+	}
+}
+
+// recordResult updates the failure count of server after a request to it completes, ejecting the server if it failed too often.
+func (c *ShardedClient) recordResult(server *memcache.PipeliningClient, err error) {
+	failed := memcache.IsServerFailure(err)
+	c.m.Lock()
+	defer c.m.Unlock()
+	health := c.health[server]
+	if !failed {
+		health.failures = 0
+		return
+	}
+	health.failures++
+	// A restored server keeps its failure count until a request succeeds, so the next failure ejects it again.
+	if health.ejected || health.failures < c.failureLimit || c.clients == nil {
+		return
+	}
+	health.ejected = true
+	stats.Global.RecordEjection(server.GetServer())
+	fmt.Fprintf(os.Stderr, "Ejecting memcache server %s after %d consecutive failures, will retry in %v: %v\n", server.Label, health.failures, c.retryTimeout, err)
+	c.rebuildLiveServers()
+	time.AfterFunc(c.retryTimeout, func() {
+		c.restore(server)
+	})
+}
+
+// restore adds an ejected server back to the pool.
+func (c *ShardedClient) restore(server *memcache.PipeliningClient) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	health := c.health[server]
+	if !health.ejected || c.clients == nil {
+		return
+	}
+	health.ejected = false
+	fmt.Fprintf(os.Stderr, "Restoring memcache server %s after %v\n", server.Label, c.retryTimeout)
+	c.rebuildLiveServers()
+}
+
+// Reachable returns false if every server was ejected by auto_eject_hosts.
+// Servers of pools without auto_eject_hosts are always considered reachable.
+func (c *ShardedClient) Reachable() bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.health == nil {
+		return true
+	}
+	for _, client := range c.clients {
+		if !c.health[client].ejected {
+			return true
+		}
+	}
+	return false
+}
+
+// EjectedServers returns the servers that are currently ejected by auto_eject_hosts.
+func (c *ShardedClient) EjectedServers() []*memcache.PipeliningClient {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	var result []*memcache.PipeliningClient
+	for _, client := range c.clients {
+		if health := c.health[client]; health != nil && health.ejected {
+			result = append(result, client)
+		}
+	}
+	return result
+}
+
+// isReachable returns true if pool has at least one server that isn't ejected.
+func isReachable(pool memcache.ClientInterface) bool {
+	if pool, ok := pool.(interface{ Reachable() bool }); ok {
+		return pool.Reachable()
+	}
+	return true
+}
+
+// rebuildLiveServers rebuilds the distribution with the servers that aren't ejected. c.m must be locked.
+func (c *ShardedClient) rebuildLiveServers() {
+	live := make([]*memcache.PipeliningClient, 0, len(c.clients))
+	for _, client := range c.clients {
+		if !c.health[client].ejected {
+			live = append(live, client)
+		}
+	}
+	if len(live) == 0 {
+		// Keep sending requests to every server rather than failing all requests.
+		fmt.Fprintf(os.Stderr, "All memcache servers are ejected, using all servers\n")
+		live = c.clients
+	}
+	c.rebuild(live)
+}
@@ -0,0 +1,153 @@
+package sharded
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// listenEmptyBackend starts a memcache server on addr that has no keys.
+func listenEmptyBackend(t *testing.T, addr string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				reader := bufio.NewReader(c)
+				for {
+					if _, err := reader.ReadBytes('\n'); err != nil {
+						return
+					}
+					c.Write([]byte("END\r\n"))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// unusedAddr returns an address on which connections are refused.
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func testServerConfig(addr string) config.TCPServer {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	return config.TCPServer{Host: "127.0.0.1", Port: uint16(tcpAddr.Port), Key: addr, Weight: 1}
+}
+
+func TestAutoEjectHosts(t *testing.T) {
+	healthy := listenEmptyBackend(t, "127.0.0.1:0")
+	defer healthy.Close()
+	healthyAddr := healthy.Addr().String()
+	failingAddr := unusedAddr(t)
+
+	conf := config.Config{
+		Hash:               "fnv1a_64",
+		Distribution:       "ketama",
+		Timeout:            100,
+		AutoEjectHosts:     true,
+		ServerFailureLimit: 2,
+		ServerRetryTimeout: 200 * time.Millisecond,
+		Servers:            []config.TCPServer{testServerConfig(healthyAddr), testServerConfig(failingAddr)},
+	}
+	c := New(conf).(*ShardedClient)
+	defer c.Finalize()
+
+	key := ""
+	for i := 0; pickServerLabel(c, key) != failingAddr; i++ {
+		key = fmt.Sprintf("%d:key", i)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := c.Get(key)
+		if !memcache.IsServerFailure(err) {
+			t.Fatalf("expected a connection error for a server refusing connections, got %v", err)
+		}
+	}
+	testutil.ExpectStringEquals(t, healthyAddr, pickServerLabel(c, key), "expected the failing server to be ejected")
+	_, err := c.Get(key)
+	testutil.ExpectEquals(t, memcache.ErrCacheMiss, err, "expected the remaining server to handle the key")
+
+	recovered := listenEmptyBackend(t, failingAddr)
+	defer recovered.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for pickServerLabel(c, key) != failingAddr {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be restored after the retry timeout", failingAddr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = c.Get(key)
+	testutil.ExpectEquals(t, memcache.ErrCacheMiss, err, "expected the restored server to handle the key")
+}
+
+func TestNoEjectionWithoutAutoEjectHosts(t *testing.T) {
+	c := newTestShardedClient(t, 2, "ketama")
+	defer c.Finalize()
+
+	label := pickServerLabel(c, "foo")
+	for i := 0; i < 3; i++ {
+		// Nothing is listening on the test ports.
+		c.Get("foo")
+	}
+	testutil.ExpectStringEquals(t, label, pickServerLabel(c, "foo"), "servers should only be ejected with auto_eject_hosts")
+}
+
+func TestReachable(t *testing.T) {
+	c := newTestShardedClient(t, 2, "ketama")
+	defer c.Finalize()
+	testutil.ExpectEquals(t, true, c.Reachable(), "servers are reachable without auto_eject_hosts")
+
+	c.enableAutoEject(1, time.Hour)
+	servers := c.Servers()
+	c.recordResult(servers[0], io.EOF)
+	testutil.ExpectEquals(t, true, c.Reachable(), "expected a server to be reachable after ejecting the other server")
+	c.recordResult(servers[1], io.EOF)
+	testutil.ExpectEquals(t, false, c.Reachable(), "expected no server to be reachable after ejecting every server")
+	c.restore(servers[1])
+	testutil.ExpectEquals(t, true, c.Reachable(), "expected the restored server to be reachable")
+}
+
+func TestStatsServer(t *testing.T) {
+	c := newTestShardedClient(t, 2, "ketama")
+	defer c.Finalize()
+	servers := c.Servers()
+	testutil.ExpectEquals(t, servers[0], c.StatsServer(), "expected stats to be sent to the first server")
+
+	c.enableAutoEject(1, time.Hour)
+	c.recordResult(servers[0], io.EOF)
+	testutil.ExpectEquals(t, servers[1], c.StatsServer(), "expected stats to be sent to a server that isn't ejected")
+	c.recordResult(servers[1], io.EOF)
+	testutil.ExpectEquals(t, servers[0], c.StatsServer(), "expected stats to be sent to the first server when every server is ejected")
+
+	conf := config.Config{Hash: "fnv1a_64", Distribution: "ketama", Timeout: 100, Servers: []config.TCPServer{
+		{Host: "127.0.0.1", Port: 11311, Key: "first", Weight: 1},
+		{Host: "127.0.0.1", Port: 11312, Key: "second", Weight: 1},
+	}, StatsServer: "second"}
+	reloadable := NewReloadable(conf)
+	defer reloadable.Finalize()
+	testutil.ExpectStringEquals(t, "second", reloadable.StatsServer().Label, "expected stats to be sent to stats_server")
+}
@@ -0,0 +1,186 @@
+package sharded
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// PrefixRouter sends each key to the pool of the longest configured prefix that the key starts with.
+// Keys that don't match any prefix are sent to the default pool.
+type PrefixRouter struct {
+	// prefixes is sorted from longest to shortest, so that the first match is the longest match.
+	prefixes    [][]byte
+	pools       []memcache.ClientInterface
+	defaultPool memcache.ClientInterface
+}
+
+var _ memcache.ClientInterface = &PrefixRouter{}
+
+func newPrefixRouter(pools map[string]memcache.ClientInterface, defaultPool memcache.ClientInterface) *PrefixRouter {
+	prefixes := make([]string, 0, len(pools))
+	for prefix := range pools {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i]) != len(prefixes[j]) {
+			return len(prefixes[i]) > len(prefixes[j])
+		}
+		return prefixes[i] < prefixes[j]
+	})
+	r := &PrefixRouter{defaultPool: defaultPool}
+	for _, prefix := range prefixes {
+		r.prefixes = append(r.prefixes, []byte(prefix))
+		r.pools = append(r.pools, pools[prefix])
+	}
+	return r
+}
+
+// Pool returns the client for the pool that the memcache key is routed to.
+func (r *PrefixRouter) Pool(key []byte) memcache.ClientInterface {
+	for i, prefix := range r.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return r.pools[i]
+		}
+	}
+	return r.defaultPool
+}
+
+// PickServer returns the client for the server that the memcache key is sharded to within its pool.
+func (r *PrefixRouter) PickServer(key []byte) memcache.ClientInterface {
+	pool := r.Pool(key)
+	if shardedClient, ok := pool.(*ShardedClient); ok {
+		return shardedClient.PickServer(key)
+	}
+	return pool
+}
+
+// allPools returns the default pool followed by the pool of each prefix.
+func (r *PrefixRouter) allPools() []memcache.ClientInterface {
+	return append([]memcache.ClientInterface{r.defaultPool}, r.pools...)
+}
+
+// Servers returns the clients for every server of every pool, including servers that are ejected.
+func (r *PrefixRouter) Servers() []*memcache.PipeliningClient {
+	var result []*memcache.PipeliningClient
+	for _, pool := range r.allPools() {
+		switch pool := pool.(type) {
+		case *ShardedClient:
+			result = append(result, pool.Servers()...)
+		case *memcache.PipeliningClient:
+			result = append(result, pool)
+		}
+	}
+	return result
+}
+
+// Reachable returns true if the default pool and the pool of each prefix each have a server that isn't ejected.
+// EjectedServers returns the servers of every pool that are currently ejected by auto_eject_hosts.
+func (r *PrefixRouter) EjectedServers() []*memcache.PipeliningClient {
+	var result []*memcache.PipeliningClient
+	for _, pool := range r.allPools() {
+		if pool, ok := pool.(*ShardedClient); ok {
+			result = append(result, pool.EjectedServers()...)
+		}
+	}
+	return result
+}
+
+func (r *PrefixRouter) Reachable() bool {
+	for _, pool := range r.allPools() {
+		if !isReachable(pool) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *PrefixRouter) SendProxiedMessageAsync(command *message.SingleMessage) {
+	r.Pool(command.Key).SendProxiedMessageAsync(command)
+}
+
+func (r *PrefixRouter) SendProxiedMessageWithContext(ctx context.Context, command *message.SingleMessage) {
+	r.Pool(command.Key).SendProxiedMessageWithContext(ctx, command)
+}
+
+func (r *PrefixRouter) Get(key string) (item *memcache.Item, err error) {
+	return r.Pool([]byte(key)).Get(key)
+}
+
+func (r *PrefixRouter) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	results := make(map[string]*memcache.Item)
+	for _, key := range keys {
+		item, err := r.Get(key)
+		if err != nil {
+			return results, err
+		}
+		if item != nil {
+			results[key] = item
+		}
+	}
+	return results, nil
+}
+
+func (r *PrefixRouter) GetMultiArray(keys []string) ([]*memcache.Item, error) {
+	var results []*memcache.Item
+	for _, key := range keys {
+		item, err := r.Get(key)
+		if err != nil {
+			return results, err
+		}
+		if item != nil {
+			results = append(results, item)
+		}
+	}
+	return results, nil
+}
+
+func (r *PrefixRouter) Set(item *memcache.Item) error {
+	return r.Pool([]byte(item.Key)).Set(item)
+}
+
+func (r *PrefixRouter) Delete(key string) error {
+	return r.Pool([]byte(key)).Delete(key)
+}
+
+func (r *PrefixRouter) DeleteAll() error {
+	return errors.New("Refusing to flush_all")
+}
+
+func (r *PrefixRouter) Touch(key string, seconds int32) error {
+	return r.Pool([]byte(key)).Touch(key, seconds)
+}
+
+func (r *PrefixRouter) Add(item *memcache.Item) error {
+	return r.Pool([]byte(item.Key)).Add(item)
+}
+
+func (r *PrefixRouter) Replace(item *memcache.Item) error {
+	return r.Pool([]byte(item.Key)).Replace(item)
+}
+
+func (r *PrefixRouter) Increment(key string, delta uint64) (newValue uint64, err error) {
+	return r.Pool([]byte(key)).Increment(key, delta)
+}
+
+func (r *PrefixRouter) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	return r.Pool([]byte(key)).Decrement(key, delta)
+}
+
+func (r *PrefixRouter) Finalize() {
+	pools := r.allPools()
+	var wg sync.WaitGroup
+	wg.Add(len(pools))
+	for _, pool := range pools {
+		go func(pool memcache.ClientInterface) {
+			pool.Finalize()
+			wg.Done()
+		}(pool)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,166 @@
+package sharded
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// RETIRED_POOL_FINALIZE_DELAY is how long the servers of a pool are kept open after Reload replaces the pool.
+// Requests that picked the old pool just before the swap are still sent to (and get responses from) the old servers.
+const RETIRED_POOL_FINALIZE_DELAY = 10 * time.Second
+
+// currentPool wraps the client in an atomic.Value, which requires every stored value to have the same concrete type.
+type currentPool struct {
+	client memcache.ClientInterface
+}
+
+// ReloadableClient is a client for a pool whose servers can be replaced while requests are being sent.
+type ReloadableClient struct {
+	current atomic.Value
+	// m serializes Reload and Finalize.
+	m         sync.Mutex
+	finalized bool
+}
+
+var _ memcache.ClientInterface = &ReloadableClient{}
+
+// NewReloadable creates a client for the servers in conf that can later be replaced with Reload.
+func NewReloadable(conf config.Config) *ReloadableClient {
+	c := &ReloadableClient{}
+	c.current.Store(currentPool{New(conf)})
+	return c
+}
+
+// Current returns the client for the servers of the most recently loaded config.
+func (c *ReloadableClient) Current() memcache.ClientInterface {
+	return c.current.Load().(currentPool).client
+}
+
+// Reload atomically replaces the servers (and hash, distribution, etc.) with the ones in conf.
+// Requests that are in flight complete against the old servers, which are closed after RETIRED_POOL_FINALIZE_DELAY.
+// This panics if conf is invalid, like New.
+func (c *ReloadableClient) Reload(conf config.Config) error {
+	client := New(conf)
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.finalized {
+		client.Finalize()
+		return errors.New("cannot reload a finalized client")
+	}
+	old := c.Current()
+	c.current.Store(currentPool{client})
+	time.AfterFunc(RETIRED_POOL_FINALIZE_DELAY, old.Finalize)
+	return nil
+}
+
+// PickServer returns the client for the server that the memcache key is sharded to.
+func (c *ReloadableClient) PickServer(key []byte) memcache.ClientInterface {
+	switch current := c.Current().(type) {
+	case *ShardedClient:
+		return current.PickServer(key)
+	case *PrefixRouter:
+		return current.PickServer(key)
+	default:
+		return current
+	}
+}
+
+// Servers returns the clients for every server of the current config, including servers that are ejected.
+func (c *ReloadableClient) Servers() []*memcache.PipeliningClient {
+	switch current := c.Current().(type) {
+	case *ShardedClient:
+		return current.Servers()
+	case *PrefixRouter:
+		return current.Servers()
+	case *memcache.PipeliningClient:
+		return []*memcache.PipeliningClient{current}
+	default:
+		return nil
+	}
+}
+
+// EjectedServers returns the servers of the current config that are currently ejected by auto_eject_hosts.
+func (c *ReloadableClient) EjectedServers() []*memcache.PipeliningClient {
+	switch current := c.Current().(type) {
+	case *ShardedClient:
+		return current.EjectedServers()
+	case *PrefixRouter:
+		return current.EjectedServers()
+	default:
+		return nil
+	}
+}
+
+// Reachable returns true if every pool of the current config has a server that isn't ejected.
+func (c *ReloadableClient) Reachable() bool {
+	return isReachable(c.Current())
+}
+
+func (c *ReloadableClient) SendProxiedMessageAsync(command *message.SingleMessage) {
+	c.Current().SendProxiedMessageAsync(command)
+}
+
+func (c *ReloadableClient) SendProxiedMessageWithContext(ctx context.Context, command *message.SingleMessage) {
+	c.Current().SendProxiedMessageWithContext(ctx, command)
+}
+
+func (c *ReloadableClient) Get(key string) (item *memcache.Item, err error) {
+	return c.Current().Get(key)
+}
+
+func (c *ReloadableClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	return c.Current().GetMulti(keys)
+}
+
+func (c *ReloadableClient) GetMultiArray(keys []string) ([]*memcache.Item, error) {
+	return c.Current().GetMultiArray(keys)
+}
+
+func (c *ReloadableClient) Set(item *memcache.Item) error {
+	return c.Current().Set(item)
+}
+
+func (c *ReloadableClient) Delete(key string) error {
+	return c.Current().Delete(key)
+}
+
+func (c *ReloadableClient) DeleteAll() error {
+	return c.Current().DeleteAll()
+}
+
+func (c *ReloadableClient) Touch(key string, seconds int32) error {
+	return c.Current().Touch(key, seconds)
+}
+
+func (c *ReloadableClient) Add(item *memcache.Item) error {
+	return c.Current().Add(item)
+}
+
+func (c *ReloadableClient) Replace(item *memcache.Item) error {
+	return c.Current().Replace(item)
+}
+
+func (c *ReloadableClient) Increment(key string, delta uint64) (newValue uint64, err error) {
+	return c.Current().Increment(key, delta)
+}
+
+func (c *ReloadableClient) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	return c.Current().Decrement(key, delta)
+}
+
+func (c *ReloadableClient) Finalize() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.finalized {
+		return
+	}
+	c.finalized = true
+	c.Current().Finalize()
+}
@@ -0,0 +1,61 @@
+package sharded
+
+import (
+	"math/rand"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+)
+
+// newReplicas creates clients for the read replicas of the servers that have replicas in conf, or returns nil if none do.
+func newReplicas(conf config.Config, clients []*memcache.PipeliningClient) map[*memcache.PipeliningClient][]*memcache.PipeliningClient {
+	var replicas map[*memcache.PipeliningClient][]*memcache.PipeliningClient
+	for _, client := range clients {
+		servers := conf.Replicas[client.Label]
+		if len(servers) == 0 {
+			continue
+		}
+		if replicas == nil {
+			replicas = make(map[*memcache.PipeliningClient][]*memcache.PipeliningClient)
+		}
+		replicas[client] = newServerClients(conf, servers)
+	}
+	return replicas
+}
+
+// isReplicaRequest returns true if requests of the type can be sent to a read replica.
+// Other requests, including gat and gats, modify items, and are sent to the primary server.
+func isReplicaRequest(requestType message.RequestType) bool {
+	return requestType == message.REQUEST_MC_GET || requestType == message.REQUEST_MC_GETS
+}
+
+// getRequestClient returns the client for a request of the type for the key:
+// a replica of the server that the key is sharded to for gets, and that server for other requests.
+func (c *ShardedClient) getRequestClient(key []byte, requestType message.RequestType) *memcache.PipeliningClient {
+	client := c.getClient(key)
+	if replicas := c.replicas[client]; len(replicas) > 0 && isReplicaRequest(requestType) {
+		if c.leastConn {
+			return leastOutstanding(replicas)
+		}
+		return replicas[rand.Intn(len(replicas))]
+	}
+	return client
+}
+
+// leastOutstanding returns the replica with the fewest outstanding requests relative to its weight, counting the request being sent.
+// Ties are broken randomly, so that idle replicas share the load.
+func leastOutstanding(replicas []*memcache.PipeliningClient) *memcache.PipeliningClient {
+	start := rand.Intn(len(replicas))
+	best := replicas[start]
+	bestOutstanding := best.Outstanding() + 1
+	for i := 1; i < len(replicas); i++ {
+		replica := replicas[(start+i)%len(replicas)]
+		outstanding := replica.Outstanding() + 1
+		// outstanding/weight < bestOutstanding/best.Weight
+		if outstanding*int64(best.Weight) < bestOutstanding*int64(replica.Weight) {
+			best, bestOutstanding = replica, outstanding
+		}
+	}
+	return best
+}
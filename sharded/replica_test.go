@@ -0,0 +1,70 @@
+package sharded
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache/proxy/message"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// listenSilentBackend starts a memcache server that reads requests and never responds, so that they stay outstanding.
+func listenSilentBackend(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(ioutil.Discard, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestLeastConnSelection(t *testing.T) {
+	slow := listenSilentBackend(t)
+	defer slow.Close()
+	fast := listenEmptyBackend(t, "127.0.0.1:0")
+	defer fast.Close()
+	conf := config.Config{
+		Hash:         "fnv1a_64",
+		Distribution: "ketama",
+		Timeout:      5000,
+		Servers:      []config.TCPServer{testServerConfig(unusedAddr(t))},
+		Selection:    "least_conn",
+	}
+	conf.Replicas = map[string][]config.TCPServer{
+		conf.Servers[0].Key: {testServerConfig(slow.Addr().String()), testServerConfig(fast.Addr().String())},
+	}
+	c, ok := New(conf).(*ShardedClient)
+	if !ok {
+		t.Fatalf("expected New to create a ShardedClient for a server with replicas")
+	}
+	defer c.Finalize()
+	replicas := c.replicas[c.Servers()[0]]
+	slowReplica := replicas[0]
+	for i := 0; i < 3; i++ {
+		m := &message.SingleMessage{}
+		m.HandleSendRequest([]byte("get k\r\n"), []byte("k"), message.REQUEST_MC_GET)
+		slowReplica.SendProxiedMessageAsync(m)
+	}
+	testutil.ExpectEquals(t, int64(3), slowReplica.Outstanding(), "expected the requests to the slow replica to be outstanding")
+
+	for i := 0; i < 20; i++ {
+		replica := c.getRequestClient([]byte("k"), message.REQUEST_MC_GET)
+		testutil.ExpectStringEquals(t, replicas[1].Label, replica.Label, "expected gets to be sent to the replica with fewer outstanding requests")
+	}
+	testutil.ExpectStringEquals(t, c.Servers()[0].Label, c.getRequestClient([]byte("k"), message.REQUEST_MC_SET).Label, "expected sets to be sent to the server")
+}
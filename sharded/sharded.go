@@ -2,6 +2,7 @@
 package sharded
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -14,19 +15,59 @@ import (
 )
 
 type ShardedClient struct {
-	getClient func(key []byte) *memcache.PipeliningClient
-	clients   []*memcache.PipeliningClient
+	// m protects pickClient and health. pickClient is replaced when servers are ejected or restored.
+	m          sync.RWMutex
+	pickClient func(key []byte) *memcache.PipeliningClient
+	// clients is the list of all servers, including ejected servers.
+	clients []*memcache.PipeliningClient
+	// hash, hashTag, and distribution are the algorithms used to build pickClient
+	hash         string
+	hashTag      string
+	distribution Distribution
+	// health tracks failures of each server if auto_eject_hosts is enabled.
+	health       map[*memcache.PipeliningClient]*serverHealth
+	failureLimit uint
+	retryTimeout time.Duration
+	// replicas maps servers to their read replicas. It isn't modified after the client is created.
+	replicas map[*memcache.PipeliningClient][]*memcache.PipeliningClient
+	// leastConn is true if gets are sent to the replica with the fewest outstanding requests instead of a random replica.
+	leastConn bool
+	// statsServer is the server of stats_server, or nil to use the first server that isn't ejected.
+	statsServer *memcache.PipeliningClient
 }
 
 var _ memcache.ClientInterface = &ShardedClient{}
 
+func (c *ShardedClient) getClient(key []byte) *memcache.PipeliningClient {
+	c.m.RLock()
+	pickClient := c.pickClient
+	c.m.RUnlock()
+	return pickClient(key)
+}
+
+// PickServer returns the client for the server that the memcache key is sharded to.
+func (c *ShardedClient) PickServer(key []byte) memcache.ClientInterface {
+	return c.getClient(key)
+}
+
+// Servers returns the clients for every server, including servers that are ejected.
+func (c *ShardedClient) Servers() []*memcache.PipeliningClient {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.clients
+}
+
 func (c *ShardedClient) SendProxiedMessageAsync(command *message.SingleMessage) {
 	// TODO: optimize out the string copy
-	c.getClient(command.Key).SendProxiedMessageAsync(command)
+	c.getRequestClient(command.Key, command.RequestType).SendProxiedMessageAsync(command)
+}
+
+func (c *ShardedClient) SendProxiedMessageWithContext(ctx context.Context, command *message.SingleMessage) {
+	c.getRequestClient(command.Key, command.RequestType).SendProxiedMessageWithContext(ctx, command)
 }
 
 func (c *ShardedClient) Get(key string) (item *memcache.Item, err error) {
-	return c.getClient([]byte(key)).Get(key)
+	return c.getRequestClient([]byte(key), message.REQUEST_MC_GET).Get(key)
 }
 
 func (c *ShardedClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
@@ -118,63 +159,130 @@ func (c *ShardedClient) Decrement(key string, delta uint64) (newValue uint64, er
 }
 
 func (c *ShardedClient) Finalize() {
+	c.m.Lock()
 	clients := c.clients
+	c.clients = nil
+	c.m.Unlock()
+	for _, replicas := range c.replicas {
+		clients = append(clients, replicas...)
+	}
 	if len(clients) == 0 {
 		return
 	}
-	c.clients = nil
 
 	var wg sync.WaitGroup
 	wg.Add(len(clients))
-	for _, server := range c.clients {
-		go func() {
+	for _, server := range clients {
+		go func(server *memcache.PipeliningClient) {
 			server.Finalize()
 			wg.Done()
-		}()
+		}(server)
 	}
 	wg.Wait()
 }
 
+// rebuild recreates the hash ring (or other distribution) for the given list of live servers.
+// This must be called whenever the list of live servers changes.
+func (c *ShardedClient) rebuild(clients []*memcache.PipeliningClient) {
+	hasher := withHashTag(createHasher(c.hash), c.hashTag)
+	distribution := createDistribution(c.distribution, clients)
+	if c.distribution == DISTRIBUTION_RANDOM {
+		// The key is irrelevant, don't bother hashing it.
+		c.pickClient = func(key []byte) *memcache.PipeliningClient {
+			return clients[distribution(0)]
+		}
+		return
+	}
+	c.pickClient = func(key []byte) *memcache.PipeliningClient {
+		hash := hasher(key)
+		clientIdx := distribution(hash)
+		// fmt.Fprintf(os.Stderr, "Hash of %q is %d, clientIdx = %d\n", key, hash, clientIdx)
+		return clients[clientIdx]
+	}
+}
+
 func New(conf config.Config) memcache.ClientInterface {
-	servers := conf.Servers
+	defaultPool := newPool(conf, conf.Servers)
+	if len(conf.PrefixRoutes) == 0 {
+		return defaultPool
+	}
+	pools := make(map[string]memcache.ClientInterface, len(conf.PrefixRoutes))
+	for prefix, servers := range conf.PrefixRoutes {
+		pools[prefix] = newPool(conf, servers)
+	}
+	return newPrefixRouter(pools, defaultPool)
+}
+
+// newPool creates a client for the given servers, using the hash, distribution, and other settings of conf.
+func newPool(conf config.Config, servers []config.TCPServer) memcache.ClientInterface {
 	if len(servers) == 0 {
 		panic("Expected 1 or more servers")
 	}
 
+	clients := newServerClients(conf, servers)
+
+	unique := make(map[string]*memcache.PipeliningClient)
+	for _, client := range clients {
+		unique[client.Label] = client
+	}
+	if len(unique) != len(servers) {
+		panic(fmt.Sprintf("List of server labels is not unique: %#v", unique))
+	}
+
+	replicas := newReplicas(conf, clients)
+	if len(clients) == 1 && len(replicas) == 0 {
+		return clients[0]
+	}
+	c := newShardedClient(conf, clients)
+	c.replicas = replicas
+	c.leastConn = conf.Selection == "least_conn"
+	c.statsServer = unique[conf.StatsServer]
+	return c
+}
+
+// newServerClients creates a client for each of the servers, using the timeouts and other settings of conf.
+func newServerClients(conf config.Config, servers []config.TCPServer) []*memcache.PipeliningClient {
 	clients := []*memcache.PipeliningClient{}
 	for _, serverConfig := range servers {
 		connString := fmt.Sprintf("%s:%d", serverConfig.Host, serverConfig.Port)
-		client := memcache.New(connString, int(conf.MaxServerConnections), time.Duration(conf.Timeout)*time.Millisecond)
+		client := memcache.NewTLS(connString, int(conf.MaxServerConnections), time.Duration(conf.Timeout)*time.Millisecond, conf.TLS)
 		client.Weight = int(serverConfig.Weight)
 		client.Label = serverConfig.Key
+		client.WriteBatchDelay = conf.WriteBatchDelay
+		client.MaxOutstanding = int(conf.MaxOutstanding)
+		client.MaxRetries = int(conf.MaxRetries)
+		client.ReadBufferSize = int(conf.BackendReadBuffer)
+		client.ConnectTimeout = conf.ConnectTimeout
+		// The servers can't store values larger than max_item_size.
+		client.MaxValueSize = int(conf.MaxItemSize)
+		if client.MaxValueSize == 0 {
+			client.MaxValueSize = config.DEFAULT_MAX_ITEM_SIZE
+		}
+		if conf.ServerAuth != nil {
+			client.Credentials = &memcache.Credentials{Username: conf.ServerAuth.Username, Password: conf.ServerAuth.Password}
+		}
 		if client.Weight < 1 {
 			panic("Expected positive weight")
 		}
 		clients = append(clients, client)
 	}
+	return clients
+}
 
-	unique := make(map[string]*memcache.PipeliningClient)
-	for _, client := range clients {
-		unique[client.Label] = client
+func newShardedClient(conf config.Config, clients []*memcache.PipeliningClient) *ShardedClient {
+	distribution, err := ParseDistribution(conf.Distribution)
+	if err != nil {
+		panic(err.Error())
 	}
-	if len(unique) != len(servers) {
-		panic(fmt.Sprintf("List of server labels is not unique: %#v", unique))
+	c := &ShardedClient{
+		clients:      clients,
+		hash:         conf.Hash,
+		hashTag:      conf.HashTag,
+		distribution: distribution,
 	}
-
-	if len(clients) == 1 {
-		return clients[0]
-	}
-	hasher := createHasher(conf.Hash)
-	distribution := createDistribution(conf.Distribution, clients)
-
-	return &ShardedClient{
-		getClient: func(key []byte) *memcache.PipeliningClient {
-			// FIXME: implement or reuse hash ring algorithm
-			hash := hasher(key)
-			clientIdx := distribution(hash)
-			// fmt.Fprintf(os.Stderr, "Hash of %q is %d, clientIdx = %d\n", key, hash, clientIdx)
-			return clients[clientIdx]
-		},
-		clients: clients,
+	c.rebuild(clients)
+	if conf.AutoEjectHosts {
+		c.enableAutoEject(conf.ServerFailureLimit, conf.ServerRetryTimeout)
 	}
+	return c
 }
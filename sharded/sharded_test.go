@@ -0,0 +1,186 @@
+package sharded
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/TysonAndre/golemproxy/config"
+	"github.com/TysonAndre/golemproxy/memcache"
+	"github.com/TysonAndre/golemproxy/testutil"
+)
+
+// newTestShardedClient creates a sharded client for servers on ports 11311, 11312, etc. No connections are made until requests are sent.
+func newTestShardedClient(t *testing.T, serverCount int, distribution string) *ShardedClient {
+	t.Helper()
+	conf := config.Config{
+		Hash:         "fnv1a_64",
+		Distribution: distribution,
+		Timeout:      100,
+	}
+	for i := 0; i < serverCount; i++ {
+		port := uint16(11311 + i)
+		conf.Servers = append(conf.Servers, config.TCPServer{Host: "127.0.0.1", Port: port, Key: fmt.Sprintf("127.0.0.1:%d", port), Weight: 1})
+	}
+	c, ok := New(conf).(*ShardedClient)
+	if !ok {
+		t.Fatalf("expected New to create a ShardedClient for %d servers", serverCount)
+	}
+	return c
+}
+
+func pickServerLabel(c *ShardedClient, key string) string {
+	return c.PickServer([]byte(key)).(*memcache.PipeliningClient).Label
+}
+
+func TestKetamaStableWhenAddingServer(t *testing.T) {
+	before := newTestShardedClient(t, 4, "ketama")
+	defer before.Finalize()
+	after := newTestShardedClient(t, 5, "ketama")
+	defer after.Finalize()
+
+	const keyCount = 10000
+	moved := 0
+	for i := 0; i < keyCount; i++ {
+		key := fmt.Sprintf("key%d", i)
+		oldLabel := pickServerLabel(before, key)
+		newLabel := pickServerLabel(after, key)
+		if oldLabel == newLabel {
+			continue
+		}
+		moved++
+		if newLabel != "127.0.0.1:11315" {
+			t.Errorf("key %q moved from %s to %s instead of the added server", key, oldLabel, newLabel)
+		}
+	}
+	// Roughly 1/5 of keys should move to the new server, though the hashes of similar keys aren't uniformly distributed.
+	if moved == 0 || moved > keyCount/2 {
+		t.Errorf("expected about %d of %d keys to move to the added server, got %d", keyCount/5, keyCount, moved)
+	}
+}
+
+func TestModulaIsDeterministic(t *testing.T) {
+	c := newTestShardedClient(t, 3, "modula")
+	defer c.Finalize()
+	other := newTestShardedClient(t, 3, "modula")
+	defer other.Finalize()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%d:key", i)
+		label := pickServerLabel(c, key)
+		testutil.ExpectStringEquals(t, label, pickServerLabel(c, key), "modula should pick the same server for "+key)
+		testutil.ExpectStringEquals(t, label, pickServerLabel(other, key), "modula should pick the same server for "+key+" in every client")
+	}
+	// The lower 32 bits of fnv1a_64("foo") are 2 modulo 3
+	testutil.ExpectStringEquals(t, "127.0.0.1:11313", pickServerLabel(c, "foo"), "unexpected server for foo")
+}
+
+func TestDistributionChangesPlacement(t *testing.T) {
+	ketama := newTestShardedClient(t, 3, "ketama")
+	defer ketama.Finalize()
+	modula := newTestShardedClient(t, 3, "modula")
+	defer modula.Finalize()
+
+	differences := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("%d:key", i)
+		if pickServerLabel(ketama, key) != pickServerLabel(modula, key) {
+			differences++
+		}
+	}
+	if differences == 0 {
+		t.Errorf("expected ketama and modula to place some keys on different servers")
+	}
+}
+
+func TestRandomDistribution(t *testing.T) {
+	c := newTestShardedClient(t, 3, "random")
+	defer c.Finalize()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		seen[pickServerLabel(c, "samekey")] = true
+	}
+	testutil.ExpectEquals(t, 3, len(seen), "random should spread a fixed key across every server")
+}
+
+func TestHashTagColocatesKeys(t *testing.T) {
+	c := newTestShardedClient(t, 3, "ketama")
+	defer c.Finalize()
+	c.hashTag = "{}"
+	c.rebuild(c.clients)
+
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprint(i)
+		label := pickServerLabel(c, "user:{"+id+"}:name")
+		testutil.ExpectStringEquals(t, label, pickServerLabel(c, "user:{"+id+"}:email"), "keys with the same hash tag should use the same server")
+		testutil.ExpectStringEquals(t, pickServerLabel(c, id), label, "only the hash tag should be hashed")
+	}
+}
+
+func TestPrefixRoutes(t *testing.T) {
+	conf := config.Config{
+		Hash:         "fnv1a_64",
+		Distribution: "ketama",
+		Timeout:      100,
+		Servers: []config.TCPServer{
+			{Host: "127.0.0.1", Port: 11311, Key: "default", Weight: 1},
+		},
+		PrefixRoutes: map[string][]config.TCPServer{
+			"session:": {
+				{Host: "127.0.0.1", Port: 11321, Key: "session1", Weight: 1},
+				{Host: "127.0.0.1", Port: 11322, Key: "session2", Weight: 1},
+			},
+			"session:admin:": {
+				{Host: "127.0.0.1", Port: 11331, Key: "admin", Weight: 1},
+			},
+		},
+	}
+	c, ok := New(conf).(*PrefixRouter)
+	if !ok {
+		t.Fatalf("expected New to create a PrefixRouter when prefix_routes is set")
+	}
+	defer c.Finalize()
+
+	label := func(key string) string {
+		return c.PickServer([]byte(key)).(*memcache.PipeliningClient).Label
+	}
+	sessionLabel := label("session:abc")
+	if sessionLabel != "session1" && sessionLabel != "session2" {
+		t.Errorf("expected session:abc to be sent to the session pool, got %s", sessionLabel)
+	}
+	testutil.ExpectStringEquals(t, "default", label("other"), "expected unmatched keys to be sent to the default pool")
+	testutil.ExpectStringEquals(t, "default", label("session"), "expected keys shorter than the prefix to be sent to the default pool")
+	testutil.ExpectStringEquals(t, "admin", label("session:admin:abc"), "expected the longest matching prefix to be used")
+	testutil.ExpectEquals(t, 4, len(c.Servers()), "expected the servers of every pool")
+}
+
+func TestReloadAddsServer(t *testing.T) {
+	conf := config.Config{
+		Hash:         "fnv1a_64",
+		Distribution: "ketama",
+		Timeout:      100,
+		Servers: []config.TCPServer{
+			{Host: "127.0.0.1", Port: 11311, Key: "first", Weight: 1},
+		},
+	}
+	c := NewReloadable(conf)
+	defer c.Finalize()
+	label := func(key string) string {
+		return c.PickServer([]byte(key)).(*memcache.PipeliningClient).Label
+	}
+	testutil.ExpectStringEquals(t, "first", label("foo"), "expected every key to be sent to the only server")
+
+	conf.Servers = append(conf.Servers, config.TCPServer{Host: "127.0.0.1", Port: 11312, Key: "second", Weight: 1})
+	err := c.Reload(conf)
+	testutil.ExpectEquals(t, nil, err, "unexpected error from Reload")
+	testutil.ExpectEquals(t, 2, len(c.Servers()), "expected the reloaded servers")
+	moved := 0
+	for i := 0; i < 100; i++ {
+		if label(fmt.Sprintf("%d:key", i)) == "second" {
+			moved++
+		}
+	}
+	if moved == 0 || moved == 100 {
+		t.Errorf("expected some keys to be sent to the added server, got %d of 100", moved)
+	}
+}
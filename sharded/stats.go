@@ -0,0 +1,40 @@
+package sharded
+
+import (
+	"github.com/TysonAndre/golemproxy/memcache"
+)
+
+// StatsServer returns the server of the current config that requests such as "stats slabs" are sent to.
+func (c *ReloadableClient) StatsServer() *memcache.PipeliningClient {
+	return statsServerOf(c.Current())
+}
+
+// statsServerOf returns the server of pool that requests such as "stats slabs" are sent to.
+// For prefix routes, this is a server of the default pool.
+func statsServerOf(pool memcache.ClientInterface) *memcache.PipeliningClient {
+	switch pool := pool.(type) {
+	case *ShardedClient:
+		return pool.StatsServer()
+	case *PrefixRouter:
+		return statsServerOf(pool.defaultPool)
+	case *memcache.PipeliningClient:
+		return pool
+	}
+	return nil
+}
+
+// StatsServer returns the server of stats_server, or else the first server that isn't ejected by auto_eject_hosts.
+// If every server is ejected, this returns the first server.
+func (c *ShardedClient) StatsServer() *memcache.PipeliningClient {
+	if c.statsServer != nil {
+		return c.statsServer
+	}
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for _, client := range c.clients {
+		if health := c.health[client]; health == nil || !health.ejected {
+			return client
+		}
+	}
+	return c.clients[0]
+}
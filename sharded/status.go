@@ -0,0 +1,40 @@
+package sharded
+
+import (
+	"time"
+
+	"github.com/TysonAndre/golemproxy/memcache"
+)
+
+// ServerStatus is the health of one server of a pool, for reporting to operators.
+type ServerStatus struct {
+	// Address is the host:port of the server.
+	Address string
+	Weight  int
+	// Ejected is true if the server is currently ejected by auto_eject_hosts.
+	Ejected bool
+	// ConsecutiveFailures is the number of requests that failed since the last request that succeeded.
+	ConsecutiveFailures int64
+	// LastFailure is when a request to the server last failed, or the zero time.
+	LastFailure time.Time
+}
+
+// ServerStatuses returns the status of every server of the current config, in the order of the config.
+func (c *ReloadableClient) ServerStatuses() []ServerStatus {
+	ejected := make(map[*memcache.PipeliningClient]bool)
+	for _, server := range c.EjectedServers() {
+		ejected[server] = true
+	}
+	servers := c.Servers()
+	result := make([]ServerStatus, 0, len(servers))
+	for _, server := range servers {
+		result = append(result, ServerStatus{
+			Address:             server.GetServer(),
+			Weight:              server.Weight,
+			Ejected:             ejected[server],
+			ConsecutiveFailures: server.ConsecutiveFailures(),
+			LastFailure:         server.LastFailure(),
+		})
+	}
+	return result
+}